@@ -0,0 +1,345 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"google.golang.org/api/iterator"
+	"html/template"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+)
+
+// default number of entities listed in a page of the admin handler
+const adminPageSize int = 20
+
+// name of the cookie and of the form field holding the token protecting the edits from cross site requests
+const adminCSRFName string = "model_admin_csrf"
+
+// AdminHandler is an http.Handler to browse the entities of the registered modelables.
+// It lists the kinds, pages through their entities and shows each entity with the flattened property names
+// used by the framework. Edits go through Update and are allowed only if an authorization function is set.
+// Requests are served with the query parameters:
+//
+//	no parameters: the list of the kinds
+//	kind, cursor: a page of the entities of the kind
+//	key: the entity with the given encoded key. A POST updates the entity with the form values
+//
+// Entities are served with their ETag, and the If-None-Match and If-Match headers of the requests are honored.
+// Every request must be accepted by the authentication function of the handler. Edits must come from the same origin
+// and carry the token of the form served with the entity
+type AdminHandler struct {
+	pageSize     int
+	authenticate func(r *http.Request) bool
+	authorize    func(r *http.Request) bool
+}
+
+// returns a handler serving the requests accepted by authenticate, i.e. the ones of the administrators.
+// The other requests are rejected with http.StatusUnauthorized
+func NewAdminHandler(authenticate func(r *http.Request) bool) *AdminHandler {
+	return &AdminHandler{pageSize: adminPageSize, authenticate: authenticate}
+}
+
+// Sets the number of entities listed in a page
+func (h *AdminHandler) WithPageSize(size int) {
+	h.pageSize = size
+}
+
+// Allows to edit the entities with the requests accepted by authorize
+func (h *AdminHandler) AllowEdits(authorize func(r *http.Request) bool) {
+	h.authorize = authorize
+}
+
+type adminEntity struct {
+	Key        string
+	Properties []datastore.Property
+}
+
+type adminField struct {
+	Name     string
+	Value    string
+	Editable bool
+}
+
+type adminPage struct {
+	Kinds    []string
+	Kind     string
+	Entities []adminEntity
+	Next     string
+	Entity   *adminEntity
+	Fields   []adminField
+	Editable bool
+	Token    string
+	Error    string
+}
+
+var adminTemplate = template.Must(template.New("admin").Funcs(template.FuncMap{
+	"query": func(name string, value string) string {
+		return "?" + url.Values{name: {value}}.Encode()
+	},
+	"page": func(kind string, cursor string) string {
+		return "?" + url.Values{"kind": {kind}, "cursor": {cursor}}.Encode()
+	},
+}).Parse(`<!DOCTYPE html>
+<html><head><title>Model admin</title></head><body>
+<p><a href="?">Kinds</a></p>
+{{if .Error}}<p><strong>{{.Error}}</strong></p>{{end}}
+{{if .Kinds}}<ul>{{range .Kinds}}<li><a href="{{query "kind" .}}">{{.}}</a></li>{{end}}</ul>{{end}}
+{{if .Kind}}<h1>{{.Kind}}</h1>
+<table>{{range .Entities}}<tr><td><a href="{{query "key" .Key}}">{{.Key}}</a></td>
+<td>{{range .Properties}}{{.Name}}: {{.Value}}<br>{{end}}</td></tr>{{end}}</table>
+{{if .Next}}<p><a href="{{page .Kind .Next}}">Next</a></p>{{end}}{{end}}
+{{with .Entity}}<h1>{{.Key}}</h1>
+<table>{{range .Properties}}<tr><td>{{.Name}}</td><td>{{.Value}}</td></tr>{{end}}</table>{{end}}
+{{if .Editable}}<form method="post"><input type="hidden" name="model_admin_csrf" value="{{.Token}}">{{range .Fields}}{{if .Editable}}
+<p><label>{{.Name}} <input name="{{.Name}}" value="{{.Value}}"></label></p>{{end}}{{end}}
+<p><input type="submit" value="Update"></p></form>{{end}}
+</body></html>`))
+
+func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.authenticate == nil || !h.authenticate(r) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	page := adminPage{}
+	status := http.StatusOK
+
+	var err error
+	switch {
+	case r.URL.Query().Get("key") != "":
+		status, err = h.serveEntity(w, r, &page)
+	case r.URL.Query().Get("kind") != "":
+		status, err = h.serveKind(r, &page)
+	default:
+		page.Kinds = registeredKinds()
+	}
+
+	if err != nil {
+		page.Error = err.Error()
+		if status == http.StatusOK {
+			status = http.StatusInternalServerError
+		}
+	}
+
+	if status == http.StatusSeeOther {
+		return
+	}
+
+	if status == http.StatusNotModified {
+		w.WriteHeader(status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	adminTemplate.Execute(w, page)
+}
+
+func (h *AdminHandler) serveKind(r *http.Request, page *adminPage) (int, error) {
+	ctx, done, err := ensureClient(r.Context())
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer done()
+
+	// only the entities of the registered modelables are listed, not the ones the framework keeps for itself
+	page.Kind = r.URL.Query().Get("kind")
+	if modelableTypeOfKind(page.Kind) == nil {
+		return http.StatusNotFound, fmt.Errorf("kind %s is not registered", page.Kind)
+	}
+
+	q := newDatastoreQuery(ctx, page.Kind).Limit(h.pageSize)
+	if c := r.URL.Query().Get("cursor"); c != "" {
+		cursor, err := datastore.DecodeCursor(c)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+		q = q.Start(cursor)
+	}
+
+	it := ClientFromContext(ctx).Run(ctx, q)
+	for {
+		var props datastore.PropertyList
+		key, err := it.Next(&props)
+		if err == iterator.Done {
+			break
+		}
+
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		page.Entities = append(page.Entities, adminEntity{Key: key.Encode(), Properties: props})
+	}
+
+	if len(page.Entities) == h.pageSize {
+		cursor, err := it.Cursor()
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		page.Next = cursor.String()
+	}
+
+	return http.StatusOK, nil
+}
+
+func (h *AdminHandler) serveEntity(w http.ResponseWriter, r *http.Request, page *adminPage) (int, error) {
+	key, err := datastore.DecodeKey(r.URL.Query().Get("key"))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	typ := modelableTypeOfKind(key.Kind)
+	if typ == nil {
+		return http.StatusNotFound, fmt.Errorf("kind %s is not registered", key.Kind)
+	}
+
+	ctx, done, err := ensureClient(r.Context())
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer done()
+
+	m := reflect.New(typ).Interface().(modelable)
+	index(m)
+	m.getModel().Key = key
+	if err := Read(ctx, m); err != nil {
+		return http.StatusNotFound, err
+	}
+
+	editable := h.authorize != nil && h.authorize(r)
+
+	switch status := CheckPreconditions(w, r, m); status {
+	case http.StatusNotModified:
+		return status, nil
+	case http.StatusPreconditionFailed:
+		return status, fmt.Errorf("the entity doesn't match the preconditions of the request")
+	}
+
+	if r.Method == http.MethodPost {
+		if !editable {
+			return http.StatusForbidden, fmt.Errorf("edits are not allowed")
+		}
+
+		if err := r.ParseForm(); err != nil {
+			return http.StatusBadRequest, err
+		}
+
+		if err := checkAdminOrigin(r); err != nil {
+			return http.StatusForbidden, err
+		}
+		// the token is not an editable field
+		r.PostForm.Del(adminCSRFName)
+
+		if err := Bind(m, r.PostForm); err != nil {
+			return http.StatusBadRequest, err
+		}
+
+		if err := Update(ctx, m); err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		http.Redirect(w, r, "?"+url.Values{"key": {key.Encode()}}.Encode(), http.StatusSeeOther)
+		return http.StatusSeeOther, nil
+	}
+
+	props, err := encodeProperties(m)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	page.Entity = &adminEntity{Key: key.Encode(), Properties: props}
+	page.Editable = editable
+	if editable {
+		if page.Token, err = adminToken(w, r); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+
+	val := reflect.ValueOf(m).Elem()
+	for _, f := range bindableFields(m) {
+		field := adminField{Name: f.Name, Value: fmt.Sprint(val.FieldByName(f.Name).Interface())}
+		switch f.Kind {
+		case reflect.String, reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64:
+			field.Editable = true
+		}
+		page.Fields = append(page.Fields, field)
+	}
+
+	return http.StatusOK, nil
+}
+
+// returns the token of the edit forms, stored in a cookie of the admin pages.
+// A new token is issued if the request has none
+func adminToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	if c, err := r.Cookie(adminCSRFName); err == nil && c.Value != "" {
+		return c.Value, nil
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{Name: adminCSRFName, Value: token, Path: "/", HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteStrictMode})
+	return token, nil
+}
+
+// rejects the edits sent from other origins: the request must come from the host of the handler,
+// and carry the token of its cookie in the form
+func checkAdminOrigin(r *http.Request) error {
+	source := r.Header.Get("Origin")
+	if source == "" {
+		source = r.Header.Get("Referer")
+	}
+
+	if u, err := url.Parse(source); source == "" || err != nil || u.Host != r.Host {
+		return fmt.Errorf("edits must come from the admin pages")
+	}
+
+	c, err := r.Cookie(adminCSRFName)
+	if err != nil || c.Value == "" {
+		return fmt.Errorf("missing edit token")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(c.Value), []byte(r.PostForm.Get(adminCSRFName))) != 1 {
+		return fmt.Errorf("invalid edit token")
+	}
+	return nil
+}
+
+// returns the names of the registered modelables
+func registeredKinds() []string {
+	encodedStructsMutex.RLock()
+	defer encodedStructsMutex.RUnlock()
+
+	var kinds []string
+	for t := range encodedStructs {
+		if reflect.PtrTo(t).Implements(typeOfModelable) {
+			kinds = append(kinds, t.Name())
+		}
+	}
+
+	sort.Strings(kinds)
+	return kinds
+}
+
+// returns the type of the registered modelable stored with the given kind
+func modelableTypeOfKind(kind string) reflect.Type {
+	encodedStructsMutex.RLock()
+	defer encodedStructsMutex.RUnlock()
+
+	for t := range encodedStructs {
+		if t.Name() == kind && reflect.PtrTo(t).Implements(typeOfModelable) {
+			return t
+		}
+	}
+	return nil
+}
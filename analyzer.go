@@ -0,0 +1,102 @@
+package model
+
+import (
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+// Analyzer normalizes string values before they are written to the search index
+// and before they are used as query terms.
+// The appengine search API does no stemming for non-english text, so the same
+// normalization must be applied on both sides for terms to match.
+type Analyzer struct {
+	lowercase   bool
+	foldAccents bool
+	// maps a normalized term to its canonical form
+	synonyms map[string]string
+}
+
+func NewAnalyzer() Analyzer {
+	return Analyzer{}
+}
+
+func (a *Analyzer) Lowercase() {
+	a.lowercase = true
+}
+
+// strips diacritics from the value, i.e. "perché" becomes "perche"
+func (a *Analyzer) FoldAccents() {
+	a.foldAccents = true
+}
+
+// Each term found as a key of synonyms is replaced by its value.
+// Keys are normalized with the other analyzer steps, so they can be provided in any form.
+func (a *Analyzer) WithSynonyms(synonyms map[string]string) {
+	a.synonyms = make(map[string]string, len(synonyms))
+	for k, v := range synonyms {
+		a.synonyms[a.normalize(k)] = a.normalize(v)
+	}
+}
+
+func (a Analyzer) normalize(s string) string {
+	if a.foldAccents {
+		t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+		if folded, _, err := transform.String(t, s); err == nil {
+			s = folded
+		}
+	}
+
+	if a.lowercase {
+		s = strings.ToLower(s)
+	}
+
+	return s
+}
+
+// Returns the analyzed version of s
+func (a Analyzer) Analyze(s string) string {
+	s = a.normalize(s)
+
+	if len(a.synonyms) == 0 {
+		return s
+	}
+
+	terms := strings.Fields(s)
+	for i, term := range terms {
+		if syn, ok := a.synonyms[term]; ok {
+			terms[i] = syn
+		}
+	}
+
+	return strings.Join(terms, " ")
+}
+
+var analyzers = map[reflect.Type]*Analyzer{}
+
+// Sets the analyzer used for the string and atom searchable fields of the given modelable type.
+// The same analyzer is applied to the values passed to searchQuery.SearchWithValue
+func SetSearchAnalyzer(m modelable, a *Analyzer) {
+	t := reflect.TypeOf(m).Elem()
+	searchMutex.Lock()
+	analyzers[t] = a
+	searchMutex.Unlock()
+}
+
+func analyzerOf(t reflect.Type) *Analyzer {
+	searchMutex.Lock()
+	defer searchMutex.Unlock()
+	return analyzers[t]
+}
+
+// applies the analyzer of type t to s, if any
+func analyze(t reflect.Type, s string) string {
+	a := analyzerOf(t)
+	if a == nil {
+		return s
+	}
+	return a.Analyze(s)
+}
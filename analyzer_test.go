@@ -0,0 +1,18 @@
+package model
+
+import "testing"
+
+func TestAnalyzer(t *testing.T) {
+	a := NewAnalyzer()
+	a.Lowercase()
+	a.FoldAccents()
+	a.WithSynonyms(map[string]string{"Spazzino": "netturbino"})
+
+	if v := a.Analyze("Perché"); v != "perche" {
+		t.Fatalf("invalid analyzed value %q, expected %q", v, "perche")
+	}
+
+	if v := a.Analyze("Enzo  SPAZZINO"); v != "enzo netturbino" {
+		t.Fatalf("invalid analyzed value %q, expected %q", v, "enzo netturbino")
+	}
+}
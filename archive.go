@@ -0,0 +1,510 @@
+package model
+
+import (
+	"bufio"
+	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/storage"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"google.golang.org/api/iterator"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// number of entities archived by each batch, and written to the same object
+const archiveBatchSize int = 500
+
+// an archived entity, stored as a line of an archive object
+type archivedEntity struct {
+	Key        string             `json:"key"`
+	Properties []archivedProperty `json:"properties"`
+}
+
+// a property of an archived entity. Value holds the JSON representation of the datastore value of type Type
+type archivedProperty struct {
+	Name    string          `json:"name,omitempty"`
+	NoIndex bool            `json:"noindex,omitempty"`
+	Type    string          `json:"type"`
+	Value   json.RawMessage `json:"value,omitempty"`
+}
+
+// Archive moves the entities matching the query to cold storage, in the Google Cloud Storage bucket.
+// Entities are read and deleted in batches: each batch is written as an object of JSON lines, one per entity,
+// holding the encoded key and the stored properties of the entity, and it is deleted once the object is written.
+// The objects are named after the namespace and the kind of the entities, i.e. Order/1589284800000000000.jsonl.
+// Only the root entities are archived, references are left untouched.
+// The entities are read and archived through the codec of the modelables, and removed as DeleteMulti does:
+// the delete hooks run, the unique values are released and the counters of the parents decremented.
+// Soft deletable entities are erased.
+// Returns the number of archived entities. See Unarchive
+func Archive(ctx context.Context, q *Query, bucket string) (int, error) {
+	if q.dq == nil {
+		return 0, errors.New("invalid query. Query is nil")
+	}
+
+	if q.disjuncts != nil {
+		return 0, errDisjunctionPaging
+	}
+
+	gcs, err := storage.NewClient(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer gcs.Close()
+
+	client := ClientFromContext(ctx)
+	it := client.Run(ctx, q.datastoreQuery(ctx).KeysOnly())
+
+	count := 0
+	keys := make([]*datastore.Key, 0, archiveBatchSize)
+
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+
+		entities := make([]datastore.PropertyList, len(keys))
+		if err := client.GetMulti(ctx, keys, entities); err != nil {
+			return err
+		}
+
+		name := fmt.Sprintf("%s%d.jsonl", archivePrefix(NamespaceFromContext(ctx), q.mType.Name()), time.Now().UnixNano())
+		w := gcs.Bucket(bucket).Object(name).NewWriter(ctx)
+		w.ContentType = "application/x-ndjson"
+
+		ms := make([]modelable, len(keys))
+		enc := json.NewEncoder(w)
+		for i, props := range entities {
+			m := reflect.New(q.mType).Interface().(modelable)
+			index(m)
+			if err := fromPropertyList(m, props); err != nil {
+				w.CloseWithError(err)
+				return err
+			}
+			m.getModel().Key = keys[i]
+			ms[i] = m
+
+			encoded, err := encodeProperties(m)
+			if err != nil {
+				w.CloseWithError(err)
+				return err
+			}
+
+			archived, err := archiveProperties(encoded)
+			if err != nil {
+				w.CloseWithError(err)
+				return err
+			}
+
+			if err := enc.Encode(archivedEntity{Key: keys[i].Encode(), Properties: archived}); err != nil {
+				w.CloseWithError(err)
+				return err
+			}
+		}
+
+		// the entities are deleted only once the archive is stored.
+		// The delete evicts them from the cache and the search index as well
+		if err := w.Close(); err != nil {
+			return err
+		}
+
+		if err := DeleteMulti(context.WithValue(ctx, keyPurge, true), ms); err != nil {
+			return err
+		}
+
+		count += len(keys)
+		keys = keys[:0]
+		return nil
+	}
+
+	for {
+		key, err := it.Next(nil)
+		if err == iterator.Done {
+			break
+		}
+
+		if err != nil {
+			return count, err
+		}
+
+		keys = append(keys, key)
+		if len(keys) == archiveBatchSize {
+			if err := flush(); err != nil {
+				return count, err
+			}
+		}
+	}
+
+	return count, flush()
+}
+
+// Unarchive restores the entities with the given keys from the archives written by Archive in the bucket.
+// The archive objects of the kinds of the keys are scanned newest first, and the latest archived copy of each entity
+// is written back through the codec of its modelable, claiming its unique values and incrementing the counters
+// of its parents. Entities of kinds with no registered modelable are written back as they were stored.
+// The archive objects are left as they are.
+// Returns the number of restored entities, and a datastore.MultiError aligned with keys
+// holding datastore.ErrNoSuchEntity for the keys not found in the archives
+func Unarchive(ctx context.Context, bucket string, keys ...*datastore.Key) (int, error) {
+	gcs, err := storage.NewClient(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer gcs.Close()
+
+	wanted := make(map[string]int, len(keys))
+	prefixes := make(map[string]bool)
+	for i, key := range keys {
+		wanted[key.Encode()] = i
+		prefixes[archivePrefix(key.Namespace, key.Kind)] = true
+	}
+
+	found := make([]datastore.PropertyList, len(keys))
+	restored := make([]bool, len(keys))
+	missing := len(keys)
+
+	for prefix := range prefixes {
+		names, err := archiveObjects(ctx, gcs.Bucket(bucket), prefix)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, name := range names {
+			if missing == 0 {
+				break
+			}
+
+			n, err := scanArchive(ctx, gcs.Bucket(bucket).Object(name), wanted, found, restored)
+			if err != nil {
+				return 0, fmt.Errorf("error reading archive %s: %w", name, err)
+			}
+			missing -= n
+		}
+	}
+
+	merr := make(datastore.MultiError, len(keys))
+	failed := false
+	var putIdx []int
+	var putKeys []*datastore.Key
+	var putEntities []datastore.PropertyList
+	ms := make([]modelable, len(keys))
+	claims := make([]uniqueClaim, len(keys))
+	for i, key := range keys {
+		if !restored[i] {
+			merr[i] = datastore.ErrNoSuchEntity
+			failed = true
+			continue
+		}
+
+		props, err := decodeArchived(ctx, key, found[i], &ms[i], &claims[i])
+		if err != nil {
+			merr[i] = err
+			failed = true
+			continue
+		}
+
+		putIdx = append(putIdx, i)
+		putKeys = append(putKeys, key)
+		putEntities = append(putEntities, props)
+	}
+
+	client := ClientFromContext(ctx)
+	size := batchSize(ctx)
+	berr := make(datastore.MultiError, len(putKeys))
+	for start := 0; start < len(putKeys); start += size {
+		end := start + size
+		if end > len(putKeys) {
+			end = len(putKeys)
+		}
+
+		_, err := client.PutMulti(ctx, putKeys[start:end], putEntities[start:end])
+		collectMultiError(berr, err, start, end-start)
+	}
+
+	count := 0
+	for k, i := range putIdx {
+		if m := ms[i]; m != nil {
+			if err := settleUnique(ctx, m, keys[i], claims[i], berr[k]); err != nil && berr[k] == nil {
+				berr[k] = err
+			}
+
+			if berr[k] == nil {
+				berr[k] = updateCounters(ctx, m, 1)
+			}
+		}
+
+		if berr[k] != nil {
+			merr[i] = berr[k]
+			failed = true
+			continue
+		}
+		count++
+	}
+
+	if failed {
+		return count, merr
+	}
+	return count, nil
+}
+
+// returns the names of the archive objects with the given prefix, newest first
+func archiveObjects(ctx context.Context, bucket *storage.BucketHandle, prefix string) ([]string, error) {
+	var names []string
+	objects := bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := objects.Next()
+		if err == iterator.Done {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, attrs.Name)
+	}
+
+	// the objects are named after the time of the archive, with the same number of digits
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	return names, nil
+}
+
+// returns the properties to restore for the archived entity with the given key.
+// If the kind has a registered modelable the entity goes through its codec, and its unique values are claimed:
+// the modelable and the claimed markers are returned in m and claim
+func decodeArchived(ctx context.Context, key *datastore.Key, props datastore.PropertyList, m *modelable, claim *uniqueClaim) (datastore.PropertyList, error) {
+	t := modelableTypeOfKind(key.Kind)
+	if t == nil {
+		return props, nil
+	}
+
+	restored := reflect.New(t).Interface().(modelable)
+	index(restored)
+	if err := fromPropertyList(restored, props); err != nil {
+		return nil, err
+	}
+	restored.getModel().Key = key
+
+	encoded, err := encodeProperties(restored)
+	if err != nil {
+		return nil, err
+	}
+
+	claimed, err := claimUnique(ctx, restored, key)
+	if err != nil {
+		return nil, err
+	}
+
+	*m = restored
+	*claim = claimed
+	return encoded, nil
+}
+
+// reads the entities listed in wanted from the archive object.
+// Returns the number of entities found and not found before
+func scanArchive(ctx context.Context, obj *storage.ObjectHandle, wanted map[string]int, found []datastore.PropertyList, restored []bool) (int, error) {
+	r, err := obj.NewReader(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	n := 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 2*memcacheMaxValueSize)
+	for scanner.Scan() {
+		var entity archivedEntity
+		if err := json.Unmarshal(scanner.Bytes(), &entity); err != nil {
+			return n, err
+		}
+
+		i, ok := wanted[entity.Key]
+		if !ok || restored[i] {
+			continue
+		}
+
+		props, err := unarchiveProperties(entity.Properties)
+		if err != nil {
+			return n, err
+		}
+
+		found[i] = props
+		restored[i] = true
+		n++
+	}
+
+	return n, scanner.Err()
+}
+
+// returns the prefix of the names of the archive objects of the kind
+func archivePrefix(namespace string, kind string) string {
+	if namespace == "" {
+		return kind + "/"
+	}
+	return namespace + "/" + kind + "/"
+}
+
+func archiveProperties(props []datastore.Property) ([]archivedProperty, error) {
+	archived := make([]archivedProperty, len(props))
+	for i, p := range props {
+		ap, err := archiveValue(p.Value)
+		if err != nil {
+			return nil, fmt.Errorf("can't archive property %s: %w", p.Name, err)
+		}
+		ap.Name = p.Name
+		ap.NoIndex = p.NoIndex
+		archived[i] = ap
+	}
+	return archived, nil
+}
+
+func archiveValue(v interface{}) (archivedProperty, error) {
+	ap := archivedProperty{}
+	var value interface{}
+
+	switch x := v.(type) {
+	case nil:
+		ap.Type = "null"
+		return ap, nil
+	case int64:
+		ap.Type, value = "int", x
+	case float64:
+		ap.Type, value = "float", x
+	case bool:
+		ap.Type, value = "bool", x
+	case string:
+		ap.Type, value = "string", x
+	case time.Time:
+		ap.Type, value = "time", x.Format(time.RFC3339Nano)
+	case []byte:
+		ap.Type, value = "bytes", base64.StdEncoding.EncodeToString(x)
+	case datastore.GeoPoint:
+		ap.Type, value = "geo", x
+	case *datastore.Key:
+		if x == nil {
+			ap.Type = "null"
+			return ap, nil
+		}
+		ap.Type, value = "key", x.Encode()
+	case []interface{}:
+		values := make([]archivedProperty, len(x))
+		for i, e := range x {
+			av, err := archiveValue(e)
+			if err != nil {
+				return ap, err
+			}
+			values[i] = av
+		}
+		ap.Type, value = "array", values
+	case *datastore.Entity:
+		props, err := archiveProperties(x.Properties)
+		if err != nil {
+			return ap, err
+		}
+		entity := archivedEntity{Properties: props}
+		if x.Key != nil {
+			entity.Key = x.Key.Encode()
+		}
+		ap.Type, value = "entity", entity
+	default:
+		return ap, fmt.Errorf("unsupported value of type %T", v)
+	}
+
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return ap, err
+	}
+	ap.Value = raw
+	return ap, nil
+}
+
+func unarchiveProperties(archived []archivedProperty) (datastore.PropertyList, error) {
+	props := make(datastore.PropertyList, len(archived))
+	for i, ap := range archived {
+		v, err := unarchiveValue(ap)
+		if err != nil {
+			return nil, fmt.Errorf("can't restore property %s: %w", ap.Name, err)
+		}
+		props[i] = datastore.Property{Name: ap.Name, NoIndex: ap.NoIndex, Value: v}
+	}
+	return props, nil
+}
+
+func unarchiveValue(ap archivedProperty) (interface{}, error) {
+	switch ap.Type {
+	case "null":
+		return nil, nil
+	case "int":
+		var x int64
+		err := json.Unmarshal(ap.Value, &x)
+		return x, err
+	case "float":
+		var x float64
+		err := json.Unmarshal(ap.Value, &x)
+		return x, err
+	case "bool":
+		var x bool
+		err := json.Unmarshal(ap.Value, &x)
+		return x, err
+	case "string":
+		var x string
+		err := json.Unmarshal(ap.Value, &x)
+		return x, err
+	case "time":
+		var s string
+		if err := json.Unmarshal(ap.Value, &s); err != nil {
+			return nil, err
+		}
+		return time.Parse(time.RFC3339Nano, s)
+	case "bytes":
+		var s string
+		if err := json.Unmarshal(ap.Value, &s); err != nil {
+			return nil, err
+		}
+		return base64.StdEncoding.DecodeString(s)
+	case "geo":
+		var x datastore.GeoPoint
+		err := json.Unmarshal(ap.Value, &x)
+		return x, err
+	case "key":
+		var s string
+		if err := json.Unmarshal(ap.Value, &s); err != nil {
+			return nil, err
+		}
+		return datastore.DecodeKey(s)
+	case "array":
+		var values []archivedProperty
+		if err := json.Unmarshal(ap.Value, &values); err != nil {
+			return nil, err
+		}
+		x := make([]interface{}, len(values))
+		for i, av := range values {
+			v, err := unarchiveValue(av)
+			if err != nil {
+				return nil, err
+			}
+			x[i] = v
+		}
+		return x, nil
+	case "entity":
+		var entity archivedEntity
+		if err := json.Unmarshal(ap.Value, &entity); err != nil {
+			return nil, err
+		}
+		props, err := unarchiveProperties(entity.Properties)
+		if err != nil {
+			return nil, err
+		}
+		x := &datastore.Entity{Properties: props}
+		if entity.Key != "" {
+			if x.Key, err = datastore.DecodeKey(entity.Key); err != nil {
+				return nil, err
+			}
+		}
+		return x, nil
+	}
+	return nil, fmt.Errorf("unknown archived type %s", ap.Type)
+}
@@ -0,0 +1,49 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestArchiveProperties(t *testing.T) {
+	parent := datastore.IDKey("Parent", 7, nil)
+	props := []datastore.Property{
+		{Name: "Name", Value: "Enzo"},
+		{Name: "Age", Value: int64(40), NoIndex: true},
+		{Name: "Score", Value: 1.5},
+		{Name: "Active", Value: true},
+		{Name: "Born", Value: time.Date(1980, 5, 4, 10, 0, 0, 123, time.UTC)},
+		{Name: "Avatar", Value: []byte{1, 2, 3}},
+		{Name: "Place", Value: datastore.GeoPoint{Lat: 45.4, Lng: 9.2}},
+		{Name: "Parent", Value: parent},
+		{Name: "Tags", Value: []interface{}{"a", int64(1)}},
+		{Name: "Empty", Value: nil},
+		{Name: "Address", Value: &datastore.Entity{Properties: []datastore.Property{{Name: "City", Value: "Milan"}}}},
+	}
+
+	archived, err := archiveProperties(props)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := unarchiveProperties(archived)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, p := range restored {
+		want := props[i]
+		if key, ok := want.Value.(*datastore.Key); ok {
+			if !key.Equal(p.Value.(*datastore.Key)) {
+				t.Fatalf("expected %+v, got %+v", want, p)
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(p, want) {
+			t.Fatalf("expected %+v, got %+v", want, p)
+		}
+	}
+}
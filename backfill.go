@@ -0,0 +1,105 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"errors"
+	"google.golang.org/api/iterator"
+	"reflect"
+	"strings"
+)
+
+// default and maximum number of entities rewritten by each Reindex batch
+const reindexBatchSize int = multiBatchSize
+
+// marks as NoIndex all the properties that don't belong to the given fields.
+// The properties of a struct field are kept indexed if the struct field is listed
+func applyIndexOnly(props []datastore.Property, fields []string) {
+	for i := range props {
+		if !isPropertyOf(props[i].Name, fields) {
+			props[i].NoIndex = true
+		}
+	}
+}
+
+// checks if the property with the given name belongs to one of the fields.
+// Properties of struct fields are flattened as Field.Child
+func isPropertyOf(name string, fields []string) bool {
+	for _, f := range fields {
+		if name == f || strings.HasPrefix(name, f+valSeparator) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reindex rewrites the entities matching the query with their default index settings.
+// It is meant as the follow-up pass of a backfill run with the IndexOnly option.
+// Only the root entities are rewritten, references are left untouched.
+// Batches hold at most 500 entities, the limit of the datastore for a single write.
+// Returns the number of rewritten entities.
+func Reindex(ctx context.Context, q *Query, batchSize int) (int, error) {
+	if q.dq == nil {
+		return 0, errors.New("invalid query. Query is nil")
+	}
+
+	if q.disjuncts != nil {
+		return 0, errDisjunctionPaging
+	}
+
+	// each batch is read with a single GetMulti and written with a single PutMulti
+	if batchSize <= 0 || batchSize > multiBatchSize {
+		batchSize = reindexBatchSize
+	}
+
+	client := ClientFromContext(ctx)
+	it := client.Run(ctx, q.datastoreQuery(ctx).KeysOnly())
+
+	count := 0
+	keys := make([]*datastore.Key, 0, batchSize)
+
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+
+		dst := reflect.MakeSlice(reflect.SliceOf(reflect.PtrTo(q.mType)), len(keys), len(keys))
+		for i := range keys {
+			m := reflect.New(q.mType)
+			index(m.Interface().(modelable))
+			dst.Index(i).Set(m)
+		}
+
+		if err := client.GetMulti(ctx, keys, dst.Interface()); err != nil {
+			return err
+		}
+
+		if _, err := client.PutMulti(ctx, keys, dst.Interface()); err != nil {
+			return err
+		}
+
+		count += len(keys)
+		keys = keys[:0]
+		return nil
+	}
+
+	for {
+		key, err := it.Next(nil)
+		if err == iterator.Done {
+			break
+		}
+
+		if err != nil {
+			return count, err
+		}
+
+		keys = append(keys, key)
+		if len(keys) == batchSize {
+			if err := flush(); err != nil {
+				return count, err
+			}
+		}
+	}
+
+	return count, flush()
+}
@@ -0,0 +1,218 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrBinding reports the fields that could not be bound, along with the cause of each failure
+type ErrBinding struct {
+	Fields map[string]error
+}
+
+func (e *ErrBinding) Error() string {
+	names := make([]string, 0, len(e.Fields))
+	for name := range e.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	msgs := make([]string, len(names))
+	for i, name := range names {
+		msgs[i] = fmt.Sprintf("%s: %s", name, e.Fields[name].Error())
+	}
+	return fmt.Sprintf("invalid values for %d fields: %s", len(names), strings.Join(msgs, "; "))
+}
+
+// tags of the fields managed by the framework, that are never bound
+var managedTags = []string{tagId, tagVersion, tagCreateTime, tagUpdateTime, tagSoftDelete, tagModified, tagCount}
+
+// returns the fields of the modelable that can be bound: references, extensions
+// and the fields managed by the framework are excluded
+func bindableFields(m modelable) []FieldInfo {
+	t := reflect.TypeOf(m).Elem()
+
+	var fields []FieldInfo
+	for _, f := range FieldsOf(m) {
+		if f.IsReference || f.IsExtension {
+			continue
+		}
+
+		field, _ := t.FieldByName(f.Name)
+		if isManaged(strings.Split(field.Tag.Get(tagDomain), ",")) {
+			continue
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func isManaged(tags []string) bool {
+	for _, tag := range managedTags {
+		if containsTag(tags, tag) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Bind populates the fields of the modelable with the form values having their name.
+// Values are converted to the type of the field: times are parsed as RFC 3339
+// and slices take all the values of their name.
+// The key and the fields managed by the framework, i.e. the id, the version, the timestamps,
+// the soft delete, modified and count fields, are never bound.
+// Fields with no values are left untouched. The fields that can't be converted are reported with an ErrBinding
+func Bind(m modelable, values url.Values) error {
+	val := reflect.ValueOf(m).Elem()
+	failed := make(map[string]error)
+
+	for _, f := range bindableFields(m) {
+		vs, ok := values[f.Name]
+		if !ok {
+			continue
+		}
+
+		field := val.FieldByName(f.Name)
+		if err := bindValues(field, vs); err != nil {
+			failed[f.Name] = err
+		}
+	}
+
+	if len(failed) > 0 {
+		return &ErrBinding{Fields: failed}
+	}
+	return nil
+}
+
+// BindJSON populates the fields of the modelable with the members of the JSON object read from r.
+// Members are matched to the fields by name. The fields that can't be decoded are reported with an ErrBinding
+func BindJSON(m modelable, r io.Reader) error {
+	var members map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&members); err != nil {
+		return err
+	}
+
+	val := reflect.ValueOf(m).Elem()
+	failed := make(map[string]error)
+
+	for _, f := range bindableFields(m) {
+		raw, ok := members[f.Name]
+		if !ok {
+			continue
+		}
+
+		field := val.FieldByName(f.Name)
+		dst := reflect.New(field.Type())
+		if err := json.Unmarshal(raw, dst.Interface()); err != nil {
+			failed[f.Name] = err
+			continue
+		}
+		field.Set(dst.Elem())
+	}
+
+	if len(failed) > 0 {
+		return &ErrBinding{Fields: failed}
+	}
+	return nil
+}
+
+func bindValues(field reflect.Value, vs []string) error {
+	if field.Kind() == reflect.Slice && field.Type().Elem().Kind() != reflect.Uint8 {
+		s := reflect.MakeSlice(field.Type(), len(vs), len(vs))
+		for i, v := range vs {
+			if err := bindValue(s.Index(i), v); err != nil {
+				return err
+			}
+		}
+		field.Set(s)
+		return nil
+	}
+
+	if len(vs) == 0 {
+		return nil
+	}
+
+	return bindValue(field, vs[0])
+}
+
+func bindValue(field reflect.Value, v string) error {
+	if field.Type() == typeOfTime {
+		if v == "" {
+			field.Set(reflect.Zero(typeOfTime))
+			return nil
+		}
+
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(t))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(v)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v == "" {
+			field.SetInt(0)
+			return nil
+		}
+
+		x, err := strconv.ParseInt(v, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(x)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v == "" {
+			field.SetUint(0)
+			return nil
+		}
+
+		x, err := strconv.ParseUint(v, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(x)
+	case reflect.Float32, reflect.Float64:
+		if v == "" {
+			field.SetFloat(0)
+			return nil
+		}
+
+		x, err := strconv.ParseFloat(v, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(x)
+	case reflect.Bool:
+		// checkboxes send "on" when checked
+		if v == "" || v == "on" {
+			field.SetBool(v == "on")
+			return nil
+		}
+
+		x, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		field.SetBool(x)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.Uint8 {
+			return fmt.Errorf("unsupported field type %s", field.Type())
+		}
+		field.SetBytes([]byte(v))
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+
+	return nil
+}
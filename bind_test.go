@@ -0,0 +1,78 @@
+package model
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type bindForm struct {
+	Model
+	Name  string
+	Age   int
+	Tags  []string
+	Admin bool
+}
+
+func TestBind(t *testing.T) {
+	form := bindForm{}
+	values := url.Values{"Name": {"Enzo"}, "Age": {"42"}, "Tags": {"a", "b"}, "Admin": {"on"}}
+
+	if err := Bind(&form, values); err != nil {
+		t.Fatal(err)
+	}
+
+	if form.Name != "Enzo" || form.Age != 42 || len(form.Tags) != 2 || !form.Admin {
+		t.Fatalf("invalid bound form %+v", form)
+	}
+
+	err := Bind(&form, url.Values{"Age": {"many"}})
+	berr := &ErrBinding{}
+	if !errors.As(err, &berr) || berr.Fields["Age"] == nil {
+		t.Fatalf("expected binding error on Age, got %v", err)
+	}
+
+	if err := BindJSON(&form, strings.NewReader(`{"Name": "Gino", "Age": 7}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if form.Name != "Gino" || form.Age != 7 {
+		t.Fatalf("invalid bound json %+v", form)
+	}
+}
+
+type bindManaged struct {
+	Model
+	Code      string    `model:"id"`
+	Version   int64     `model:"version"`
+	UpdatedAt time.Time `model:"updatetime"`
+	Stock     uint32
+}
+
+func TestBindManagedFields(t *testing.T) {
+	form := bindManaged{}
+	values := url.Values{
+		"Code":      {"forged"},
+		"Version":   {"9"},
+		"UpdatedAt": {"2020-01-01T00:00:00Z"},
+		"Stock":     {"12"},
+	}
+
+	if err := Bind(&form, values); err != nil {
+		t.Fatal(err)
+	}
+
+	if form.Code != "" || form.Version != 0 || !form.UpdatedAt.IsZero() {
+		t.Fatalf("the fields managed by the framework have been bound: %+v", form)
+	}
+
+	if form.Stock != 12 {
+		t.Fatalf("expected Stock 12, got %d", form.Stock)
+	}
+
+	if err := Bind(&form, url.Values{"Stock": {"-1"}}); err == nil {
+		t.Fatal("expected an error for a negative unsigned value")
+	}
+}
@@ -0,0 +1,199 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"encoding/base64"
+	"google.golang.org/api/iterator"
+	"reflect"
+	"strings"
+)
+
+const (
+	blobRefPrefix = "gs://"
+	// prefix of the legacy blob keys of the files stored in GCS through the blobstore API
+	legacyGSKeyPrefix = "encoded_gs_file:"
+	legacyGSPath      = "/gs/"
+)
+
+var typeOfBlobRef = reflect.TypeOf(BlobRef(""))
+
+// BlobRef references an object stored in Google Cloud Storage, in the form gs://bucket/object.
+// It replaces the deprecated appengine.BlobKey fields.
+// BlobRef fields load legacy blob keys too: the keys of GCS files are converted on the fly,
+// while the others are kept as they are until they are migrated with MigrateBlobKeys
+type BlobRef string
+
+func NewBlobRef(bucket string, object string) BlobRef {
+	return BlobRef(blobRefPrefix + bucket + "/" + object)
+}
+
+// reports whether the reference still holds a legacy blob key
+func (r BlobRef) IsLegacy() bool {
+	return r != "" && !strings.HasPrefix(string(r), blobRefPrefix)
+}
+
+func (r BlobRef) Bucket() string {
+	if r.IsLegacy() {
+		return ""
+	}
+	path := strings.TrimPrefix(string(r), blobRefPrefix)
+	return strings.SplitN(path, "/", 2)[0]
+}
+
+func (r BlobRef) Object() string {
+	if r.IsLegacy() {
+		return ""
+	}
+	path := strings.TrimPrefix(string(r), blobRefPrefix)
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// converts a legacy blob key of a GCS file to a BlobRef. Returns false if the key doesn't embed a GCS path
+func blobRefFromKey(key string) (BlobRef, bool) {
+	if !strings.HasPrefix(key, legacyGSKeyPrefix) {
+		return "", false
+	}
+
+	encoded := strings.TrimPrefix(key, legacyGSKeyPrefix)
+	path, err := base64.URLEncoding.DecodeString(encoded)
+	if err != nil {
+		if path, err = base64.RawURLEncoding.DecodeString(encoded); err != nil {
+			return "", false
+		}
+	}
+
+	if !strings.HasPrefix(string(path), legacyGSPath) {
+		return "", false
+	}
+
+	return BlobRef(blobRefPrefix + strings.TrimPrefix(string(path), legacyGSPath)), true
+}
+
+// loads a stored BlobRef or a legacy blob key into a BlobRef field
+func decodeBlobRef(field reflect.Value, p datastore.Property) error {
+	var s string
+	switch x := p.Value.(type) {
+	case string:
+		s = x
+	case []byte:
+		s = string(x)
+	default:
+		if p.Value != nil {
+			return &PropertyError{Name: p.Name, Kind: field.Kind(), Value: p.Value, Err: ErrTypeMismatch}
+		}
+	}
+
+	if ref, ok := blobRefFromKey(s); ok {
+		s = string(ref)
+	}
+
+	field.SetString(s)
+	return nil
+}
+
+// MigrateBlobKeys rewrites the legacy blob keys stored in field by the entities of the given kind as BlobRef values.
+// Keys of files stored in GCS are converted directly, the others are passed to convert,
+// which is expected to copy the blob to GCS. If convert is nil, those keys are left untouched.
+// Entities are rewritten in batches and evicted from the cache.
+// Returns the number of migrated entities
+func MigrateBlobKeys(ctx context.Context, kind string, field string, convert func(ctx context.Context, blobKey string) (BlobRef, error)) (int, error) {
+	client := ClientFromContext(ctx)
+	it := client.Run(ctx, newDatastoreQuery(ctx, kind).KeysOnly())
+
+	count := 0
+	size := batchSize(ctx)
+	keys := make([]*datastore.Key, 0, size)
+
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+
+		entities := make([]datastore.PropertyList, len(keys))
+		if err := client.GetMulti(ctx, keys, entities); err != nil {
+			return err
+		}
+
+		var changedKeys []*datastore.Key
+		var changed []datastore.PropertyList
+		for i, props := range entities {
+			migrated := false
+			for j := range props {
+				if props[j].Name != field {
+					continue
+				}
+
+				key, ok := props[j].Value.(string)
+				if !ok || key == "" || !BlobRef(key).IsLegacy() {
+					continue
+				}
+
+				ref, ok := blobRefFromKey(key)
+				if !ok {
+					if convert == nil {
+						continue
+					}
+
+					var err error
+					if ref, err = convert(ctx, key); err != nil {
+						return err
+					}
+				}
+
+				props[j].Value = string(ref)
+				migrated = true
+			}
+
+			if migrated {
+				changedKeys = append(changedKeys, keys[i])
+				changed = append(changed, props)
+			}
+		}
+
+		if len(changed) > 0 {
+			if _, err := client.PutMulti(ctx, changedKeys, changed); err != nil {
+				return err
+			}
+		}
+
+		cache := cacheFromContext(ctx)
+		for _, k := range changedKeys {
+			if err := cache.Delete(ctx, cacheKey(k)); err != nil && err != ErrCacheMiss {
+				return err
+			}
+		}
+
+		count += len(changed)
+		keys = keys[:0]
+		return nil
+	}
+
+	for {
+		key, err := it.Next(nil)
+		if err == iterator.Done {
+			break
+		}
+
+		if err != nil {
+			return count, err
+		}
+
+		keys = append(keys, key)
+		if len(keys) == size {
+			if err := flush(); err != nil {
+				return count, err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return count, err
+	}
+
+	return count, nil
+}
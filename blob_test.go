@@ -0,0 +1,27 @@
+package model
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestBlobRefFromKey(t *testing.T) {
+	key := legacyGSKeyPrefix + base64.URLEncoding.EncodeToString([]byte("/gs/bucket/path/to/file.png"))
+
+	ref, ok := blobRefFromKey(key)
+	if !ok {
+		t.Fatalf("legacy key %s not converted", key)
+	}
+
+	if ref.Bucket() != "bucket" || ref.Object() != "path/to/file.png" {
+		t.Fatalf("invalid blob reference %s", ref)
+	}
+
+	if _, ok := blobRefFromKey("AMIfv96legacyblobkey"); ok {
+		t.Fatal("blobstore key converted to a GCS reference")
+	}
+
+	if !BlobRef("AMIfv96legacyblobkey").IsLegacy() || NewBlobRef("bucket", "file").IsLegacy() {
+		t.Fatal("invalid legacy detection")
+	}
+}
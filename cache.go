@@ -0,0 +1,131 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"google.golang.org/appengine/memcache"
+	"sync"
+	"time"
+)
+
+const keyCache = "__model_cache"
+
+// maximum number of items kept by the in-memory cache
+const memoryCacheSize int = 10000
+
+var ErrCacheMiss = errors.New("cache miss")
+
+// Cache is the storage of the encoded modelables.
+// Get must return ErrCacheMiss if the key is not found.
+type Cache interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Set(ctx context.Context, key string, value []byte) error
+	Delete(ctx context.Context, key string) error
+}
+
+// the cache used when the context holds none
+var defaultCache Cache = NewMemoryCache()
+
+// returns the cache attached to the context by the service, or the default in-memory cache,
+// behind the request cache of the context if any. Nothing is cached with the CacheNone policy
+func cacheFromContext(ctx context.Context) Cache {
+	if cachePolicyFromContext(ctx) == CacheNone {
+		return noCache{}
+	}
+
+	if c, ok := ctx.Value(keyCache).(Cache); ok {
+		return requestCacheOf(ctx, c)
+	}
+	return requestCacheOf(ctx, defaultCache)
+}
+
+// MemoryCache is a Cache local to the running instance.
+// When full, arbitrary items are evicted to make room for the new ones.
+type MemoryCache struct {
+	mutex sync.RWMutex
+	items map[string]memoryItem
+}
+
+type memoryItem struct {
+	value []byte
+	// zero if the item doesn't expire
+	expires time.Time
+}
+
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{items: make(map[string]memoryItem)}
+}
+
+func (c *MemoryCache) Get(ctx context.Context, key string) ([]byte, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	item, ok := c.items[key]
+	if !ok || !item.expires.IsZero() && time.Now().After(item.expires) {
+		return nil, ErrCacheMiss
+	}
+	return item.value, nil
+}
+
+func (c *MemoryCache) Set(ctx context.Context, key string, value []byte) error {
+	return c.SetWithTTL(ctx, key, value, 0)
+}
+
+// Sets the value of the key, which expires after ttl. A non positive ttl never expires
+func (c *MemoryCache) SetWithTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.items[key]; !ok && len(c.items) >= memoryCacheSize {
+		for k := range c.items {
+			delete(c.items, k)
+			break
+		}
+	}
+
+	item := memoryItem{value: value}
+	if ttl > 0 {
+		item.expires = time.Now().Add(ttl)
+	}
+	c.items[key] = item
+	return nil
+}
+
+func (c *MemoryCache) Delete(ctx context.Context, key string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.items[key]; !ok {
+		return ErrCacheMiss
+	}
+	delete(c.items, key)
+	return nil
+}
+
+// AppEngineCache is a Cache backed by the legacy App Engine memcache service
+type AppEngineCache struct{}
+
+func (AppEngineCache) Get(ctx context.Context, key string) ([]byte, error) {
+	item, err := memcache.Get(ctx, key)
+	if err == memcache.ErrCacheMiss {
+		return nil, ErrCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.Value, nil
+}
+
+func (AppEngineCache) Set(ctx context.Context, key string, value []byte) error {
+	return memcache.Set(ctx, &memcache.Item{Key: key, Value: value})
+}
+
+func (AppEngineCache) SetWithTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return memcache.Set(ctx, &memcache.Item{Key: key, Value: value, Expiration: ttl})
+}
+
+func (AppEngineCache) Delete(ctx context.Context, key string) error {
+	err := memcache.Delete(ctx, key)
+	if err == memcache.ErrCacheMiss {
+		return ErrCacheMiss
+	}
+	return err
+}
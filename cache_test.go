@@ -0,0 +1,263 @@
+package model
+
+import (
+	"bufio"
+	"cloud.google.com/go/datastore"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryCache(t *testing.T) {
+	ctx := context.Background()
+	c := NewMemoryCache()
+
+	if _, err := c.Get(ctx, "key"); err != ErrCacheMiss {
+		t.Fatalf("expected cache miss, got %v", err)
+	}
+
+	if err := c.Set(ctx, "key", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := c.Get(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(v) != "value" {
+		t.Fatalf("invalid cached value %q", v)
+	}
+
+	if err := c.Delete(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Delete(ctx, "key"); err != ErrCacheMiss {
+		t.Fatalf("expected cache miss on deleted key, got %v", err)
+	}
+}
+
+func TestReadRedisReply(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("$5\r\nvalue\r\n$-1\r\n:1\r\n-ERR wrong\r\n"))
+
+	if v, err := readRedisReply(r); err != nil || string(v.([]byte)) != "value" {
+		t.Fatalf("invalid bulk reply %v: %v", v, err)
+	}
+
+	if v, err := readRedisReply(r); err != nil || v != nil {
+		t.Fatalf("invalid nil reply %v: %v", v, err)
+	}
+
+	if v, err := readRedisReply(r); err != nil || v.(int64) != 1 {
+		t.Fatalf("invalid integer reply %v: %v", v, err)
+	}
+
+	if _, err := readRedisReply(r); err == nil || err.Error() != "ERR wrong" {
+		t.Fatalf("invalid error reply: %v", err)
+	}
+}
+
+func TestCacheDeleteOnWrite(t *testing.T) {
+	c := NewMemoryCache()
+	ctx := context.WithValue(context.Background(), keyCache, c)
+	ctx = context.WithValue(ctx, keyCachePolicy, CacheDeleteOnWrite)
+
+	m := SingletonSettings{Theme: "dark"}
+	index(&m)
+	m.Key = singletonKey(context.Background(), m.getModel())
+
+	if err := c.Set(ctx, m.EncodedKey(), []byte("stale")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cacheWritten(ctx, &m, saveInMemcache); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Get(ctx, m.EncodedKey()); err != ErrCacheMiss {
+		t.Fatalf("expected the written modelable to be evicted, got %v", err)
+	}
+
+	if m.Key == nil {
+		t.Fatal("eviction must not clear the key")
+	}
+
+	none := context.WithValue(ctx, keyCachePolicy, CacheNone)
+	if _, ok := cacheFromContext(none).(noCache); !ok {
+		t.Fatal("the CacheNone policy must not use the cache")
+	}
+}
+
+func TestCacheOptions(t *testing.T) {
+	c := NewMemoryCache()
+	ctx := context.WithValue(context.Background(), keyCache, c)
+
+	ConfigureCache(&SingletonSettings{}, CacheOptions{TTL: time.Millisecond, Prefix: "app:"})
+	defer ConfigureCache(&SingletonSettings{}, CacheOptions{})
+
+	m := SingletonSettings{Theme: "dark"}
+	index(&m)
+	m.Key = singletonKey(context.Background(), m.getModel())
+
+	if err := saveInMemcache(ctx, &m); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Get(ctx, "app:"+m.EncodedKey()); err != nil {
+		t.Fatalf("expected the modelable to be cached with the prefix, got %v", err)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	if _, err := c.Get(ctx, "app:"+m.EncodedKey()); err != ErrCacheMiss {
+		t.Fatalf("expected the cached modelable to expire, got %v", err)
+	}
+
+	ConfigureCache(&SingletonSettings{}, CacheOptions{Disabled: true})
+	if err := saveInMemcache(ctx, &m); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Get(ctx, m.EncodedKey()); err != ErrCacheMiss {
+		t.Fatalf("expected a disabled kind not to be cached, got %v", err)
+	}
+}
+
+func TestRequestCache(t *testing.T) {
+	c := NewMemoryCache()
+	ctx := WithRequestCache(context.WithValue(context.Background(), keyCache, c))
+
+	if err := cacheFromContext(ctx).Set(ctx, "key", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the shared cache loses the item, but the request still holds it
+	if err := c.Delete(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := cacheFromContext(ctx).Get(ctx, "key"); err != nil || string(v) != "value" {
+		t.Fatalf("expected the memoized value, got %q, %v", v, err)
+	}
+
+	if err := cacheFromContext(ctx).Delete(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := cacheFromContext(ctx).Get(ctx, "key"); err != ErrCacheMiss {
+		t.Fatalf("expected a cache miss after the delete, got %v", err)
+	}
+}
+
+func TestCacheEntries(t *testing.T) {
+	c := NewMemoryCache()
+	ctx := context.WithValue(context.Background(), keyCache, c)
+
+	m := SingletonSettings{Theme: "dark"}
+	index(&m)
+	m.Key = singletonKey(context.Background(), m.getModel())
+
+	if err := saveInMemcache(ctx, &m); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := SingletonSettings{}
+	index(&dst)
+	dst.Key = m.Key
+	if err := loadFromMemcache(ctx, &dst); err != nil {
+		t.Fatal(err)
+	}
+
+	if dst.Theme != m.Theme {
+		t.Fatalf("invalid cached modelable %+v", dst)
+	}
+
+	// entries written by an older layout are discarded
+	if err := c.Set(ctx, m.EncodedKey(), []byte("stale")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := loadFromMemcache(ctx, &dst); err != ErrCacheMiss {
+		t.Fatalf("expected a stale entry to be a miss, got %v", err)
+	}
+
+	if _, err := c.Get(ctx, m.EncodedKey()); err != ErrCacheMiss {
+		t.Fatalf("expected the stale entry to be deleted, got %v", err)
+	}
+}
+
+func cacheSerializerProperties() []datastore.Property {
+	parent := datastore.IDKey("Parent", 1, nil)
+	return []datastore.Property{
+		{Name: "Name", Value: "Enzo"},
+		{Name: "Age", Value: int64(42)},
+		{Name: "Score", Value: 1.5, NoIndex: true},
+		{Name: "Admin", Value: true},
+		{Name: "Born", Value: time.Date(1980, 5, 12, 10, 0, 0, 0, time.UTC)},
+		{Name: "Avatar", Value: []byte{0, 1, 2}},
+		{Name: "Parent", Value: parent},
+		{Name: "Empty", Value: (*datastore.Key)(nil)},
+		{Name: "Tags", Value: []interface{}{"a", "b"}},
+		{Name: "Place", Value: datastore.GeoPoint{Lat: 45, Lng: 9}},
+	}
+}
+
+func TestGobSerializer(t *testing.T) {
+	props := cacheSerializerProperties()
+
+	data, err := GobSerializer{}.Marshal(props)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := GobSerializer{}.Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(decoded) != len(props) {
+		t.Fatalf("expected %d properties, got %d", len(props), len(decoded))
+	}
+
+	for i, p := range decoded {
+		if p.Name != props[i].Name || p.NoIndex != props[i].NoIndex {
+			t.Fatalf("invalid property %+v, expected %+v", p, props[i])
+		}
+	}
+
+	if k, ok := decoded[6].Value.(*datastore.Key); !ok || !k.Equal(props[6].Value.(*datastore.Key)) {
+		t.Fatalf("invalid key %v", decoded[6].Value)
+	}
+
+	if decoded[7].Value != nil {
+		t.Fatalf("expected a nil key to be decoded as nil, got %v", decoded[7].Value)
+	}
+
+	if born, ok := decoded[4].Value.(time.Time); !ok || !born.Equal(props[4].Value.(time.Time)) {
+		t.Fatalf("invalid time %v", decoded[4].Value)
+	}
+}
+
+func benchmarkCacheSerializer(b *testing.B, s CacheSerializer) {
+	props := cacheSerializerProperties()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		data, err := s.Marshal(props)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if _, err := s.Unmarshal(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGobSerializer(b *testing.B) {
+	benchmarkCacheSerializer(b, GobSerializer{})
+}
+
+func BenchmarkJSONSerializer(b *testing.B) {
+	benchmarkCacheSerializer(b, JSONSerializer{})
+}
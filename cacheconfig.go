@@ -0,0 +1,62 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// CacheOptions configures how the entities of a kind are cached. See ConfigureCache
+type CacheOptions struct {
+	// the cached entities expire after TTL. If zero, they are kept until evicted.
+	// It is honored by the caches implementing ExpiringCache
+	TTL time.Duration
+	// prefixed to the cache keys of the entities, to keep them apart from the ones of other applications sharing the cache
+	Prefix string
+	// if true the entities are never cached
+	Disabled bool
+}
+
+// ExpiringCache is a Cache whose items can expire
+type ExpiringCache interface {
+	Cache
+	SetWithTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error
+}
+
+var cacheOptionsMutex sync.RWMutex
+var cacheOptions = map[string]CacheOptions{}
+
+// ConfigureCache sets how the entities with the kind of the modelable are cached
+func ConfigureCache(m modelable, opts CacheOptions) {
+	kind := reflect.TypeOf(m).Elem().Name()
+	cacheOptionsMutex.Lock()
+	defer cacheOptionsMutex.Unlock()
+	cacheOptions[kind] = opts
+}
+
+func cacheOptionsOf(kind string) CacheOptions {
+	cacheOptionsMutex.RLock()
+	defer cacheOptionsMutex.RUnlock()
+	return cacheOptions[kind]
+}
+
+// returns the key of the cached entity
+func cacheKey(key *datastore.Key) string {
+	return cacheOptionsOf(key.Kind).Prefix + key.Encode()
+}
+
+// caches the value of the entity with the given key, with the TTL of its kind
+func setCached(ctx context.Context, key *datastore.Key, value []byte) error {
+	opts := cacheOptionsOf(key.Kind)
+	ttl := opts.TTL
+	if ttl <= 0 {
+		ttl = defaultsFromContext(ctx).CacheTTL
+	}
+	cache := cacheFromContext(ctx)
+	if ec, ok := cache.(ExpiringCache); ok && ttl > 0 {
+		return ec.SetWithTTL(ctx, opts.Prefix+key.Encode(), value, ttl)
+	}
+	return cache.Set(ctx, opts.Prefix+key.Encode(), value)
+}
@@ -0,0 +1,80 @@
+package model
+
+import (
+	"context"
+	"fmt"
+)
+
+const keyCachePolicy = "__model_cache_policy"
+
+// CachePolicy sets how the cache is kept aligned with the datastore when modelables are written
+type CachePolicy int
+
+const (
+	// the written modelables are saved in the cache. Readers racing with the write may cache a stale graph
+	CacheWriteThrough CachePolicy = iota
+	// the written modelables are removed from the cache, and the next read caches them from the datastore
+	CacheDeleteOnWrite
+	// the cache is not used
+	CacheNone
+)
+
+func cachePolicyFromContext(ctx context.Context) CachePolicy {
+	p, _ := ctx.Value(keyCachePolicy).(CachePolicy)
+	return p
+}
+
+// refreshes the cache after the modelable has been written, according to the policy of ctx.
+// save is how the modelable is saved with the write through policy
+func cacheWritten(ctx context.Context, m modelable, save func(ctx context.Context, m modelable) error) error {
+	switch cachePolicyFromContext(ctx) {
+	case CacheDeleteOnWrite:
+		return evictFromCache(ctx, m)
+	case CacheNone:
+		return nil
+	}
+	return save(ctx, m)
+}
+
+// removes the modelable and its references from the cache, leaving their keys untouched
+func evictFromCache(ctx context.Context, m modelable) error {
+	model := m.getModel()
+	if model.Key == nil {
+		return nil
+	}
+
+	for _, ref := range model.references {
+		if ref.Modelable.getModel().readonly {
+			continue
+		}
+
+		if err := evictFromCache(ctx, ref.Modelable); err != nil {
+			return err
+		}
+	}
+
+	cKey := cacheKey(model.Key)
+	if !validCacheKey(cKey) {
+		return fmt.Errorf("cacheModel box Key %s is too long", cKey)
+	}
+
+	if err := cacheFromContext(ctx).Delete(ctx, cKey); err != nil && err != ErrCacheMiss {
+		return err
+	}
+	return nil
+}
+
+// the cache of the CacheNone policy: it never holds anything
+type noCache struct{}
+
+func (noCache) Get(ctx context.Context, key string) ([]byte, error) {
+	return nil, ErrCacheMiss
+}
+
+func (noCache) Set(ctx context.Context, key string, value []byte) error {
+	return nil
+}
+
+func (noCache) Delete(ctx context.Context, key string) error {
+	return nil
+}
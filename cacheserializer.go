@@ -0,0 +1,221 @@
+package model
+
+import (
+	"bytes"
+	"cloud.google.com/go/datastore"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// CacheSerializer encodes the properties of the modelables stored in the cache.
+// The properties are the ones written to the datastore, thus the serializer needs no knowledge of the Go types
+type CacheSerializer interface {
+	Marshal(props []datastore.Property) ([]byte, error)
+	Unmarshal(data []byte) ([]datastore.Property, error)
+}
+
+// GobSerializer is the default CacheSerializer. It encodes the properties with encoding/gob.
+// Only the types of the property values are registered with gob, never the structs of the modelables
+type GobSerializer struct{}
+
+func init() {
+	gob.Register(time.Time{})
+	gob.Register(&datastore.Key{})
+	gob.Register(datastore.GeoPoint{})
+	gob.Register([]interface{}{})
+	gob.Register(&datastore.Entity{})
+}
+
+func (GobSerializer) Marshal(props []datastore.Property) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(gobProperties(props)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobSerializer) Unmarshal(data []byte) ([]datastore.Property, error) {
+	var props []datastore.Property
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&props); err != nil {
+		return nil, err
+	}
+	return props, nil
+}
+
+// returns a copy of the properties gob can encode: gob rejects the nil pointers held by interfaces,
+// thus the nil keys are replaced by nil values
+func gobProperties(props []datastore.Property) []datastore.Property {
+	encoded := make([]datastore.Property, len(props))
+	for i, p := range props {
+		p.Value = gobValue(p.Value)
+		encoded[i] = p
+	}
+	return encoded
+}
+
+func gobValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case *datastore.Key:
+		if x == nil {
+			return nil
+		}
+	case []interface{}:
+		values := make([]interface{}, len(x))
+		for i, e := range x {
+			values[i] = gobValue(e)
+		}
+		return values
+	case *datastore.Entity:
+		if x == nil {
+			return nil
+		}
+		return &datastore.Entity{Key: x.Key, Properties: gobProperties(x.Properties)}
+	}
+	return v
+}
+
+// JSONSerializer encodes the properties as typed JSON, the same way Archive does.
+// Its entries are readable by other languages, at the cost of a bigger size
+type JSONSerializer struct{}
+
+func (JSONSerializer) Marshal(props []datastore.Property) ([]byte, error) {
+	archived, err := archiveProperties(props)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(archived)
+}
+
+func (JSONSerializer) Unmarshal(data []byte) ([]datastore.Property, error) {
+	var archived []archivedProperty
+	if err := json.Unmarshal(data, &archived); err != nil {
+		return nil, err
+	}
+	return unarchiveProperties(archived)
+}
+
+var cacheSerializerMutex sync.RWMutex
+var cacheSerializer CacheSerializer = GobSerializer{}
+
+// SetCacheSerializer sets the serializer of the cached modelables.
+// The entries written by another serializer can't be decoded and are discarded when read
+func SetCacheSerializer(s CacheSerializer) {
+	cacheSerializerMutex.Lock()
+	defer cacheSerializerMutex.Unlock()
+	cacheSerializer = s
+}
+
+func cacheSerializerOf() CacheSerializer {
+	cacheSerializerMutex.RLock()
+	defer cacheSerializerMutex.RUnlock()
+	return cacheSerializer
+}
+
+// version of the layout of the cache entries, changed whenever the envelope changes
+const cacheFormat byte = 1
+
+// returned when a cache entry has been written by an older version of the struct of the modelable,
+// or by another serializer
+var errStaleCacheEntry = errors.New("stale cache entry")
+
+// encodes the cache entry of a modelable, made of an envelope holding the version of the layout of its struct
+// and the keys of its references, followed by the serialized properties
+func encodeCacheEntry(s *encodedStruct, keys KeyMap, props []datastore.Property) ([]byte, error) {
+	payload, err := cacheSerializerOf().Marshal(props)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(cacheFormat)
+	binary.Write(&buf, binary.BigEndian, s.layout)
+
+	var n [binary.MaxVarintLen64]byte
+	buf.Write(n[:binary.PutUvarint(n[:], uint64(len(keys)))])
+	for idx, key := range keys {
+		buf.Write(n[:binary.PutUvarint(n[:], uint64(idx))])
+		buf.Write(n[:binary.PutUvarint(n[:], uint64(len(key)))])
+		buf.WriteString(key)
+	}
+
+	buf.Write(payload)
+	return buf.Bytes(), nil
+}
+
+// decodes a cache entry written by encodeCacheEntry.
+// It returns errStaleCacheEntry if the entry doesn't match the current layout of the struct
+func decodeCacheEntry(s *encodedStruct, data []byte) (KeyMap, []datastore.Property, error) {
+	r := bytes.NewReader(data)
+	if format, err := r.ReadByte(); err != nil || format != cacheFormat {
+		return nil, nil, errStaleCacheEntry
+	}
+
+	var layout uint64
+	if err := binary.Read(r, binary.BigEndian, &layout); err != nil || layout != s.layout {
+		return nil, nil, errStaleCacheEntry
+	}
+
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, nil, errStaleCacheEntry
+	}
+
+	keys := make(KeyMap, count)
+	for i := uint64(0); i < count; i++ {
+		idx, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, nil, errStaleCacheEntry
+		}
+
+		size, err := binary.ReadUvarint(r)
+		if err != nil || size > uint64(r.Len()) {
+			return nil, nil, errStaleCacheEntry
+		}
+
+		key := make([]byte, size)
+		r.Read(key)
+		keys[int(idx)] = string(key)
+	}
+
+	props, err := cacheSerializerOf().Unmarshal(data[len(data)-r.Len():])
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", errStaleCacheEntry, err.Error())
+	}
+
+	return keys, props, nil
+}
+
+// returns a hash of the layout of struct t: the names, types and tags of its fields and of the structs they hold.
+// Any change of the struct changes the layout, discarding its cache entries
+func layoutOf(t reflect.Type) uint64 {
+	h := fnv.New64a()
+	writeLayout(h, t, map[reflect.Type]bool{})
+	return h.Sum64()
+}
+
+func writeLayout(w io.Writer, t reflect.Type, visited map[reflect.Type]bool) {
+	visited[t] = true
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		fmt.Fprintf(w, "%s\x00%s\x00%s\n", field.Name, field.Type, field.Tag)
+
+		ft := field.Type
+		for ft.Kind() == reflect.Ptr || ft.Kind() == reflect.Slice || ft.Kind() == reflect.Array || ft.Kind() == reflect.Map {
+			ft = ft.Elem()
+		}
+
+		if ft.Kind() == reflect.Struct && ft != typeOfModel && !visited[ft] {
+			w.Write([]byte{'{'})
+			writeLayout(w, ft, visited)
+			w.Write([]byte{'}'})
+		}
+	}
+}
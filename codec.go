@@ -0,0 +1,192 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+var codecMutex sync.Mutex
+var codecTypes = map[reflect.Type]bool{}
+
+// UseDatastoreCodec makes the modelables of the given type saved and loaded by the struct codec
+// of the official datastore library, following its `datastore` tags and flattening rules.
+// The framework keeps managing the key and the references of the modelable, which are stored as keys as usual.
+// Framework tags affecting the encoding, like noindex, omitempty, json or the map fields support, are ignored
+func UseDatastoreCodec(m modelable, use bool) {
+	t := reflect.TypeOf(m).Elem()
+	codecMutex.Lock()
+	codecTypes[t] = use
+	codecMutex.Unlock()
+}
+
+func usesDatastoreCodec(t reflect.Type) bool {
+	codecMutex.Lock()
+	defer codecMutex.Unlock()
+	return codecTypes[t]
+}
+
+// returns the names of the top level properties managed by the framework rather than by the datastore codec:
+// the references and the key of the model, unless the struct declares its own Key field
+func managedProperties(m modelable) map[string]bool {
+	model := m.getModel()
+	t := reflect.TypeOf(m).Elem()
+
+	managed := make(map[string]bool)
+	if f, ok := t.FieldByName("Key"); ok && len(f.Index) > 1 {
+		managed["Key"] = true
+	}
+
+	for _, ref := range model.references {
+		managed[t.Field(ref.idx).Name] = true
+	}
+
+	for _, i := range model.referenceSlicesIdx {
+		managed[t.Field(i).Name] = true
+	}
+
+	return managed
+}
+
+// returns the name of the top level field a property belongs to
+func topLevelName(name string) string {
+	if i := strings.Index(name, valSeparator); i > 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// encodes the modelable with the datastore struct codec, then stores its references as keys
+func saveWithDatastoreCodec(m modelable) ([]datastore.Property, error) {
+	props, err := datastore.SaveStruct(m)
+	if err != nil {
+		return nil, err
+	}
+
+	managed := managedProperties(m)
+	kept := props[:0]
+	for _, p := range props {
+		if !managed[topLevelName(p.Name)] {
+			kept = append(kept, p)
+		}
+	}
+
+	model := m.getModel()
+	value := reflect.ValueOf(m).Elem()
+	t := value.Type()
+	for _, ref := range model.references {
+		kept = append(kept, datastore.Property{Name: t.Field(ref.idx).Name, Value: ref.Modelable.getModel().Key})
+	}
+
+	for _, i := range model.referenceSlicesIdx {
+		kept = append(kept, datastore.Property{Name: t.Field(i).Name, Value: referenceSliceKeys(value.Field(i))})
+	}
+
+	return kept, nil
+}
+
+// loads the modelable with the datastore struct codec, setting the keys of its references apart
+func loadWithDatastoreCodec(m modelable, props []datastore.Property) error {
+	model := m.getModel()
+	value := reflect.ValueOf(m).Elem()
+	t := value.Type()
+
+	managed := managedProperties(m)
+	loaded := make([]datastore.Property, 0, len(props))
+	for _, p := range props {
+		if !managed[topLevelName(p.Name)] {
+			loaded = append(loaded, p)
+			continue
+		}
+
+		sf, ok := t.FieldByName(p.Name)
+		if !ok || len(sf.Index) > 1 {
+			continue
+		}
+
+		if ref := model.referenceAtIndex(sf.Index[0]); ref != nil {
+			key, ok := p.Value.(*datastore.Key)
+			if !ok && p.Value != nil {
+				return &PropertyError{Name: p.Name, Kind: sf.Type.Kind(), Value: p.Value, Err: ErrTypeMismatch}
+			}
+			ref.Modelable.getModel().Key = key
+			continue
+		}
+
+		if err := decodeReferenceSlice(value.Field(sf.Index[0]), p); err != nil {
+			return err
+		}
+	}
+
+	return datastore.LoadStruct(m, loaded)
+}
+
+// the precompiled encoding of a field of a struct, computed once when the struct is mapped
+// so that the tags of the field are not parsed again on every save
+type fieldCodec struct {
+	index     int
+	name      string
+	noIndex   bool
+	omitEmpty bool
+	// the mapping of the field, if mapped
+	attr   encodedField
+	mapped bool
+	// encodes the values of the plain kinds without boxing them first, nil for the other fields
+	encode func(v reflect.Value) interface{}
+}
+
+// Register maps the modelable type of the prototype and precompiles its codec ahead of the first save or load,
+// i.e. at startup, so that the requests don't pay for it and invalid tags are reported early.
+// The types that are not registered are compiled on their first use
+func Register(prototype modelable) {
+	m := reflect.New(reflect.TypeOf(prototype).Elem()).Interface().(modelable)
+	index(m)
+}
+
+// compiles the codecs of the encoded fields of struct t. Must be called once the fields of s are mapped
+func compileCodec(t reflect.Type, s *encodedStruct) []fieldCodec {
+	var codec []fieldCodec
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Type == typeOfModel || field.Tag.Get("datastore") == "-" {
+			continue
+		}
+
+		tags := strings.Split(field.Tag.Get(tagDomain), ",")
+		if containsTag(tags, tagSkip) != "" {
+			continue
+		}
+
+		fc := fieldCodec{
+			index:     i,
+			name:      field.Name,
+			noIndex:   containsTag(tags, tagNoindex) != "" || containsTag(tags, tagModified) != "",
+			omitEmpty: containsTag(tags, tagOmitEmpty) != "",
+		}
+		fc.attr, fc.mapped = s.fieldNames[field.Name]
+
+		// the property savers and the values with a type of their own are encoded as they are
+		if !field.Type.Implements(typeOfPLS) && !fc.attr.isJSON {
+			fc.encode = plainEncoder(field.Type.Kind())
+		}
+
+		codec = append(codec, fc)
+	}
+	return codec
+}
+
+// returns the encoder of the values of the given kind, or nil if the kind is not a plain one
+func plainEncoder(kind reflect.Kind) func(v reflect.Value) interface{} {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return func(v reflect.Value) interface{} { return v.Int() }
+	case reflect.Bool:
+		return func(v reflect.Value) interface{} { return v.Bool() }
+	case reflect.String:
+		return func(v reflect.Value) interface{} { return v.String() }
+	case reflect.Float32, reflect.Float64:
+		return func(v reflect.Value) interface{} { return v.Float() }
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type WideEntity struct {
+	Model
+	Name     string
+	Surname  string
+	Email    string `model:"noindex"`
+	Phone    string `model:"omitempty"`
+	Street   string
+	City     string
+	Zip      string
+	Country  string
+	Age      int
+	Score    int64
+	Rank     int32
+	Rating   float64
+	Weight   float32
+	Active   bool
+	Verified bool
+	Notes    string `model:"noindex"`
+	Tags     []string
+	Born     time.Time
+	Level    int8
+	Visits   int64
+}
+
+func newWideEntity() WideEntity {
+	return WideEntity{
+		Name: "name", Surname: "surname", Email: "name@example.com", Street: "street", City: "city",
+		Zip: "00100", Country: "IT", Age: 40, Score: 1000, Rank: 3, Rating: 4.5, Weight: 70.5,
+		Active: true, Notes: "notes", Tags: []string{"a", "b"}, Born: time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC),
+		Level: 2, Visits: 12,
+	}
+}
+
+func TestRegister(t *testing.T) {
+	Register(&WideEntity{})
+
+	es, ok := encodedStructOf(reflect.TypeOf(WideEntity{}))
+	if !ok {
+		t.Fatal("registered struct not mapped")
+	}
+
+	if len(es.codec) != reflect.TypeOf(WideEntity{}).NumField()-1 {
+		t.Fatalf("expected a codec for each field, got %d", len(es.codec))
+	}
+
+	src := newWideEntity()
+	index(&src)
+	props, err := toPropertyList(&src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := WideEntity{}
+	index(&dst)
+	if err := fromPropertyList(&dst, props); err != nil {
+		t.Fatal(err)
+	}
+
+	dst.Model = src.Model
+	if !reflect.DeepEqual(dst, src) {
+		t.Fatalf("invalid decoded entity %+v", dst)
+	}
+}
+
+func BenchmarkToPropertyList(b *testing.B) {
+	Register(&WideEntity{})
+	entity := newWideEntity()
+	index(&entity)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := toPropertyList(&entity); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFromPropertyList(b *testing.B) {
+	Register(&WideEntity{})
+	src := newWideEntity()
+	index(&src)
+	props, err := toPropertyList(&src)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	entity := WideEntity{}
+	index(&entity)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if err := fromPropertyList(&entity, props); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+type codecAuthor struct {
+	Model
+	Name string
+}
+
+type codecPost struct {
+	Model
+	Title   string `datastore:"title"`
+	Body    string `datastore:"body,noindex"`
+	Summary string `model:"noindex"`
+	Tags    []string
+	Author  codecAuthor
+}
+
+func TestDatastoreCodec(t *testing.T) {
+	UseDatastoreCodec(&codecPost{}, true)
+
+	src := codecPost{Title: "title", Body: "body", Summary: "summary", Tags: []string{"a", "b"}}
+	index(&src)
+	src.Key = datastore.IDKey("codecPost", 1, nil)
+	src.Author.Key = datastore.IDKey("codecAuthor", 3, nil)
+
+	props, err := toPropertyList(&src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byName := make(map[string]datastore.Property, len(props))
+	for _, p := range props {
+		byName[p.Name] = p
+	}
+
+	// the properties follow the datastore tags rather than the model ones
+	if _, ok := byName["title"]; !ok {
+		t.Fatalf("expected the property named by the datastore tag, got %v", props)
+	}
+
+	if !byName["body"].NoIndex || byName["Summary"].NoIndex {
+		t.Fatalf("expected the index settings of the datastore tags, got %v", props)
+	}
+
+	// the framework keeps storing the key of the model apart, and the references as keys
+	for _, name := range []string{"Key", "Author.Key", "Author.Name"} {
+		if _, ok := byName[name]; ok {
+			t.Fatalf("property %s must not be stored", name)
+		}
+	}
+
+	if k, ok := byName["Author"].Value.(*datastore.Key); !ok || !k.Equal(src.Author.Key) {
+		t.Fatalf("expected the reference to be stored as its key, got %v", byName["Author"].Value)
+	}
+
+	dst := codecPost{}
+	index(&dst)
+	if err := fromPropertyList(&dst, props); err != nil {
+		t.Fatal(err)
+	}
+
+	if dst.Title != src.Title || dst.Body != src.Body || dst.Summary != src.Summary || !reflect.DeepEqual(dst.Tags, src.Tags) {
+		t.Fatalf("invalid decoded entity %+v", dst)
+	}
+
+	if !dst.Author.Key.Equal(src.Author.Key) {
+		t.Fatalf("expected the reference key %s, got %v", src.Author.Key, dst.Author.Key)
+	}
+}
+
+func TestDatastoreCodecMismatch(t *testing.T) {
+	UseDatastoreCodec(&codecPost{}, true)
+
+	dst := codecPost{}
+	index(&dst)
+	err := fromPropertyList(&dst, []datastore.Property{{Name: "Author", Value: "not a key"}})
+	if !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("expected %v for a reference not stored as a key, got %v", ErrTypeMismatch, err)
+	}
+}
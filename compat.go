@@ -0,0 +1,60 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+)
+
+// Entities written by other libraries, like the official datastore library or goon, can store nested structs
+// as embedded entities and slices as array values, while the framework flattens structs into "Field.Sub" properties
+// and repeats a property for each item of a slice.
+// The layout is detected per property: nested entities and arrays are flattened before being loaded,
+// so that datasets written by other libraries can be read without rewriting them first.
+
+// returns the properties with the embedded entities and the arrays flattened, or props itself if there is none.
+// The arrays of the fields for which keep returns true are left untouched
+func flattenProperties(props []datastore.Property, keep func(name string) bool) []datastore.Property {
+	nested := false
+	for _, p := range props {
+		switch p.Value.(type) {
+		case *datastore.Entity:
+			nested = true
+		case []interface{}:
+			nested = nested || !keep(p.Name)
+		}
+	}
+
+	if !nested {
+		return props
+	}
+
+	flat := make([]datastore.Property, 0, len(props))
+	for _, p := range props {
+		if _, ok := p.Value.([]interface{}); ok && keep(p.Name) {
+			flat = append(flat, p)
+			continue
+		}
+		flat = appendFlattened(flat, p)
+	}
+	return flat
+}
+
+func appendFlattened(props []datastore.Property, p datastore.Property) []datastore.Property {
+	switch x := p.Value.(type) {
+	case *datastore.Entity:
+		if x == nil {
+			return props
+		}
+		for _, ep := range x.Properties {
+			ep.Name = referenceName(p.Name, ep.Name)
+			ep.NoIndex = ep.NoIndex || p.NoIndex
+			props = appendFlattened(props, ep)
+		}
+	case []interface{}:
+		for _, v := range x {
+			props = appendFlattened(props, datastore.Property{Name: p.Name, Value: v, NoIndex: p.NoIndex})
+		}
+	default:
+		props = append(props, p)
+	}
+	return props
+}
@@ -0,0 +1,53 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"testing"
+)
+
+type compatAddress struct {
+	City string
+	Zip  string
+}
+
+type compatEntity struct {
+	Model
+	Name      string
+	Tags      []string
+	Address   compatAddress
+	Addresses []compatAddress
+}
+
+func TestNestedEntityLoading(t *testing.T) {
+	address := func(city string) *datastore.Entity {
+		return &datastore.Entity{Properties: []datastore.Property{
+			{Name: "City", Value: city},
+			{Name: "Zip", Value: "00100"},
+		}}
+	}
+
+	props := []datastore.Property{
+		{Name: "Name", Value: "Enzo"},
+		{Name: "Tags", Value: []interface{}{"a", "b"}},
+		{Name: "Address", Value: address("Rome")},
+		{Name: "Addresses", Value: []interface{}{address("Milan"), address("Turin")}},
+	}
+
+	e := compatEntity{}
+	index(&e)
+	if err := fromPropertyList(&e, props); err != nil {
+		t.Fatal(err)
+	}
+
+	if e.Name != "Enzo" || len(e.Tags) != 2 || e.Tags[1] != "b" {
+		t.Fatalf("invalid loaded entity %+v", e)
+	}
+
+	if e.Address.City != "Rome" || e.Address.Zip != "00100" {
+		t.Fatalf("invalid embedded entity %+v", e.Address)
+	}
+
+	if len(e.Addresses) != 2 || e.Addresses[0].City != "Milan" || e.Addresses[1].City != "Turin" {
+		t.Fatalf("invalid embedded entities %+v", e.Addresses)
+	}
+}
@@ -0,0 +1,104 @@
+package model
+
+import (
+	"reflect"
+)
+
+// Cost is an approximation of the datastore operations issued by the framework,
+// computed according to the datastore pricing model: writing an entity costs
+// 2 writes plus 2 writes for each indexed property value (ascending and descending index).
+// Composite indexes are not accounted for.
+type Cost struct {
+	// number of entities involved in the operation, references included
+	Entities int
+	// entity reads
+	Reads int
+	// entity writes
+	Writes int
+	// number of indexed property values written
+	IndexedValues int
+	// number of fields written to the search index
+	SearchFields int
+}
+
+func (c *Cost) add(o Cost) {
+	c.Entities += o.Entities
+	c.Reads += o.Reads
+	c.Writes += o.Writes
+	c.IndexedValues += o.IndexedValues
+	c.SearchFields += o.SearchFields
+}
+
+// EstimateCost returns the approximate cost of creating the modelable, with its references.
+// Readonly references and empty references tagged with zero are not written and not accounted for.
+func EstimateCost(m modelable) (Cost, error) {
+	index(m)
+	return estimateWriteCost(m)
+}
+
+func estimateWriteCost(m modelable) (Cost, error) {
+	model := m.getModel()
+
+	cost := Cost{}
+	for _, ref := range model.references {
+		rm := ref.Modelable.getModel()
+		if rm.readonly || (rm.skipIfZero && isZero(ref.Modelable)) {
+			continue
+		}
+
+		rc, err := estimateWriteCost(ref.Modelable)
+		if err != nil {
+			return cost, err
+		}
+		cost.add(rc)
+	}
+
+	// the estimate is a dry run: the modelable is encoded without validating nor stamping it
+	props, err := encodeProperties(m)
+	if err != nil {
+		return cost, err
+	}
+
+	indexed := 0
+	for _, p := range props {
+		if !p.NoIndex {
+			indexed++
+		}
+	}
+
+	cost.Entities++
+	cost.IndexedValues += indexed
+	cost.Writes += 2 + 2*indexed
+
+	if model.searchable {
+		cost.SearchFields += len(getSearchablefields(reflect.TypeOf(m).Elem()))
+	}
+
+	return cost, nil
+}
+
+// estimates the number of entities read for each hydrated result of the query,
+// assuming no result is served by memcache.
+// Keys only queries are billed as small operations and are not accounted for
+func estimateReadCost(m modelable) Cost {
+	model := m.getModel()
+
+	cost := Cost{Entities: 1, Reads: 1}
+	for _, ref := range model.references {
+		cost.add(estimateReadCost(ref.Modelable))
+	}
+
+	return cost
+}
+
+// EstimateCost returns the approximate cost of loading a single result of the query.
+// Projection queries don't load the entities and their cost is a single read per result.
+func (q *Query) EstimateCost() Cost {
+	if q.projection {
+		return Cost{Entities: 1, Reads: 1}
+	}
+
+	m := reflect.New(q.mType).Interface().(modelable)
+	index(m)
+	return estimateReadCost(m)
+}
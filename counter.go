@@ -0,0 +1,209 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// flags an int field of a parent model as the counter of the entities of the given kind referencing it,
+// i.e. `model:"count=Comment"` on Post.CommentCount.
+// The counter is kept in sync when the children are created or deleted through the framework
+const tagCount string = "count"
+
+type counterDescriptor struct {
+	// type of the model holding the counter
+	parent reflect.Type
+	// index of the counter field
+	index int
+	// name of the property of the counter
+	name string
+}
+
+// maps the kind of the counted children to the counters of their parents
+var counters = map[string][]counterDescriptor{}
+
+// registers a counter. Must be called with the encodedStructsMutex held
+func registerCounterLocked(kind string, parent reflect.Type, idx int, name string) {
+	for _, c := range counters[kind] {
+		if c.parent == parent && c.index == idx {
+			return
+		}
+	}
+	counters[kind] = append(counters[kind], counterDescriptor{parent: parent, index: idx, name: name})
+}
+
+// the change of a counter of a parent, accumulated by the operations of a transaction
+type counterDelta struct {
+	parent modelable
+	key    *datastore.Key
+	desc   counterDescriptor
+	delta  int64
+}
+
+// reports whether the entities of the kind of the modelable are counted by their parents
+func hasCounters(m modelable) bool {
+	encodedStructsMutex.RLock()
+	defer encodedStructsMutex.RUnlock()
+	return len(counters[m.getModel().structName]) > 0
+}
+
+// runs write, which writes the modelable, and adds delta to the counters of its parents in a single transaction,
+// the one of ctx if any, so that the counters can't drift from the entities they count.
+// Modelables that are not counted are written as they are
+func writeCounted(ctx context.Context, m modelable, delta int64, write func(ctx context.Context) error) error {
+	if !hasCounters(m) {
+		return write(ctx)
+	}
+
+	counted := func(ctx context.Context) error {
+		if err := write(ctx); err != nil {
+			return err
+		}
+		return updateCounters(ctx, m, delta)
+	}
+
+	if txStateFrom(ctx) != nil {
+		return counted(ctx)
+	}
+
+	return runTransaction(ctx, func(ctx context.Context, tx *datastore.Transaction) error {
+		return counted(ctx)
+	})
+}
+
+// adds delta to the counters of the parents referenced by the modelable.
+// Within a transaction the deltas are accumulated and written once, before the commit:
+// otherwise they are written by a transaction of their own
+func updateCounters(ctx context.Context, m modelable, delta int64) error {
+	model := m.getModel()
+	if model.Key == nil {
+		return nil
+	}
+
+	encodedStructsMutex.RLock()
+	descs := counters[model.Key.Kind]
+	encodedStructsMutex.RUnlock()
+
+	if len(descs) == 0 {
+		return nil
+	}
+
+	state := txStateFrom(ctx)
+	if state == nil {
+		return runTransaction(ctx, func(ctx context.Context, tx *datastore.Transaction) error {
+			return updateCounters(ctx, m, delta)
+		})
+	}
+
+	for _, ref := range model.references {
+		parent := ref.Modelable
+		pkey := parent.getModel().Key
+		if pkey == nil {
+			continue
+		}
+
+		ptype := reflect.TypeOf(parent).Elem()
+		for _, desc := range descs {
+			if desc.parent == ptype {
+				state.count(parent, pkey, desc, delta)
+			}
+		}
+	}
+
+	return nil
+}
+
+// accumulates the delta of the counter of the parent with the given key
+func (state *txState) count(parent modelable, key *datastore.Key, desc counterDescriptor, delta int64) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	id := fmt.Sprintf("%s/%d", key.Encode(), desc.index)
+	if c, ok := state.counters[id]; ok {
+		c.delta += delta
+		return
+	}
+	state.counters[id] = &counterDelta{parent: parent, key: key, desc: desc, delta: delta}
+}
+
+// writes the counters changed in the transaction, adding the accumulated deltas to their values.
+// Transactions don't read their own writes, thus the parents written by the transaction are counted
+// from their written values. The in-memory parents are updated, and evicted from the cache, once committed.
+// Returns an error if a parent to increment doesn't exist
+func writeCounters(ctx context.Context, state *txState) error {
+	state.mutex.Lock()
+	ids := make([]string, 0, len(state.counters))
+	for id := range state.counters {
+		ids = append(ids, id)
+	}
+	state.mutex.Unlock()
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		c := state.counters[id]
+		encoded := c.key.Encode()
+
+		// a parent deleted by the transaction has nothing left to count
+		if c.delta == 0 || state.deleted[encoded] {
+			continue
+		}
+
+		var props datastore.PropertyList
+		if written, ok := state.written[encoded]; ok {
+			encodedProps, err := encodeProperties(written)
+			if err != nil {
+				return err
+			}
+			props = encodedProps
+		} else if err := state.tx.Get(c.key, &props); err == datastore.ErrNoSuchEntity {
+			// a missing parent has nothing to decrement
+			if c.delta < 0 {
+				continue
+			}
+			return fmt.Errorf("can't count %s: parent %s doesn't exist", c.desc.name, c.key)
+		} else if err != nil {
+			return err
+		}
+
+		count := c.delta
+		found := false
+		for i := range props {
+			if props[i].Name != c.desc.name {
+				continue
+			}
+			v, _ := props[i].Value.(int64)
+			count = v + c.delta
+			if count < 0 {
+				count = 0
+			}
+			props[i].Value = count
+			found = true
+		}
+
+		if !found {
+			if count < 0 {
+				count = 0
+			}
+			props = append(props, datastore.Property{Name: c.desc.name, Value: count})
+		}
+
+		if _, err := state.tx.Put(c.key, &props); err != nil {
+			return err
+		}
+
+		parent, idx, key, value := c.parent, c.desc.index, c.key, count
+		state.onCommit(func() {
+			reflect.ValueOf(parent).Elem().Field(idx).SetInt(value)
+
+			// the cached parent is now stale
+			if err := deleteFromMemcache(ctx, &Model{Key: key}); err != nil && err != ErrCacheMiss {
+				warningf(ctx, "error removing the counted %s from the cache: %s", key, err.Error())
+			}
+		})
+	}
+
+	return nil
+}
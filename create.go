@@ -4,13 +4,20 @@ import (
 	"cloud.google.com/go/datastore"
 	"context"
 	"errors"
+	"fmt"
+	"reflect"
+	"time"
 )
 
 // Create methods
 type CreateOptions struct {
-	stringId string
-	intId    int64
-	attempts int
+	stringId  string
+	intId     int64
+	attempts  int
+	messages  []OutboxMessage
+	indexOnly []string
+	atomic    bool
+	timeout   time.Duration
 }
 
 func NewCreateOptions() CreateOptions {
@@ -31,23 +38,82 @@ func (opts *CreateOptions) InTransaction(attempts int) {
 	opts.attempts = attempts
 }
 
-func CreateWithOptions(ctx context.Context, m modelable, copts *CreateOptions) error {
+// Marks as NoIndex all the properties of the created entity but the ones of the given fields.
+// It is meant for backfills: the skipped indexes can be written later on with Reindex.
+// References are written with their default index settings
+func (opts *CreateOptions) IndexOnly(fields ...string) {
+	opts.indexOnly = append([]string{}, fields...)
+}
+
+// Creates the entity and all its new references with a single transactional commit,
+// so that a failure can't leave a partially created tree.
+// The keys of the tree are allocated before the transaction starts.
+// Trees holding children in reference slices, or loaded references that are not read only,
+// are rejected, since writing them would escape the transaction.
+// If no attempts are set with InTransaction, the transaction is tried once
+func (opts *CreateOptions) Atomic() {
+	opts.atomic = true
+}
+
+// Attaches a message to the outbox, to be stored along with the created entity.
+// If the create runs in a transaction, the message is stored within the same transaction
+func (opts *CreateOptions) AttachMessage(topic string, payload []byte) {
+	opts.messages = append(opts.messages, newOutboxMessage(topic, payload))
+}
+
+// Cancels the create, along with the creation of the references, if it takes longer than d.
+// The create then fails with context.DeadlineExceeded: references already written are handled
+// as for any other failure
+func (opts *CreateOptions) WithTimeout(d time.Duration) {
+	opts.timeout = d
+}
+
+func CreateWithOptions(ctx context.Context, m modelable, copts *CreateOptions) (err error) {
+	ctx, span := startOperation(ctx, OpCreate, "CreateWithOptions")
+	defer func() { span.end(ctx, m, err) }()
+
+	if timeout := operationTimeout(ctx, copts.timeout); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	ctx = withHookContext(ctx, OpCreate, "CreateWithOptions", copts.attempts > 0 || copts.atomic, false)
 	index(m)
 
-	var err error
-	if copts.attempts > 0 {
-		client := ClientFromContext(ctx)
+	if err := beforeCreate(ctx, m); err != nil {
+		return err
+	}
+
+	if copts.indexOnly != nil {
+		model := m.getModel()
+		model.indexOnly = copts.indexOnly
+		defer func() {
+			model.indexOnly = nil
+		}()
+	}
+
+	if copts.atomic {
+		err = createAtomic(ctx, m, copts)
+	} else if copts.attempts > 0 {
 		opts := datastore.MaxAttempts(copts.attempts)
 
-		_, err = client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
-			return createWithOptions(ctx, m, copts)
+		// the entities are written within the transaction of the outbox
+		err = runTransaction(ctx, func(tctx context.Context, tx *datastore.Transaction) error {
+			if err := createWithOptions(tctx, m, copts); err != nil {
+				return err
+			}
+			return putOutbox(ctx, tx, m.getModel().Key, copts.messages)
 		}, opts)
 	} else {
 		err = createWithOptions(ctx, m, copts)
+		if err == nil {
+			err = putOutbox(ctx, nil, m.getModel().Key, copts.messages)
+		}
 	}
 
 	if err == nil {
-		if err = saveInMemcache(ctx, m); err != nil {
+		if err = cacheWritten(ctx, m, saveInMemcache); err != nil {
 			return err
 		}
 	}
@@ -58,10 +124,96 @@ func CreateWithOptions(ctx context.Context, m modelable, copts *CreateOptions) e
 // Reads data from a modelable and writes it to the datastore as an entity with a new Key.
 // Uses default options
 func Create(ctx context.Context, m modelable) (err error) {
+	ctx, span := startOperation(ctx, OpCreate, "Create")
+	defer func() { span.end(ctx, m, err) }()
+
+	ctx = withHookContext(ctx, OpCreate, "Create", false, false)
 	return CreateWithOptions(ctx, m, new(CreateOptions))
 }
 
+// ErrPartialCreate is returned when a create fails after some of the new references have been written.
+// The written references are deleted on a best effort basis: Orphans holds the keys of the ones
+// that could not be deleted
+type ErrPartialCreate struct {
+	Err     error
+	Orphans []*datastore.Key
+}
+
+func (e *ErrPartialCreate) Error() string {
+	return fmt.Sprintf("create failed leaving %d orphan entities: %s", len(e.Orphans), e.Err.Error())
+}
+
+func (e *ErrPartialCreate) Unwrap() error {
+	return e.Err
+}
+
 func createWithOptions(ctx context.Context, m modelable, opts *CreateOptions) error {
+	var created []modelable
+	err := createTracked(ctx, m, opts, &created)
+	if err != nil && len(created) > 0 {
+		err = rollbackCreate(ctx, created, err)
+		clearDanglingReferences(m)
+	}
+	return err
+}
+
+// clears the reference keys pointing to entities that have been rolled back, so that the create can be retried
+func clearDanglingReferences(m modelable) {
+	model := m.getModel()
+	for i, ref := range model.references {
+		rm := ref.Modelable.getModel()
+		if rm.readonly {
+			continue
+		}
+
+		clearDanglingReferences(ref.Modelable)
+		if rm.Key == nil {
+			model.references[i].Key = nil
+		}
+	}
+}
+
+// deletes the entities written by a failed create.
+// Returns an ErrPartialCreate if some of them can't be deleted, cause otherwise
+func rollbackCreate(ctx context.Context, created []modelable, cause error) error {
+	client := ClientFromContext(ctx)
+
+	var orphans []*datastore.Key
+	for _, m := range created {
+		model := m.getModel()
+		if err := client.Delete(ctx, model.Key); err != nil {
+			orphans = append(orphans, model.Key)
+			continue
+		}
+
+		if len(model.uniqueGroups) > 0 {
+			if err := releaseUnique(ctx, m, model.Key); err != nil {
+				warningf(ctx, "error releasing unique values of %s: %s", model.Name(), err.Error())
+			}
+		}
+
+		if err := updateCounters(ctx, m, -1); err != nil {
+			warningf(ctx, "error updating counters of %s: %s", model.Name(), err.Error())
+		}
+
+		if model.searchable {
+			if err := searchDelete(ctx, model, model.Name()); err != nil {
+				warningf(ctx, "error removing %s from the search index: %s", model.Name(), err.Error())
+			}
+		}
+
+		model.Key = nil
+	}
+
+	if len(orphans) > 0 {
+		return &ErrPartialCreate{Err: cause, Orphans: orphans}
+	}
+
+	return cause
+}
+
+// creates the modelable along with its new references, appending to created every entity written
+func createTracked(ctx context.Context, m modelable, opts *CreateOptions, created *[]modelable) error {
 	model := m.getModel()
 
 	//if the root model has a Key then this is the wrong operation
@@ -69,10 +221,23 @@ func createWithOptions(ctx context.Context, m modelable, opts *CreateOptions) er
 		return errors.New("data has already been created")
 	}
 
+	// if the transaction fails the tree is left to be created again by its next attempt.
+	// The hooks run in reverse order, thus the keys of the references are cleared before this one
+	if state := txStateFrom(ctx); state != nil {
+		state.onRollback(func() {
+			model.Key = nil
+			clearDanglingReferences(m)
+		})
+	}
+
 	var ancKey *datastore.Key = nil
 	//we iterate through the model references.
 	//if a reference has its own Key we use it as a value in the root entity
 	for i, ref := range model.references {
+		if err := treeCanceled(ctx, m); err != nil {
+			return err
+		}
+
 		rm := ref.Modelable.getModel()
 		if ref.Key != nil {
 			//this can't happen because we are in create, thus the root model can't have a Key
@@ -90,10 +255,11 @@ func createWithOptions(ctx context.Context, m modelable, opts *CreateOptions) er
 			} else if rm.skipIfZero && isZero(ref.Modelable) {
 				continue
 			} else {
-				err := createReference(ctx, &ref)
-				if err != nil {
+				refOpts := NewCreateOptions()
+				if err := createTracked(ctx, ref.Modelable, &refOpts, created); err != nil {
 					return err
 				}
+				ref.Key = rm.Key
 			}
 		}
 		if ref.Ancestor {
@@ -102,19 +268,74 @@ func createWithOptions(ctx context.Context, m modelable, opts *CreateOptions) er
 		model.references[i] = ref
 	}
 
-	var newKey *datastore.Key
-	if opts.stringId != "" {
-		newKey = datastore.NameKey(model.structName, opts.stringId, ancKey)
-	} else {
-		newKey = datastore.IDKey(model.structName, opts.intId, ancKey)
+	if err := writeChildren(ctx, m); err != nil {
+		return err
 	}
 
+	initVersion(m)
+	initCreateTime(m)
+	copyDenormalized(m)
+
+	newKey, err := newKeyOf(m, opts, ancKey)
+	if err != nil {
+		return err
+	}
+	newKey = namespacedKey(ctx, newKey)
+
+	defer traceModel(ctx, model)()
 	client := ClientFromContext(ctx)
-	key, err := client.Put(ctx, newKey, m)
+
+	// unique values are claimed on behalf of the new key, thus we need it to be complete
+	if len(model.uniqueGroups) > 0 {
+		if newKey.Incomplete() {
+			done := traceDatastoreCall(ctx, "AllocateIDs", newKey.Kind, 1)
+			keys, err := client.AllocateIDs(ctx, []*datastore.Key{newKey})
+			done(err)
+			if err != nil {
+				return err
+			}
+			newKey = keys[0]
+		}
+
+		if err := claimSlug(ctx, m, newKey); err != nil {
+			return err
+		}
+
+		if _, err := claimUnique(ctx, m, newKey); err != nil {
+			return err
+		}
+	}
+
+	// keys derived from the id field must not overwrite a stored entity
+	derived := model.id != nil && opts.stringId == "" && opts.intId == 0
+
+	// the counters of the parents are updated in the transaction writing the entity
+	err = writeCounted(ctx, m, 1, func(ctx context.Context) error {
+		if derived {
+			if err := insertDerived(ctx, newKey, m); err != nil {
+				return err
+			}
+			model.Key = newKey
+			return nil
+		}
+
+		key, err := putEntity(ctx, newKey, m)
+		if err != nil {
+			return err
+		}
+		model.Key = key
+		return nil
+	})
+
 	if err != nil {
+		model.Key = nil
+		if len(model.uniqueGroups) > 0 {
+			// release the claimed values
+			_ = releaseUnique(ctx, m, newKey)
+		}
 		return err
 	}
-	model.Key = key
+	*created = append(*created, m)
 
 	// if the model is searchable, update the search index with the new values
 	if model.searchable {
@@ -124,6 +345,182 @@ func createWithOptions(ctx context.Context, m modelable, opts *CreateOptions) er
 	return err
 }
 
+// allocates the keys of the modelable and of its new references, then inserts them all with one transaction
+func createAtomic(ctx context.Context, m modelable, opts *CreateOptions) error {
+	model := m.getModel()
+
+	if model.Key != nil {
+		return errors.New("data has already been created")
+	}
+
+	if err := checkAtomicTree(m); err != nil {
+		return err
+	}
+
+	batch := &createBatch{}
+
+	var ancKey *datastore.Key = nil
+	for i, ref := range model.references {
+		if err := treeCanceled(ctx, m); err != nil {
+			return err
+		}
+
+		rm := ref.Modelable.getModel()
+		if ref.Key != nil {
+			return errors.New("create called with a non-nil reference map")
+		}
+
+		if rm.Key != nil {
+			if err := updateReference(ctx, &ref, rm.Key); err != nil {
+				batch.discard(ctx)
+				return err
+			}
+		} else if rm.skipIfZero && isZero(ref.Modelable) {
+			continue
+		} else {
+			if err := batch.allocate(ctx, []modelable{ref.Modelable}, []int{0}); err != nil {
+				batch.discard(ctx)
+				return err
+			}
+			ref.Key = rm.Key
+		}
+
+		if ref.Ancestor {
+			ancKey = ref.Key
+		}
+		model.references[i] = ref
+	}
+
+	initVersion(m)
+	initCreateTime(m)
+	copyDenormalized(m)
+
+	newKey, err := newKeyOf(m, opts, ancKey)
+	if err != nil {
+		batch.discard(ctx)
+		return err
+	}
+	newKey = namespacedKey(ctx, newKey)
+
+	client := ClientFromContext(ctx)
+	if newKey.Incomplete() {
+		done := traceDatastoreCall(ctx, "AllocateIDs", newKey.Kind, 1)
+		keys, err := client.AllocateIDs(ctx, []*datastore.Key{newKey})
+		done(err)
+		if err != nil {
+			batch.discard(ctx)
+			return err
+		}
+		newKey = keys[0]
+	}
+
+	model.Key = newKey
+	batch.ms = append(batch.ms, m)
+	batch.keys = append(batch.keys, newKey)
+	batch.owners = append(batch.owners, 0)
+
+	if err := claimSlug(ctx, m, newKey); err != nil {
+		batch.discard(ctx)
+		return err
+	}
+
+	if _, err := claimUnique(ctx, m, newKey); err != nil {
+		batch.discard(ctx)
+		return err
+	}
+
+	muts := make([]*datastore.Mutation, len(batch.ms))
+	for i, bm := range batch.ms {
+		muts[i] = datastore.NewInsert(batch.keys[i], bm)
+	}
+
+	attempts := transactionAttempts(ctx, opts.attempts)
+	if attempts <= 0 {
+		attempts = 1
+	}
+
+	// the counters of the parents are written by the transaction inserting the tree
+	err = runTransaction(ctx, func(tctx context.Context, tx *datastore.Transaction) error {
+		if _, err := tx.Mutate(muts...); err != nil {
+			return err
+		}
+
+		state := txStateFrom(tctx)
+		for i, bm := range batch.ms {
+			state.put(batch.keys[i], bm)
+		}
+
+		for _, bm := range batch.ms {
+			if err := updateCounters(tctx, bm, 1); err != nil {
+				return err
+			}
+		}
+		return putOutbox(ctx, tx, newKey, opts.messages)
+	}, datastore.MaxAttempts(attempts))
+
+	if err != nil {
+		batch.discard(ctx)
+		return err
+	}
+
+	for _, bm := range batch.ms {
+		if bmodel := bm.getModel(); bmodel.searchable {
+			if err := searchPut(ctx, bmodel, bmodel.Name()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// returns an error if creating the tree of m would write entities other than the new ones:
+// the loaded references are updated and the children of reference slices are created or updated
+// with their own datastore calls, thus outside of the transaction of an atomic create
+func checkAtomicTree(m modelable) error {
+	model := m.getModel()
+	if len(childrenOf(m)) > 0 {
+		return fmt.Errorf("can't create %s atomically. Children of reference slices are written outside of the transaction", model.Name())
+	}
+
+	for _, ref := range model.references {
+		rm := ref.Modelable.getModel()
+		if rm.Key != nil {
+			if rm.readonly {
+				continue
+			}
+			return fmt.Errorf("can't create %s atomically. Its reference %s has been loaded and would be updated outside of the transaction", model.Name(), rm.Name())
+		}
+
+		if rm.skipIfZero && isZero(ref.Modelable) {
+			continue
+		}
+
+		if err := checkAtomicTree(ref.Modelable); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// returns the key of the entity to create: the id set in the options, if any,
+// or the one derived from the id field, or an incomplete key
+func newKeyOf(m modelable, opts *CreateOptions, parent *datastore.Key) (*datastore.Key, error) {
+	model := m.getModel()
+	if opts.stringId != "" {
+		return datastore.NameKey(model.structName, opts.stringId, parent), nil
+	}
+
+	if opts.intId == 0 {
+		if key, err := idKey(m, parent); key != nil || err != nil {
+			return key, err
+		}
+	}
+
+	return datastore.IDKey(model.structName, opts.intId, parent), nil
+}
+
 // creates a datastore entity and stores the Key into the model field
 // using default options
 func createReference(ctx context.Context, ref *reference) (err error) {
@@ -138,3 +535,417 @@ func createReference(ctx context.Context, ref *reference) (err error) {
 
 	return nil
 }
+
+// Batch version of Create.
+// The keys of the entities and of their new references are allocated up front,
+// then the whole batch is written with datastore PutMulti calls of at most 500 entities each.
+// Ids, transactions and outbox messages set in the options are ignored: each entity gets a new id,
+// unless it derives its key from an id field. Such entities fail with ErrAlreadyExists if their key is stored.
+// It can return a datastore.MultiError aligned to dst: the entities written before a failed call are deleted,
+// and an ErrPartialCreate wrapping the MultiError holds the keys of the ones that could not be.
+func CreateMulti(ctx context.Context, dst interface{}, opts *CreateOptions) (err error) {
+	ctx, span := startOperation(ctx, OpCreate, "CreateMulti")
+	defer func() { span.end(ctx, dst, err) }()
+
+	ctx = withHookContext(ctx, OpCreate, "CreateMulti", false, true)
+	ms, err := modelablesOf(dst)
+	if err != nil {
+		return err
+	}
+
+	if opts == nil {
+		opts = &CreateOptions{}
+	}
+
+	for _, m := range ms {
+		index(m)
+	}
+
+	if err := runHooks(ctx, ms, beforeCreate); err != nil {
+		return err
+	}
+
+	if err := createMulti(ctx, ms, opts); err != nil {
+		return err
+	}
+
+	for _, m := range ms {
+		if err := cacheWritten(ctx, m, saveInMemcache); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// creates the modelables, which must be of the same type, along with their new references.
+// All the keys are allocated before writing, so that the whole batch, references included,
+// is written with PutMulti calls of at most 500 entities each
+func createMulti(ctx context.Context, ms []modelable, opts *CreateOptions) error {
+	// the modelables are allocated by type, since the ones of a type share the same references layout
+	var types []reflect.Type
+	groups := make(map[reflect.Type][]int)
+	for i, m := range ms {
+		t := reflect.TypeOf(m)
+		if _, ok := groups[t]; !ok {
+			types = append(types, t)
+		}
+		groups[t] = append(groups[t], i)
+	}
+
+	batch := &createBatch{}
+	for _, t := range types {
+		owners := groups[t]
+		group := make([]modelable, len(owners))
+		for k, i := range owners {
+			group[k] = ms[i]
+		}
+
+		if err := batch.allocate(ctx, group, owners); err != nil {
+			batch.discard(ctx)
+			return err
+		}
+	}
+
+	for _, m := range ms {
+		if opts.indexOnly != nil {
+			model := m.getModel()
+			model.indexOnly = opts.indexOnly
+			defer func() {
+				model.indexOnly = nil
+			}()
+		}
+	}
+
+	counted := false
+	for _, m := range batch.ms {
+		if hasCounters(m) {
+			counted = true
+			break
+		}
+	}
+
+	client := ClientFromContext(ctx)
+	merr := make(datastore.MultiError, len(ms))
+	berr := make(datastore.MultiError, len(batch.ms))
+	failed := false
+	size := batchSize(ctx)
+	if counted {
+		// a batch is written along with the counters of its parents, within the entity limit of a commit
+		size = (size + 1) / 2
+	}
+
+	for start := 0; start < len(batch.ms); start += size {
+		end := start + size
+		if end > len(batch.ms) {
+			end = len(batch.ms)
+		}
+
+		keys, src := batch.keys[start:end], batch.ms[start:end]
+		if !counted && !batch.derived {
+			done := traceDatastoreCall(ctx, "PutMulti", keys[0].Kind, end-start)
+			_, err := client.PutMulti(ctx, keys, src)
+			done(err)
+			if collectMultiError(berr, err, start, end-start) {
+				failed = true
+			}
+			continue
+		}
+
+		// the counters of the parents are written by the transaction putting the batch,
+		// which checks that the keys derived from id fields are not stored yet
+		err := runTransaction(ctx, func(tctx context.Context, tx *datastore.Transaction) error {
+			done := traceDatastoreCall(tctx, "PutMulti", keys[0].Kind, len(keys))
+			var err error
+			if batch.derived {
+				err = insertEntities(tx, keys, src)
+			} else {
+				_, err = tx.PutMulti(keys, src)
+			}
+			done(err)
+			if err != nil {
+				return err
+			}
+
+			state := txStateFrom(tctx)
+			for i, bm := range src {
+				state.put(keys[i], bm)
+			}
+
+			for _, bm := range src {
+				if err := updateCounters(tctx, bm, 1); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if !collectMultiError(berr, err, start, end-start) {
+			continue
+		}
+
+		// none of the entities of a failed transaction is written
+		failed = true
+		for j := start; j < end; j++ {
+			if berr[j] == nil {
+				berr[j] = fmt.Errorf("entity not written, the transaction of its batch failed: %w", err)
+			}
+		}
+	}
+
+	if failed {
+		for j, err := range berr {
+			if err != nil && merr[batch.owners[j]] == nil {
+				merr[batch.owners[j]] = err
+			}
+		}
+		return batch.rollback(ctx, berr, merr)
+	}
+
+	searched := make(map[string][]modelable)
+	for _, m := range batch.ms {
+		if model := m.getModel(); model.searchable {
+			searched[model.Name()] = append(searched[model.Name()], m)
+		}
+	}
+
+	for _, sms := range searched {
+		if err := searchPutModelables(ctx, sms); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// the entities written by a batch create, references first
+type createBatch struct {
+	ms   []modelable
+	keys []*datastore.Key
+	// the position of the input item each entity belongs to
+	owners []int
+	// whether some keys are derived from id fields, thus must not overwrite stored entities
+	derived bool
+}
+
+// assigns complete keys to the modelables, which must be of the same type, and to their new references,
+// then appends them to the batch. Owners holds the position of the input item of each modelable
+func (b *createBatch) allocate(ctx context.Context, ms []modelable, owners []int) error {
+	if len(ms) == 0 {
+		return nil
+	}
+
+	for _, m := range ms {
+		if reflect.TypeOf(m) != reflect.TypeOf(ms[0]) {
+			return fmt.Errorf("can't allocate %T along with %T in the same batch", m, ms[0])
+		}
+
+		if m.getModel().Key != nil {
+			return errors.New("data has already been created")
+		}
+	}
+
+	// all the modelables share the same references layout:
+	// the references of each field are allocated together
+	for j := range ms[0].getModel().references {
+		var created []modelable
+		var holders []int
+		var refOwners []int
+
+		for i, m := range ms {
+			model := m.getModel()
+			ref := model.references[j]
+			rm := ref.Modelable.getModel()
+
+			if rm.Key != nil {
+				if err := updateReference(ctx, &ref, rm.Key); err != nil {
+					return err
+				}
+				model.references[j] = ref
+			} else if rm.skipIfZero && isZero(ref.Modelable) {
+				continue
+			} else {
+				created = append(created, ref.Modelable)
+				holders = append(holders, i)
+				refOwners = append(refOwners, owners[i])
+			}
+		}
+
+		if err := b.allocate(ctx, created, refOwners); err != nil {
+			return err
+		}
+
+		for k, i := range holders {
+			ms[i].getModel().references[j].Key = created[k].getModel().Key
+		}
+	}
+
+	keys := make([]*datastore.Key, len(ms))
+	for i, m := range ms {
+		model := m.getModel()
+
+		var ancKey *datastore.Key
+		for _, ref := range model.references {
+			if ref.Ancestor {
+				ancKey = ref.Key
+			}
+		}
+
+		key, err := idKey(m, ancKey)
+		if err != nil {
+			return err
+		}
+
+		if key == nil {
+			key = datastore.IncompleteKey(model.structName, ancKey)
+		} else {
+			b.derived = true
+		}
+		keys[i] = namespacedKey(ctx, key)
+	}
+
+	// allocate the ids of the keys not derived from an id field
+	var incomplete []int
+	for i, key := range keys {
+		if key.Incomplete() {
+			incomplete = append(incomplete, i)
+		}
+	}
+
+	client := ClientFromContext(ctx)
+	size := batchSize(ctx)
+	for start := 0; start < len(incomplete); start += size {
+		end := start + size
+		if end > len(incomplete) {
+			end = len(incomplete)
+		}
+
+		pending := make([]*datastore.Key, end-start)
+		for k, i := range incomplete[start:end] {
+			pending[k] = keys[i]
+		}
+
+		done := traceDatastoreCall(ctx, "AllocateIDs", pending[0].Kind, len(pending))
+		allocated, err := client.AllocateIDs(ctx, pending)
+		done(err)
+		if err != nil {
+			return err
+		}
+
+		for k, i := range incomplete[start:end] {
+			keys[i] = allocated[k]
+		}
+	}
+
+	for i, m := range ms {
+		if err := writeChildren(ctx, m); err != nil {
+			return err
+		}
+
+		initVersion(m)
+		initCreateTime(m)
+		m.getModel().Key = keys[i]
+		b.ms = append(b.ms, m)
+		b.keys = append(b.keys, keys[i])
+		b.owners = append(b.owners, owners[i])
+
+		copyDenormalized(m)
+
+		if err := claimSlug(ctx, m, keys[i]); err != nil {
+			return err
+		}
+
+		if _, err := claimUnique(ctx, m, keys[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// releases the unique values claimed by the batch and clears the allocated keys
+func (b *createBatch) discard(ctx context.Context) {
+	for _, m := range b.ms {
+		model := m.getModel()
+		if len(model.uniqueGroups) > 0 {
+			if err := releaseUnique(ctx, m, model.Key); err != nil {
+				warningf(ctx, "error releasing unique values of %s: %s", model.Name(), err.Error())
+			}
+		}
+		model.Key = nil
+	}
+}
+
+// deletes the entities of the batch written before a failure, whose errors in berr are nil,
+// then releases the unique values and clears the keys of the batch.
+// Returns an ErrPartialCreate if some of the written entities can't be deleted, cause otherwise
+func (b *createBatch) rollback(ctx context.Context, berr datastore.MultiError, cause error) error {
+	var written []int
+	for j, err := range berr {
+		if err == nil {
+			written = append(written, j)
+		}
+	}
+
+	client := ClientFromContext(ctx)
+	orphaned := make(map[int]bool)
+	var orphans []*datastore.Key
+	size := batchSize(ctx)
+	for start := 0; start < len(written); start += size {
+		end := start + size
+		if end > len(written) {
+			end = len(written)
+		}
+
+		keys := make([]*datastore.Key, end-start)
+		for k, j := range written[start:end] {
+			keys[k] = b.keys[j]
+		}
+
+		done := traceDatastoreCall(ctx, "DeleteMulti", keys[0].Kind, len(keys))
+		err := client.DeleteMulti(ctx, keys)
+		done(err)
+		if err == nil {
+			continue
+		}
+
+		merr, _ := err.(datastore.MultiError)
+		for k, j := range written[start:end] {
+			if merr == nil || merr[k] != nil {
+				orphaned[j] = true
+				orphans = append(orphans, b.keys[j])
+			}
+		}
+	}
+
+	stored := make(map[int]bool, len(written))
+	for _, j := range written {
+		stored[j] = true
+	}
+
+	// the orphans keep their keys, their unique values and their counts, as they are still stored
+	for j, m := range b.ms {
+		if orphaned[j] {
+			continue
+		}
+
+		model := m.getModel()
+		if stored[j] {
+			if err := updateCounters(ctx, m, -1); err != nil {
+				warningf(ctx, "error updating counters of %s: %s", model.Name(), err.Error())
+			}
+		}
+
+		if len(model.uniqueGroups) > 0 {
+			if err := releaseUnique(ctx, m, model.Key); err != nil {
+				warningf(ctx, "error releasing unique values of %s: %s", model.Name(), err.Error())
+			}
+		}
+		model.Key = nil
+	}
+
+	if len(orphans) > 0 {
+		return &ErrPartialCreate{Err: cause, Orphans: orphans}
+	}
+
+	return cause
+}
@@ -0,0 +1,303 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// kind of the entities holding the last run of each job
+const jobKind string = "_ModelJob"
+
+// CronJob is a periodic maintenance task, run by the CronHandler
+type CronJob func(ctx context.Context) error
+
+type registeredJob struct {
+	name     string
+	interval time.Duration
+	// maximum duration of a run, for which the job is locked
+	timeout time.Duration
+	run     CronJob
+}
+
+// the entity holding the last run of a job
+type jobRun struct {
+	LastRun time.Time
+	Error   string `datastore:",noindex"`
+}
+
+var jobsMutex sync.Mutex
+var jobs = map[string]*registeredJob{}
+
+// RegisterJob registers a job run by the CronHandler at most once every interval.
+// Runs are serialized across the instances with a lock held for timeout at most.
+// Registering a job with the name of an existing one replaces it.
+// The timeout must be positive, since a lock with no duration can't serialize the runs
+func RegisterJob(name string, interval time.Duration, timeout time.Duration, job CronJob) {
+	if timeout <= 0 {
+		panic(fmt.Errorf("job %s must have a positive timeout, got %s", name, timeout))
+	}
+
+	if job == nil {
+		panic(fmt.Errorf("job %s has no function to run", name))
+	}
+
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	jobs[name] = &registeredJob{name: name, interval: interval, timeout: timeout, run: job}
+}
+
+// CronHandler is an http.Handler running the registered jobs that are due, meant to be the target of a cron schedule,
+// i.e. the App Engine cron.yaml, firing more often than the shortest job interval.
+// The job parameter runs the given job only, whether due or not.
+// A job that is already running elsewhere is skipped. The handler replies with the outcome of each job,
+// and with a 500 status if any job failed.
+// Only the requests of the App Engine cron service, carrying the X-Appengine-Cron header that App Engine strips
+// from the external requests, and the ones accepted by the authorization function of the handler are served
+type CronHandler struct {
+	authorize func(r *http.Request) bool
+}
+
+func NewCronHandler() *CronHandler {
+	return &CronHandler{}
+}
+
+// Allows the requests accepted by authorize to run the jobs, i.e. the ones of a scheduler other than App Engine cron
+func (h *CronHandler) AllowRequests(authorize func(r *http.Request) bool) {
+	h.authorize = authorize
+}
+
+func (h *CronHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Appengine-Cron") != "true" && (h.authorize == nil || !h.authorize(r)) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	ctx, done, err := ensureClient(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer done()
+
+	forced := r.URL.Query().Get("job")
+
+	jobsMutex.Lock()
+	var due []*registeredJob
+	for name, job := range jobs {
+		if forced == "" || forced == name {
+			due = append(due, job)
+		}
+	}
+	jobsMutex.Unlock()
+
+	if forced != "" && len(due) == 0 {
+		http.Error(w, fmt.Sprintf("job %s is not registered", forced), http.StatusNotFound)
+		return
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].name < due[j].name
+	})
+
+	status := http.StatusOK
+	var report []string
+	for _, job := range due {
+		outcome, err := runJob(ctx, job, forced != "")
+		if err != nil {
+			status = http.StatusInternalServerError
+			outcome = err.Error()
+		}
+		report = append(report, fmt.Sprintf("%s: %s", job.name, outcome))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	for _, line := range report {
+		fmt.Fprintln(w, line)
+	}
+}
+
+// runs the job if due, holding its lock. Returns the outcome of the job
+func runJob(ctx context.Context, job *registeredJob, force bool) (string, error) {
+	unlock, err := Lock(ctx, jobKind+"/"+job.name, job.timeout)
+	if err == ErrLocked {
+		return "running elsewhere", nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := unlock(); err != nil {
+			warningf(ctx, "error releasing the lock of job %s: %s", job.name, err.Error())
+		}
+	}()
+
+	client := ClientFromContext(ctx)
+	key := datastore.NameKey(jobKind, job.name, nil)
+
+	var last jobRun
+	if err := client.Get(ctx, key, &last); err != nil && err != datastore.ErrNoSuchEntity {
+		return "", err
+	}
+
+	start := time.Now()
+	if !force && start.Sub(last.LastRun) < job.interval {
+		return "not due", nil
+	}
+
+	jctx, cancel := context.WithTimeout(ctx, job.timeout)
+	defer cancel()
+
+	run := jobRun{LastRun: start}
+	jerr := job.run(jctx)
+	if jerr != nil {
+		run.Error = jerr.Error()
+	}
+
+	if _, err := client.Put(ctx, key, &run); err != nil {
+		return "", err
+	}
+
+	if jerr != nil {
+		return "", jerr
+	}
+
+	return fmt.Sprintf("done in %s", time.Since(start)), nil
+}
+
+// PurgeDeletedJob erases the entities of the kind of prototype that have been soft deleted more than olderThan ago
+func PurgeDeletedJob(prototype modelable, olderThan time.Duration) CronJob {
+	return func(ctx context.Context) error {
+		index(prototype)
+		sd := prototype.getModel().softDelete
+		if sd == nil {
+			return fmt.Errorf("modelable %s is not soft deletable", prototype.getModel().Name())
+		}
+
+		q := NewQuery(prototype).WithDeleted().
+			WithField(fmt.Sprintf("%s >", sd.name), time.Time{}).
+			WithField(fmt.Sprintf("%s <", sd.name), time.Now().Add(-olderThan))
+
+		keys, err := q.GetKeys(ctx)
+		if err != nil || len(keys) == 0 {
+			return err
+		}
+
+		return DeleteMulti(context.WithValue(ctx, keyPurge, true), keys)
+	}
+}
+
+// OrphanReportJob checks the referential integrity of the given kind and passes the violations found to report
+func OrphanReportJob(kind string, report func(ctx context.Context, violations []Violation)) CronJob {
+	return func(ctx context.Context) error {
+		violations, err := CheckIntegrity(ctx, kind)
+		if err != nil {
+			return err
+		}
+
+		if len(violations) > 0 {
+			report(ctx, violations)
+		}
+		return nil
+	}
+}
+
+// WarmCacheJob reads the entities satisfying the query, so that they are in the cache when requested
+func WarmCacheJob(q *Query) CronJob {
+	return func(ctx context.Context) error {
+		keys, err := q.GetKeys(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			m := reflect.New(q.mType).Interface().(modelable)
+			index(m)
+			m.getModel().Key = key
+			if err := Read(ctx, m); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// number of documents checked by each page of the search garbage collection
+const searchGCPageSize int = 500
+
+// SearchGCJob removes from the search index of the kind of prototype the documents
+// whose entity no longer exists, or has been soft deleted.
+// Documents are paged through with offsets, thus the App Engine Search API checks the first 1000 documents at most
+func SearchGCJob(prototype modelable) CronJob {
+	return func(ctx context.Context) error {
+		index(prototype)
+		model := prototype.getModel()
+		backend := searchBackendFromContext(ctx)
+		client := ClientFromContext(ctx)
+
+		offset := 0
+		for {
+			res, err := backend.Query(ctx, model.Name(), SearchRequest{Limit: searchGCPageSize, Offset: offset})
+			if err != nil {
+				return err
+			}
+			ids := res.IDs
+
+			var stale []string
+			keys := make([]*datastore.Key, 0, len(ids))
+			for _, id := range ids {
+				key, err := datastore.DecodeKey(id)
+				if err != nil {
+					stale = append(stale, id)
+					continue
+				}
+				keys = append(keys, key)
+			}
+
+			entities := make([]datastore.PropertyList, len(keys))
+			err = client.GetMulti(ctx, keys, entities)
+			merr, _ := err.(datastore.MultiError)
+			if err != nil && merr == nil {
+				return err
+			}
+
+			for i, key := range keys {
+				if merr != nil && merr[i] == datastore.ErrNoSuchEntity || isSoftDeleted(entities[i], model) {
+					stale = append(stale, key.Encode())
+				}
+			}
+
+			if len(stale) > 0 {
+				if err := searchDeleteMulti(ctx, stale, model.Name()); err != nil {
+					return err
+				}
+			}
+
+			if len(ids) < searchGCPageSize {
+				return nil
+			}
+			offset += len(ids) - len(stale)
+		}
+	}
+}
+
+// reports whether the stored entity has been soft deleted
+func isSoftDeleted(props datastore.PropertyList, model *Model) bool {
+	if model.softDelete == nil {
+		return false
+	}
+
+	for _, p := range props {
+		if t, ok := p.Value.(time.Time); ok && p.Name == model.softDelete.name {
+			return !t.IsZero()
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package model
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRegisterJobTimeout(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a job without timeout to be rejected")
+		}
+	}()
+
+	RegisterJob("untimed", time.Hour, 0, func(ctx context.Context) error {
+		return nil
+	})
+}
+
+func TestCronHandlerForbidden(t *testing.T) {
+	h := NewCronHandler()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/cron?job=any", nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected %d for a request outside of cron, got %d", http.StatusForbidden, w.Code)
+	}
+
+	h.AllowRequests(func(r *http.Request) bool {
+		return r.Header.Get("Authorization") == "Bearer scheduler"
+	})
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/cron", nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected %d for an unauthorized request, got %d", http.StatusForbidden, w.Code)
+	}
+}
@@ -0,0 +1,198 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"google.golang.org/api/iterator"
+	"io"
+	"reflect"
+	"time"
+)
+
+// name of the csv column holding the encoded key of the entities
+const csvKeyColumn string = "Key"
+
+// ExportCSV writes the entities satisfying the query to w as csv, one row per entity.
+// The first row holds the column names: the encoded key, then the given fields.
+// If no fields are given, all the fields of the modelable but extensions are exported.
+// Reference columns hold the encoded key of the reference, times are formatted as RFC 3339
+func ExportCSV(ctx context.Context, q *Query, w io.Writer, fields ...string) error {
+	if q.disjuncts != nil {
+		return errDisjunctionPaging
+	}
+
+	proto := reflect.New(q.mType).Interface().(modelable)
+	if len(fields) == 0 {
+		for _, f := range FieldsOf(proto) {
+			if !f.IsExtension {
+				fields = append(fields, f.Name)
+			}
+		}
+	}
+
+	for _, f := range fields {
+		if _, ok := q.mType.FieldByName(f); !ok {
+			return fmt.Errorf("struct of type %s has no field with name %s", q.mType.Name(), f)
+		}
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(append([]string{csvKeyColumn}, fields...)); err != nil {
+		return err
+	}
+
+	client := ClientFromContext(ctx)
+	it := client.Run(ctx, q.datastoreQuery(ctx).KeysOnly())
+	for {
+		key, err := it.Next(nil)
+		if err == iterator.Done {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		m := reflect.New(q.mType).Interface().(modelable)
+		index(m)
+		m.getModel().Key = key
+		if err := Read(ctx, m); err != nil {
+			return err
+		}
+
+		row := []string{key.Encode()}
+		val := reflect.ValueOf(m).Elem()
+		for _, f := range fields {
+			row = append(row, csvValue(val.FieldByName(f)))
+		}
+
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func csvValue(v reflect.Value) string {
+	if m, ok := v.Addr().Interface().(modelable); ok {
+		if key := m.getModel().Key; key != nil {
+			return key.Encode()
+		}
+		return ""
+	}
+
+	if t, ok := v.Interface().(time.Time); ok {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+
+	return fmt.Sprint(v.Interface())
+}
+
+// ImportCSV reads the csv written by ExportCSV and writes its rows as entities of the type of prototype.
+// Columns are mapped onto the fields with the same name, unknown columns are ignored.
+// Rows with a key update the existing entity, the others create a new one.
+// Reference columns take the encoded key of an existing entity.
+// Returns the number of imported rows
+func ImportCSV(ctx context.Context, prototype modelable, r io.Reader) (int, error) {
+	typ := reflect.TypeOf(prototype).Elem()
+	cr := csv.NewReader(r)
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for line := 2; ; line++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return count, nil
+		}
+
+		if err != nil {
+			return count, err
+		}
+
+		m := reflect.New(typ).Interface().(modelable)
+		if err := importRow(ctx, m, header, row); err != nil {
+			return count, fmt.Errorf("error importing line %d: %w", line, err)
+		}
+		count++
+	}
+}
+
+func importRow(ctx context.Context, m modelable, header []string, row []string) error {
+	index(m)
+	model := m.getModel()
+
+	for i, name := range header {
+		if name == csvKeyColumn && i < len(row) && row[i] != "" {
+			key, err := datastore.DecodeKey(row[i])
+			if err != nil {
+				return err
+			}
+
+			model.Key = key
+			if err := Read(ctx, m); err != nil {
+				return err
+			}
+		}
+	}
+
+	val := reflect.ValueOf(m).Elem()
+	failed := make(map[string]error)
+	for i, name := range header {
+		if name == csvKeyColumn || i >= len(row) {
+			continue
+		}
+
+		sf, ok := val.Type().FieldByName(name)
+		if !ok || sf.PkgPath != "" {
+			continue
+		}
+
+		field := val.FieldByIndex(sf.Index)
+		if ref := model.referenceAtIndex(sf.Index[0]); ref != nil {
+			if err := importReference(ctx, ref.Modelable, row[i]); err != nil {
+				failed[name] = err
+			}
+			continue
+		}
+
+		if err := bindValue(field, row[i]); err != nil {
+			failed[name] = err
+		}
+	}
+
+	if len(failed) > 0 {
+		return &ErrBinding{Fields: failed}
+	}
+
+	return Save(ctx, m)
+}
+
+// loads into the reference the entity with the given encoded key
+func importReference(ctx context.Context, ref modelable, encoded string) error {
+	if encoded == "" {
+		return nil
+	}
+
+	key, err := datastore.DecodeKey(encoded)
+	if err != nil {
+		return err
+	}
+
+	ref.getModel().Key = key
+	return Read(ctx, ref)
+}
@@ -0,0 +1,61 @@
+package model
+
+import (
+	"context"
+	"time"
+)
+
+const keyDefaults = "__model_defaults"
+
+// Defaults holds the package-wide behavior of the operations, consulted when the options of a call don't set it.
+// The zero value of each field keeps the behavior of the package. See Service.WithDefaults
+type Defaults struct {
+	// attempts of the transactions run by the operations whose options don't set them
+	TransactionAttempts int
+	// expiration of the entities cached by the kinds whose CacheOptions don't set a TTL
+	CacheTTL time.Duration
+	// number of entities read or written by each datastore call of the multi operations.
+	// It can't exceed the limit of the datastore, 500 entities
+	BatchSize int
+	// timeout of the reads and creates whose options don't set one
+	Timeout time.Duration
+	// if true, the reads tolerate schema drift, as ReadOptions.IgnoreFieldMismatch does
+	LenientLoading bool
+}
+
+// WithDefaults returns a context whose operations use the given defaults, i.e. to tune a single task.
+// The defaults of the whole deployment are set with Service.WithDefaults
+func WithDefaults(ctx context.Context, defaults Defaults) context.Context {
+	return context.WithValue(ctx, keyDefaults, defaults)
+}
+
+func defaultsFromContext(ctx context.Context) Defaults {
+	defaults, _ := ctx.Value(keyDefaults).(Defaults)
+	return defaults
+}
+
+// returns the attempts set by the options of the call, or the default ones.
+// A non positive result leaves the choice to the caller
+func transactionAttempts(ctx context.Context, attempts int) int {
+	if attempts > 0 {
+		return attempts
+	}
+	return defaultsFromContext(ctx).TransactionAttempts
+}
+
+// returns the number of entities of each batch of the multi operations
+func batchSize(ctx context.Context) int {
+	size := defaultsFromContext(ctx).BatchSize
+	if size <= 0 || size > multiBatchSize {
+		return multiBatchSize
+	}
+	return size
+}
+
+// returns the timeout set by the options of the call, or the default one
+func operationTimeout(ctx context.Context, timeout time.Duration) time.Duration {
+	if timeout > 0 {
+		return timeout
+	}
+	return defaultsFromContext(ctx).Timeout
+}
@@ -0,0 +1,32 @@
+package model
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDefaults(t *testing.T) {
+	ctx := context.Background()
+	if batchSize(ctx) != multiBatchSize || transactionAttempts(ctx, 0) != 0 || operationTimeout(ctx, 0) != 0 {
+		t.Fatal("expected the package behavior without defaults")
+	}
+
+	ctx = WithDefaults(ctx, Defaults{TransactionAttempts: 5, BatchSize: 100, Timeout: time.Second})
+	if batchSize(ctx) != 100 {
+		t.Fatalf("expected batches of 100 entities, got %d", batchSize(ctx))
+	}
+
+	if transactionAttempts(ctx, 0) != 5 || transactionAttempts(ctx, 2) != 2 {
+		t.Fatal("expected the attempts of the call to override the default ones")
+	}
+
+	if operationTimeout(ctx, time.Minute) != time.Minute || operationTimeout(ctx, 0) != time.Second {
+		t.Fatal("expected the timeout of the call to override the default one")
+	}
+
+	ctx = WithDefaults(ctx, Defaults{BatchSize: 1000})
+	if batchSize(ctx) != multiBatchSize {
+		t.Fatalf("expected batches capped to %d entities, got %d", multiBatchSize, batchSize(ctx))
+	}
+}
@@ -4,21 +4,40 @@ import (
 	"cloud.google.com/go/datastore"
 	"context"
 	"fmt"
-	"google.golang.org/appengine/memcache"
+	"google.golang.org/api/iterator"
 	"reflect"
+	"time"
 )
 
 // recursively deletes a modelable and all its references
 func Clear(ctx context.Context, m modelable) (err error) {
+	ctx, span := startOperation(ctx, OpDelete, "Clear")
+	defer func() { span.end(ctx, m, err) }()
+
+	ctx = withHookContext(ctx, OpDelete, "Clear", true, false)
+
+	if err := beforeDelete(ctx, m); err != nil {
+		return err
+	}
+
+	if hasDeleteGuards() {
+		if err := checkDeleteGuards(ctx, clearedKeys(m), nil); err != nil {
+			return err
+		}
+	}
 
 	client := ClientFromContext(ctx)
-	opts := datastore.MaxAttempts(1)
+	attempts := transactionAttempts(ctx, 0)
+	if attempts <= 0 {
+		attempts = 1
+	}
+	opts := datastore.MaxAttempts(attempts)
 	_, err = client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
 		return clear(ctx, m)
 	}, opts)
 
 	if err == nil {
-		if err = deleteFromMemcache(ctx, m); err != nil && err != memcache.ErrCacheMiss {
+		if err = deleteFromMemcache(ctx, m); err != nil && err != ErrCacheMiss {
 			return err
 		}
 	}
@@ -33,7 +52,45 @@ func clear(ctx context.Context, m modelable) (err error) {
 		return nil
 	}
 
+	for _, child := range childrenOf(m) {
+		if err := treeCanceled(ctx, m); err != nil {
+			return err
+		}
+
+		if err = clear(ctx, child); err != nil {
+			return err
+		}
+	}
+
+	var markers []*datastore.Key
+	if len(model.uniqueGroups) > 0 && (model.softDelete == nil || isPurging(ctx)) {
+		if markers, err = deletedMarkerKeys(ctx, m); err != nil {
+			return err
+		}
+	}
+
+	// the entity is deleted before its references, so that the counters of the parents it references
+	// are updated while the parents still exist, within the same transaction
+	if model.softDelete != nil && !isPurging(ctx) {
+		err = softDelete(ctx, m)
+	} else {
+		err = writeCounted(ctx, m, -1, func(ctx context.Context) error {
+			return deleteEntity(ctx, model.Key)
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = releaseMarkers(ctx, model.Key, markers); err != nil {
+		return err
+	}
+
 	for k := range model.references {
+		if err := treeCanceled(ctx, m); err != nil {
+			return err
+		}
+
 		ref := model.references[k]
 		rm := ref.Modelable.getModel()
 		if rm.readonly {
@@ -45,23 +102,53 @@ func clear(ctx context.Context, m modelable) (err error) {
 			return err
 		}
 	}
-	client := ClientFromContext(ctx)
-	err = client.Delete(ctx, model.Key)
 
-	return err
+	return nil
 }
 
 // deletes a single reference
 func Delete(ctx context.Context, ref modelable, parent modelable) (err error) {
+	ctx, span := startOperation(ctx, OpDelete, "Delete")
+	defer func() { span.end(ctx, ref, err) }()
+
+	ctx = withHookContext(ctx, OpDelete, "Delete", false, false)
 
 	child := ref.getModel()
 	if child.Key == nil {
 		return fmt.Errorf("reference %s has a nil key", child.Name())
 	}
 
+	if err := beforeDelete(ctx, ref); err != nil {
+		return err
+	}
+
+	if hasDeleteGuards() {
+		var ignore []*datastore.Key
+		if parent != nil {
+			ignore = append(ignore, parent.getModel().Key)
+		}
+		if err := checkDeleteGuards(ctx, []*datastore.Key{child.Key}, ignore); err != nil {
+			return err
+		}
+	}
+
+	var markers []*datastore.Key
+	if len(child.uniqueGroups) > 0 && (child.softDelete == nil || isPurging(ctx)) {
+		if markers, err = deletedMarkerKeys(ctx, ref); err != nil {
+			return err
+		}
+	}
+
 	client := ClientFromContext(ctx)
-	err = client.Delete(ctx, child.Key)
-	if err == nil {
+	if child.softDelete != nil && !isPurging(ctx) {
+		err = softDelete(ctx, ref)
+	} else if err = writeCounted(ctx, ref, -1, func(ctx context.Context) error {
+		return deleteEntity(ctx, child.Key)
+	}); err == nil {
+
+		if err := releaseMarkers(ctx, child.Key, markers); err != nil {
+			return err
+		}
 
 		if child.searchable {
 			if err := searchDelete(ctx, child, child.Name()); err != nil {
@@ -69,11 +156,15 @@ func Delete(ctx context.Context, ref modelable, parent modelable) (err error) {
 			}
 		}
 
-		if err = deleteFromMemcache(ctx, child); err != nil && err != memcache.ErrCacheMiss {
+		if err = deleteFromMemcache(ctx, child); err != nil && err != ErrCacheMiss {
 			return err
 		}
 	}
 
+	if err != nil {
+		return err
+	}
+
 	if parent == nil {
 		return nil
 	}
@@ -106,5 +197,324 @@ func Delete(ctx context.Context, ref modelable, parent modelable) (err error) {
 
 	index(parent)
 
-	return saveInMemcache(ctx, parent)
+	return cacheWritten(ctx, parent, saveInMemcache)
+}
+
+// number of parents detached with a single batch
+const detachBatchSize int = 500
+
+// Clears the reference to ref held in field by every entity of kind parentKind, then deletes ref.
+// Parents are found with a query and updated in batches.
+func DetachFromAll(ctx context.Context, ref modelable, parentKind string, field string) error {
+	child := ref.getModel()
+	if child.Key == nil {
+		return fmt.Errorf("reference %s has a nil key", child.Name())
+	}
+
+	client := ClientFromContext(ctx)
+	q := datastore.NewQuery(parentKind).Namespace(child.Key.Namespace).Filter(fmt.Sprintf("%s =", field), child.Key).KeysOnly()
+
+	keys := make([]*datastore.Key, 0, detachBatchSize)
+
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+
+		parents := make([]datastore.PropertyList, len(keys))
+		if err := client.GetMulti(ctx, keys, parents); err != nil {
+			return err
+		}
+
+		for _, props := range parents {
+			for i := range props {
+				if props[i].Name == field {
+					props[i].Value = nil
+				}
+			}
+		}
+
+		if _, err := client.PutMulti(ctx, keys, parents); err != nil {
+			return err
+		}
+
+		cache := cacheFromContext(ctx)
+		for _, k := range keys {
+			if err := cache.Delete(ctx, cacheKey(k)); err != nil && err != ErrCacheMiss {
+				return err
+			}
+		}
+
+		keys = keys[:0]
+		return nil
+	}
+
+	it := client.Run(ctx, q)
+	for {
+		key, err := it.Next(nil)
+		if err == iterator.Done {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		keys = append(keys, key)
+		if len(keys) == detachBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return err
+	}
+
+	return Delete(ctx, ref, nil)
+}
+
+// Batch version of Delete: it deletes the given entities without touching their references nor their parents.
+// src can be a slice of modelables or a []*datastore.Key.
+// Counters are updated only when deleting modelables.
+// It can return a datastore.MultiError aligned to src.
+func DeleteMulti(ctx context.Context, src interface{}) (err error) {
+	ctx, span := startOperation(ctx, OpDelete, "DeleteMulti")
+	defer func() { span.end(ctx, src, err) }()
+
+	ctx = withHookContext(ctx, OpDelete, "DeleteMulti", false, true)
+	if keys, ok := src.([]*datastore.Key); ok {
+		owners := make([]int, len(keys))
+		for i := range owners {
+			owners[i] = i
+		}
+		return deleteMulti(ctx, keys, owners, make([]modelable, len(keys)), make(datastore.MultiError, len(keys)))
+	}
+
+	ms, err := modelablesOf(src)
+	if err != nil {
+		return err
+	}
+
+	if err := runHooks(ctx, ms, beforeDelete); err != nil {
+		return err
+	}
+
+	merr := make(datastore.MultiError, len(ms))
+	keys := make([]*datastore.Key, 0, len(ms))
+	owners := make([]int, 0, len(ms))
+	deleted := make([]modelable, 0, len(ms))
+	for i, m := range ms {
+		index(m)
+		model := m.getModel()
+		if model.Key == nil {
+			merr[i] = fmt.Errorf("modelable %s has a nil key", model.Name())
+			continue
+		}
+
+		keys = append(keys, model.Key)
+		owners = append(owners, i)
+		deleted = append(deleted, m)
+	}
+
+	return deleteMulti(ctx, keys, owners, deleted, merr)
+}
+
+// Batch version of Clear: it recursively deletes the given modelables and their references.
+// Unlike Clear, the entities are not deleted within a transaction.
+// It can return a datastore.MultiError aligned to src.
+func ClearMulti(ctx context.Context, src interface{}) (err error) {
+	ctx, span := startOperation(ctx, OpDelete, "ClearMulti")
+	defer func() { span.end(ctx, src, err) }()
+
+	ctx = withHookContext(ctx, OpDelete, "ClearMulti", false, true)
+	ms, err := modelablesOf(src)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range ms {
+		index(m)
+	}
+
+	if err := runHooks(ctx, ms, beforeDelete); err != nil {
+		return err
+	}
+
+	merr := make(datastore.MultiError, len(ms))
+	var keys []*datastore.Key
+	var owners []int
+	var deleted []modelable
+	for i, m := range ms {
+		index(m)
+		for _, cm := range clearedModelables(m) {
+			keys = append(keys, cm.getModel().Key)
+			owners = append(owners, i)
+			deleted = append(deleted, cm)
+		}
+	}
+
+	return deleteMulti(ctx, keys, owners, deleted, merr)
+}
+
+// returns the modelable and the references that clear would delete
+func clearedModelables(m modelable) []modelable {
+	model := m.getModel()
+	if model.Key == nil {
+		return nil
+	}
+
+	ms := []modelable{m}
+	for _, ref := range model.references {
+		if ref.Modelable.getModel().readonly {
+			continue
+		}
+		ms = append(ms, clearedModelables(ref.Modelable)...)
+	}
+
+	for _, child := range childrenOf(m) {
+		ms = append(ms, clearedModelables(child)...)
+	}
+
+	return ms
+}
+
+// deletes the keys in batches, then releases their unique values and removes them from the cache and the search index.
+// owners maps each key to the position of the item of the input it belongs to, and the errors are reported
+// in merr at that position. deleted holds the modelable of each key, if any
+func deleteMulti(ctx context.Context, keys []*datastore.Key, owners []int, deleted []modelable, merr datastore.MultiError) error {
+	if hasDeleteGuards() {
+		if err := checkDeleteGuards(ctx, keys, nil); err != nil {
+			return err
+		}
+	}
+
+	// soft deletable entities are marked as deleted, grouped by kind
+	kerr := make(datastore.MultiError, len(keys))
+	soft := make([]bool, len(keys))
+	if !isPurging(ctx) {
+		now := time.Now().Truncate(time.Microsecond)
+		softKeys := make(map[string][]int)
+		for j, key := range keys {
+			encodedStructsMutex.RLock()
+			es := encodedStructByName(key.Kind)
+			encodedStructsMutex.RUnlock()
+
+			if es != nil && es.softDelete != nil {
+				soft[j] = true
+				softKeys[es.softDelete.name] = append(softKeys[es.softDelete.name], j)
+			}
+		}
+
+		for property, idxs := range softKeys {
+			marked := make([]*datastore.Key, len(idxs))
+			for k, j := range idxs {
+				marked[k] = keys[j]
+			}
+
+			err := softDeleteKeys(ctx, marked, property, now)
+			for _, j := range idxs {
+				kerr[j] = err
+				if err == nil && deleted[j] != nil {
+					setDeletedAt(deleted[j], now)
+				}
+			}
+		}
+	}
+
+	var hard []*datastore.Key
+	var hardIdx []int
+	for j, key := range keys {
+		if !soft[j] {
+			hard = append(hard, key)
+			hardIdx = append(hardIdx, j)
+		}
+	}
+
+	client := ClientFromContext(ctx)
+	herr := make(datastore.MultiError, len(hard))
+	markers := make([][]*datastore.Key, len(hard))
+	size := batchSize(ctx)
+	for start := 0; start < len(hard); start += size {
+		end := start + size
+		if end > len(hard) {
+			end = len(hard)
+		}
+
+		// the unique values are read before the entities are deleted
+		stored, err := storedMarkerKeys(ctx, hard[start:end])
+		if collectMultiError(herr, err, start, end-start) {
+			continue
+		}
+		copy(markers[start:end], stored)
+
+		done := traceDatastoreCall(ctx, "DeleteMulti", hard[start].Kind, end-start)
+		err = client.DeleteMulti(ctx, hard[start:end])
+		done(err)
+		collectMultiError(herr, err, start, end-start)
+	}
+
+	released := make(map[int][]*datastore.Key, len(hard))
+	for k, j := range hardIdx {
+		kerr[j] = herr[k]
+		released[j] = markers[k]
+		if deleted[j] != nil {
+			released[j] = append(released[j], namespacedMarkerKeys(deleted[j], keys[j])...)
+		}
+	}
+
+	cache := cacheFromContext(ctx)
+	searchIds := make(map[string][]string)
+	for j, key := range keys {
+		if kerr[j] != nil {
+			continue
+		}
+
+		encodedStructsMutex.RLock()
+		es := encodedStructByName(key.Kind)
+		encodedStructsMutex.RUnlock()
+
+		if len(released[j]) > 0 {
+			kerr[j] = releaseMarkers(ctx, key, released[j])
+		}
+
+		if kerr[j] == nil && deleted[j] != nil && !soft[j] {
+			kerr[j] = updateCounters(ctx, deleted[j], -1)
+		}
+
+		if err := cache.Delete(ctx, cacheKey(key)); err != nil && err != ErrCacheMiss && kerr[j] == nil {
+			kerr[j] = err
+		}
+
+		if es != nil && es.searchable {
+			searchIds[key.Kind] = append(searchIds[key.Kind], key.Encode())
+		}
+	}
+
+	for name, ids := range searchIds {
+		if err := searchDeleteMulti(ctx, ids, name); err != nil {
+			return err
+		}
+	}
+
+	failed := false
+	for j, err := range kerr {
+		if err != nil && merr[owners[j]] == nil {
+			merr[owners[j]] = err
+		}
+	}
+
+	for _, err := range merr {
+		if err != nil {
+			failed = true
+			break
+		}
+	}
+
+	if failed {
+		return merr
+	}
+
+	return nil
 }
@@ -0,0 +1,212 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"encoding/json"
+	"fmt"
+	"google.golang.org/api/iterator"
+	"reflect"
+	"strings"
+)
+
+// flags a field as a denormalized copy of a field of a reference, i.e. `model:"denorm=Product.Name"`.
+// The copy is refreshed when the model is written and, through the outbox,
+// whenever the referenced entity is updated
+const tagDenorm string = "denorm"
+
+// topic of the outbox messages refreshing the denormalized copies.
+// DispatchOutbox runs the refreshes itself, they are never handed to the Publisher
+const denormTopic string = "model-refresh-denormalized"
+
+// number of entities refreshed by a single denormalization task
+const denormBatchSize int = 100
+
+type denormDescriptor struct {
+	// type of the model holding the copy
+	holder reflect.Type
+	// index of the copy in the holder
+	index int
+	// index of the reference field in the holder
+	ref int
+	// index of the copied field in the reference
+	source int
+}
+
+// maps the type of the referenced models to the denormalized copies of their fields
+var denormalizations = map[reflect.Type][]denormDescriptor{}
+
+// maps the kind of the holders to their types, for the refresh tasks
+var denormHolders = map[string]reflect.Type{}
+
+// parses a denorm tag of field idx of t. Must be called with the encodedStructsMutex held
+func registerDenormLocked(t reflect.Type, idx int, path string) denormDescriptor {
+	parts := strings.SplitN(path, valSeparator, 2)
+	if len(parts) != 2 {
+		panic(fmt.Errorf("invalid denorm path %q for field %s of struct %s", path, t.Field(idx).Name, t.Name()))
+	}
+
+	rf, ok := t.FieldByName(parts[0])
+	if !ok || rf.Type.Kind() != reflect.Struct || !reflect.PtrTo(rf.Type).Implements(typeOfModelable) {
+		panic(fmt.Errorf("denorm path %q of struct %s must start with a reference field", path, t.Name()))
+	}
+
+	sf, ok := rf.Type.FieldByName(parts[1])
+	if !ok {
+		panic(fmt.Errorf("reference %s of struct %s has no field %s", parts[0], t.Name(), parts[1]))
+	}
+
+	if sf.Type != t.Field(idx).Type {
+		panic(fmt.Errorf("denorm field %s of struct %s must have the same type of %s", t.Field(idx).Name, t.Name(), path))
+	}
+
+	desc := denormDescriptor{holder: t, index: idx, ref: rf.Index[0], source: sf.Index[0]}
+
+	for _, d := range denormalizations[rf.Type] {
+		if d == desc {
+			return desc
+		}
+	}
+
+	denormalizations[rf.Type] = append(denormalizations[rf.Type], desc)
+	denormHolders[t.Name()] = t
+	return desc
+}
+
+func containsDenorm(descs []denormDescriptor, d denormDescriptor) bool {
+	for _, v := range descs {
+		if v == d {
+			return true
+		}
+	}
+	return false
+}
+
+// copies the denormalized values from the references of the modelable
+func copyDenormalized(m modelable) {
+	model := m.getModel()
+	if len(model.denorms) == 0 {
+		return
+	}
+
+	val := reflect.ValueOf(m).Elem()
+	for _, d := range model.denorms {
+		val.Field(d.index).Set(val.Field(d.ref).Field(d.source))
+	}
+}
+
+// the payload of the outbox message refreshing the holders of kind referencing
+// the entity with the given key through the field ref, starting from cursor
+type denormRefresh struct {
+	Kind   string
+	Ref    string
+	Key    string
+	Cursor string `json:",omitempty"`
+}
+
+// schedules the refresh of the copies of the fields of the modelable held by other entities.
+// The refreshes are stored in the outbox, within the transaction of ctx if any
+func scheduleDenormalization(ctx context.Context, m modelable) error {
+	model := m.getModel()
+	if model.Key == nil {
+		return nil
+	}
+
+	encodedStructsMutex.RLock()
+	descs := denormalizations[reflect.TypeOf(m).Elem()]
+	encodedStructsMutex.RUnlock()
+
+	var messages []OutboxMessage
+	for _, d := range descs {
+		payload, err := json.Marshal(denormRefresh{Kind: d.holder.Name(), Ref: d.holder.Field(d.ref).Name, Key: model.EncodedKey()})
+		if err != nil {
+			return err
+		}
+		messages = append(messages, newOutboxMessage(denormTopic, payload))
+	}
+
+	return putOutbox(ctx, transactionFrom(ctx), model.Key, messages)
+}
+
+// refreshes a batch of the holders described by the payload of a denormTopic message.
+// If more holders are left, the refresh of the next batch is stored in the outbox, starting from the last cursor
+func refreshDenormalized(ctx context.Context, payload []byte) error {
+	var refresh denormRefresh
+	if err := json.Unmarshal(payload, &refresh); err != nil {
+		return err
+	}
+	kind, ref, encodedKey, cursor := refresh.Kind, refresh.Ref, refresh.Key, refresh.Cursor
+
+	encodedStructsMutex.RLock()
+	typ, ok := denormHolders[kind]
+	encodedStructsMutex.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("no denormalized copies registered for kind %s", kind)
+	}
+
+	key, err := datastore.DecodeKey(encodedKey)
+	if err != nil {
+		return err
+	}
+
+	q := datastore.NewQuery(kind).Namespace(key.Namespace).Filter(fmt.Sprintf("%s =", ref), key).KeysOnly().Limit(denormBatchSize)
+	if cursor != "" {
+		c, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return err
+		}
+		q = q.Start(c)
+	}
+
+	client := ClientFromContext(ctx)
+	it := client.Run(ctx, q)
+
+	count := 0
+	for {
+		hkey, err := it.Next(nil)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		count++
+
+		holder := reflect.New(typ).Interface().(modelable)
+		index(holder)
+		holder.getModel().Key = hkey
+
+		if err := read(ctx, holder); err != nil {
+			return err
+		}
+
+		copyDenormalized(holder)
+
+		// only the holder is written: its references are left untouched
+		if _, err := client.Put(ctx, hkey, holder); err != nil {
+			return err
+		}
+
+		if err := deleteFromMemcache(ctx, &Model{Key: hkey}); err != nil && err != ErrCacheMiss {
+			warningf(ctx, "error deleting %s from memcache: %s", hkey, err.Error())
+		}
+	}
+
+	if count < denormBatchSize {
+		return nil
+	}
+
+	next, err := it.Cursor()
+	if err != nil {
+		return err
+	}
+
+	refresh.Cursor = next.String()
+	payload, err = json.Marshal(refresh)
+	if err != nil {
+		return err
+	}
+
+	return putOutbox(ctx, nil, key, []OutboxMessage{newOutboxMessage(denormTopic, payload)})
+}
@@ -0,0 +1,73 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestElasticQuery(t *testing.T) {
+	cases := map[string]string{
+		`Name = "Enzo"`:                  `Name:"Enzo"`,
+		`Name = "a = b" AND Age >= 30`:   `Name:"a = b" AND Age:>=30`,
+		`Age < 10 OR Job_prefix = "dev"`: `Age:<10 OR Job_prefix:"dev"`,
+		`enzo`:                           `enzo`,
+		// the escapes of strconv.Quote don't end the quoted values
+		`Name = ` + strconv.Quote(`say "hi" = bye`) + ` AND Age > 3`: `Name:"say \"hi\" = bye" AND Age:>3`,
+		`Path = ` + strconv.Quote(`c:\`) + ` OR Age < 1`:             `Path:"c:\\" OR Age:<1`,
+		`Name = ` + strconv.Quote("tab\tbed"):                        "Name:\"tab\tbed\"",
+	}
+
+	for query, expected := range cases {
+		if q := elasticQuery(query); q != expected {
+			t.Fatalf("query %s translated to %s, expected %s", query, q, expected)
+		}
+	}
+}
+
+func TestElasticDocument(t *testing.T) {
+	doc := elasticDocument(SearchDocument{
+		Fields: []SearchField{
+			{Name: "Name", Value: "Enzo"},
+			{Name: "Name_prefix", Value: SearchAtom("e")},
+			{Name: "Name_prefix", Value: SearchAtom("en")},
+			{Name: "Where", Value: datastore.GeoPoint{Lat: 1, Lng: 2}},
+		},
+		Facets: []SearchFacet{{Name: "Age", Value: float64(30)}},
+	})
+
+	expected := map[string]interface{}{
+		"Name":        "Enzo",
+		"Name_prefix": []interface{}{"e", "en"},
+		"Where":       map[string]float64{"lat": 1, "lon": 2},
+		"facets":      map[string]string{"Age": "30"},
+	}
+
+	if !reflect.DeepEqual(doc, expected) {
+		t.Fatalf("document is %v, expected %v", doc, expected)
+	}
+}
+
+func TestElasticCursor(t *testing.T) {
+	sort := json.RawMessage(`[1.5,9007199254740993,"agxtb2RlbC10ZXN0cg"]`)
+	cursor := elasticCursor(sort)
+	if cursor == "" {
+		t.Fatal("expected a cursor for the sort values")
+	}
+
+	after, err := elasticSearchAfter(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the sort values are searched after as they were returned, without losing precision
+	if string(after) != string(sort) {
+		t.Fatalf("expected to search after %s, got %s", sort, after)
+	}
+
+	if _, err := elasticSearchAfter("20"); err == nil {
+		t.Fatal("expected an error for an offset cursor")
+	}
+}
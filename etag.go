@@ -0,0 +1,123 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ETag returns a strong entity tag of the modelable, derived from its key and from the hash of its properties.
+// It changes whenever the stored representation of the modelable changes, thus it can be used
+// to answer conditional HTTP requests. An empty string is returned if the modelable can't be encoded
+func ETag(m modelable) string {
+	index(m)
+
+	props, err := encodeProperties(m)
+	if err != nil {
+		return ""
+	}
+
+	h := sha256.New()
+	if key := m.getModel().Key; key != nil {
+		fmt.Fprint(h, key.Encode())
+	}
+	h.Write([]byte{0})
+	hashProperties(h, props)
+
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+func hashProperties(h hash.Hash, props []datastore.Property) {
+	for _, p := range props {
+		fmt.Fprintf(h, "%s\x00%t\x00", p.Name, p.NoIndex)
+		hashValue(h, p.Value)
+		h.Write([]byte{'\n'})
+	}
+}
+
+func hashValue(h hash.Hash, v interface{}) {
+	switch x := v.(type) {
+	case *datastore.Key:
+		if x != nil {
+			fmt.Fprint(h, x.Encode())
+		}
+	case *datastore.Entity:
+		if x != nil {
+			if x.Key != nil {
+				fmt.Fprint(h, x.Key.Encode())
+			}
+			h.Write([]byte{'{'})
+			hashProperties(h, x.Properties)
+			h.Write([]byte{'}'})
+		}
+	case []interface{}:
+		h.Write([]byte{'['})
+		for _, e := range x {
+			hashValue(h, e)
+			h.Write([]byte{0})
+		}
+		h.Write([]byte{']'})
+	case time.Time:
+		// loaded times may be in a different location than the saved ones
+		fmt.Fprint(h, x.UTC().Format(time.RFC3339Nano))
+	default:
+		fmt.Fprintf(h, "%T:%v", v, v)
+	}
+}
+
+// Checks the conditional headers of the request against the ETag of the modelable, which is set in the response.
+// It returns http.StatusNotModified if a GET or HEAD request carries an If-None-Match header matching the tag,
+// http.StatusPreconditionFailed if the tag doesn't match the If-Match header or if any other request
+// carries a matching If-None-Match header, and http.StatusOK if the request must be served
+func CheckPreconditions(w http.ResponseWriter, r *http.Request, m modelable) int {
+	etag := ETag(m)
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+
+	if im := r.Header.Get("If-Match"); im != "" && !etagMatches(im, etag, false) {
+		return http.StatusPreconditionFailed
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, etag, true) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			return http.StatusNotModified
+		}
+		return http.StatusPreconditionFailed
+	}
+
+	return http.StatusOK
+}
+
+// reports whether the list of entity tags of a conditional header matches the etag.
+// Weak comparison ignores the W/ prefix of the listed tags, as required by If-None-Match
+func etagMatches(header string, etag string, weak bool) bool {
+	if etag == "" {
+		return false
+	}
+
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if strings.HasPrefix(t, "W/") {
+			if !weak {
+				continue
+			}
+			t = t[2:]
+		}
+
+		if t == etag {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,47 @@
+package model
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestETag(t *testing.T) {
+	s := SingletonSettings{Theme: "dark", MaxItems: 10}
+	index(&s)
+	s.Key = singletonKey(context.Background(), s.getModel())
+
+	etag := ETag(&s)
+	if etag == "" || etag != ETag(&s) {
+		t.Fatalf("unstable etag %s", etag)
+	}
+
+	s.MaxItems = 11
+	if ETag(&s) == etag {
+		t.Fatal("etag not changed along with the properties")
+	}
+	s.MaxItems = 10
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("If-None-Match", `"other", W/`+etag)
+	w := httptest.NewRecorder()
+	if status := CheckPreconditions(w, r, &s); status != http.StatusNotModified {
+		t.Fatalf("expected %d, got %d", http.StatusNotModified, status)
+	}
+
+	if w.Header().Get("ETag") != etag {
+		t.Fatalf("etag header not set: %q", w.Header().Get("ETag"))
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("If-Match", `"other"`)
+	if status := CheckPreconditions(httptest.NewRecorder(), r, &s); status != http.StatusPreconditionFailed {
+		t.Fatalf("expected %d, got %d", http.StatusPreconditionFailed, status)
+	}
+
+	r.Header.Set("If-Match", etag)
+	if status := CheckPreconditions(httptest.NewRecorder(), r, &s); status != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, status)
+	}
+}
@@ -0,0 +1,131 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"time"
+)
+
+// Exists reports whether the entity of the modelable is stored, without reading it nor its references.
+// The cache is looked up first, then the entity is fetched by key without being decoded.
+// Soft deleted entities don't exist
+func Exists(ctx context.Context, m modelable) (bool, error) {
+	index(m)
+	model := m.getModel()
+	if model.Key == nil {
+		return false, nil
+	}
+
+	if !cacheOptionsOf(model.Key.Kind).Disabled {
+		if _, err := cacheFromContext(ctx).Get(ctx, cacheKey(model.Key)); err == nil {
+			return true, nil
+		}
+	}
+
+	probe := existenceProbe{}
+	if model.softDelete != nil {
+		probe.deletedProperty = model.softDelete.name
+	}
+
+	err := getEntity(ctx, model.Key, &probe)
+	if err == datastore.ErrNoSuchEntity {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return !probe.deleted, nil
+}
+
+// ExistMulti reports whether the entities with the given int ids, and the kind of the modelable, are stored.
+// The result is aligned with ids. It is meant for the cheap validation of large lists of references before writes:
+// the cache is looked up first, then the remaining entities are fetched in batches without being decoded.
+// Soft deleted entities don't exist
+func ExistMulti(ctx context.Context, m modelable, ids []int64) ([]bool, error) {
+	index(m)
+	model := m.getModel()
+
+	exist := make([]bool, len(ids))
+	var keys []*datastore.Key
+	var idxs []int
+	for i, id := range ids {
+		key := namespacedKey(ctx, datastore.IDKey(model.structName, id, nil))
+		if !cacheOptionsOf(key.Kind).Disabled {
+			if _, err := cacheFromContext(ctx).Get(ctx, cacheKey(key)); err == nil {
+				exist[i] = true
+				continue
+			}
+		}
+		keys = append(keys, key)
+		idxs = append(idxs, i)
+	}
+
+	deleted := ""
+	if model.softDelete != nil {
+		deleted = model.softDelete.name
+	}
+
+	client := ClientFromContext(ctx)
+	size := batchSize(ctx)
+	for start := 0; start < len(keys); start += size {
+		end := start + size
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		probes := make([]*existenceProbe, end-start)
+		for j := range probes {
+			probes[j] = &existenceProbe{deletedProperty: deleted}
+		}
+
+		var err error
+		if tx := transactionFrom(ctx); tx != nil {
+			err = tx.GetMulti(keys[start:end], probes)
+		} else {
+			err = client.GetMulti(ctx, keys[start:end], probes)
+		}
+		merr, isMulti := err.(datastore.MultiError)
+		if err != nil && !isMulti {
+			return nil, err
+		}
+
+		for j, probe := range probes {
+			if isMulti && merr[j] != nil {
+				if merr[j] != datastore.ErrNoSuchEntity {
+					return nil, merr[j]
+				}
+				continue
+			}
+			exist[idxs[start+j]] = !probe.deleted
+		}
+	}
+
+	return exist, nil
+}
+
+// loads nothing but whether the entity has been soft deleted
+type existenceProbe struct {
+	deletedProperty string
+	deleted         bool
+}
+
+func (probe *existenceProbe) Load(props []datastore.Property) error {
+	for _, p := range props {
+		if t, ok := p.Value.(time.Time); ok && p.Name == probe.deletedProperty && !t.IsZero() {
+			probe.deleted = true
+		}
+	}
+	return nil
+}
+
+func (probe *existenceProbe) Save() ([]datastore.Property, error) {
+	return nil, nil
+}
+
+// Count returns the number of stored entities of the kind of the prototype, soft deleted entities excluded.
+// See Query.SkipDeleted
+func Count(ctx context.Context, prototype modelable) (int, error) {
+	return NewQuery(prototype).SkipDeleted().Count(ctx)
+}
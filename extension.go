@@ -1,8 +1,12 @@
 package model
 
 import (
+	"cloud.google.com/go/datastore"
 	"fmt"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 )
 
 const typeAppendix = "__ptrType"
@@ -14,8 +18,160 @@ func makeExtensionTypeName(base string) string {
 	return fmt.Sprintf("%s%s%s", base, valSeparator, typeAppendix)
 }
 
+// RawExtension holds the stored properties of an extension whose type can't be resolved on load,
+// i.e. because it is registered with RegisterExtension later on.
+// The properties are saved back as they are, so that the extension survives a load and save round-trip.
+// The RawExtension is assigned to the field if the interface of the field allows it,
+// else it is returned by RawExtensionOf
+type RawExtension struct {
+	// the name of the stored type of the extension
+	Type string
+	// the stored properties of the extension, named relatively to the field, i.e. Color for Ext.Color
+	Properties []datastore.Property
+}
+
+// returns the value of the property with the given name, or nil if the extension has none
+func (raw *RawExtension) Value(name string) interface{} {
+	for _, p := range raw.Properties {
+		if p.Name == name {
+			return p.Value
+		}
+	}
+	return nil
+}
+
+// returns the properties to save for the extension field with the given name
+func (raw *RawExtension) properties(field string, noIndex bool) []datastore.Property {
+	props := []datastore.Property{{Name: makeExtensionTypeName(field), Value: raw.Type, NoIndex: noIndex}}
+	for _, p := range raw.Properties {
+		p.Name = field + valSeparator + p.Name
+		props = append(props, p)
+	}
+	return props
+}
+
+// RawExtensionOf returns the stored properties of the extension field of the modelable
+// if its type couldn't be resolved when the modelable was loaded, or nil
+func RawExtensionOf(m modelable, field string) *RawExtension {
+	index(m)
+	model := m.getModel()
+	attr, ok := model.fieldNames[field]
+	if !ok || !attr.isExtension {
+		return nil
+	}
+	return rawExtensionAt(model, reflect.ValueOf(m).Elem().Field(attr.index), attr.index)
+}
+
+// returns the raw extension held by the field at index i, or kept by the model for it if the field is still nil
+func rawExtensionAt(model *Model, field reflect.Value, i int) *RawExtension {
+	if raw, ok := field.Interface().(*RawExtension); ok {
+		return raw
+	}
+
+	if field.IsNil() {
+		return model.rawExtensions[i]
+	}
+	return nil
+}
+
+// adds the property of the extension field at index i to its raw extension
+func loadRawExtension(model *Model, field reflect.Value, i int, name string, p datastore.Property) {
+	raw := rawExtensionAt(model, field, i)
+	if raw == nil {
+		raw = &RawExtension{}
+		if reflect.TypeOf(raw).Implements(field.Type()) {
+			field.Set(reflect.ValueOf(raw))
+		} else {
+			if model.rawExtensions == nil {
+				model.rawExtensions = map[int]*RawExtension{}
+			}
+			model.rawExtensions[i] = raw
+		}
+	}
+
+	if p.Name == makeExtensionTypeName(name) {
+		raw.Type, _ = p.Value.(string)
+		return
+	}
+
+	p.Name = strings.TrimPrefix(p.Name, name+valSeparator)
+	raw.Properties = append(raw.Properties, p)
+}
+
 func isValidExtension(v reflect.Value) bool {
 	isPtr := v.Elem().Kind() == reflect.Ptr
 	isStruct := v.Elem().Elem().Kind() == reflect.Struct
 	return isPtr && isStruct
 }
+
+var extensionsMutex sync.RWMutex
+
+// the extension types registered with RegisterExtension, by struct name
+var extensionTypes = map[string]reflect.Type{}
+var extensionListeners []func(ext reflect.Type, parents []string)
+
+// RegisterExtension makes the type of ext available to the extension fields of all the modelables,
+// including the ones already mapped. It can be called at any time, i.e. when a plugin is loaded:
+// entities whose stored extension type names a type registered later on are decoded from then on.
+// Registering a type with the name of an already registered one replaces it
+func RegisterExtension(ext interface{}) {
+	t := reflect.TypeOf(ext)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t.Kind() != reflect.Struct {
+		panic(fmt.Errorf("extension of type %s must be a struct or a pointer to a struct", t))
+	}
+
+	encodedStructFor(t)
+
+	extensionsMutex.Lock()
+	extensionTypes[t.Name()] = t
+	listeners := append([]func(reflect.Type, []string){}, extensionListeners...)
+	extensionsMutex.Unlock()
+
+	parents := extensionParents()
+	for _, l := range listeners {
+		l(t, parents)
+	}
+}
+
+// OnExtensionRegistered adds a listener notified whenever an extension type is registered,
+// along with the names of the mapped modelables holding extension fields.
+// Entities of those modelables loaded leniently before the registration miss the extensions of the new type,
+// thus the listener may read them again
+func OnExtensionRegistered(fn func(ext reflect.Type, parents []string)) {
+	extensionsMutex.Lock()
+	defer extensionsMutex.Unlock()
+	extensionListeners = append(extensionListeners, fn)
+}
+
+// returns the names of the mapped structs holding extension fields
+func extensionParents() []string {
+	encodedStructsMutex.RLock()
+	defer encodedStructsMutex.RUnlock()
+
+	var parents []string
+	for _, s := range encodedStructs {
+		if len(s.extensionsIdx) > 0 {
+			parents = append(parents, s.structName)
+		}
+	}
+	sort.Strings(parents)
+	return parents
+}
+
+// returns the extension type with the given name, preferring the registered types to the mapped ones
+func extensionTypeByName(name string) reflect.Type {
+	extensionsMutex.RLock()
+	t, ok := extensionTypes[name]
+	extensionsMutex.RUnlock()
+	if ok {
+		return t
+	}
+
+	encodedStructsMutex.RLock()
+	defer encodedStructsMutex.RUnlock()
+	return structTypeByName(name)
+}
@@ -0,0 +1,68 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"reflect"
+	"testing"
+)
+
+type PluginExtension struct {
+	Color string
+}
+
+func TestRegisterExtension(t *testing.T) {
+	props := []datastore.Property{{Name: makeExtensionTypeName("Ext"), Value: "PluginExtension"}}
+
+	var notified reflect.Type
+	OnExtensionRegistered(func(ext reflect.Type, parents []string) {
+		notified = ext
+	})
+
+	RegisterExtension(&PluginExtension{})
+
+	if notified != reflect.TypeOf(PluginExtension{}) {
+		t.Fatalf("listener notified of %v", notified)
+	}
+
+	if typ := findExtensionType("Ext", props); typ != reflect.TypeOf(PluginExtension{}) {
+		t.Fatalf("extension type resolved as %v", typ)
+	}
+}
+
+type RawHolder struct {
+	Model
+	Ext interface{}
+}
+
+func TestRawExtension(t *testing.T) {
+	props := []datastore.Property{
+		{Name: makeExtensionTypeName("Ext"), Value: "UnknownExtension"},
+		{Name: "Ext.Size", Value: int64(3)},
+	}
+
+	h := RawHolder{}
+	index(&h)
+	if err := fromPropertyList(&h, props); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := RawExtensionOf(&h, "Ext")
+	if raw == nil || raw.Type != "UnknownExtension" || raw.Value("Size") != int64(3) {
+		t.Fatalf("unexpected raw extension %+v", raw)
+	}
+
+	saved, err := toPropertyList(&h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(saved) != len(props) {
+		t.Fatalf("expected %d properties, got %+v", len(props), saved)
+	}
+
+	for i, p := range saved {
+		if p.Name != props[i].Name || p.Value != props[i].Value {
+			t.Fatalf("expected property %+v, got %+v", props[i], p)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// FeatureFlags is the singleton entity holding the feature flags of the application.
+// Flags are stored as strings and parsed by the typed accessors,
+// which return the given default value when the flag is unset or malformed
+type FeatureFlags struct {
+	Model
+	Values map[string]string `model:"json"`
+}
+
+// describes a flag that has been set, changed or unset
+type FlagChange struct {
+	Name  string
+	Value string
+	// true if the flag has been unset
+	Deleted bool
+}
+
+// LoadFeatureFlags returns the feature flags, which are kept in the memory of the instance as any singleton
+func LoadFeatureFlags(ctx context.Context) (*FeatureFlags, error) {
+	flags := &FeatureFlags{}
+	if err := Singleton(ctx, flags); err != nil {
+		return nil, err
+	}
+	return flags, nil
+}
+
+// SetFeatureFlag sets the flag to the string representation of value
+func SetFeatureFlag(ctx context.Context, name string, value interface{}) error {
+	var s string
+	switch v := value.(type) {
+	case string:
+		s = v
+	case time.Duration:
+		s = v.String()
+	default:
+		s = fmt.Sprint(v)
+	}
+
+	flags := &FeatureFlags{}
+	return UpdateSingleton(ctx, flags, func() error {
+		if flags.Values == nil {
+			flags.Values = make(map[string]string)
+		}
+		flags.Values[name] = s
+		return nil
+	})
+}
+
+// UnsetFeatureFlag removes the flag, so that the accessors return their default value
+func UnsetFeatureFlag(ctx context.Context, name string) error {
+	flags := &FeatureFlags{}
+	return UpdateSingleton(ctx, flags, func() error {
+		delete(flags.Values, name)
+		return nil
+	})
+}
+
+func (f *FeatureFlags) value(name string) (string, bool) {
+	if f == nil || f.Values == nil {
+		return "", false
+	}
+	v, ok := f.Values[name]
+	return v, ok
+}
+
+func (f *FeatureFlags) String(name string, def string) string {
+	if v, ok := f.value(name); ok {
+		return v
+	}
+	return def
+}
+
+func (f *FeatureFlags) Bool(name string, def bool) bool {
+	if v, ok := f.value(name); ok {
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return def
+}
+
+func (f *FeatureFlags) Int(name string, def int64) int64 {
+	if v, ok := f.value(name); ok {
+		if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return i
+		}
+	}
+	return def
+}
+
+func (f *FeatureFlags) Float(name string, def float64) float64 {
+	if v, ok := f.value(name); ok {
+		if x, err := strconv.ParseFloat(v, 64); err == nil {
+			return x
+		}
+	}
+	return def
+}
+
+func (f *FeatureFlags) Duration(name string, def time.Duration) time.Duration {
+	if v, ok := f.value(name); ok {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return def
+}
+
+// WatchFeatureFlags polls the feature flags every WatchPollInterval and sends the flags
+// that changed since the previous poll. The first poll sends nothing.
+// Flags are read through the cache, bypassing the memory of the instance.
+// The channel is closed when ctx is done
+func WatchFeatureFlags(ctx context.Context) <-chan FlagChange {
+	changes := make(chan FlagChange)
+
+	go func() {
+		defer close(changes)
+
+		var last map[string]string
+		first := true
+		ticker := time.NewTicker(WatchPollInterval)
+		defer ticker.Stop()
+
+		for {
+			flags := &FeatureFlags{}
+			index(flags)
+			flags.Key = singletonKey(ctx, flags.getModel())
+
+			err := Read(ctx, flags)
+			if errors.Is(err, datastore.ErrNoSuchEntity) {
+				// no flag has been set yet
+				err = nil
+			}
+
+			if err != nil {
+				if ctx.Err() == nil {
+					warningf(ctx, "error watching feature flags: %s", err.Error())
+				}
+			} else {
+				if !first {
+					for _, c := range flagChanges(last, flags.Values) {
+						select {
+						case changes <- c:
+						case <-ctx.Done():
+							return
+						}
+					}
+				}
+				last = flags.Values
+				first = false
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return changes
+}
+
+// returns the flags set, changed or unset from old to current
+func flagChanges(old map[string]string, current map[string]string) []FlagChange {
+	if reflect.DeepEqual(old, current) {
+		return nil
+	}
+
+	var changes []FlagChange
+	for name, v := range current {
+		if ov, ok := old[name]; !ok || ov != v {
+			changes = append(changes, FlagChange{Name: name, Value: v})
+		}
+	}
+
+	for name := range old {
+		if _, ok := current[name]; !ok {
+			changes = append(changes, FlagChange{Name: name, Deleted: true})
+		}
+	}
+
+	return changes
+}
@@ -0,0 +1,48 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFeatureFlagAccessors(t *testing.T) {
+	flags := &FeatureFlags{Values: map[string]string{
+		"beta":    "true",
+		"limit":   "42",
+		"ratio":   "0.5",
+		"timeout": "3s",
+		"broken":  "maybe",
+	}}
+
+	if !flags.Bool("beta", false) || flags.Bool("broken", true) != true || flags.Bool("missing", false) {
+		t.Fatal("unexpected bool flags")
+	}
+
+	if flags.Int("limit", 0) != 42 || flags.Int("missing", 7) != 7 {
+		t.Fatal("unexpected int flags")
+	}
+
+	if flags.Float("ratio", 0) != 0.5 || flags.Duration("timeout", 0) != 3*time.Second {
+		t.Fatal("unexpected float or duration flags")
+	}
+
+	var unset *FeatureFlags
+	if unset.String("theme", "dark") != "dark" {
+		t.Fatal("nil flags must return the default value")
+	}
+}
+
+func TestFlagChanges(t *testing.T) {
+	old := map[string]string{"a": "1", "b": "2"}
+	current := map[string]string{"a": "1", "b": "3", "c": "4"}
+
+	changes := flagChanges(old, current)
+	if len(changes) != 2 {
+		t.Fatalf("expected 2 changes, got %v", changes)
+	}
+
+	changes = flagChanges(current, nil)
+	if len(changes) != 3 || !changes[0].Deleted {
+		t.Fatalf("expected 3 deletions, got %v", changes)
+	}
+}
@@ -0,0 +1,83 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// a result of FederatedSearch
+type FederatedHit struct {
+	// the matching modelable, which is also appended to the destination of its kind
+	Modelable modelable
+	// the relevance of the modelable. If the backend doesn't score the documents it is derived from the rank
+	// of the modelable within the results of its kind, so that the results of the kinds are interleaved
+	Score float64
+}
+
+// FederatedSearch runs the query against the search indexes of several kinds at once, i.e. for a global search of the site.
+// Each dst must be a pointer to a slice of pointers to searchable modelables, the kind of which is searched.
+// The indexes are queried concurrently and the matching modelables are appended to their dst.
+// The returned hits merge the results of all the kinds, sorted by decreasing score
+func FederatedSearch(ctx context.Context, query string, dsts ...interface{}) ([]FederatedHit, error) {
+	queries := make([]*searchQuery, len(dsts))
+	for i, dst := range dsts {
+		dstv := reflect.ValueOf(dst)
+		if !isValidContainer(dstv) {
+			return nil, fmt.Errorf("invalid container of type %s. Container must be a modelable slice", dstv.Type())
+		}
+
+		sq := &searchQuery{mType: dstv.Elem().Type().Elem().Elem()}
+		sq.name = sq.mType.Name()
+		sq.SearchWith(query)
+		queries[i] = sq
+	}
+
+	hits := make([][]FederatedHit, len(dsts))
+	errs := make([]error, len(dsts))
+
+	var wg sync.WaitGroup
+	for i := range dsts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			modelables := reflect.ValueOf(dsts[i]).Elem()
+			start := modelables.Len()
+
+			res, err := queries[i].searchInto(ctx, dsts[i], nil, "")
+			if err != nil {
+				errs[i] = err
+				return
+			}
+
+			modelables = reflect.ValueOf(dsts[i]).Elem()
+			for j := range res.IDs {
+				hit := FederatedHit{Modelable: modelables.Index(start + j).Interface().(modelable)}
+				if res.Scores != nil {
+					hit.Score = res.Scores[j]
+				} else {
+					hit.Score = 1 / float64(j+1)
+				}
+				hits[i] = append(hits[i], hit)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var merged []FederatedHit
+	for i := range dsts {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("error searching %s: %w", queries[i].name, errs[i])
+		}
+		merged = append(merged, hits[i]...)
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].Score > merged[j].Score
+	})
+
+	return merged, nil
+}
@@ -0,0 +1,57 @@
+package model
+
+import (
+	"reflect"
+	"strings"
+)
+
+// FieldInfo describes a field of a modelable as it is mapped by the framework
+type FieldInfo struct {
+	Name string
+	Kind reflect.Kind
+	Type reflect.Type
+	// false if the field is tagged noindex
+	Indexed bool
+	// true if the field is added to the search index
+	Searchable bool
+	// true if the field holds a reference to another modelable
+	IsReference bool
+	// true if the field is an extension interface
+	IsExtension bool
+}
+
+// FieldsOf returns the fields of the modelable mapped by the framework, in declaration order.
+// Skipped and unexported fields are not reported
+func FieldsOf(m modelable) []FieldInfo {
+	index(m)
+	model := m.getModel()
+	t := reflect.TypeOf(m).Elem()
+
+	es := model.encodedStruct
+
+	fields := make([]FieldInfo, 0, len(es.fieldNames))
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" || field.Type == typeOfModel {
+			continue
+		}
+
+		ef, ok := es.fieldNames[field.Name]
+		if !ok || ef.index != i {
+			continue
+		}
+
+		tags := strings.Split(field.Tag.Get(tagDomain), ",")
+		fields = append(fields, FieldInfo{
+			Name:        field.Name,
+			Kind:        field.Type.Kind(),
+			Type:        field.Type,
+			Indexed:     containsTag(tags, tagNoindex) == "",
+			Searchable:  containsTag(tags, tagSearch) != "",
+			IsReference: model.referenceAtIndex(i) != nil,
+			IsExtension: ef.isExtension,
+		})
+	}
+
+	return fields
+}
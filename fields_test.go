@@ -0,0 +1,40 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+)
+
+type fieldsOwner struct {
+	Model
+	Name string
+}
+
+type fieldsHolder struct {
+	Model
+	Title string `model:"search"`
+	Body  string `model:"noindex"`
+	Owner fieldsOwner
+	Skip  string `model:"-"`
+}
+
+func TestFieldsOf(t *testing.T) {
+	fields := FieldsOf(&fieldsHolder{})
+
+	if len(fields) != 3 {
+		t.Fatalf("expected 3 fields, got %d: %+v", len(fields), fields)
+	}
+
+	title, body, owner := fields[0], fields[1], fields[2]
+	if title.Name != "Title" || !title.Indexed || !title.Searchable || title.Kind != reflect.String {
+		t.Fatalf("invalid title field %+v", title)
+	}
+
+	if body.Indexed || body.Searchable {
+		t.Fatalf("invalid body field %+v", body)
+	}
+
+	if !owner.IsReference || owner.Kind != reflect.Struct {
+		t.Fatalf("invalid owner field %+v", owner)
+	}
+}
@@ -0,0 +1,243 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// the comparison operators supported by the filters of the datastore client.
+// IN and OR filters are run by the model as a union of queries, see Query.WhereIn
+var filterOperators = map[string]bool{"=": true, "<": true, "<=": true, ">": true, ">=": true}
+
+// maximum number of datastore queries an IN or OR filter expands to
+const maxDisjunctions = 30
+
+// returned by the functions that page through the results of a query, which can't run the union of an IN or OR filter
+var errDisjunctionPaging = errors.New("invalid query. Queries with IN or OR filters can't be paged")
+
+// returned by First, FirstKey and Last for the union of an IN or OR filter ordered by properties:
+// the queries of the union are run keys only, thus their results can only be merged by key
+var errDisjunctionOrder = errors.New("invalid query. Queries with IN or OR filters can only be ordered by key to get their first result")
+
+// returns an error if the operator is not supported by the datastore client
+func validateOperator(op string) error {
+	op = strings.TrimSpace(op)
+	if filterOperators[op] {
+		return nil
+	}
+
+	if strings.EqualFold(op, "in") {
+		return fmt.Errorf("invalid operator %s. Use WhereIn", op)
+	}
+	return fmt.Errorf("invalid operator %s. The datastore client supports =, <, <=, > and >=", op)
+}
+
+// WithKey returns a query filtering the entities by key, i.e. WithKey(">", key) for key ranges.
+// The operator is one of =, <, <=, > and >=
+func (q *Query) WithKey(op string, key *datastore.Key) (*Query, error) {
+	if err := validateOperator(op); err != nil {
+		return nil, err
+	}
+
+	if key == nil {
+		return nil, errors.New("invalid key filter. Key is nil")
+	}
+
+	filter := fmt.Sprintf("__key__ %s", strings.TrimSpace(op))
+	return q.derive(func(dq *datastore.Query) *datastore.Query {
+		return dq.Filter(filter, key)
+	}), nil
+}
+
+// WhereIn returns a query finding the entities whose field equals any of the values.
+// The datastore client has no IN operator: the query runs as a union of equality queries, one for each value,
+// whose results are merged and deduplicated by the model, in the order of the values.
+// Orders, offsets and limits apply to each of the queries, not to the union, and the query can't be paged.
+// The filters added to the returned query apply to all the values
+func (q *Query) WhereIn(field string, values []interface{}) (*Query, error) {
+	if len(values) == 0 {
+		return nil, fmt.Errorf("invalid IN filter on field %s. No values given", field)
+	}
+
+	filter := q.filterProperty(fmt.Sprintf("%s =", strings.TrimSpace(field)))
+	branches := q.branches()
+	if len(branches)*len(values) > maxDisjunctions {
+		return nil, fmt.Errorf("invalid IN filter on field %s. The query would run more than %d queries", field, maxDisjunctions)
+	}
+
+	c := q.Clone()
+	c.disjuncts = make([]*datastore.Query, 0, len(branches)*len(values))
+	for _, b := range branches {
+		for _, v := range values {
+			c.disjuncts = append(c.disjuncts, b.Filter(filter, v))
+		}
+	}
+	return c, nil
+}
+
+// Or returns a query finding the entities satisfying q or any of the other queries, which must have the kind of q.
+// Only the filters of the other queries are combined: the orders, the ancestor and the soft delete filtering of q
+// apply to all of them. As with WhereIn, the query runs as a union of datastore queries and can't be paged
+func (q *Query) Or(others ...*Query) (*Query, error) {
+	branches := q.branches()
+	for _, o := range others {
+		if o.mType != q.mType {
+			return nil, fmt.Errorf("invalid OR filter. Can't combine queries of %s with queries of %s", q.mType.Name(), o.mType.Name())
+		}
+		branches = append(branches, o.branches()...)
+	}
+
+	if len(branches) > maxDisjunctions {
+		return nil, fmt.Errorf("invalid OR filter. The query would run more than %d queries", maxDisjunctions)
+	}
+
+	c := q.Clone()
+	c.disjuncts = branches
+	return c, nil
+}
+
+// returns the datastore queries whose results make the results of the query
+func (q *Query) branches() []*datastore.Query {
+	if q.disjuncts == nil {
+		return []*datastore.Query{q.dq}
+	}
+	return append([]*datastore.Query{}, q.disjuncts...)
+}
+
+// runs the queries of an IN or OR filter and returns the keys they found, without duplicates
+func (q *Query) unionKeys(ctx context.Context) ([]*datastore.Key, error) {
+	client := ClientFromContext(ctx)
+	seen := make(map[string]bool)
+	var keys []*datastore.Key
+	for _, b := range q.disjuncts {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		done := traceDatastoreCall(ctx, "GetAll", q.mType.Name(), 0)
+		found, err := client.GetAll(ctx, q.decorate(ctx, b).KeysOnly(), nil)
+		done(err)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range found {
+			encoded := key.Encode()
+			if seen[encoded] {
+				continue
+			}
+			seen[encoded] = true
+			keys = append(keys, key)
+		}
+	}
+
+	countQueryResults(ctx, q.mType.Name(), len(keys))
+	return keys, nil
+}
+
+// returns the first key found by the queries of an IN or OR filter, under the key order of the query.
+// Unions ordered by properties can't be merged, and they return errDisjunctionOrder
+func (q *Query) firstUnionKey(ctx context.Context) (*datastore.Key, error) {
+	desc := false
+	if len(q.orders) > 0 {
+		switch q.orders[0] {
+		case "__key__":
+		case "-__key__":
+			desc = true
+		default:
+			return nil, errDisjunctionOrder
+		}
+	}
+
+	keys, err := q.unionKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		return nil, ErrNotFound
+	}
+
+	first := keys[0]
+	for _, key := range keys[1:] {
+		if c := compareKeys(key, first); (c < 0 && !desc) || (c > 0 && desc) {
+			first = key
+		}
+	}
+	return first, nil
+}
+
+// compares the keys as the datastore orders them: path element by path element from the root,
+// kinds first, then numeric ids before names. An ancestor comes before its descendants
+func compareKeys(a *datastore.Key, b *datastore.Key) int {
+	pa, pb := keyPath(a), keyPath(b)
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		ea, eb := pa[i], pb[i]
+		if ea.Kind != eb.Kind {
+			return strings.Compare(ea.Kind, eb.Kind)
+		}
+
+		switch {
+		case ea.Name == "" && eb.Name != "":
+			return -1
+		case ea.Name != "" && eb.Name == "":
+			return 1
+		case ea.Name != eb.Name:
+			return strings.Compare(ea.Name, eb.Name)
+		case ea.ID < eb.ID:
+			return -1
+		case ea.ID > eb.ID:
+			return 1
+		}
+	}
+	return len(pa) - len(pb)
+}
+
+// returns the path of the key, from the root
+func keyPath(key *datastore.Key) []*datastore.Key {
+	var path []*datastore.Key
+	for k := key; k != nil; k = k.Parent {
+		path = append([]*datastore.Key{k}, path...)
+	}
+	return path
+}
+
+// appends to dst the entities found by the queries of an IN or OR filter
+func (q *Query) getUnion(ctx context.Context, dst interface{}) error {
+	if q.projection {
+		return errors.New("invalid query. Can't use projection queries with IN or OR filters")
+	}
+
+	dstv := reflect.ValueOf(dst)
+	if !isValidContainer(dstv) {
+		return fmt.Errorf("invalid container of type %s. Container must be a modelable slice", dstv.Elem().Type().Name())
+	}
+
+	keys, err := q.unionKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	found := reflect.MakeSlice(dstv.Elem().Type(), 0, len(keys))
+	for _, key := range keys {
+		m := reflect.New(q.mType).Interface().(modelable)
+		index(m)
+		m.getModel().Key = key
+		found = reflect.Append(found, reflect.ValueOf(m))
+	}
+
+	if found.Len() == 0 {
+		return nil
+	}
+
+	if err := ReadMulti(ctx, found.Interface()); err != nil {
+		return err
+	}
+
+	dstv.Elem().Set(reflect.AppendSlice(dstv.Elem(), found))
+	return nil
+}
@@ -0,0 +1,155 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"fmt"
+	"google.golang.org/appengine/search"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maximum number of results loaded by Find when it answers with the search index
+const findSearchLimit int = 1000
+
+// Condition is a comparison of a field of the modelable with a value. See Find
+type Condition struct {
+	Field string
+	// one of =, <, <=, >, >=
+	Op    string
+	Value interface{}
+}
+
+// returns the condition comparing the field with the value, i.e. Where("Age", ">", 30)
+func Where(field string, op string, value interface{}) Condition {
+	return Condition{Field: field, Op: op, Value: value}
+}
+
+// Find loads into dst, a pointer to a slice of modelables, the modelables satisfying all the conditions.
+// Callers don't need to know which subsystem can answer: if all the fields of the conditions are indexed properties
+// a datastore query is run, else if all of them are searchable fields the search index is queried,
+// loading at most 1000 results. An error is returned if neither can answer
+func Find(ctx context.Context, dst interface{}, conds ...Condition) error {
+	dstv := reflect.ValueOf(dst)
+	if !isValidContainer(dstv) {
+		return fmt.Errorf("invalid container of type %s. Container must be a pointer to a modelable slice", dstv.Type())
+	}
+
+	typ := dstv.Elem().Type().Elem().Elem()
+	for _, c := range conds {
+		switch c.Op {
+		case "=", "<", "<=", ">", ">=":
+		default:
+			return fmt.Errorf("invalid operator %q for field %s", c.Op, c.Field)
+		}
+	}
+
+	if indexedFields(typ, conds) {
+		return findWithQuery(ctx, typ, dst, conds)
+	}
+
+	if searchableFields(typ, conds) {
+		return findWithSearch(ctx, typ, dst, conds)
+	}
+
+	return fmt.Errorf("the fields of the conditions are neither indexed nor searchable in struct of type %s", typ.Name())
+}
+
+// reports whether the fields of the conditions are stored as indexed properties of their own
+func indexedFields(t reflect.Type, conds []Condition) bool {
+	for _, c := range conds {
+		field, ok := t.FieldByName(c.Field)
+		if !ok || len(field.Index) != 1 || field.Tag.Get("datastore") == "-" {
+			return false
+		}
+
+		tags := strings.Split(field.Tag.Get(tagDomain), ",")
+		if containsTag(tags, tagSkip) != "" || containsTag(tags, tagNoindex) != "" || containsTag(tags, tagJSON) != "" {
+			return false
+		}
+
+		switch field.Type.Kind() {
+		case reflect.Map, reflect.Interface, reflect.Ptr:
+			return false
+		case reflect.Slice:
+			if field.Type.Elem().Kind() == reflect.Uint8 {
+				return false
+			}
+		case reflect.Struct:
+			// references are stored as keys
+			if field.Type != typeOfTime && field.Type != typeOfGeoPoint && !reflect.PtrTo(field.Type).Implements(typeOfModelable) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// reports whether the fields of the conditions are searchable
+func searchableFields(t reflect.Type, conds []Condition) bool {
+	descs := getSearchablefields(t)
+	for _, c := range conds {
+		found := false
+		for _, desc := range descs {
+			if desc.name == c.Field {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+	return len(descs) > 0
+}
+
+func findWithQuery(ctx context.Context, typ reflect.Type, dst interface{}, conds []Condition) error {
+	q := NewQuery(reflect.New(typ).Interface().(modelable))
+	for _, c := range conds {
+		if ref, ok := c.Value.(modelable); ok && c.Op == "=" {
+			q = q.WithModelable(c.Field, ref)
+			continue
+		}
+		q = q.WithField(c.Field+" "+c.Op, c.Value)
+	}
+	return q.GetAll(ctx, dst)
+}
+
+func findWithSearch(ctx context.Context, typ reflect.Type, dst interface{}, conds []Condition) error {
+	sq := NewSearchQuery(reflect.New(typ).Interface().(modelable))
+	for _, c := range conds {
+		field := c.Field + " " + c.Op
+		switch v := c.Value.(type) {
+		case string:
+			sq.SearchWithValue(field, v, SearchAnd)
+			continue
+		case modelable:
+			sq.SearchWithModel(field+" ", v, SearchAnd)
+			continue
+		}
+
+		if sq.query.Len() != 0 {
+			sq.query.WriteString(" " + string(SearchAnd) + " ")
+		}
+		sq.query.WriteString(field + " " + searchLiteral(c.Value))
+	}
+
+	_, err := sq.Search(ctx, dst, &search.SearchOptions{Limit: findSearchLimit})
+	return err
+}
+
+// formats the value as a literal of the search query syntax
+func searchLiteral(value interface{}) string {
+	switch v := value.(type) {
+	case time.Time:
+		return v.Format("2006-01-02")
+	case *datastore.Key:
+		return strconv.Quote(v.Encode())
+	case int, int8, int16, int32, int64, float32, float64:
+		return fmt.Sprint(v)
+	}
+	return strconv.Quote(fmt.Sprint(value))
+}
@@ -0,0 +1,33 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+)
+
+type FindArticle struct {
+	Model
+	Title string `model:"search"`
+	Body  string `model:"noindex,search"`
+	Views int
+}
+
+func TestFindStrategy(t *testing.T) {
+	typ := reflect.TypeOf(FindArticle{})
+
+	if !indexedFields(typ, []Condition{Where("Title", "=", "go"), Where("Views", ">", 10)}) {
+		t.Fatal("Title and Views should be answered by a query")
+	}
+
+	if indexedFields(typ, []Condition{Where("Body", "=", "go")}) {
+		t.Fatal("Body is not indexed")
+	}
+
+	if !searchableFields(typ, []Condition{Where("Title", "=", "go"), Where("Body", "=", "go")}) {
+		t.Fatal("Title and Body should be answered by the search index")
+	}
+
+	if searchableFields(typ, []Condition{Where("Views", ">", 10)}) {
+		t.Fatal("Views is not searchable")
+	}
+}
@@ -2,7 +2,11 @@ module github.com/decodica/model
 
 require (
 	cloud.google.com/go/datastore v1.1.0
+	cloud.google.com/go/storage v1.6.0
+	go.opentelemetry.io/otel v1.7.0
+	go.opentelemetry.io/otel/trace v1.7.0
 	golang.org/x/net v0.0.0-20200324143707-d3edc9973b7e
+	golang.org/x/text v0.3.2
 	google.golang.org/api v0.24.0
 	google.golang.org/appengine v1.6.6
 )
@@ -0,0 +1,164 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"errors"
+	"fmt"
+	"google.golang.org/api/iterator"
+	"reflect"
+	"sync"
+)
+
+// DeleteAction defines what happens on delete to the entities referencing the deleted one
+type DeleteAction int
+
+const (
+	// the delete fails if the entity is referenced
+	DeleteRestrict DeleteAction = iota + 1
+	// the references to the deleted entity are cleared
+	DeleteNullify
+)
+
+var ErrReferenced = errors.New("entity is referenced")
+
+type deleteGuard struct {
+	holderKind string
+	field      string
+	action     DeleteAction
+}
+
+var guardsMutex sync.Mutex
+
+// maps the referenced kinds to the guards of their referencing kinds
+var deleteGuards = map[string][]deleteGuard{}
+
+// DeclareReference declares that the entities of the holder kind reference the entities of the referenced kind
+// through field. Delete and Clear on a referenced entity check the holders before deleting it,
+// and either refuse or clear the holders references according to action.
+func DeclareReference(referenced modelable, holder modelable, field string, action DeleteAction) {
+	rt := reflect.TypeOf(referenced).Elem()
+	ht := reflect.TypeOf(holder).Elem()
+
+	if _, ok := ht.FieldByName(field); !ok {
+		panic(fmt.Errorf("struct of type %s has no field with name %s", ht.Name(), field))
+	}
+
+	guardsMutex.Lock()
+	defer guardsMutex.Unlock()
+	deleteGuards[rt.Name()] = append(deleteGuards[rt.Name()], deleteGuard{holderKind: ht.Name(), field: field, action: action})
+}
+
+func hasDeleteGuards() bool {
+	guardsMutex.Lock()
+	defer guardsMutex.Unlock()
+	return len(deleteGuards) > 0
+}
+
+// runs the delete guards for the keys about to be deleted.
+// Holders in the ignore list are being deleted as well, or are handled by the caller, and are skipped
+func checkDeleteGuards(ctx context.Context, keys []*datastore.Key, ignore []*datastore.Key) error {
+	client := ClientFromContext(ctx)
+
+	for _, key := range keys {
+		guardsMutex.Lock()
+		guards := deleteGuards[key.Kind]
+		guardsMutex.Unlock()
+
+		for _, g := range guards {
+			q := datastore.NewQuery(g.holderKind).Namespace(key.Namespace).Filter(fmt.Sprintf("%s =", g.field), key).KeysOnly()
+
+			var holders []*datastore.Key
+			it := client.Run(ctx, q)
+			for {
+				hk, err := it.Next(nil)
+				if err == iterator.Done {
+					break
+				}
+				if err != nil {
+					return err
+				}
+
+				if !containsKey(ignore, hk) && !containsKey(keys, hk) {
+					holders = append(holders, hk)
+				}
+			}
+
+			if len(holders) == 0 {
+				continue
+			}
+
+			if g.action == DeleteRestrict {
+				return fmt.Errorf("%w: %s is referenced by %d entities of kind %s", ErrReferenced, key, len(holders), g.holderKind)
+			}
+
+			for _, hk := range holders {
+				if err := nullifyReference(ctx, hk, g.field); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// clears the reference stored in field by the entity with the given key
+func nullifyReference(ctx context.Context, key *datastore.Key, field string) error {
+	err := runInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var props datastore.PropertyList
+		if err := tx.Get(key, &props); err != nil {
+			return err
+		}
+
+		for i := range props {
+			if props[i].Name == field {
+				props[i].Value = nil
+			}
+		}
+
+		_, err := tx.Put(key, &props)
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if err := cacheFromContext(ctx).Delete(ctx, cacheKey(key)); err != nil && err != ErrCacheMiss {
+		return err
+	}
+
+	return nil
+}
+
+func containsKey(keys []*datastore.Key, key *datastore.Key) bool {
+	for _, k := range keys {
+		if k.Equal(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the keys of the modelable and of its references that clear would delete
+func clearedKeys(m modelable) []*datastore.Key {
+	model := m.getModel()
+	if model.Key == nil {
+		return nil
+	}
+
+	keys := []*datastore.Key{model.Key}
+	for _, ref := range model.references {
+		if ref.Modelable.getModel().readonly {
+			continue
+		}
+		keys = append(keys, clearedKeys(ref.Modelable)...)
+	}
+
+	for _, child := range childrenOf(m) {
+		keys = append(keys, clearedKeys(child)...)
+	}
+
+	return keys
+}
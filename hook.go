@@ -0,0 +1,139 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+)
+
+const keyHookContext = "__model_hook_context"
+
+// Operation is the kind of write or read a hook, or a Tracer, runs for
+type Operation int
+
+const (
+	OpCreate Operation = iota + 1
+	OpUpdate
+	OpDelete
+	OpRead
+	// queries are reported to the Tracer only
+	OpQuery
+)
+
+func (op Operation) String() string {
+	switch op {
+	case OpCreate:
+		return "create"
+	case OpUpdate:
+		return "update"
+	case OpDelete:
+		return "delete"
+	case OpRead:
+		return "read"
+	case OpQuery:
+		return "query"
+	}
+	return "unknown"
+}
+
+// HookContext describes the operation running a hook
+type HookContext struct {
+	// the operation on the entity the hook runs for
+	Operation Operation
+	// true if the operation runs in a datastore transaction
+	InTransaction bool
+	// true if the operation is part of a batch call, like CreateMulti
+	Batch bool
+	// the API function called by the application, i.e. "Save".
+	// Operations on references report the call that originated them
+	Call string
+}
+
+// returns the hook context of the operation running with ctx
+func HookContextFrom(ctx context.Context) (HookContext, bool) {
+	hc, ok := ctx.Value(keyHookContext).(HookContext)
+	return hc, ok
+}
+
+// attaches the description of the operation to the context.
+// If the operation is nested into another one, the originating call and the transaction status are kept
+func withHookContext(ctx context.Context, op Operation, call string, inTransaction bool, batch bool) context.Context {
+	hc := HookContext{Operation: op, InTransaction: inTransaction, Batch: batch, Call: call}
+	if outer, ok := HookContextFrom(ctx); ok {
+		hc.Call = outer.Call
+		hc.InTransaction = hc.InTransaction || outer.InTransaction
+		hc.Batch = hc.Batch || outer.Batch
+	}
+	return context.WithValue(ctx, keyHookContext, hc)
+}
+
+// BeforeCreator is implemented by the modelables running logic before being created, like validation.
+// Returning an error aborts the create
+type BeforeCreator interface {
+	BeforeCreate(ctx context.Context) error
+}
+
+// BeforeUpdater is implemented by the modelables running logic before being updated.
+// Returning an error aborts the update
+type BeforeUpdater interface {
+	BeforeUpdate(ctx context.Context) error
+}
+
+// BeforeDeleter is implemented by the modelables running logic before being deleted.
+// Returning an error aborts the delete
+type BeforeDeleter interface {
+	BeforeDelete(ctx context.Context) error
+}
+
+// AfterLoader is implemented by the modelables running logic once read, either from the datastore or from the cache.
+// The error returned is reported to the caller of the read
+type AfterLoader interface {
+	AfterLoad(ctx context.Context) error
+}
+
+// runs the BeforeCreate hook of the modelable, if any.
+// Lifecycle hooks run for the modelables passed to the API functions, not for their references
+func beforeCreate(ctx context.Context, m modelable) error {
+	if h, ok := m.(BeforeCreator); ok {
+		return h.BeforeCreate(ctx)
+	}
+	return nil
+}
+
+func beforeUpdate(ctx context.Context, m modelable) error {
+	if h, ok := m.(BeforeUpdater); ok {
+		return h.BeforeUpdate(ctx)
+	}
+	return nil
+}
+
+func beforeDelete(ctx context.Context, m modelable) error {
+	if h, ok := m.(BeforeDeleter); ok {
+		return h.BeforeDelete(ctx)
+	}
+	return nil
+}
+
+func afterLoad(ctx context.Context, m modelable) error {
+	if h, ok := m.(AfterLoader); ok {
+		return h.AfterLoad(ctx)
+	}
+	return nil
+}
+
+// runs the hook for each modelable of a batch.
+// If any of them fails it returns a datastore.MultiError aligned to ms, so that nothing gets written
+func runHooks(ctx context.Context, ms []modelable, hook func(ctx context.Context, m modelable) error) error {
+	merr := make(datastore.MultiError, len(ms))
+	failed := false
+	for i, m := range ms {
+		if err := hook(ctx, m); err != nil {
+			merr[i] = err
+			failed = true
+		}
+	}
+
+	if failed {
+		return merr
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"errors"
+	"testing"
+)
+
+type hookedEntity struct {
+	Model
+	Name string
+}
+
+func (h *hookedEntity) BeforeCreate(ctx context.Context) error {
+	if h.Name == "" {
+		return errors.New("name is required")
+	}
+	return nil
+}
+
+func TestRunHooks(t *testing.T) {
+	ms := []modelable{&hookedEntity{Name: "a"}, &hookedEntity{}, &Model{}}
+
+	err := runHooks(context.Background(), ms, beforeCreate)
+	merr, ok := err.(datastore.MultiError)
+	if !ok {
+		t.Fatalf("expected a datastore.MultiError, got %v", err)
+	}
+
+	if merr[0] != nil || merr[1] == nil || merr[2] != nil {
+		t.Fatalf("invalid hook errors %v", merr)
+	}
+
+	if err := runHooks(context.Background(), ms[:1], beforeCreate); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// derives the key of the entity from the field, i.e. `model:"id"`.
+// String fields give named keys, int fields give numeric ids
+const tagId string = "id"
+
+var ErrImmutableId = errors.New("id field can't be changed")
+
+var ErrAlreadyExists = errors.New("entity already exists")
+
+type idDescriptor struct {
+	// index of the id field
+	index int
+}
+
+// returns the key derived from the id field of the modelable, or nil if the modelable has no id field
+func idKey(m modelable, parent *datastore.Key) (*datastore.Key, error) {
+	model := m.getModel()
+	if model.id == nil {
+		return nil, nil
+	}
+
+	field := reflect.ValueOf(m).Elem().Field(model.id.index)
+	name := reflect.TypeOf(m).Elem().Field(model.id.index).Name
+
+	switch field.Kind() {
+	case reflect.String:
+		if field.String() == "" {
+			return nil, fmt.Errorf("id field %s of %s is not set", name, model.Name())
+		}
+		return datastore.NameKey(model.structName, field.String(), parent), nil
+	default:
+		if field.Int() == 0 {
+			return nil, fmt.Errorf("id field %s of %s is not set", name, model.Name())
+		}
+		return datastore.IDKey(model.structName, field.Int(), parent), nil
+	}
+}
+
+// checks that the id field of the modelable still matches its key
+func checkIdUnchanged(m modelable) error {
+	model := m.getModel()
+	if model.id == nil || model.Key == nil {
+		return nil
+	}
+
+	key, err := idKey(m, model.Key.Parent)
+	if err != nil {
+		return err
+	}
+
+	if key.Name != model.Key.Name || key.ID != model.Key.ID {
+		return fmt.Errorf("%w: %s has key %s", ErrImmutableId, model.Name(), model.Key)
+	}
+
+	return nil
+}
+
+// the reads and writes of the transaction inserting entities, satisfied by *datastore.Transaction
+type insertTx interface {
+	GetMulti(keys []*datastore.Key, dst interface{}) error
+	PutMulti(keys []*datastore.Key, src interface{}) ([]*datastore.PendingKey, error)
+}
+
+// puts the new entities within the transaction, unless an entity with one of their keys is already stored.
+// Keys derived from id fields are chosen by the caller, thus a plain put would overwrite the stored entity.
+// Returns a datastore.MultiError aligned to keys, holding ErrAlreadyExists for the stored ones
+func insertEntities(tx insertTx, keys []*datastore.Key, src []modelable) error {
+	stored := make([]datastore.PropertyList, len(keys))
+	err := tx.GetMulti(keys, stored)
+	merr, ok := err.(datastore.MultiError)
+	if err != nil && !ok {
+		return err
+	}
+
+	ierr := make(datastore.MultiError, len(keys))
+	failed := false
+	for i, key := range keys {
+		if err == nil || merr[i] == nil {
+			ierr[i] = fmt.Errorf("%w: %s", ErrAlreadyExists, key)
+			failed = true
+		} else if merr[i] != datastore.ErrNoSuchEntity {
+			ierr[i] = merr[i]
+			failed = true
+		}
+	}
+
+	if failed {
+		return ierr
+	}
+
+	_, err = tx.PutMulti(keys, src)
+	return err
+}
+
+// inserts the entity with the key derived from its id field, within the transaction of ctx or a new one
+func insertDerived(ctx context.Context, key *datastore.Key, m modelable) (err error) {
+	state := txStateFrom(ctx)
+	if state == nil {
+		return runTransaction(ctx, func(ctx context.Context, tx *datastore.Transaction) error {
+			return insertDerived(ctx, key, m)
+		})
+	}
+
+	done := traceDatastoreCall(ctx, "Put", key.Kind, 1)
+	defer func() { done(err) }()
+
+	err = insertEntities(state.tx, []*datastore.Key{key}, []modelable{m})
+	if merr, ok := err.(datastore.MultiError); ok {
+		err = merr[0]
+	}
+
+	if err == nil {
+		state.put(key, m)
+	}
+	return err
+}
@@ -0,0 +1,181 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"errors"
+	"testing"
+)
+
+type namedIdEntity struct {
+	Model
+	Code string `model:"id"`
+	Name string
+}
+
+type intIdEntity struct {
+	Model
+	Number int64 `model:"id"`
+}
+
+func TestDerivedKeys(t *testing.T) {
+	parent := datastore.NameKey("Parent", "p", nil)
+
+	named := namedIdEntity{Code: "abc"}
+	index(&named)
+	key, err := newKeyOf(&named, &CreateOptions{}, parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key.Kind != "namedIdEntity" || key.Name != "abc" || !key.Parent.Equal(parent) {
+		t.Fatalf("invalid named key %v", key)
+	}
+
+	numbered := intIdEntity{Number: 42}
+	index(&numbered)
+	key, err = newKeyOf(&numbered, &CreateOptions{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key.ID != 42 || key.Name != "" {
+		t.Fatalf("invalid numeric key %v", key)
+	}
+
+	// the id set in the options wins over the id field
+	key, err = newKeyOf(&named, &CreateOptions{stringId: "xyz"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key.Name != "xyz" {
+		t.Fatalf("expected the id of the options, got %v", key)
+	}
+
+	if _, err := newKeyOf(&intIdEntity{}, &CreateOptions{}, nil); err == nil {
+		t.Fatal("expected an error for an unset id field")
+	}
+}
+
+func TestBatchDerivedKeys(t *testing.T) {
+	ms := []modelable{&namedIdEntity{Code: "a"}, &namedIdEntity{Code: "b"}}
+	for _, m := range ms {
+		index(m)
+	}
+
+	// derived keys are complete, thus no id is allocated with the client
+	ctx := context.WithValue(context.Background(), keyDatastoreClient, (*datastore.Client)(nil))
+	batch := &createBatch{}
+	if err := batch.allocate(ctx, ms, []int{0, 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, code := range []string{"a", "b"} {
+		if key := ms[i].getModel().Key; key == nil || key.Name != code {
+			t.Fatalf("modelable %d has key %v, expected the name %s", i, key, code)
+		}
+
+		if batch.owners[i] != i {
+			t.Fatalf("modelable %d is owned by %d", i, batch.owners[i])
+		}
+	}
+}
+
+func TestImmutableId(t *testing.T) {
+	e := namedIdEntity{Code: "abc"}
+	index(&e)
+	e.Key = datastore.NameKey("namedIdEntity", "abc", nil)
+
+	if err := checkIdUnchanged(&e); err != nil {
+		t.Fatalf("unexpected error for an unchanged id: %s", err)
+	}
+
+	e.Code = "changed"
+	if err := Update(context.Background(), &e); !errors.Is(err, ErrImmutableId) {
+		t.Fatalf("expected %v, got %v", ErrImmutableId, err)
+	}
+}
+
+// a transaction holding the entities stored by key
+type fakeInsertTx struct {
+	stored map[string]bool
+}
+
+func (tx *fakeInsertTx) GetMulti(keys []*datastore.Key, dst interface{}) error {
+	merr := make(datastore.MultiError, len(keys))
+	failed := false
+	for i, key := range keys {
+		if !tx.stored[key.Encode()] {
+			merr[i] = datastore.ErrNoSuchEntity
+			failed = true
+		}
+	}
+
+	if failed {
+		return merr
+	}
+	return nil
+}
+
+func (tx *fakeInsertTx) PutMulti(keys []*datastore.Key, src interface{}) ([]*datastore.PendingKey, error) {
+	for _, key := range keys {
+		tx.stored[key.Encode()] = true
+	}
+	return nil, nil
+}
+
+func TestCreateSameIdTwice(t *testing.T) {
+	tx := &fakeInsertTx{stored: map[string]bool{}}
+
+	first := namedIdEntity{Code: "abc", Name: "first"}
+	index(&first)
+	key, err := newKeyOf(&first, &CreateOptions{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := insertEntities(tx, []*datastore.Key{key}, []modelable{&first}); err != nil {
+		t.Fatal(err)
+	}
+
+	second := namedIdEntity{Code: "abc", Name: "second"}
+	index(&second)
+	other := namedIdEntity{Code: "def", Name: "other"}
+	index(&other)
+	keys := []*datastore.Key{key, datastore.NameKey("namedIdEntity", "def", nil)}
+
+	err = insertEntities(tx, keys, []modelable{&second, &other})
+	merr, ok := err.(datastore.MultiError)
+	if !ok {
+		t.Fatalf("expected a MultiError, got %v", err)
+	}
+
+	if !errors.Is(merr[0], ErrAlreadyExists) {
+		t.Fatalf("expected %v for the stored id, got %v", ErrAlreadyExists, merr[0])
+	}
+
+	// a batch holding a stored id is not written at all
+	if merr[1] != nil || tx.stored[keys[1].Encode()] {
+		t.Fatalf("expected the new id to be left unwritten, got %v", merr[1])
+	}
+}
+
+func TestMixedBatch(t *testing.T) {
+	ms := []modelable{&namedIdEntity{Code: "a"}, &intIdEntity{Number: 7}}
+	for _, m := range ms {
+		index(m)
+	}
+
+	ctx := context.WithValue(context.Background(), keyDatastoreClient, (*datastore.Client)(nil))
+	batch := &createBatch{}
+	if err := batch.allocate(ctx, ms, []int{0, 1}); err == nil {
+		t.Fatal("expected an error for a batch of mixed types")
+	}
+
+	for i, m := range ms {
+		if m.getModel().Key != nil {
+			t.Fatalf("modelable %d of the rejected batch got the key %v", i, m.getModel().Key)
+		}
+	}
+}
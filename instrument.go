@@ -0,0 +1,159 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+const keyTracer = "__model_tracer"
+const keyOperationSpan = "__model_operation_span"
+
+// Tracer receives an event for every Create, Read, Update, Delete and query run by the application.
+// The work done for the references of the modelables is accounted to the operation that originated it,
+// so that i.e. N+1 reference loads show up as operations with many datastore calls.
+// OnOperation runs synchronously at the end of the operation, thus it must be fast
+type Tracer interface {
+	OnOperation(ctx context.Context, e OperationEvent)
+}
+
+// OperationEvent describes an operation run by the application
+type OperationEvent struct {
+	Operation Operation
+	// the API function called by the application, i.e. "ReadMulti"
+	Call string
+	Kind string
+	// the key of the modelable, if known. It is nil for batch operations and queries
+	Key      *datastore.Key
+	Duration time.Duration
+	// the lookups of entities in the cache, and the ones that found the entity
+	CacheLookups int
+	CacheHits    int
+	// the calls to the datastore, including the ones run for the references
+	DatastoreCalls int
+	Err            error
+}
+
+// collects the counters of an operation while it runs
+type operationSpan struct {
+	// nil if the operation is nested into another one
+	tracer Tracer
+	// the OpenTelemetry span of the operation, nil without a TracerProvider
+	otel      trace.Span
+	operation Operation
+	call      string
+	start     time.Time
+
+	cacheLookups   int64
+	cacheHits      int64
+	datastoreCalls int64
+}
+
+// starts tracing an operation if the context has a tracer or a TracerProvider.
+// Operations nested into another one, like the reads of the references, are accounted to the outer one:
+// they only get their own OpenTelemetry span, and return a nil span without a TracerProvider
+func startOperation(ctx context.Context, op Operation, call string) (context.Context, *operationSpan) {
+	span := &operationSpan{operation: op, call: call, start: time.Now()}
+	if tracer, ok := ctx.Value(keyTracer).(Tracer); ok && operationSpanFrom(ctx) == nil {
+		span.tracer = tracer
+		ctx = context.WithValue(ctx, keyOperationSpan, span)
+	}
+
+	ctx, span.otel = startSpan(ctx, "model."+call, attribute.String("model.operation", string(op)))
+
+	if span.tracer == nil && span.otel == nil {
+		return ctx, nil
+	}
+	return ctx, span
+}
+
+func operationSpanFrom(ctx context.Context) *operationSpan {
+	span, _ := ctx.Value(keyOperationSpan).(*operationSpan)
+	return span
+}
+
+// reports the operation to the tracer. subject is the modelable, the container or the query the operation ran on
+func (span *operationSpan) end(ctx context.Context, subject interface{}, err error) {
+	if span == nil {
+		return
+	}
+
+	e := OperationEvent{
+		Operation:      span.operation,
+		Call:           span.call,
+		Duration:       time.Since(span.start),
+		CacheLookups:   int(atomic.LoadInt64(&span.cacheLookups)),
+		CacheHits:      int(atomic.LoadInt64(&span.cacheHits)),
+		DatastoreCalls: int(atomic.LoadInt64(&span.datastoreCalls)),
+		Err:            err,
+	}
+
+	// the number of modelables the operation ran on, unknown for queries
+	keys := 0
+	switch x := subject.(type) {
+	case *Query:
+		if x.mType != nil {
+			e.Kind = x.mType.Name()
+		}
+	case modelable:
+		e.Kind = reflect.TypeOf(x).Elem().Name()
+		e.Key = x.getModel().Key
+		keys = 1
+	default:
+		v := reflect.ValueOf(subject)
+		for v.Kind() == reflect.Ptr {
+			v = v.Elem()
+		}
+		if v.Kind() == reflect.Slice {
+			keys = v.Len()
+		}
+
+		if t := reflect.TypeOf(subject); t != nil {
+			for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+				t = t.Elem()
+			}
+			e.Kind = t.Name()
+		}
+	}
+
+	if span.otel != nil {
+		span.otel.SetAttributes(attribute.String("model.kind", e.Kind))
+		if keys > 0 {
+			span.otel.SetAttributes(attribute.Int("model.keys", keys))
+		}
+		endSpan(span.otel, err)
+	}
+
+	if span.tracer != nil {
+		span.tracer.OnOperation(ctx, e)
+	}
+}
+
+// accounts a call to the datastore to the operation running with ctx, and to the metrics
+func countDatastoreCall(ctx context.Context, kind string, method string, keys int) {
+	if span := operationSpanFrom(ctx); span != nil {
+		atomic.AddInt64(&span.datastoreCalls, 1)
+	}
+
+	if metrics := metricsFromContext(ctx); metrics != nil {
+		metrics.DatastoreCall(kind, method, keys)
+	}
+}
+
+// accounts a lookup of an entity in the cache to the operation running with ctx, and to the metrics
+func countCacheLookup(ctx context.Context, kind string, hit bool) {
+	if span := operationSpanFrom(ctx); span != nil {
+		atomic.AddInt64(&span.cacheLookups, 1)
+		if hit {
+			atomic.AddInt64(&span.cacheHits, 1)
+		}
+	}
+
+	if metrics := metricsFromContext(ctx); metrics != nil {
+		metrics.CacheLookup(kind, hit)
+	}
+}
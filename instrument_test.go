@@ -0,0 +1,49 @@
+package model
+
+import (
+	"context"
+	"testing"
+)
+
+type recordingTracer struct {
+	events []OperationEvent
+}
+
+func (t *recordingTracer) OnOperation(ctx context.Context, e OperationEvent) {
+	t.events = append(t.events, e)
+}
+
+func TestTracer(t *testing.T) {
+	tracer := &recordingTracer{}
+	ctx := context.WithValue(context.Background(), keyTracer, tracer)
+
+	m := SingletonSettings{}
+	index(&m)
+
+	ctx, span := startOperation(ctx, OpRead, "Read")
+	countCacheLookup(ctx, "SingletonSettings", false)
+
+	// the reads of the references are accounted to the outer operation
+	nested, inner := startOperation(ctx, OpRead, "Read")
+	if inner != nil {
+		t.Fatal("expected nested operations not to be traced on their own")
+	}
+	countDatastoreCall(nested, "SingletonSettings", "Get", 1)
+	countDatastoreCall(nested, "SingletonSettings", "Get", 1)
+	inner.end(nested, &m, nil)
+
+	span.end(ctx, &m, nil)
+
+	if len(tracer.events) != 1 {
+		t.Fatalf("expected one event, got %+v", tracer.events)
+	}
+
+	e := tracer.events[0]
+	if e.Operation != OpRead || e.Call != "Read" || e.Kind != "SingletonSettings" {
+		t.Fatalf("invalid event %+v", e)
+	}
+
+	if e.CacheLookups != 1 || e.CacheHits != 0 || e.DatastoreCalls != 2 {
+		t.Fatalf("invalid counters %+v", e)
+	}
+}
@@ -0,0 +1,160 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"fmt"
+	"google.golang.org/api/iterator"
+	"reflect"
+)
+
+// number of reference keys checked with a single GetMulti
+const integrityBatchSize int = 500
+
+type ViolationType int
+
+const (
+	// the reference key points to a missing entity
+	ViolationMissing ViolationType = iota + 1
+	// the reference key points to an entity of a kind other than the one of the reference field
+	ViolationWrongKind
+	// the stored reference property is not a key
+	ViolationTypeMismatch
+)
+
+func (vt ViolationType) String() string {
+	switch vt {
+	case ViolationMissing:
+		return "missing entity"
+	case ViolationWrongKind:
+		return "wrong kind"
+	case ViolationTypeMismatch:
+		return "type mismatch"
+	}
+	return "unknown violation"
+}
+
+// Violation describes a reference of an entity breaking the referential integrity
+type Violation struct {
+	Type ViolationType
+	// key of the entity holding the reference
+	Key *datastore.Key
+	// name of the reference field
+	Field string
+	// the stored reference value
+	Value interface{}
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%s: field %s of %s holds %v", v.Type, v.Field, v.Key, v.Value)
+}
+
+// CheckIntegrity scans the entities of the given kind and reports the references
+// pointing to missing entities, to entities of the wrong kind, or not stored as keys.
+// The kind must belong to a modelable that has already been indexed.
+// Empty references are not reported.
+func CheckIntegrity(ctx context.Context, kind string) ([]Violation, error) {
+	encodedStructsMutex.RLock()
+	typ := structTypeByName(kind)
+	encodedStructsMutex.RUnlock()
+
+	if typ == nil {
+		return nil, fmt.Errorf("no modelable registered for kind %s", kind)
+	}
+
+	prototype := reflect.New(typ).Interface().(modelable)
+	index(prototype)
+
+	// maps the stored names of the reference fields to the fields and to the kinds they must point to
+	type referenceField struct {
+		name string
+		kind string
+	}
+
+	model := prototype.getModel()
+	fields := make(map[string]referenceField)
+	for _, ref := range model.references {
+		name := typ.Field(ref.idx).Name
+		stored := storedFieldNames(model.encodedStruct, []string{name})[0]
+		fields[stored] = referenceField{name: name, kind: reflect.TypeOf(ref.Modelable).Elem().Name()}
+	}
+
+	client := ClientFromContext(ctx)
+
+	var violations []Violation
+	var pending []Violation
+
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+
+		keys := make([]*datastore.Key, len(pending))
+		for i, v := range pending {
+			keys[i] = v.Value.(*datastore.Key)
+		}
+
+		dst := make([]datastore.PropertyList, len(keys))
+		err := client.GetMulti(ctx, keys, dst)
+		if merr, ok := err.(datastore.MultiError); ok {
+			for i, e := range merr {
+				if e == datastore.ErrNoSuchEntity {
+					violations = append(violations, pending[i])
+				} else if e != nil {
+					return e
+				}
+			}
+		} else if err != nil {
+			return err
+		}
+
+		pending = pending[:0]
+		return nil
+	}
+
+	it := client.Run(ctx, newDatastoreQuery(ctx, kind))
+	for {
+		var props datastore.PropertyList
+		key, err := it.Next(&props)
+		if err == iterator.Done {
+			break
+		}
+
+		if err != nil {
+			return violations, err
+		}
+
+		for _, p := range props {
+			field, ok := fields[p.Name]
+			if !ok || p.Value == nil {
+				continue
+			}
+
+			v := Violation{Key: key, Field: field.name, Value: p.Value}
+
+			rk, ok := p.Value.(*datastore.Key)
+			if !ok {
+				v.Type = ViolationTypeMismatch
+				violations = append(violations, v)
+				continue
+			}
+
+			if rk.Kind != field.kind {
+				v.Type = ViolationWrongKind
+				violations = append(violations, v)
+				continue
+			}
+
+			v.Type = ViolationMissing
+			pending = append(pending, v)
+		}
+
+		if len(pending) >= integrityBatchSize {
+			if err := flush(); err != nil {
+				return violations, err
+			}
+		}
+	}
+
+	return violations, flush()
+}
@@ -0,0 +1,47 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// stores the field as an opaque JSON blob, i.e. `model:"json"`.
+// The field is marshaled into a noindex []byte property, bypassing the struct flattening,
+// thus it can hold any data encoding/json supports, like nested maps and slices of structs
+const tagJSON string = "json"
+
+// returns the noindex property holding the JSON encoding of the field value
+func jsonProperty(name string, v reflect.Value) (datastore.Property, error) {
+	data, err := json.Marshal(v.Interface())
+	if err != nil {
+		return datastore.Property{}, fmt.Errorf("can't marshal json field %s: %w", name, err)
+	}
+	return datastore.Property{Name: name, Value: data, NoIndex: true}, nil
+}
+
+// unmarshals the JSON held by the property into the field, which is zeroed first
+func decodeJSONField(field reflect.Value, p datastore.Property) error {
+	var data []byte
+	switch x := p.Value.(type) {
+	case []byte:
+		data = x
+	case string:
+		data = []byte(x)
+	default:
+		if p.Value != nil {
+			return &PropertyError{Name: p.Name, Kind: field.Kind(), Value: p.Value, Err: ErrTypeMismatch}
+		}
+	}
+
+	field.Set(reflect.Zero(field.Type()))
+	if len(data) == 0 {
+		return nil
+	}
+
+	if err := json.Unmarshal(data, field.Addr().Interface()); err != nil {
+		return &PropertyError{Name: p.Name, Kind: field.Kind(), Value: string(data), Err: fmt.Errorf("%w: %s", ErrTypeMismatch, err.Error())}
+	}
+	return nil
+}
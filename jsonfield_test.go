@@ -0,0 +1,52 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+)
+
+type jsonPayload struct {
+	Items []string
+	Attrs map[string][]int
+}
+
+type jsonEntity struct {
+	Model
+	Name    string
+	Payload jsonPayload            `model:"json"`
+	Extra   map[string]interface{} `model:"json"`
+}
+
+func TestJSONFields(t *testing.T) {
+	src := jsonEntity{
+		Name:    "Enzo",
+		Payload: jsonPayload{Items: []string{"a"}, Attrs: map[string][]int{"x": {1, 2}}},
+		Extra:   map[string]interface{}{"k": "v"},
+	}
+	index(&src)
+
+	props, err := toPropertyList(&src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(props) != 3 {
+		t.Fatalf("expected 3 properties, got %+v", props)
+	}
+
+	for _, p := range props[1:] {
+		if _, ok := p.Value.([]byte); !ok || !p.NoIndex {
+			t.Fatalf("invalid json property %+v", p)
+		}
+	}
+
+	dst := jsonEntity{Extra: map[string]interface{}{"stale": true}}
+	index(&dst)
+	if err := fromPropertyList(&dst, props); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(dst.Payload, src.Payload) || !reflect.DeepEqual(dst.Extra, src.Extra) {
+		t.Fatalf("invalid decoded entity %+v", dst)
+	}
+}
@@ -0,0 +1,121 @@
+package model
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Warning describes a misuse of the struct tags of a modelable, found by LintModel
+type Warning struct {
+	// the name of the field, i.e. Child.Name for the fields of references and nested structs
+	Field   string
+	Message string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%s: %s", w.Field, w.Message)
+}
+
+// LintModel checks the struct tags of the modelable, of its references and of its nested structs,
+// and returns the misuses that would otherwise be silently ignored.
+// It is meant to be called by the test suites of the applications, i.e.
+//
+//	if warnings := model.LintModel(&Product{}); len(warnings) > 0 { t.Error(warnings) }
+func LintModel(m modelable) []Warning {
+	return lintStruct(reflect.TypeOf(m).Elem(), "", map[reflect.Type]bool{})
+}
+
+func lintStruct(t reflect.Type, prefix string, seen map[reflect.Type]bool) []Warning {
+	if seen[t] {
+		return nil
+	}
+	seen[t] = true
+
+	var warnings []Warning
+	warn := func(field string, format string, args ...interface{}) {
+		warnings = append(warnings, Warning{Field: prefix + field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Type == typeOfModel {
+			continue
+		}
+
+		mtag, hasModelTag := field.Tag.Lookup(tagDomain)
+		tags := strings.Split(mtag, ",")
+		isRef := field.Type.Kind() == reflect.Struct && reflect.PtrTo(field.Type).Implements(typeOfModelable)
+
+		if field.PkgPath != "" {
+			if hasModelTag || field.Tag.Get("datastore") != "" {
+				warn(field.Name, "unexported fields are not stored, their tags are ignored")
+			}
+			continue
+		}
+
+		if containsTag(tags, tagSkip) != "" {
+			if len(tags) > 1 {
+				warn(field.Name, "skipped field has other model tags, which are ignored")
+			}
+			continue
+		}
+
+		if dtag, ok := field.Tag.Lookup("datastore"); ok {
+			dtags := strings.Split(dtag, ",")
+			switch {
+			case dtags[0] == "-" && hasModelTag:
+				warn(field.Name, "datastore:\"-\" skips the field, but it has model tags")
+			case dtags[0] != "" && dtags[0] != "-":
+				warn(field.Name, "the property name %q set by the datastore tag is ignored, the property is named after the field", dtags[0])
+			}
+
+			for _, opt := range dtags[1:] {
+				if (opt == "noindex" || opt == "omitempty") && containsTag(tags, opt) == "" {
+					warn(field.Name, "datastore option %s is ignored, use model:\"%s\"", opt, opt)
+				}
+			}
+		}
+
+		if containsTag(tags, tagSearch) != "" && !isSearchableType(field.Type) {
+			warn(field.Name, "fields of type %s can't be searched", field.Type)
+		}
+
+		if source, ok := tagValue(tags, tagSlug); ok {
+			if err := checkSlugTag(t, field, source); err != nil {
+				warn(field.Name, "%s", err.Error())
+			}
+		}
+
+		if containsTag(tags, tagScoped) != "" && containsTag(tags, tagAncestor) == "" {
+			warn(field.Name, "the %s tag applies to the ancestor reference only", tagScoped)
+		}
+
+		for _, refOnly := range []string{tagZero, tagReadonly, tagAncestor} {
+			if containsTag(tags, refOnly) != "" && !isRef {
+				warn(field.Name, "the %s tag applies to references only, and %s is not a modelable", refOnly, field.Type)
+			}
+		}
+
+		if field.Type.Kind() == reflect.Struct && field.Type != typeOfTime && field.Type != typeOfGeoPoint {
+			nested := prefix
+			if !field.Anonymous {
+				nested = prefix + field.Name + valSeparator
+			}
+			warnings = append(warnings, lintStruct(field.Type, nested, seen)...)
+		}
+	}
+
+	return warnings
+}
+
+// reports whether the values of type t can be added to the search index
+func isSearchableType(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Float32, reflect.Float64:
+		return true
+	case reflect.Struct:
+		return t == typeOfTime || t == typeOfGeoPoint || reflect.PtrTo(t).Implements(typeOfModelable)
+	}
+	return false
+}
@@ -0,0 +1,37 @@
+package model
+
+import (
+	"testing"
+)
+
+type LintedReference struct {
+	Model
+	Name string
+}
+
+type LintedModel struct {
+	Model
+	Valid     string          `model:"search"`
+	Flag      bool            `model:"search"`
+	NotARef   string          `model:"zero"`
+	ReadOnly  int             `model:"readonly"`
+	hidden    string          `model:"noindex"`
+	Renamed   string          `datastore:"other"`
+	Unindexed string          `datastore:",noindex"`
+	Reference LintedReference `model:"zero"`
+}
+
+func TestLintModel(t *testing.T) {
+	warnings := LintModel(&LintedModel{})
+
+	expected := []string{"Flag", "NotARef", "ReadOnly", "hidden", "Renamed", "Unindexed"}
+	if len(warnings) != len(expected) {
+		t.Fatalf("expected %d warnings, got %v", len(expected), warnings)
+	}
+
+	for i, w := range warnings {
+		if w.Field != expected[i] {
+			t.Fatalf("warning %d is about %s, expected %s", i, w.Field, expected[i])
+		}
+	}
+}
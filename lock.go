@@ -0,0 +1,78 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+const lockKind string = "_ModelLock"
+
+var ErrLocked = errors.New("lock is held by someone else")
+
+// the entity holding a lock. The lock is free once expired
+type lockEntity struct {
+	Owner   string
+	Expires time.Time
+}
+
+// Lock acquires the lock with the given name, shared by all the instances of the application.
+// The lock is held until the returned release function is called, or until ttl expires:
+// ttl must exceed the duration of the work done while holding the lock.
+// Returns ErrLocked if the lock is held by someone else
+func Lock(ctx context.Context, name string, ttl time.Duration) (release func() error, err error) {
+	owner := make([]byte, 16)
+	if _, err := rand.Read(owner); err != nil {
+		return nil, err
+	}
+	id := hex.EncodeToString(owner)
+
+	key := datastore.NameKey(lockKind, name, nil)
+	client := ClientFromContext(ctx)
+	_, err = client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var held lockEntity
+		err := tx.Get(key, &held)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		if err == nil && time.Now().Before(held.Expires) {
+			return ErrLocked
+		}
+
+		_, err = tx.Put(key, &lockEntity{Owner: id, Expires: time.Now().Add(ttl)})
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		return unlock(ctx, key, id)
+	}, nil
+}
+
+// releases the lock, unless it has expired and has been acquired by someone else meanwhile
+func unlock(ctx context.Context, key *datastore.Key, owner string) error {
+	client := ClientFromContext(ctx)
+	_, err := client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var held lockEntity
+		if err := tx.Get(key, &held); err != nil {
+			if err == datastore.ErrNoSuchEntity {
+				return nil
+			}
+			return err
+		}
+
+		if held.Owner != owner {
+			return nil
+		}
+
+		return tx.Delete(key)
+	})
+	return err
+}
@@ -0,0 +1,11 @@
+package model
+
+import (
+	"context"
+	"log"
+)
+
+// logs a warning to the standard logger
+func warningf(ctx context.Context, format string, args ...interface{}) {
+	log.Printf("WARNING: "+format, args...)
+}
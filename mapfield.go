@@ -0,0 +1,100 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Map fields are fields of type map[string]T, where T is a string, a bool, a number or a time.Time.
+// Each entry is stored as a property on its own, named after the field and the key: "Field.key".
+// Maps of other types are not stored.
+
+// checks if the type is a map the property codec can store
+func isMapField(t reflect.Type) bool {
+	if t.Kind() != reflect.Map || t.Key().Kind() != reflect.String {
+		return false
+	}
+
+	et := t.Elem()
+	if et == typeOfTime {
+		return true
+	}
+
+	switch et.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Bool, reflect.String, reflect.Float32, reflect.Float64:
+		return true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+// returns the properties of the entries of the map value, sorted by key
+func mapProperties(name string, v reflect.Value, noIndex bool) ([]datastore.Property, error) {
+	keys := make([]string, 0, v.Len())
+	for _, k := range v.MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+
+	props := make([]datastore.Property, 0, len(keys))
+	for _, k := range keys {
+		p := datastore.Property{Name: referenceName(name, k), NoIndex: noIndex}
+		ev := v.MapIndex(reflect.ValueOf(k).Convert(v.Type().Key()))
+		switch ev.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			p.Value = ev.Int()
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			x, err := uintValue(p.Name, ev)
+			if err != nil {
+				return nil, err
+			}
+			p.Value = x
+		case reflect.Bool:
+			p.Value = ev.Bool()
+		case reflect.String:
+			p.Value = ev.String()
+		case reflect.Float32, reflect.Float64:
+			p.Value = ev.Float()
+		default:
+			p.Value = ev.Interface().(time.Time)
+		}
+		props = append(props, p)
+	}
+	return props, nil
+}
+
+// returns the name of the map field the property belongs to, if any
+func mapFieldOf(s *encodedStruct, name string) (encodedField, bool) {
+	i := strings.Index(name, valSeparator)
+	if i <= 0 {
+		return encodedField{}, false
+	}
+
+	attr, ok := s.fieldNames[name[:i]]
+	return attr, ok && attr.isMap
+}
+
+// sets the entry of the map field held by the property
+func decodeMapEntry(field reflect.Value, p datastore.Property) error {
+	key := childName(p.Name)
+	ev := reflect.New(field.Type().Elem()).Elem()
+	if ev.Type() == typeOfTime {
+		x, ok := p.Value.(time.Time)
+		if !ok && p.Value != nil {
+			return &PropertyError{Name: p.Name, Kind: ev.Kind(), Value: p.Value, Err: ErrTypeMismatch}
+		}
+		ev.Set(reflect.ValueOf(x))
+	} else if err := decodeField(ev, p); err != nil {
+		return err
+	}
+
+	if field.IsNil() {
+		field.Set(reflect.MakeMap(field.Type()))
+	}
+	field.SetMapIndex(reflect.ValueOf(key).Convert(field.Type().Key()), ev)
+	return nil
+}
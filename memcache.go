@@ -3,19 +3,13 @@ package model
 import (
 	"cloud.google.com/go/datastore"
 	"context"
-	"google.golang.org/appengine/memcache"
+	"errors"
 	//"log"
 	"fmt"
-	"reflect"
 )
 
 type KeyMap map[int]string
 
-type cacheModel struct {
-	Modelable modelable
-	Keys      KeyMap
-}
-
 //checks if cache Key is valid
 //as per documentation Key max length is set at 250 bytes
 func validCacheKey(Key string) bool {
@@ -24,6 +18,50 @@ func validCacheKey(Key string) bool {
 	return valid
 }
 
+// ErrStaleReference is returned when the key of a reference model
+// doesn't match the key its parent holds for the reference
+type ErrStaleReference struct {
+	// index of the reference field in the parent struct
+	Index int
+	// key of the reference model
+	ModelKey *datastore.Key
+	// key held by the parent
+	ReferenceKey *datastore.Key
+}
+
+func (e *ErrStaleReference) Error() string {
+	return fmt.Sprintf("stale reference at field index %d: reference key %v doesn't match model key %v", e.Index, e.ReferenceKey, e.ModelKey)
+}
+
+//Saves the modelable to memcache.
+//If a stale reference is found, the reference keys are realigned with the keys of their models
+//and the save is attempted once more
+func saveInMemcacheRepairing(ctx context.Context, m modelable) error {
+	err := saveInMemcache(ctx, m)
+
+	stale := &ErrStaleReference{}
+	if !errors.As(err, &stale) {
+		return err
+	}
+
+	index(m)
+	alignReferenceKeys(m)
+	return saveInMemcache(ctx, m)
+}
+
+//recursively sets the keys held by the parents to the keys of the reference models
+func alignReferenceKeys(m modelable) {
+	model := m.getModel()
+	for i, ref := range model.references {
+		rm := ref.Modelable.getModel()
+		if rm.readonly {
+			continue
+		}
+		alignReferenceKeys(ref.Modelable)
+		model.references[i].Key = rm.Key
+	}
+}
+
 //Saves the modelable representation and all related references to memcache.
 //It assumes that there are no stale references
 func saveInMemcache(ctx context.Context, m modelable) (err error) {
@@ -40,11 +78,14 @@ func saveInMemcache(ctx context.Context, m modelable) (err error) {
 		// return fmt.Errorf("no key registered for modelable %s. Can't save in memcache", model.structName)
 	}
 
-	i := memcache.Item{}
-	i.Key = model.EncodedKey()
+	if cacheOptionsOf(model.Key.Kind).Disabled || model.unresolved {
+		return nil
+	}
+
+	cKey := cacheKey(model.Key)
 
-	if !validCacheKey(i.Key) {
-		return fmt.Errorf("cacheModel box Key %s is too long", i.Key)
+	if !validCacheKey(cKey) {
+		return fmt.Errorf("cacheModel box Key %s is too long", cKey)
 	}
 
 	keyMap := make(KeyMap)
@@ -62,8 +103,8 @@ func saveInMemcache(ctx context.Context, m modelable) (err error) {
 			// return fmt.Errorf("can't save to memcache. reference model Key is nil for reference: %+v", ref)
 		}
 
-		if rm.Key != ref.Key {
-			return fmt.Errorf("can't save to memcache. Key of the model doesn't equal the Key of the reference for reference %+v", ref)
+		if !rm.Key.Equal(ref.Key) {
+			return &ErrStaleReference{Index: ref.idx, ModelKey: rm.Key, ReferenceKey: ref.Key}
 		}
 
 		err = saveInMemcache(ctx, r)
@@ -77,12 +118,19 @@ func saveInMemcache(ctx context.Context, m modelable) (err error) {
 		}
 	}
 
-	box := cacheModel{Keys: keyMap}
-	box.Modelable = m
-	i.Object = box
+	props, err := encodeProperties(m)
+	if err != nil {
+		return err
+	}
 
-	err = memcache.Gob.Set(ctx, &i)
+	data, err := encodeCacheEntry(model.encodedStruct, keyMap, props)
+	if err != nil {
+		return err
+	}
 
+	done := traceCacheCall(ctx, "Set", model.Key.Kind)
+	err = setCached(ctx, model.Key, data)
+	done(err)
 	return err
 }
 
@@ -94,22 +142,44 @@ func loadFromMemcache(ctx context.Context, m modelable) (err error) {
 		// return fmt.Errorf("no Key registered from modelable %s. Can't load from memcache", model.structName)
 	}
 
-	cKey := model.EncodedKey()
+	if cacheOptionsOf(model.Key.Kind).Disabled {
+		return ErrCacheMiss
+	}
+
+	cKey := cacheKey(model.Key)
 
 	if !validCacheKey(cKey) {
 		return fmt.Errorf("cacheModel box Key %s is too long", cKey)
 	}
 
-	box := cacheModel{Keys: make(map[int]string), Modelable: m}
+	done := traceCacheCall(ctx, "Get", model.Key.Kind)
+	data, err := cacheFromContext(ctx).Get(ctx, cKey)
+	countCacheLookup(ctx, model.Key.Kind, err == nil)
+	done(err)
 
-	_, err = memcache.Gob.Get(ctx, cKey, &box)
+	if err != nil {
+		return err
+	}
+
+	keys, props, err := decodeCacheEntry(model.encodedStruct, data)
+	if errors.Is(err, errStaleCacheEntry) {
+		// the entry has been written by another version of the struct: it is discarded
+		if err := cacheFromContext(ctx).Delete(ctx, cKey); err != nil && err != ErrCacheMiss {
+			warningf(ctx, "error deleting stale cache entry %s: %s", cKey, err.Error())
+		}
+		return ErrCacheMiss
+	}
 
 	if err != nil {
 		return err
 	}
 
+	if err = fromPropertyList(m, props); err != nil {
+		return err
+	}
+
 	for _, ref := range model.references {
-		if encodedKey, ok := box.Keys[ref.idx]; ok {
+		if encodedKey, ok := keys[ref.idx]; ok {
 			decodedKey, err := datastore.DecodeKey(encodedKey)
 			if err != nil {
 				return err
@@ -124,38 +194,14 @@ func loadFromMemcache(ctx context.Context, m modelable) (err error) {
 				return err
 			}
 			ref.Key = decodedKey
-			//assign the reference values to the box struct.
-			//this needs to be done so that the passing modelable is updated
-			field := reflect.Indirect(reflect.ValueOf(box.Modelable)).Field(ref.idx)
-			src := reflect.Indirect(reflect.ValueOf(r))
-			field.Set(src)
 		} else {
 			// there is no reference saved at the given key: we could be in readonly.
 			// return an error and retrieve the item from datastore
-			return memcache.ErrCacheMiss
+			return ErrCacheMiss
 		}
 	}
 
-	//if there are no error we assign the value recovered from memcache to the modelable
-	defer func(error) {
-		if err == nil {
-			modValue := reflect.ValueOf(*model)
-			dstValue := reflect.Indirect(reflect.ValueOf(m))
-			srcValue := reflect.Indirect(reflect.ValueOf(box.Modelable))
-			dstValue.Set(srcValue)
-			//set model to the modelable Model Field
-			for i := 0; i < dstValue.NumField(); i++ {
-				field := dstValue.Field(i)
-				fieldType := field.Type()
-				if fieldType == typeOfModel {
-					field.Set(modValue)
-					break
-				}
-			}
-		}
-	}(err)
-
-	return err
+	return nil
 }
 
 func deleteFromMemcache(ctx context.Context, m modelable) (err error) {
@@ -179,7 +225,7 @@ func deleteFromMemcache(ctx context.Context, m modelable) (err error) {
 		ref.Key = nil
 	}
 
-	cKey := model.EncodedKey()
+	cKey := cacheKey(model.Key)
 	if !validCacheKey(cKey) {
 		return fmt.Errorf("cacheModel box Key %s is too long", cKey)
 	}
@@ -190,5 +236,8 @@ func deleteFromMemcache(ctx context.Context, m modelable) (err error) {
 		}
 	}(err)
 
-	return memcache.Delete(ctx, cKey)
+	done := traceCacheCall(ctx, "Delete", model.Key.Kind)
+	err = cacheFromContext(ctx).Delete(ctx, cKey)
+	done(err)
+	return err
 }
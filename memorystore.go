@@ -0,0 +1,107 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// environment variables holding the address of the Memorystore for Redis instance,
+// as configured for the App Engine second generation runtimes
+const (
+	envRedisHost string = "REDISHOST"
+	envRedisPort string = "REDISPORT"
+)
+
+// selects the cache of the service when none is set with Service.WithCache.
+// It eases the migration from the legacy runtime: "memcache" keeps using AppEngineCache,
+// "memorystore" switches to a MemorystoreCache, anything else uses the in-memory cache
+const envCacheBackend string = "MODEL_CACHE"
+
+// maximum size of a value stored by memcache
+const memcacheMaxValueSize int = 1 << 20
+
+var ErrCacheKeyTooLong = errors.New("cache key longer than 250 bytes")
+var ErrCacheValueTooLarge = errors.New("cache value larger than 1MB")
+
+// MemorystoreCache is a Cache backed by a Memorystore for Redis instance, with the semantics of the legacy App Engine memcache:
+// keys longer than 250 bytes and values larger than 1MB are rejected, and items can expire.
+// It replaces AppEngineCache on the second generation runtimes, where memcache is not available
+type MemorystoreCache struct {
+	redis *RedisCache
+	// if positive, the items are evicted once expired
+	expiration time.Duration
+}
+
+// returns a cache connecting to the Memorystore instance set by the REDISHOST and REDISPORT environment variables.
+// The port defaults to 6379. Items expire after expiration, or never if expiration is not positive
+func NewMemorystoreCache(expiration time.Duration) (*MemorystoreCache, error) {
+	host := os.Getenv(envRedisHost)
+	if host == "" {
+		return nil, fmt.Errorf("missing memorystore host: %s is not set", envRedisHost)
+	}
+
+	port := os.Getenv(envRedisPort)
+	if port == "" {
+		port = "6379"
+	}
+
+	return &MemorystoreCache{redis: NewRedisCache(net.JoinHostPort(host, port), 8), expiration: expiration}, nil
+}
+
+func (c *MemorystoreCache) Get(ctx context.Context, key string) ([]byte, error) {
+	if !validCacheKey(key) {
+		return nil, ErrCacheKeyTooLong
+	}
+	return c.redis.Get(ctx, key)
+}
+
+func (c *MemorystoreCache) Set(ctx context.Context, key string, value []byte) error {
+	if !validCacheKey(key) {
+		return ErrCacheKeyTooLong
+	}
+
+	if len(value) > memcacheMaxValueSize {
+		return ErrCacheValueTooLarge
+	}
+
+	return c.redis.SetWithTTL(ctx, key, value, c.expiration)
+}
+
+// Sets the value of the key, which expires after ttl instead of the expiration of the cache
+func (c *MemorystoreCache) SetWithTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if !validCacheKey(key) {
+		return ErrCacheKeyTooLong
+	}
+
+	if len(value) > memcacheMaxValueSize {
+		return ErrCacheValueTooLarge
+	}
+
+	return c.redis.SetWithTTL(ctx, key, value, ttl)
+}
+
+func (c *MemorystoreCache) Delete(ctx context.Context, key string) error {
+	if !validCacheKey(key) {
+		return ErrCacheKeyTooLong
+	}
+	return c.redis.Delete(ctx, key)
+}
+
+// returns the cache selected by the MODEL_CACHE environment variable, or nil for the in-memory cache
+func cacheFromEnv() Cache {
+	switch os.Getenv(envCacheBackend) {
+	case "memcache":
+		return AppEngineCache{}
+	case "memorystore":
+		c, err := NewMemorystoreCache(0)
+		if err != nil {
+			panic(fmt.Errorf("error initializing the memorystore cache: %s", err.Error()))
+		}
+		return c
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package model
+
+import (
+	"context"
+	"expvar"
+)
+
+const keyMetrics = "__model_metrics"
+
+// Metrics receives the counters of the work done by the operations, by kind, i.e. to feed a monitoring system.
+// The methods are called synchronously and concurrently by the requests, thus they must be fast and thread safe.
+// See ExpvarMetrics for an implementation publishing the counters with the expvar package
+type Metrics interface {
+	// a lookup of an entity in the cache, and whether the entity was found
+	CacheLookup(kind string, hit bool)
+	// a call to the datastore, i.e. "Get", "PutMulti" or "RunQuery", and the number of keys it involved, if known
+	DatastoreCall(kind string, method string, keys int)
+	// the entities returned by a query
+	QueryResults(kind string, entities int)
+	// a call to the search backend, one of "Put", "Delete" and "Query"
+	SearchCall(kind string, method string)
+}
+
+func metricsFromContext(ctx context.Context) Metrics {
+	metrics, _ := ctx.Value(keyMetrics).(Metrics)
+	return metrics
+}
+
+func countQueryResults(ctx context.Context, kind string, entities int) {
+	if metrics := metricsFromContext(ctx); metrics != nil {
+		metrics.QueryResults(kind, entities)
+	}
+}
+
+func countSearchCall(ctx context.Context, kind string, method string) {
+	if metrics := metricsFromContext(ctx); metrics != nil {
+		metrics.SearchCall(kind, method)
+	}
+}
+
+// ExpvarMetrics publishes the counters as an expvar map, served at /debug/vars along with the other variables.
+// The map holds a counter for each kind and event, named after them, i.e.
+// "Order.cache.hit", "Order.cache.miss", "Order.datastore.Get", "Order.datastore.Get.keys",
+// "Order.query.entities" and "Order.search.Query"
+type ExpvarMetrics struct {
+	counters *expvar.Map
+}
+
+// Publishes the counters under the given name, which must be unique among the expvar variables
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	return &ExpvarMetrics{counters: expvar.NewMap(name)}
+}
+
+func (m *ExpvarMetrics) CacheLookup(kind string, hit bool) {
+	if hit {
+		m.counters.Add(kind+".cache.hit", 1)
+		return
+	}
+	m.counters.Add(kind+".cache.miss", 1)
+}
+
+func (m *ExpvarMetrics) DatastoreCall(kind string, method string, keys int) {
+	m.counters.Add(kind+".datastore."+method, 1)
+	if keys > 0 {
+		m.counters.Add(kind+".datastore."+method+".keys", int64(keys))
+	}
+}
+
+func (m *ExpvarMetrics) QueryResults(kind string, entities int) {
+	m.counters.Add(kind+".query.entities", int64(entities))
+}
+
+func (m *ExpvarMetrics) SearchCall(kind string, method string) {
+	m.counters.Add(kind+".search."+method, 1)
+}
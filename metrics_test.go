@@ -0,0 +1,33 @@
+package model
+
+import (
+	"context"
+	"testing"
+)
+
+func TestExpvarMetrics(t *testing.T) {
+	metrics := NewExpvarMetrics("model_test_metrics")
+	ctx := context.WithValue(context.Background(), keyMetrics, Metrics(metrics))
+
+	countCacheLookup(ctx, "Order", true)
+	countCacheLookup(ctx, "Order", false)
+	countCacheLookup(ctx, "Order", false)
+	countDatastoreCall(ctx, "Order", "GetMulti", 20)
+	countDatastoreCall(ctx, "Order", "GetMulti", 5)
+	countQueryResults(ctx, "Order", 25)
+
+	expected := map[string]string{
+		"Order.cache.hit":               "1",
+		"Order.cache.miss":              "2",
+		"Order.datastore.GetMulti":      "2",
+		"Order.datastore.GetMulti.keys": "25",
+		"Order.query.entities":          "25",
+	}
+
+	for name, value := range expected {
+		v := metrics.counters.Get(name)
+		if v == nil || v.String() != value {
+			t.Fatalf("expected counter %s to be %s, got %v", name, value, v)
+		}
+	}
+}
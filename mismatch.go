@@ -0,0 +1,78 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+const keyIgnoreMismatch = "__model_ignore_mismatch"
+
+var lenientMutex sync.Mutex
+var lenientTypes = map[reflect.Type]bool{}
+
+// SetLenientLoading makes the loads of the given modelable type tolerant to schema drift.
+// The properties that can't be converted to their field, i.e. an int stored into a now string field,
+// are skipped and reported by a *FieldMismatchError, while all the other fields are loaded
+func SetLenientLoading(m modelable, lenient bool) {
+	t := reflect.TypeOf(m).Elem()
+	lenientMutex.Lock()
+	lenientTypes[t] = lenient
+	lenientMutex.Unlock()
+}
+
+func isLenient(t reflect.Type) bool {
+	lenientMutex.Lock()
+	defer lenientMutex.Unlock()
+	return lenientTypes[t]
+}
+
+// FieldMismatch describes a property that could not be loaded into its field
+type FieldMismatch struct {
+	Property string
+	Err      error
+}
+
+// FieldMismatchError reports the properties skipped by a lenient load.
+// The modelable holds all the other properties.
+// It matches a *datastore.ErrFieldMismatch describing the first mismatch, thus code
+// written for the official datastore library handles it the same way
+type FieldMismatchError struct {
+	StructName string
+	StructType reflect.Type
+	Fields     []FieldMismatch
+}
+
+func (e *FieldMismatchError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = fmt.Sprintf("%s: %s", f.Property, f.Err.Error())
+	}
+	return fmt.Sprintf("cannot load properties of %s: %s", e.StructName, strings.Join(msgs, "; "))
+}
+
+func (e *FieldMismatchError) As(target interface{}) bool {
+	t, ok := target.(**datastore.ErrFieldMismatch)
+	if !ok || len(e.Fields) == 0 {
+		return false
+	}
+
+	*t = &datastore.ErrFieldMismatch{StructType: e.StructType, FieldName: e.Fields[0].Property, Reason: e.Fields[0].Err.Error()}
+	return true
+}
+
+// reports whether err describes properties that could not be loaded
+func isFieldMismatch(err error) bool {
+	var fm *datastore.ErrFieldMismatch
+	return errors.As(err, &fm)
+}
+
+// reports whether the reads running with ctx skip the properties that can't be loaded
+func ignoresFieldMismatch(ctx context.Context) bool {
+	ignore, _ := ctx.Value(keyIgnoreMismatch).(bool)
+	return ignore || defaultsFromContext(ctx).LenientLoading
+}
@@ -0,0 +1,68 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type driftedEntity struct {
+	Model
+	Name  string
+	Count int
+}
+
+func TestLenientLoading(t *testing.T) {
+	props := []datastore.Property{
+		{Name: "Name", Value: "Enzo"},
+		{Name: "Count", Value: "three"},
+	}
+
+	strict := driftedEntity{}
+	index(&strict)
+	if err := fromPropertyList(&strict, props); err == nil {
+		t.Fatal("expected a strict load to fail")
+	}
+
+	SetLenientLoading(&driftedEntity{}, true)
+	defer SetLenientLoading(&driftedEntity{}, false)
+
+	lenient := driftedEntity{}
+	index(&lenient)
+	err := fromPropertyList(&lenient, props)
+
+	var merr *FieldMismatchError
+	if !errors.As(err, &merr) {
+		t.Fatalf("expected a FieldMismatchError, got %v", err)
+	}
+
+	if len(merr.Fields) != 1 || merr.Fields[0].Property != "Count" {
+		t.Fatalf("invalid mismatches %+v", merr.Fields)
+	}
+
+	if lenient.Name != "Enzo" {
+		t.Fatalf("expected the other fields to be loaded, got %+v", lenient)
+	}
+}
+
+func TestFieldMismatchCompatibility(t *testing.T) {
+	err := error(&FieldMismatchError{
+		StructName: "driftedEntity",
+		StructType: reflect.TypeOf(driftedEntity{}),
+		Fields:     []FieldMismatch{{Property: "Count", Err: errors.New("type mismatch")}},
+	})
+
+	var fm *datastore.ErrFieldMismatch
+	if !errors.As(err, &fm) {
+		t.Fatalf("expected a datastore.ErrFieldMismatch, got %v", err)
+	}
+
+	if fm.FieldName != "Count" || fm.StructType != reflect.TypeOf(driftedEntity{}) {
+		t.Fatalf("invalid field mismatch %+v", fm)
+	}
+
+	if !isFieldMismatch(err) || isFieldMismatch(errors.New("other")) {
+		t.Fatal("invalid field mismatch detection")
+	}
+}
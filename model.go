@@ -13,8 +13,16 @@ const valSeparator string = "."
 const tagDomain string = "model"
 const tagNoindex string = "noindex"
 const tagZero string = "zero"
+
+// Skips writing the field when it holds its zero value, sparing its index writes.
+// A missing property is loaded as the zero value of the field
+const tagOmitEmpty string = "omitempty"
 const tagAncestor string = "ancestor"
 
+// Scopes the queries built from a modelable to the ancestor held by its ancestor reference, if the ancestor has a key.
+// i.e. with a field Post Post `model:"ancestor,scoped"`, NewQuery(&Comment{Post: post}) only finds the comments of post
+const tagScoped string = "scoped"
+
 // Indicates that the given reference is "readonly"
 // That is, it is provided from outside of the model
 // An example would be the product model on a purchase model:
@@ -57,6 +65,30 @@ type Model struct {
 	Key *datastore.Key `model:"-"`
 	//the embedding modelable
 	modelable modelable `model:"-"`
+
+	//if not nil, only the properties of the listed fields are indexed on save
+	indexOnly []string `model:"-"`
+
+	//the properties of the excluded fields are not encoded on save:
+	//the stored properties of the fields, if any, are written instead
+	exclude []string             `model:"-"`
+	merged  []datastore.Property `model:"-"`
+
+	//if true, the properties that can't be loaded are skipped, as SetLenientLoading does
+	lenient bool `model:"-"`
+
+	//if not nil, the saved and loaded properties are recorded in the trace
+	trace *PropertyTrace `model:"-"`
+
+	//if true, the type of an extension couldn't be resolved on load.
+	//The modelable is not cached, so that it is decoded again once the type is registered
+	unresolved bool `model:"-"`
+
+	//the stored properties of the extensions whose type couldn't be resolved, by field index
+	rawExtensions map[int]*RawExtension `model:"-"`
+
+	//the hashes of the properties of the fields when loaded or last saved, to detect the modified fields
+	fingerprints map[string]uint64 `model:"-"`
 }
 
 func (model *Model) getModel() *Model {
@@ -124,7 +156,7 @@ func FromIntID(ctx context.Context, m modelable, id int64, ancestor modelable) e
 		ancKey = ancestor.getModel().Key
 	}
 
-	model.Key = datastore.IDKey(model.structName, id, ancKey)
+	model.Key = namespacedKey(ctx, datastore.IDKey(model.structName, id, ancKey))
 	return Read(ctx, m)
 }
 
@@ -145,7 +177,7 @@ func FromStringID(ctx context.Context, m modelable, id string, ancestor modelabl
 		ancKey = ancestor.getModel().Key
 	}
 
-	model.Key = datastore.NameKey(model.structName, id, ancKey)
+	model.Key = namespacedKey(ctx, datastore.NameKey(model.structName, id, ancKey))
 	return Read(ctx, m)
 }
 
@@ -194,10 +226,41 @@ func (model Model) EncodedKey() string {
 }
 
 func (model *Model) Save() ([]datastore.Property, error) {
-	return toPropertyList(model.modelable)
+	props, err := toPropertyList(model.modelable)
+	if err != nil {
+		return nil, err
+	}
+
+	if model.exclude != nil {
+		kept := props[:0]
+		for _, p := range props {
+			if !isPropertyOf(p.Name, storedFieldNames(model.encodedStruct, model.exclude)) {
+				kept = append(kept, p)
+			}
+		}
+		props = append(kept, model.merged...)
+	}
+
+	props, err = stampModified(model.modelable, props)
+	if err != nil {
+		return nil, err
+	}
+
+	if model.indexOnly != nil {
+		applyIndexOnly(props, storedFieldNames(model.encodedStruct, model.indexOnly))
+	}
+
+	if model.trace != nil {
+		model.trace.record("save", model.modelable, props)
+	}
+
+	return props, nil
 }
 
 func (model *Model) Load(props []datastore.Property) error {
+	if model.trace != nil {
+		model.trace.record("load", model.modelable, props)
+	}
 	return fromPropertyList(model.modelable, props)
 }
 
@@ -212,8 +275,6 @@ func (model *Model) Load(props []datastore.Property) error {
 func index(m modelable) {
 	mType := reflect.TypeOf(m).Elem()
 	obj := reflect.ValueOf(m).Elem()
-	//retrieve modelable anagraphics
-	name := mType.Name()
 
 	model := m.getModel()
 	key := model.Key
@@ -230,13 +291,10 @@ func index(m modelable) {
 	model.Key = key
 
 	//we assign the structure to the model.
-	//if we already mapped the same struct earlier we get it from the cache
-	if enStruct, ok := encodedStructs[mType]; ok {
-		model.structure.encodedStruct = enStruct
-	} else {
-		//we didn't map the structure earlier on. Map it now
-		model.structure.encodedStruct = newEncodedStruct(name)
-		mapStructure(mType, model.structure.encodedStruct)
+	//if we already mapped the same struct earlier we get it from the cache, else we map it now.
+	//The structure can be shared with a stale copy of the model, thus it is written only if it changes
+	if es := encodedStructFor(mType); model.structure.encodedStruct != es {
+		model.structure.encodedStruct = es
 	}
 
 	hasAncestor := false
@@ -248,10 +306,11 @@ func index(m modelable) {
 			continue
 		}
 
-		et := ef.Elem().Type().Elem()
-		if _, ok := encodedStructs[et]; !ok {
-			mapStructure(et, newEncodedStruct(et.Name()))
+		if _, ok := ef.Interface().(*RawExtension); ok {
+			continue
 		}
+
+		encodedStructFor(ef.Elem().Type().Elem())
 	}
 
 	if model.references == nil {
@@ -329,6 +388,15 @@ func index(m modelable) {
 	m.setModel(*model)
 }
 
+// returns a wrapped context error if ctx is done, to stop walking the tree of the modelable
+// before issuing more datastore calls
+func treeCanceled(ctx context.Context, m modelable) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("walk of the references of %s aborted: %w", m.getModel().Name(), err)
+	}
+	return nil
+}
+
 // Returns a pointer to the Model the container is holding
 func modelOf(src interface{}) *Model {
 	m, ok := src.(modelable)
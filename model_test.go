@@ -1,6 +1,9 @@
 package model
 
 import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"errors"
 	"fmt"
 	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/memcache"
@@ -147,6 +150,61 @@ func TestUpdate(t *testing.T) {
 	}
 }
 
+func TestReadWithRepair(t *testing.T) {
+	done, ctx := newContextWithStartupTime(t, 60)
+	defer done()
+
+	service := Service{}
+	service.Initialize()
+
+	ctx = service.OnStart(ctx)
+	defer service.OnEnd(ctx)
+
+	resetDatastoreEmulator(t)
+
+	entity := Entity{}
+	entity.Child.Name = "cached"
+	if err := Create(ctx, &entity); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	stored := Child{Name: "stored"}
+	if err := Create(ctx, &stored); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the stored entity points to another child than the cached one
+	client := ClientFromContext(ctx)
+	var props datastore.PropertyList
+	if err := client.Get(ctx, entity.Key, &props); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for i := range props {
+		if props[i].Name == "Child" {
+			props[i].Value = stored.Key
+		}
+	}
+
+	if _, err := client.Put(ctx, entity.Key, &props); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the repair is applied without a transaction as well
+	read := Entity{}
+	index(&read)
+	read.Key = entity.Key
+	opts := NewReadOptions()
+	opts.WithRepair()
+	if err := ReadWithOptions(ctx, &read, &opts); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if read.Child.Name != "stored" || !read.Child.Key.Equal(stored.Key) {
+		t.Fatalf("the child has not been repaired: %s with key %v", read.Child.Name, read.Child.Key)
+	}
+}
+
 func TestDelete(t *testing.T) {
 
 	done, ctx := newContextWithStartupTime(t, 60)
@@ -309,3 +367,37 @@ func BenchmarkReindexing(b *testing.B) {
 		index(&entity)
 	}
 }
+
+func TestEstimateCost(t *testing.T) {
+	entity := Entity{}
+	entity.Name = "entity"
+
+	cost, err := EstimateCost(&entity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// entity, child and grandchild: the empty child and the readonly child are not written
+	if cost.Entities != 3 {
+		t.Fatalf("invalid number of entities: %d, expected 3", cost.Entities)
+	}
+
+	if cost.Writes != 2*cost.Entities+2*cost.IndexedValues {
+		t.Fatalf("invalid number of writes %d for %d indexed values", cost.Writes, cost.IndexedValues)
+	}
+}
+
+func TestTreeCanceled(t *testing.T) {
+	entity := Entity{}
+	index(&entity)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := treeCanceled(ctx, &entity); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	cancel()
+	if err := treeCanceled(ctx, &entity); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected a wrapped context.Canceled, got %v", err)
+	}
+}
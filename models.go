@@ -2,11 +2,9 @@ package model
 
 import (
 	"cloud.google.com/go/datastore"
+	"context"
 	"errors"
 	"fmt"
-	"golang.org/x/net/context"
-	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/memcache"
 	"reflect"
 )
 
@@ -14,8 +12,79 @@ import (
 //Can't be run in a transaction because of too many entities group.
 //It can return a datastore multierror.
 //todo: EXPERIMENTAL - USE AT OWN RISK
-func ReadMulti(ctx context.Context, dst interface{}) error {
-	return readMulti(ctx, dst)
+func ReadMulti(ctx context.Context, dst interface{}) (err error) {
+	ctx, span := startOperation(ctx, OpRead, "ReadMulti")
+	defer func() { span.end(ctx, dst, err) }()
+
+	ctx = withHookContext(ctx, OpRead, "ReadMulti", false, true)
+	if err := readMulti(ctx, dst); err != nil {
+		return err
+	}
+
+	ms, err := modelablesOf(dst)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range ms {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if m.getModel().Key == nil {
+			continue
+		}
+		if err := afterLoad(ctx, m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// maximum number of entities written or deleted by a single datastore batch call
+const multiBatchSize int = 500
+
+// returns the modelables held by a slice, or by a pointer to a slice, of modelables
+func modelablesOf(src interface{}) ([]modelable, error) {
+	v := reflect.ValueOf(src)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+
+	if v.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("invalid container: container kind must be slice. Kind %s provided", v.Kind())
+	}
+
+	ms := make([]modelable, v.Len())
+	for i := range ms {
+		m, ok := v.Index(i).Interface().(modelable)
+		if !ok {
+			return nil, fmt.Errorf("invalid container of type %s. Container must be a slice of modelables", v.Type())
+		}
+		ms[i] = m
+	}
+
+	return ms, nil
+}
+
+// copies the errors of a batch starting at offset into merr, which is aligned to the whole input.
+// Returns true if the batch failed
+func collectMultiError(merr datastore.MultiError, err error, offset int, n int) bool {
+	if err == nil {
+		return false
+	}
+
+	if berr, ok := err.(datastore.MultiError); ok {
+		for i, e := range berr {
+			merr[offset+i] = e
+		}
+		return true
+	}
+
+	for i := 0; i < n; i++ {
+		merr[offset+i] = err
+	}
+	return true
 }
 
 type source byte
@@ -56,6 +125,10 @@ func readMulti(ctx context.Context, dst interface{}) error {
 	destination := reflect.MakeSlice(collection.Type(), 0, collection.Cap())
 
 	for i := 0; i < l; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		mble, ok := collection.Index(i).Interface().(modelable)
 		if !ok {
 			return fmt.Errorf("invalid container of type %s. Container must be a slice of modelables", collection.Elem().Type().Name())
@@ -68,8 +141,8 @@ func readMulti(ctx context.Context, dst interface{}) error {
 			continue
 		}
 
-		if err != memcache.ErrCacheMiss {
-			log.Warningf(ctx, "error retrieving model %s from memcache: %s", mble.getModel().Name(), err.Error())
+		if err != ErrCacheMiss {
+			warningf(ctx, "error retrieving model %s from memcache: %s", mble.getModel().Name(), err.Error())
 		}
 
 		// we have an empty ref, skip it
@@ -85,8 +158,10 @@ func readMulti(ctx context.Context, dst interface{}) error {
 	di := destination.Interface()
 	// we retrieved everything from memcache, no need to call datastore
 	if len(keys) > 0 {
+		done := traceDatastoreCall(ctx, "GetMulti", keys[0].Kind, len(keys))
 		client := ClientFromContext(ctx)
 		err := client.GetMulti(ctx, keys, di)
+		done(err)
 
 		if err != nil {
 			return err
@@ -94,6 +169,10 @@ func readMulti(ctx context.Context, dst interface{}) error {
 	}
 
 	for j, ref := range mod.references {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		//allocate a slice and fill it with pointers of the entities retrieved
 		typ := reflect.TypeOf(ref.Modelable)
 		refs := reflect.MakeSlice(reflect.SliceOf(typ), l, l)
@@ -111,5 +190,111 @@ func readMulti(ctx context.Context, dst interface{}) error {
 		}
 	}
 
+	if len(mod.referenceSlicesIdx) > 0 {
+		for i := 0; i < l; i++ {
+			m := collection.Index(i).Interface().(modelable)
+			index(m)
+			if err := treeCanceled(ctx, m); err != nil {
+				return err
+			}
+			if err := readChildren(ctx, m); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Reads the entities with the given keys into dst, which must be a pointer to a slice of modelables.
+// A modelable is allocated and appended to dst for each key, then the modelables are read in batch
+// along with their references, from the cache when possible.
+// It can return a datastore.MultiError, i.e. if some of the entities don't exist:
+// the modelables are appended anyway, so that the errors are aligned with them
+func ReadByKeys(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	dstv := reflect.ValueOf(dst)
+	if !isValidContainer(dstv) {
+		return fmt.Errorf("invalid container of type %s. Container must be a pointer to a modelable slice", dstv.Type())
+	}
+
+	modelables := dstv.Elem()
+	typ := modelables.Type().Elem().Elem()
+
+	read := reflect.MakeSlice(modelables.Type(), 0, len(keys))
+	for _, key := range keys {
+		m := reflect.New(typ).Interface().(modelable)
+		index(m)
+		m.getModel().Key = key
+		read = reflect.Append(read, reflect.ValueOf(m))
+	}
+
+	err := ReadMulti(ctx, read.Interface())
+	modelables.Set(reflect.AppendSlice(modelables, read))
+	return err
+}
+
+// Reads the entities with the given int ids, and the kind of the modelables of dst, into dst. See ReadByKeys
+func ReadByIntIDs(ctx context.Context, ids []int64, dst interface{}) error {
+	kind, err := kindOfContainer(dst)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]*datastore.Key, len(ids))
+	for i, id := range ids {
+		keys[i] = namespacedKey(ctx, datastore.IDKey(kind, id, nil))
+	}
+	return ReadByKeys(ctx, keys, dst)
+}
+
+// Reads the entities with the given string ids, and the kind of the modelables of dst, into dst. See ReadByKeys
+func ReadByStringIDs(ctx context.Context, ids []string, dst interface{}) error {
+	kind, err := kindOfContainer(dst)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]*datastore.Key, len(ids))
+	for i, id := range ids {
+		keys[i] = namespacedKey(ctx, datastore.NameKey(kind, id, nil))
+	}
+	return ReadByKeys(ctx, keys, dst)
+}
+
+// Loads into dst the entities with the given int ids, as FromIntID does for a single modelable.
+// Unlike ReadByIntIDs, the content of dst is replaced, so that dst is aligned with ids
+// and with the datastore.MultiError returned if some of the entities don't exist
+func FromIntIDs(ctx context.Context, dst interface{}, ids []int64) error {
+	if err := resetContainer(dst); err != nil {
+		return err
+	}
+	return ReadByIntIDs(ctx, ids, dst)
+}
+
+// Loads into dst the entities with the given string ids, as FromStringID does for a single modelable.
+// The content of dst is replaced. See FromIntIDs
+func FromStringIDs(ctx context.Context, dst interface{}, ids []string) error {
+	if err := resetContainer(dst); err != nil {
+		return err
+	}
+	return ReadByStringIDs(ctx, ids, dst)
+}
+
+// empties the slice of modelables dst points to
+func resetContainer(dst interface{}) error {
+	dstv := reflect.ValueOf(dst)
+	if !isValidContainer(dstv) {
+		return fmt.Errorf("invalid container of type %s. Container must be a pointer to a modelable slice", dstv.Type())
+	}
+	dstv.Elem().SetLen(0)
 	return nil
 }
+
+// returns the kind of the modelables held by a pointer to a slice of modelables
+func kindOfContainer(dst interface{}) (string, error) {
+	dstv := reflect.ValueOf(dst)
+	if !isValidContainer(dstv) {
+		return "", fmt.Errorf("invalid container of type %s. Container must be a pointer to a modelable slice", dstv.Type())
+	}
+	return dstv.Elem().Type().Elem().Elem().Name(), nil
+}
@@ -0,0 +1,149 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// flags a string field as the record of the last change of each field of the modelable, i.e. `model:"modified"`.
+// The field holds a JSON object mapping the field names to the time they last changed, updated on every write,
+// so that conflict resolution and sync protocols can merge the entities field by field.
+// A field changes when its properties differ from the ones it had when the entity was loaded.
+// The property is never indexed
+const tagModified string = "modified"
+
+type modifiedDescriptor struct {
+	// index of the string field holding the JSON object
+	index int
+	name  string
+}
+
+// ModifiedTimes returns the time each field of the modelable last changed, by field name,
+// as recorded in its field tagged modified. It returns nil if the modelable has no such field
+func ModifiedTimes(m modelable) (map[string]time.Time, error) {
+	index(m)
+	model := m.getModel()
+	if model.modified == nil {
+		return nil, nil
+	}
+
+	return decodeModified(reflect.ValueOf(m).Elem().Field(model.modified.index).String())
+}
+
+func decodeModified(data string) (map[string]time.Time, error) {
+	times := make(map[string]time.Time)
+	if data == "" {
+		return times, nil
+	}
+
+	if err := json.Unmarshal([]byte(data), &times); err != nil {
+		return nil, fmt.Errorf("invalid modified times %q: %w", data, err)
+	}
+	return times, nil
+}
+
+// records the properties the fields of the modelable are loaded from, to detect the changed fields on save
+func trackModified(m modelable, props []datastore.Property) {
+	model := m.getModel()
+	if model.modified == nil {
+		return
+	}
+	model.fingerprints = fieldFingerprints(props)
+}
+
+// sets the current time for the fields whose properties changed since the modelable was loaded or saved,
+// both in the modified field and in its property. Fields of new entities are all changed
+func stampModified(m modelable, props []datastore.Property) ([]datastore.Property, error) {
+	model := m.getModel()
+	if model.modified == nil {
+		return props, nil
+	}
+
+	field := reflect.ValueOf(m).Elem().Field(model.modified.index)
+	times, err := decodeModified(field.String())
+	if err != nil {
+		return nil, err
+	}
+
+	prints := fieldFingerprints(renameProperties(props, model.fieldsOfStored))
+	now := time.Now().Truncate(time.Microsecond).UTC()
+
+	changed := false
+	for name, fp := range prints {
+		if old, ok := model.fingerprints[name]; (!ok || old != fp) && isModifiedTracked(model, name) {
+			times[name] = now
+			changed = true
+		}
+	}
+
+	// fields emptied since the load have no properties left
+	for name := range model.fingerprints {
+		if _, ok := prints[name]; !ok && isModifiedTracked(model, name) {
+			times[name] = now
+			changed = true
+		}
+	}
+
+	model.fingerprints = prints
+	if !changed {
+		return props, nil
+	}
+
+	data, err := json.Marshal(times)
+	if err != nil {
+		return nil, err
+	}
+	field.SetString(string(data))
+
+	for i := range props {
+		if props[i].Name == model.modified.name {
+			props[i].Value = string(data)
+			return props, nil
+		}
+	}
+	return append(props, datastore.Property{Name: model.modified.name, Value: string(data), NoIndex: true}), nil
+}
+
+// reports if the changes of the field are recorded.
+// The modified field itself and the fields maintained by the framework on every write are not
+func isModifiedTracked(model *Model, name string) bool {
+	attr, ok := model.fieldNames[name]
+	if !ok {
+		return false
+	}
+
+	for _, d := range []*timestampDescriptor{model.createTime, model.updateTime} {
+		if d != nil && d.index == attr.index {
+			return false
+		}
+	}
+
+	if model.version != nil && model.version.index == attr.index {
+		return false
+	}
+
+	return attr.index != model.modified.index
+}
+
+// returns a hash of the properties of each field, by field name.
+// The index settings of the properties are ignored, as they don't change the stored values
+func fieldFingerprints(props []datastore.Property) map[string]uint64 {
+	hashes := make(map[string]uint64)
+	for _, p := range props {
+		name := p.Name
+		if i := strings.Index(name, valSeparator); i > 0 {
+			name = name[:i]
+		}
+
+		h := fnv.New64a()
+		fmt.Fprintf(h, "%d\x00%s\x00", hashes[name], p.Name)
+		hashValue(h, p.Value)
+		hashes[name] = h.Sum64()
+	}
+	return hashes
+}
@@ -0,0 +1,53 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+type TrackedNote struct {
+	Model
+	Title   string
+	Body    string
+	Changes string `model:"modified"`
+}
+
+func TestModifiedTimes(t *testing.T) {
+	src := TrackedNote{Title: "title", Body: "body"}
+	index(&src)
+
+	props, err := src.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created, err := ModifiedTimes(&src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(created) != 2 || created["Title"].IsZero() || created["Body"].IsZero() {
+		t.Fatalf("invalid modified times of a new entity %v", created)
+	}
+
+	dst := TrackedNote{}
+	index(&dst)
+	if err := dst.Load(props); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	dst.Body = "changed"
+	if _, err := dst.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	updated, err := ModifiedTimes(&dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !updated["Title"].Equal(created["Title"]) || !updated["Body"].After(created["Body"]) {
+		t.Fatalf("invalid modified times after an update %v, was %v", updated, created)
+	}
+}
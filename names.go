@@ -0,0 +1,75 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"reflect"
+	"strings"
+)
+
+// overrides the name of the property storing a field of the modelable, i.e. `model:"name=customName"`.
+// It allows to read and write entities written by other libraries.
+// The properties of nested structs are prefixed by the overridden name, while their own names are kept
+const tagName string = "name"
+
+// records the stored name of the field of the struct, if overridden by the tags
+func mapStoredName(s *encodedStruct, field string, tags []string) string {
+	stored, ok := tagValue(tags, tagName)
+	if !ok || stored == "" || stored == field {
+		return field
+	}
+
+	if s.storedNames == nil {
+		s.storedNames = make(map[string]string)
+		s.fieldsOfStored = make(map[string]string)
+	}
+	s.storedNames[field] = stored
+	s.fieldsOfStored[stored] = field
+	return stored
+}
+
+// returns a copy of the properties with the first segment of their names renamed as names tells.
+// Properties whose name is not in names are copied as they are
+func renameProperties(props []datastore.Property, names map[string]string) []datastore.Property {
+	if len(names) == 0 {
+		return props
+	}
+
+	renamed := make([]datastore.Property, len(props))
+	for i, p := range props {
+		p.Name = renameProperty(p.Name, names)
+		renamed[i] = p
+	}
+	return renamed
+}
+
+func renameProperty(name string, names map[string]string) string {
+	first, rest := name, ""
+	if i := strings.Index(name, valSeparator); i > 0 {
+		first, rest = name[:i], name[i:]
+	}
+
+	if renamed, ok := names[first]; ok {
+		return renamed + rest
+	}
+	return name
+}
+
+// returns the names of the properties storing the given fields of the struct
+func storedFieldNames(s *encodedStruct, fields []string) []string {
+	if s == nil || len(s.storedNames) == 0 {
+		return fields
+	}
+
+	stored := make([]string, len(fields))
+	for i, f := range fields {
+		stored[i] = renameProperty(f, s.storedNames)
+	}
+	return stored
+}
+
+// returns the overridden property names of the fields of the modelables of type t
+func storedNamesOf(t reflect.Type) map[string]string {
+	m := reflect.New(t).Interface().(modelable)
+	index(m)
+	return m.getModel().storedNames
+}
@@ -0,0 +1,50 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"testing"
+)
+
+type LegacyCustomer struct {
+	Model
+	FullName string `model:"name=full_name"`
+	Age      int
+}
+
+func TestStoredNames(t *testing.T) {
+	c := LegacyCustomer{FullName: "Enzo", Age: 40}
+	index(&c)
+
+	props, err := toPropertyList(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := map[string]bool{}
+	for _, p := range props {
+		names[p.Name] = true
+	}
+
+	if !names["full_name"] || names["FullName"] || !names["Age"] {
+		t.Fatalf("unexpected properties %+v", props)
+	}
+
+	loaded := LegacyCustomer{}
+	index(&loaded)
+	if err := fromPropertyList(&loaded, []datastore.Property{{Name: "full_name", Value: "Enzo"}, {Name: "Age", Value: int64(40)}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.FullName != "Enzo" || loaded.Age != 40 {
+		t.Fatalf("loaded %+v", loaded)
+	}
+
+	q := NewQuery(&LegacyCustomer{})
+	if f := q.filterProperty("FullName ="); f != "full_name =" {
+		t.Fatalf("filter translated as %q", f)
+	}
+
+	if f := q.filterProperty("Age>"); f != "Age>" {
+		t.Fatalf("filter translated as %q", f)
+	}
+}
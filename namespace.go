@@ -0,0 +1,72 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+)
+
+const keyNamespace = "__model_namespace"
+
+// WithNamespace returns a context whose operations are isolated in the given datastore namespace,
+// i.e. to keep the data of a tenant apart from the others in a multi-tenant application.
+// The keys of the created entities, the queries, the cached entities and the search indexes are all scoped by the namespace.
+// Keys read from the storage keep their own namespace.
+// The bookkeeping entities of the framework, like locks, jobs and the outbox, stay in the default namespace
+func WithNamespace(ctx context.Context, ns string) context.Context {
+	return context.WithValue(ctx, keyNamespace, ns)
+}
+
+// NamespaceFromContext returns the namespace set with WithNamespace, or the default namespace
+func NamespaceFromContext(ctx context.Context) string {
+	ns, _ := ctx.Value(keyNamespace).(string)
+	return ns
+}
+
+// puts the new key in the namespace of the context.
+// Keys with a parent share its namespace, as the datastore requires
+func namespacedKey(ctx context.Context, key *datastore.Key) *datastore.Key {
+	if key == nil {
+		return nil
+	}
+
+	if key.Parent != nil {
+		key.Namespace = key.Parent.Namespace
+		return key
+	}
+
+	if key.Namespace == "" {
+		key.Namespace = NamespaceFromContext(ctx)
+	}
+	return key
+}
+
+// returns a query of the kind in the namespace of the context
+func newDatastoreQuery(ctx context.Context, kind string) *datastore.Query {
+	q := datastore.NewQuery(kind)
+	if ns := NamespaceFromContext(ctx); ns != "" {
+		q = q.Namespace(ns)
+	}
+	return q
+}
+
+// namespacedSearch keeps the search indexes of a namespace apart from the ones of the other namespaces
+type namespacedSearch struct {
+	SearchBackend
+	namespace string
+}
+
+func (b namespacedSearch) index(name string) string {
+	return b.namespace + "." + name
+}
+
+func (b namespacedSearch) IndexPut(ctx context.Context, index string, ids []string, docs []SearchDocument) error {
+	return b.SearchBackend.IndexPut(ctx, b.index(index), ids, docs)
+}
+
+func (b namespacedSearch) IndexDelete(ctx context.Context, index string, ids []string) error {
+	return b.SearchBackend.IndexDelete(ctx, b.index(index), ids)
+}
+
+func (b namespacedSearch) Query(ctx context.Context, index string, req SearchRequest) (*SearchResponse, error) {
+	return b.SearchBackend.Query(ctx, b.index(index), req)
+}
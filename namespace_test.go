@@ -0,0 +1,30 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"testing"
+)
+
+func TestNamespacedKey(t *testing.T) {
+	ctx := WithNamespace(context.Background(), "tenant")
+
+	key := namespacedKey(ctx, datastore.IDKey("Parent", 1, nil))
+	if key.Namespace != "tenant" {
+		t.Fatalf("key in namespace %q", key.Namespace)
+	}
+
+	child := namespacedKey(context.Background(), datastore.IDKey("Child", 2, key))
+	if child.Namespace != "tenant" {
+		t.Fatalf("child key in namespace %q", child.Namespace)
+	}
+
+	stored := &datastore.Key{Kind: "Parent", ID: 3, Namespace: "other"}
+	if namespacedKey(ctx, stored).Namespace != "other" {
+		t.Fatal("the namespace of a stored key has been replaced")
+	}
+
+	if cacheKey(key) == cacheKey(datastore.IDKey("Parent", 1, nil)) {
+		t.Fatal("cache keys of different namespaces collide")
+	}
+}
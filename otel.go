@@ -0,0 +1,82 @@
+package model
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/iterator"
+)
+
+const keyOtelTracer = "__model_otel_tracer"
+
+// the name of the instrumentation library reported with the spans
+const instrumentationName = "github.com/decodica/model"
+
+func otelTracerFrom(ctx context.Context) trace.Tracer {
+	tracer, _ := ctx.Value(keyOtelTracer).(trace.Tracer)
+	return tracer
+}
+
+// starts an OpenTelemetry span as a child of the one of ctx, if the service has a TracerProvider.
+// Returns a nil span otherwise
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	tracer := otelTracerFrom(ctx)
+	if tracer == nil {
+		return ctx, nil
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// ends the span, if any, recording the error the operation failed with
+func endSpan(span trace.Span, err error) {
+	if span == nil {
+		return
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traces a call to the datastore with the given number of keys, which is accounted to the operation running with ctx.
+// The returned function must be called with the result of the call
+func traceDatastoreCall(ctx context.Context, method string, kind string, keys int) func(err error) {
+	countDatastoreCall(ctx, kind, method, keys)
+
+	attrs := []attribute.KeyValue{attribute.String("model.kind", kind)}
+	if keys > 0 {
+		attrs = append(attrs, attribute.Int("model.batch_size", keys))
+	}
+
+	_, span := startSpan(ctx, "datastore."+method, attrs...)
+	return func(err error) {
+		// the end of the results of a query is not a failure
+		if err == iterator.Done {
+			err = nil
+		}
+		endSpan(span, err)
+	}
+}
+
+// traces a call to the cache for an entity of the given kind.
+// The returned function must be called with the result of the call: cache misses are not reported as errors
+func traceCacheCall(ctx context.Context, method string, kind string) func(err error) {
+	_, span := startSpan(ctx, "cache."+method, attribute.String("model.kind", kind))
+	return func(err error) {
+		if span == nil {
+			return
+		}
+
+		if method == "Get" {
+			span.SetAttributes(attribute.Bool("model.cache.hit", err == nil))
+		}
+
+		if err == ErrCacheMiss {
+			err = nil
+		}
+		endSpan(span, err)
+	}
+}
@@ -0,0 +1,125 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"google.golang.org/api/iterator"
+	"time"
+)
+
+// kind of the stored outbox messages
+const outboxKind string = "Outbox"
+
+// A message attached to a write operation.
+// Messages are stored in the Outbox kind along with the write,
+// and delivered later on by DispatchOutbox
+type OutboxMessage struct {
+	Topic   string
+	Payload []byte `datastore:",noindex"`
+	// key of the entity written along with the message
+	Entity  *datastore.Key
+	Created time.Time
+	Sent    bool
+	SentAt  time.Time
+}
+
+// Publisher delivers the outbox messages, i.e. to a Pub/Sub topic
+type Publisher interface {
+	Publish(ctx context.Context, topic string, payload []byte) error
+}
+
+func newOutboxMessage(topic string, payload []byte) OutboxMessage {
+	return OutboxMessage{Topic: topic, Payload: payload}
+}
+
+// stores the messages for the entity with the given key.
+// If tx is not nil the messages are stored within the transaction,
+// so that they get committed only if the write operation succeeds
+func putOutbox(ctx context.Context, tx *datastore.Transaction, key *datastore.Key, messages []OutboxMessage) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	keys := make([]*datastore.Key, len(messages))
+	msgs := make([]*OutboxMessage, len(messages))
+	now := time.Now()
+	for i := range messages {
+		msg := messages[i]
+		msg.Entity = key
+		msg.Created = now
+		msgs[i] = &msg
+		keys[i] = datastore.IncompleteKey(outboxKind, nil)
+	}
+
+	if tx != nil {
+		_, err := tx.PutMulti(keys, msgs)
+		return err
+	}
+
+	client := ClientFromContext(ctx)
+	_, err := client.PutMulti(ctx, keys, msgs)
+	return err
+}
+
+// DispatchOutbox publishes up to limit pending messages, oldest first, and marks them as sent.
+// Each message is marked in its own transaction: if marking fails after publishing,
+// the message is published again on the next dispatch.
+// The messages stored by the framework itself, i.e. the refreshes of the denormalized copies, are run instead.
+// Returns the number of messages sent
+func DispatchOutbox(ctx context.Context, publisher Publisher, limit int) (int, error) {
+	client := ClientFromContext(ctx)
+
+	q := datastore.NewQuery(outboxKind).Filter("Sent =", false).Order("Created").KeysOnly()
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+
+	sent := 0
+	it := client.Run(ctx, q)
+	for {
+		key, err := it.Next(nil)
+		if err == iterator.Done {
+			break
+		}
+
+		if err != nil {
+			return sent, err
+		}
+
+		_, err = client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+			msg := OutboxMessage{}
+			if err := tx.Get(key, &msg); err != nil {
+				return err
+			}
+
+			// dispatched concurrently
+			if msg.Sent {
+				return nil
+			}
+
+			if err := deliver(ctx, publisher, msg); err != nil {
+				return err
+			}
+
+			msg.Sent = true
+			msg.SentAt = time.Now()
+			_, err := tx.Put(key, &msg)
+			return err
+		}, datastore.MaxAttempts(1))
+
+		if err != nil {
+			return sent, err
+		}
+		sent++
+	}
+
+	return sent, nil
+}
+
+// publishes the message, or runs it if it has been stored by the framework
+func deliver(ctx context.Context, publisher Publisher, msg OutboxMessage) error {
+	if msg.Topic == denormTopic {
+		return refreshDenormalized(ctx, msg.Payload)
+	}
+	return publisher.Publish(ctx, msg.Topic, msg.Payload)
+}
@@ -2,17 +2,32 @@ package model
 
 import (
 	"cloud.google.com/go/datastore"
+	"context"
 	"errors"
 	"fmt"
-	"golang.org/x/net/context"
 	"google.golang.org/api/iterator"
 	"reflect"
+	"strings"
+	"time"
 )
 
 type Query struct {
 	dq         *datastore.Query
 	mType      reflect.Type
 	projection bool
+	// orders are kept apart from dq so that they can be inverted
+	orders []string
+	// the property holding the deletion time of the soft deletable entities
+	softDelete string
+	// if set, the entities with a deletion time are skipped
+	skipDeleted bool
+	// the names of the properties of the fields tagged with name=
+	names map[string]string
+	// if set, the query only finds the descendants of the entity with this key.
+	// It is put in the namespace of the context when the query is run
+	ancestor *datastore.Key
+	// if set, the query is the union of these queries, set by IN and OR filters
+	disjuncts []*datastore.Query
 }
 
 type Order uint8
@@ -22,6 +37,9 @@ const (
 	DESC
 )
 
+// NewQuery returns a query on the entities of the kind of the modelable.
+// If the ancestor reference of the modelable is tagged scoped and holds an entity with a key,
+// the query only finds the descendants of that entity
 func NewQuery(m modelable) *Query {
 	typ := reflect.TypeOf(m).Elem()
 
@@ -30,12 +48,98 @@ func NewQuery(m modelable) *Query {
 		dq:         q,
 		mType:      typ,
 		projection: false,
+		softDelete: softDeleteFieldOf(typ),
+		names:      storedNamesOf(typ),
+		ancestor:   scopedAncestorOf(m),
 	}
 	return &query
 }
 
+// returns the key of the entity held by the ancestor reference of m, if the reference is tagged scoped
+func scopedAncestorOf(m modelable) *datastore.Key {
+	v := reflect.ValueOf(m).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		tags := strings.Split(v.Type().Field(i).Tag.Get(tagDomain), ",")
+		if containsTag(tags, tagAncestor) == "" || containsTag(tags, tagScoped) == "" {
+			continue
+		}
+
+		if !v.Field(i).CanAddr() {
+			return nil
+		}
+
+		if ref, ok := v.Field(i).Addr().Interface().(modelable); ok {
+			return ref.getModel().Key
+		}
+		return nil
+	}
+	return nil
+}
+
+// Clone returns a copy of the query that can be refined independently of q
+func (q *Query) Clone() *Query {
+	c := *q
+	return &c
+}
+
+// returns a copy of the query running the datastore query derived by fn.
+// Queries are never modified once built, thus they can be shared and run concurrently
+func (q *Query) derive(fn func(dq *datastore.Query) *datastore.Query) *Query {
+	c := q.Clone()
+	c.dq = fn(q.dq)
+	if q.disjuncts != nil {
+		c.disjuncts = make([]*datastore.Query, len(q.disjuncts))
+		for i, d := range q.disjuncts {
+			c.disjuncts[i] = fn(d)
+		}
+	}
+	return c
+}
+
+// returns the datastore query to run, with the orders applied, in the namespace of the context
+func (q *Query) datastoreQuery(ctx context.Context) *datastore.Query {
+	return q.decorate(ctx, q.dq)
+}
+
+// applies the orders, the ancestor, the soft delete filter and the namespace of the context to dq
+func (q *Query) decorate(ctx context.Context, dq *datastore.Query) *datastore.Query {
+	if ns := NamespaceFromContext(ctx); ns != "" {
+		dq = dq.Namespace(ns)
+	}
+	if q.ancestor != nil {
+		key := *q.ancestor
+		dq = dq.Ancestor(namespacedKey(ctx, &key))
+	}
+	if q.skipDeleted && q.softDelete != "" {
+		dq = dq.Filter(fmt.Sprintf("%s =", q.softDelete), time.Time{})
+	}
+
+	for _, o := range q.orders {
+		dq = dq.Order(o)
+	}
+	return dq
+}
+
+// SkipDeleted returns a query skipping the soft deleted entities, filtering on a zero deletion time.
+// Entities stored without the property of the soft delete field, i.e. written before the field was added,
+// are skipped as well: they must be rewritten first, for instance with Reindex.
+// Combined with other filters or orders, the filter requires a composite index including the property
+func (q *Query) SkipDeleted() *Query {
+	c := q.Clone()
+	c.skipDeleted = true
+	return c
+}
+
+// WithDeleted returns a query including the soft deleted entities, undoing SkipDeleted
+func (q *Query) WithDeleted() *Query {
+	c := q.Clone()
+	c.skipDeleted = false
+	return c
+}
+
 /**
-Filter functions
+Filter functions.
+They return a new query, leaving the receiver untouched
 */
 func (q *Query) WithModelable(field string, ref modelable) *Query {
 	refm := ref.getModel()
@@ -60,90 +164,228 @@ func (q *Query) WithAncestor(ancestor modelable) (*Query, error) {
 		return nil, fmt.Errorf("invalid ancestor. %s has empty Key", am.Name())
 	}
 
-	q.dq = q.dq.Ancestor(am.Key)
-	return q, nil
+	return q.derive(func(dq *datastore.Query) *datastore.Query {
+		return dq.Ancestor(am.Key)
+	}), nil
+}
+
+// WithAncestorKey returns a query finding the descendants of the root entity with the given kind and id,
+// without building its key. The id is either an int, an int64 or a string.
+// The key of the ancestor is put in the namespace of the context when the query is run
+func (q *Query) WithAncestorKey(kind string, id interface{}) (*Query, error) {
+	var key *datastore.Key
+	switch x := id.(type) {
+	case int:
+		key = datastore.IDKey(kind, int64(x), nil)
+	case int64:
+		key = datastore.IDKey(kind, x, nil)
+	case string:
+		key = datastore.NameKey(kind, x, nil)
+	default:
+		return nil, fmt.Errorf("invalid ancestor id of type %T. Id must be an int, an int64 or a string", id)
+	}
+
+	if key.Incomplete() {
+		return nil, fmt.Errorf("invalid ancestor. %s has an empty id", kind)
+	}
+
+	c := q.Clone()
+	c.ancestor = key
+	return c, nil
 }
 
 func (q *Query) WithField(field string, value interface{}) *Query {
-	prepared := field
-	q.dq = q.dq.Filter(prepared, value)
-	return q
+	field = q.filterProperty(field)
+	return q.derive(func(dq *datastore.Query) *datastore.Query {
+		return dq.Filter(field, value)
+	})
+}
+
+// translates the field of the filter, i.e. "Name =", to the name of the property storing it
+func (q *Query) filterProperty(filter string) string {
+	if len(q.names) == 0 {
+		return filter
+	}
+
+	trimmed := strings.TrimSpace(filter)
+	end := strings.IndexAny(trimmed, " =<>!")
+	if end < 0 {
+		end = len(trimmed)
+	}
+	return renameProperty(trimmed[:end], q.names) + trimmed[end:]
+}
+
+// translates the fields to the names of the properties storing them
+func (q *Query) properties(fields []string) []string {
+	if len(q.names) == 0 {
+		return fields
+	}
+
+	props := make([]string, len(fields))
+	for i, f := range fields {
+		props[i] = renameProperty(f, q.names)
+	}
+	return props
 }
 
 func (q *Query) OrderBy(field string, order Order) *Query {
-	prepared := field
+	prepared := renameProperty(field, q.names)
 	if order == DESC {
 		prepared = fmt.Sprintf("-%s", prepared)
 	}
-	q.dq = q.dq.Order(prepared)
-	return q
+	c := q.Clone()
+	c.orders = append(append([]string{}, q.orders...), prepared)
+	return c
 }
 
 func (q *Query) OffsetBy(offset int) *Query {
-	q.dq = q.dq.Offset(offset)
-	return q
+	return q.derive(func(dq *datastore.Query) *datastore.Query {
+		return dq.Offset(offset)
+	})
 }
 
 func (q *Query) Limit(limit int) *Query {
-	q.dq = q.dq.Limit(limit)
-	return q
+	return q.derive(func(dq *datastore.Query) *datastore.Query {
+		return dq.Limit(limit)
+	})
 }
 
-func (q *Query) Count(ctx context.Context) (int, error) {
+func (q *Query) Count(ctx context.Context) (n int, err error) {
+	ctx, span := startOperation(ctx, OpQuery, "Query.Count")
+	defer func() { span.end(ctx, q, err) }()
+
+	if q.disjuncts != nil {
+		keys, err := q.unionKeys(ctx)
+		return len(keys), err
+	}
+
+	done := traceDatastoreCall(ctx, "Count", q.mType.Name(), 0)
 	client := ClientFromContext(ctx)
-	return client.Count(ctx, q.dq)
+	n, err = client.Count(ctx, q.datastoreQuery(ctx))
+	done(err)
+	return n, err
 }
 
 func (q *Query) Distinct(fields ...string) *Query {
-	q.dq = q.dq.Project(fields...)
-	q.dq = q.dq.Distinct()
-	q.projection = true
-	return q
+	fields = q.properties(fields)
+	c := q.derive(func(dq *datastore.Query) *datastore.Query {
+		return dq.Project(fields...).Distinct()
+	})
+	c.projection = true
+	return c
 }
 
 func (q *Query) Project(fields ...string) *Query {
-	q.dq = q.dq.Project(fields...)
-	q.projection = true
-	return q
+	fields = q.properties(fields)
+	c := q.derive(func(dq *datastore.Query) *datastore.Query {
+		return dq.Project(fields...)
+	})
+	c.projection = true
+	return c
 }
 
-//Shorthand method to retrieve only the first entity satisfying the query
-//It is equivalent to a Get With limit 1
-func (q *Query) First(ctx context.Context, m modelable) (err error) {
-	q.dq = q.dq.Limit(1)
-
-	var mm []modelable
+// ErrNotFound is returned when no entity satisfies a query.
+// It wraps datastore.ErrNoSuchEntity
+var ErrNotFound = fmt.Errorf("no entity satisfies the query: %w", datastore.ErrNoSuchEntity)
 
-	err = q.GetAll(ctx, &mm)
+//Shorthand method to retrieve only the first entity satisfying the query.
+//It runs a keys only query with limit 1 and reads the entity found
+func (q *Query) First(ctx context.Context, m modelable) (err error) {
+	ctx, span := startOperation(ctx, OpQuery, "Query.First")
+	defer func() { span.end(ctx, m, err) }()
 
+	key, err := q.FirstKey(ctx)
 	if err != nil {
 		return err
 	}
 
-	if len(mm) > 0 {
-		src := reflect.Indirect(reflect.ValueOf(mm[0]))
-		reflect.Indirect(reflect.ValueOf(m)).Set(src)
-		index(m)
-		return nil
+	index(m)
+	m.getModel().Key = key
+	return Read(ctx, m)
+}
+
+// FirstKey returns the key of the first entity satisfying the query, or ErrNotFound
+func (q *Query) FirstKey(ctx context.Context) (key *datastore.Key, err error) {
+	ctx, span := startOperation(ctx, OpQuery, "Query.FirstKey")
+	defer func() { span.end(ctx, q, err) }()
+
+	if q.disjuncts != nil {
+		return q.firstUnionKey(ctx)
+	}
+
+	done := traceDatastoreCall(ctx, "RunQuery", q.mType.Name(), 0)
+	client := ClientFromContext(ctx)
+	key, err = client.Run(ctx, q.datastoreQuery(ctx).Limit(1).KeysOnly()).Next(nil)
+	done(err)
+	if err == iterator.Done {
+		countQueryResults(ctx, q.mType.Name(), 0)
+		return nil, ErrNotFound
+	}
+
+	if err == nil {
+		countQueryResults(ctx, q.mType.Name(), 1)
 	}
 
-	return datastore.ErrNoSuchEntity
+	return key, err
 }
 
-func (query *Query) Get(ctx context.Context, dst interface{}) error {
+// GetKeys returns the keys of all the entities satisfying the query, without loading them
+func (q *Query) GetKeys(ctx context.Context) (keys []*datastore.Key, err error) {
+	ctx, span := startOperation(ctx, OpQuery, "Query.GetKeys")
+	defer func() { span.end(ctx, q, err) }()
+
+	if q.disjuncts != nil {
+		return q.unionKeys(ctx)
+	}
+
+	done := traceDatastoreCall(ctx, "GetAll", q.mType.Name(), 0)
+	client := ClientFromContext(ctx)
+	keys, err = client.GetAll(ctx, q.datastoreQuery(ctx).KeysOnly(), nil)
+	done(err)
+	if err == nil {
+		countQueryResults(ctx, q.mType.Name(), len(keys))
+	}
+	return keys, err
+}
+
+// Last retrieves the last entity satisfying the query, running it with all its orders inverted.
+// A query without orders is sorted by key. Queries with IN or OR filters can only be ordered by key
+func (q *Query) Last(ctx context.Context, m modelable) error {
+	last := q.Clone()
+	last.orders = make([]string, 0, len(q.orders))
+	for _, o := range q.orders {
+		if strings.HasPrefix(o, "-") {
+			last.orders = append(last.orders, strings.TrimPrefix(o, "-"))
+		} else {
+			last.orders = append(last.orders, "-"+o)
+		}
+	}
+
+	if len(last.orders) == 0 {
+		last.orders = append(last.orders, "-__key__")
+	}
+
+	return last.First(ctx, m)
+}
+
+func (query *Query) Get(ctx context.Context, dst interface{}) (err error) {
+	ctx, span := startOperation(ctx, OpQuery, "Query.Get")
+	defer func() { span.end(ctx, query, err) }()
+
 	if query.dq == nil {
 		return errors.New("invalid query. Query is nil")
 	}
 
-	defer func() {
-		query = nil
-	}()
+	if query.disjuncts != nil {
+		return query.getUnion(ctx, dst)
+	}
 
+	dq := query.datastoreQuery(ctx)
 	if !query.projection {
-		query.dq = query.dq.KeysOnly()
+		dq = dq.KeysOnly()
 	}
 
-	_, err := query.get(ctx, dst)
+	_, err = query.get(ctx, dq, dst)
 
 	if err != nil && err != iterator.Done {
 		return err
@@ -152,17 +394,21 @@ func (query *Query) Get(ctx context.Context, dst interface{}) error {
 	return nil
 }
 
-func (query *Query) GetAll(ctx context.Context, dst interface{}) error {
+func (query *Query) GetAll(ctx context.Context, dst interface{}) (err error) {
+	ctx, span := startOperation(ctx, OpQuery, "Query.GetAll")
+	defer func() { span.end(ctx, query, err) }()
+
 	if query.dq == nil {
 		return errors.New("invalid query. Query is nil")
 	}
 
-	defer func() {
-		query = nil
-	}()
+	if query.disjuncts != nil {
+		return query.getUnion(ctx, dst)
+	}
 
+	dq := query.datastoreQuery(ctx)
 	if !query.projection {
-		query.dq = query.dq.KeysOnly()
+		dq = dq.KeysOnly()
 	}
 
 	var cursor *datastore.Cursor
@@ -171,12 +417,15 @@ func (query *Query) GetAll(ctx context.Context, dst interface{}) error {
 	done := false
 
 	for !done {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
 		if cursor != nil {
-			query.dq = query.dq.Start(*cursor)
+			dq = dq.Start(*cursor)
 		}
 
-		cursor, e = query.get(ctx, dst)
+		cursor, e = query.get(ctx, dq, dst)
 
 		if e != iterator.Done && e != nil {
 			return e
@@ -188,22 +437,77 @@ func (query *Query) GetAll(ctx context.Context, dst interface{}) error {
 	return nil
 }
 
-func (query *Query) GetMulti(ctx context.Context, dst interface{}) error {
+// GetPage loads into dst up to limit entities satisfying the query, starting from cursor.
+// An empty cursor starts from the first result.
+// It returns the cursor of the next page, which is empty if there are no more results
+func (query *Query) GetPage(ctx context.Context, dst interface{}, limit int, cursor string) (_ string, err error) {
+	ctx, span := startOperation(ctx, OpQuery, "Query.GetPage")
+	defer func() { span.end(ctx, query, err) }()
+
 	if query.dq == nil {
-		return errors.New("invalid query. Query is nil")
+		return "", errors.New("invalid query. Query is nil")
+	}
+
+	if query.disjuncts != nil {
+		return "", errDisjunctionPaging
+	}
+
+	dq := query.datastoreQuery(ctx).Limit(limit)
+	if !query.projection {
+		dq = dq.KeysOnly()
+	}
+
+	if cursor != "" {
+		c, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return "", err
+		}
+		dq = dq.Start(c)
 	}
 
-	defer func() {
-		query = nil
-	}()
+	dstv := reflect.ValueOf(dst)
+	if !isValidContainer(dstv) {
+		return "", fmt.Errorf("invalid container of type %s. Container must be a modelable slice", dstv.Elem().Type().Name())
+	}
+
+	before := dstv.Elem().Len()
+	next, err := query.get(ctx, dq, dst)
+	if err == iterator.Done {
+		return "", nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	// a short page is the last one
+	if dstv.Elem().Len()-before < limit {
+		return "", nil
+	}
+
+	return next.String(), nil
+}
+
+func (query *Query) GetMulti(ctx context.Context, dst interface{}) (err error) {
+	ctx, span := startOperation(ctx, OpQuery, "Query.GetMulti")
+	defer func() { span.end(ctx, query, err) }()
+
+	if query.dq == nil {
+		return errors.New("invalid query. Query is nil")
+	}
 
 	if query.projection {
 		return errors.New("invalid query. Can't use projection queries with GetMulti")
 	}
 
+	if query.disjuncts != nil {
+		return query.getUnion(ctx, dst)
+	}
+
 	client := ClientFromContext(ctx)
-	query.dq = query.dq.KeysOnly()
-	it := client.Run(ctx, query.dq)
+	done := traceDatastoreCall(ctx, "RunQuery", query.mType.Name(), 0)
+	it := client.Run(ctx, query.datastoreQuery(ctx).KeysOnly())
+	found := 0
 
 	dstv := reflect.ValueOf(dst)
 
@@ -214,6 +518,11 @@ func (query *Query) GetMulti(ctx context.Context, dst interface{}) error {
 	modelables := dstv.Elem()
 
 	for {
+		if err := ctx.Err(); err != nil {
+			done(err)
+			return err
+		}
+
 		key, err := it.Next(nil)
 
 		if err == iterator.Done {
@@ -221,6 +530,7 @@ func (query *Query) GetMulti(ctx context.Context, dst interface{}) error {
 		}
 
 		if err != nil {
+			done(err)
 			return err
 		}
 
@@ -229,7 +539,7 @@ func (query *Query) GetMulti(ctx context.Context, dst interface{}) error {
 
 		if !ok {
 			err = fmt.Errorf("can't cast struct of type %s to modelable", query.mType.Name())
-			query = nil
+			done(err)
 			return err
 		}
 
@@ -242,19 +552,27 @@ func (query *Query) GetMulti(ctx context.Context, dst interface{}) error {
 		model.Key = key
 
 		modelables.Set(reflect.Append(modelables, reflect.ValueOf(m)))
+		found++
 	}
+	done(nil)
+	countQueryResults(ctx, query.mType.Name(), found)
 
 	return ReadMulti(ctx, reflect.Indirect(dstv).Interface())
 }
 
-func (query *Query) get(ctx context.Context, dst interface{}) (*datastore.Cursor, error) {
+// runs dq, which is derived from the query, and appends the results to dst.
+// The query itself is left untouched so that it can be run again
+func (query *Query) get(ctx context.Context, dq *datastore.Query, dst interface{}) (_ *datastore.Cursor, err error) {
 
 	client := ClientFromContext(ctx)
 
 	more := false
 	rc := 0
 
-	it := client.Run(ctx, query.dq)
+	// the span covers the whole iteration, including the reads of the entities found
+	done := traceDatastoreCall(ctx, "RunQuery", query.mType.Name(), 0)
+	defer func() { done(err) }()
+	it := client.Run(ctx, dq)
 
 	dstv := reflect.ValueOf(dst)
 
@@ -265,6 +583,10 @@ func (query *Query) get(ctx context.Context, dst interface{}) (*datastore.Cursor
 	modelables := dstv.Elem()
 
 	for {
+		// the entities are read one by one: stop as soon as the caller gives up
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 
 		Key, err := it.Next(nil)
 
@@ -273,7 +595,6 @@ func (query *Query) get(ctx context.Context, dst interface{}) (*datastore.Cursor
 		}
 
 		if err != nil {
-			query = nil
 			return nil, err
 		}
 
@@ -284,7 +605,6 @@ func (query *Query) get(ctx context.Context, dst interface{}) (*datastore.Cursor
 
 		if !ok {
 			err = fmt.Errorf("can't cast struct of type %s to modelable", query.mType.Name())
-			query = nil
 			return nil, err
 		}
 
@@ -298,12 +618,12 @@ func (query *Query) get(ctx context.Context, dst interface{}) (*datastore.Cursor
 
 		err = Read(ctx, m)
 		if err != nil {
-			query = nil
 			return nil, err
 		}
 		modelables.Set(reflect.Append(modelables, reflect.ValueOf(m)))
 		rc++
 	}
+	countQueryResults(ctx, query.mType.Name(), rc)
 
 	if !more {
 		//if there are no more entries to be loaded, break the loop
@@ -0,0 +1,162 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"testing"
+	"time"
+)
+
+type ScopedPost struct {
+	Model
+	Title string
+}
+
+type ScopedComment struct {
+	Model
+	Post ScopedPost `model:"ancestor,scoped"`
+	Text string
+}
+
+func TestScopedAncestor(t *testing.T) {
+	post := ScopedPost{}
+	index(&post)
+	post.Key = datastore.IDKey("ScopedPost", 7, nil)
+
+	q := NewQuery(&ScopedComment{Post: post})
+	if q.ancestor == nil || !q.ancestor.Equal(post.Key) {
+		t.Fatalf("expected the query to be scoped to %s, got %v", post.Key, q.ancestor)
+	}
+
+	if q := NewQuery(&ScopedComment{}); q.ancestor != nil {
+		t.Fatalf("expected an unscoped query without the ancestor, got %s", q.ancestor)
+	}
+}
+
+func TestWithAncestorKey(t *testing.T) {
+	q, err := NewQuery(&ScopedComment{}).WithAncestorKey("ScopedPost", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := WithNamespace(context.Background(), "tenant")
+	key := *q.ancestor
+	if k := namespacedKey(ctx, &key); k.Kind != "ScopedPost" || k.ID != 7 || k.Namespace != "tenant" {
+		t.Fatalf("invalid ancestor %s", k)
+	}
+
+	if q.ancestor.Namespace != "" {
+		t.Fatal("the ancestor of the query has been modified")
+	}
+
+	if _, err := NewQuery(&ScopedComment{}).WithAncestorKey("ScopedPost", 1.5); err == nil {
+		t.Fatal("expected an error for an id of invalid type")
+	}
+}
+
+func TestDisjunctions(t *testing.T) {
+	q, err := NewQuery(&ScopedComment{}).WhereIn("Text", []interface{}{"a", "b", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(q.disjuncts) != 3 {
+		t.Fatalf("expected 3 queries, got %d", len(q.disjuncts))
+	}
+
+	// the filters added later apply to every value
+	if q = q.Limit(10); len(q.disjuncts) != 3 {
+		t.Fatalf("expected the derived query to keep 3 queries, got %d", len(q.disjuncts))
+	}
+
+	or, err := q.Or(NewQuery(&ScopedComment{}).WithField("Text =", "d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(or.disjuncts) != 4 || len(q.disjuncts) != 3 {
+		t.Fatalf("expected 4 queries, got %d", len(or.disjuncts))
+	}
+
+	if _, err := q.Or(NewQuery(&ScopedPost{})); err == nil {
+		t.Fatal("expected an error combining queries of different kinds")
+	}
+
+	values := make([]interface{}, maxDisjunctions+1)
+	if _, err := NewQuery(&ScopedComment{}).WhereIn("Text", values); err == nil {
+		t.Fatal("expected an error for too many values")
+	}
+}
+
+func TestWithKeyOperators(t *testing.T) {
+	key := datastore.IDKey("ScopedComment", 1, nil)
+	for _, op := range []string{"=", "<", "<=", ">", ">="} {
+		if _, err := NewQuery(&ScopedComment{}).WithKey(op, key); err != nil {
+			t.Fatalf("operator %s: %s", op, err.Error())
+		}
+	}
+
+	for _, op := range []string{"!=", "in", "~"} {
+		if _, err := NewQuery(&ScopedComment{}).WithKey(op, key); err == nil {
+			t.Fatalf("expected operator %s to be rejected", op)
+		}
+	}
+}
+
+type SoftDeletedPost struct {
+	Model
+	Title     string
+	DeletedAt time.Time `model:"softdelete"`
+}
+
+func TestSkipDeleted(t *testing.T) {
+	q := NewQuery(&SoftDeletedPost{})
+	if q.softDelete != "DeletedAt" {
+		t.Fatalf("expected the soft delete property DeletedAt, got %q", q.softDelete)
+	}
+
+	// the deleted entities are filtered only on demand, since the filter needs the property and an index
+	if q.skipDeleted {
+		t.Fatal("a new query skips the deleted entities")
+	}
+
+	skipping := q.SkipDeleted()
+	if !skipping.skipDeleted || q.skipDeleted {
+		t.Fatal("SkipDeleted must return a skipping copy of the query")
+	}
+
+	if skipping.WithDeleted().skipDeleted {
+		t.Fatal("WithDeleted must undo SkipDeleted")
+	}
+}
+
+func TestFirstOfUnion(t *testing.T) {
+	q, err := NewQuery(&ScopedComment{}).WhereIn("Text", []interface{}{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the keys only results of the union can't be merged under a property order
+	if _, err := q.OrderBy("Text", ASC).FirstKey(context.Background()); err != errDisjunctionOrder {
+		t.Fatalf("expected %v, got %v", errDisjunctionOrder, err)
+	}
+
+	parent := datastore.IDKey("ScopedPost", 1, nil)
+	ordered := []*datastore.Key{
+		parent,
+		datastore.IDKey("ScopedComment", 2, parent),
+		datastore.NameKey("ScopedComment", "a", parent),
+		datastore.IDKey("ScopedPost", 2, nil),
+		datastore.NameKey("ScopedPost", "a", nil),
+	}
+
+	for i := 1; i < len(ordered); i++ {
+		if compareKeys(ordered[i-1], ordered[i]) >= 0 || compareKeys(ordered[i], ordered[i-1]) <= 0 {
+			t.Fatalf("expected %s to come before %s", ordered[i-1], ordered[i])
+		}
+	}
+
+	if compareKeys(ordered[1], datastore.IDKey("ScopedComment", 2, parent)) != 0 {
+		t.Fatal("equal keys must compare as equal")
+	}
+}
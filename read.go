@@ -3,11 +3,21 @@ package model
 import (
 	"cloud.google.com/go/datastore"
 	"context"
-	"google.golang.org/appengine/log"
+	"fmt"
+	"reflect"
+	"time"
 )
 
 type ReadOptions struct {
 	attempts int
+	repair   bool
+	// if limited, references deeper than depth are not loaded
+	limited bool
+	depth   int
+	// if true, the properties that can't be loaded into their fields are skipped
+	ignoreMismatch bool
+	// if positive, the read is canceled once it runs longer
+	timeout time.Duration
 }
 
 func NewReadOptions() ReadOptions {
@@ -18,71 +28,238 @@ func (opts *ReadOptions) InTransaction(attempts int) {
 	opts.attempts = attempts
 }
 
+// Repairs the reference keys of the modelable after reading it from the datastore. See Repair
+func (opts *ReadOptions) WithRepair() {
+	opts.repair = true
+}
+
+// Loads the references of the modelable up to the given depth: 0 loads the root entity only,
+// 1 its direct references and so on. References past depth only get their key,
+// and can be loaded later on with LoadReference.
+// Partial trees are read from the datastore and are not cached, and they are not repaired
+func (opts *ReadOptions) LoadReferences(depth int) {
+	opts.limited = true
+	opts.depth = depth
+}
+
+// Loads the modelable and its references leniently, as SetLenientLoading does,
+// without reporting the properties that can't be loaded into their fields.
+// This is how the official datastore library behaves when ErrFieldMismatch errors are ignored
+func (opts *ReadOptions) IgnoreFieldMismatch() {
+	opts.ignoreMismatch = true
+}
+
+// Cancels the read, along with the reads of the references, if it takes longer than d.
+// The read then fails with context.DeadlineExceeded
+func (opts *ReadOptions) WithTimeout(d time.Duration) {
+	opts.timeout = d
+}
+
+// Reads data into the modelable according to the given options
+func ReadWithOptions(ctx context.Context, m modelable, opts *ReadOptions) (err error) {
+	ctx, span := startOperation(ctx, OpRead, "ReadWithOptions")
+	defer func() { span.end(ctx, m, err) }()
+
+	if timeout := operationTimeout(ctx, opts.timeout); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	ctx = withHookContext(ctx, OpRead, "ReadWithOptions", opts.attempts > 0, false)
+	if opts.ignoreMismatch {
+		ctx = context.WithValue(ctx, keyIgnoreMismatch, true)
+	}
+	if !opts.limited {
+		if opts.attempts > 0 {
+			return ReadInTransaction(ctx, m, opts)
+		}
+
+		if err := Read(ctx, m); err != nil {
+			return err
+		}
+
+		if opts.repair {
+			return Repair(ctx, m)
+		}
+		return nil
+	}
+
+	index(m)
+
+	if opts.attempts <= 0 {
+		if err := readDepth(ctx, m, opts.depth); err != nil {
+			return err
+		}
+		return afterLoad(ctx, m)
+	}
+
+	client := ClientFromContext(ctx)
+	_, err = client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		return readDepth(ctx, m, opts.depth)
+	}, datastore.MaxAttempts(transactionAttempts(ctx, opts.attempts)), datastore.ReadOnly)
+	if err != nil {
+		return err
+	}
+
+	return afterLoad(ctx, m)
+}
+
+// Loads the reference held by the given field of parent, which must have been read already.
+// It is meant for the references left unloaded by ReadOptions.LoadReferences
+func LoadReference(ctx context.Context, parent modelable, field string) error {
+	index(parent)
+	model := parent.getModel()
+
+	sf, ok := reflect.TypeOf(parent).Elem().FieldByName(field)
+	if !ok {
+		return fmt.Errorf("struct of type %s has no field with name %s", model.Name(), field)
+	}
+
+	for k, ref := range model.references {
+		if ref.idx != sf.Index[0] {
+			continue
+		}
+
+		rm := ref.Modelable.getModel()
+		if rm.Key == nil {
+			rm.Key = ref.Key
+		}
+
+		if rm.Key == nil {
+			return nil
+		}
+
+		if err := Read(ctx, ref.Modelable); err != nil {
+			return err
+		}
+
+		model.references[k].Key = rm.Key
+		return nil
+	}
+
+	return fmt.Errorf("field %s of %s is not a reference", field, model.Name())
+}
+
 func Read(ctx context.Context, m modelable) (err error) {
+	ctx, span := startOperation(ctx, OpRead, "Read")
+	defer func() { span.end(ctx, m, err) }()
+
+	ctx = withHookContext(ctx, OpRead, "Read", false, false)
 	index(m)
 
 	err = loadFromMemcache(ctx, m)
 	if err == nil {
-		return nil
+		if err = readChildrenTree(ctx, m); err != nil {
+			return err
+		}
+		return afterLoad(ctx, m)
 	}
 
 	err = read(ctx, m)
-	if err == nil {
-		if err = saveInMemcache(ctx, m); err != nil {
-			log.Warningf(ctx, "error saving modelable %s to memcache: %s", m.getModel().Name(), err.Error())
-		}
+	if err != nil {
+		return err
 	}
-	return err
+
+	if err = saveInMemcacheRepairing(ctx, m); err != nil {
+		warningf(ctx, "error saving modelable %s to memcache: %s", m.getModel().Name(), err.Error())
+	}
+
+	return afterLoad(ctx, m)
 }
 
 // Reads data from the datastore and writes them into the modelable.
 func ReadInTransaction(ctx context.Context, m modelable, opts *ReadOptions) (err error) {
+	ctx, span := startOperation(ctx, OpRead, "ReadInTransaction")
+	defer func() { span.end(ctx, m, err) }()
+
+	ctx = withHookContext(ctx, OpRead, "ReadInTransaction", true, false)
 	index(m)
 
 	err = loadFromMemcache(ctx, m)
 
 	if err == nil {
-		return nil
+		if err = readChildrenTree(ctx, m); err != nil {
+			return err
+		}
+
+		// the cached tree may be stale as well
+		if opts.repair {
+			if err := Repair(ctx, m); err != nil {
+				return err
+			}
+		}
+		return afterLoad(ctx, m)
 	}
 
-	to := datastore.MaxAttempts(opts.attempts)
+	to := datastore.MaxAttempts(transactionAttempts(ctx, opts.attempts))
 	// else we ignore the memcache result and we read from datastore
 	client := ClientFromContext(ctx)
 	_, err = client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
 		return read(ctx, m)
 	}, to, datastore.ReadOnly)
 
-	if err == nil {
-		if err := saveInMemcache(ctx, m); err != nil {
-			log.Warningf(ctx, "error saving modelable %s to memcache: %s", m.getModel().Name(), err.Error())
-		}
+	if err == nil && opts.repair {
+		err = repair(ctx, m)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err := saveInMemcacheRepairing(ctx, m); err != nil {
+		warningf(ctx, "error saving modelable %s to memcache: %s", m.getModel().Name(), err.Error())
 	}
-	return err
+
+	return afterLoad(ctx, m)
 }
 
 func read(ctx context.Context, m modelable) error {
+	return readDepth(ctx, m, -1)
+}
+
+// reads the modelable and its references up to depth. A negative depth reads the whole tree
+func readDepth(ctx context.Context, m modelable, depth int) error {
 	model := m.getModel()
 
 	if model.Key == nil {
 		return nil
 	}
 
-	client := ClientFromContext(ctx)
-	err := client.Get(ctx, model.Key, m)
+	defer traceModel(ctx, model)()
 
-	if err != nil {
+	ignore := ignoresFieldMismatch(ctx)
+	if ignore {
+		model.lenient = true
+		defer func() {
+			model.lenient = false
+		}()
+	}
+
+	err := getEntity(ctx, model.Key, m)
+
+	if err != nil && !(ignore && isFieldMismatch(err)) {
 		return err
 	}
 
 	for k, ref := range model.references {
-		rm := ref.Modelable.getModel()
-		err := read(ctx, ref.Modelable)
-		if err != nil {
+		if err := treeCanceled(ctx, m); err != nil {
 			return err
 		}
+
+		rm := ref.Modelable.getModel()
+		if depth != 0 {
+			if err := readDepth(ctx, ref.Modelable, depth-1); err != nil {
+				return err
+			}
+		}
 		ref.Key = rm.Key
 		model.references[k] = ref
 	}
 
+	if depth != 0 {
+		return readChildren(ctx, m)
+	}
+
 	return nil
 }
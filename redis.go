@@ -0,0 +1,211 @@
+package model
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// timeout applied to the redis connections when the context has no deadline
+const redisTimeout = 5 * time.Second
+
+// RedisCache is a Cache backed by a redis server.
+// It speaks the redis protocol over a small pool of connections.
+type RedisCache struct {
+	addr string
+	pool chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// returns a cache connecting to the redis server at addr, i.e. "localhost:6379".
+// At most poolSize idle connections are kept open
+func NewRedisCache(addr string, poolSize int) *RedisCache {
+	if poolSize <= 0 {
+		poolSize = 1
+	}
+	return &RedisCache{addr: addr, pool: make(chan *redisConn, poolSize)}
+}
+
+func (c *RedisCache) Get(ctx context.Context, key string) ([]byte, error) {
+	reply, err := c.do(ctx, "GET", []byte(key))
+	if err != nil {
+		return nil, err
+	}
+
+	if reply == nil {
+		return nil, ErrCacheMiss
+	}
+
+	v, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected redis reply %v", reply)
+	}
+	return v, nil
+}
+
+func (c *RedisCache) Set(ctx context.Context, key string, value []byte) error {
+	_, err := c.do(ctx, "SET", []byte(key), value)
+	return err
+}
+
+// Sets the value of the key, which expires after ttl. A non positive ttl never expires
+func (c *RedisCache) SetWithTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return c.Set(ctx, key, value)
+	}
+
+	ms := strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+	_, err := c.do(ctx, "SET", []byte(key), value, []byte("PX"), []byte(ms))
+	return err
+}
+
+func (c *RedisCache) Delete(ctx context.Context, key string) error {
+	reply, err := c.do(ctx, "DEL", []byte(key))
+	if err != nil {
+		return err
+	}
+
+	if n, ok := reply.(int64); ok && n == 0 {
+		return ErrCacheMiss
+	}
+	return nil
+}
+
+func (c *RedisCache) conn(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-c.pool:
+		return conn, nil
+	default:
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &redisConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+func (c *RedisCache) release(conn *redisConn) {
+	select {
+	case c.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// sends a command and reads its reply
+func (c *RedisCache) do(ctx context.Context, cmd string, args ...[]byte) (interface{}, error) {
+	conn, err := c.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(redisTimeout)
+	}
+
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "*%d\r\n$%d\r\n%s\r\n", len(args)+1, len(cmd), cmd)
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n", len(arg))
+		w.Write(arg)
+		w.WriteString("\r\n")
+	}
+
+	if err := w.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reply, err := readRedisReply(conn.r)
+	if err != nil {
+		// protocol errors leave the connection in an unknown state
+		if _, ok := err.(redisError); !ok {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	c.release(conn)
+	return reply, err
+}
+
+// an error reply of the redis server
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("invalid redis reply")
+	}
+
+	payload := line[1 : len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, redisError(payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+
+		if n < 0 {
+			return nil, nil
+		}
+
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+
+		if n < 0 {
+			return nil, nil
+		}
+
+		replies := make([]interface{}, n)
+		for i := range replies {
+			if replies[i], err = readRedisReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return replies, nil
+	}
+
+	return nil, fmt.Errorf("unknown redis reply type %q", line[0])
+}
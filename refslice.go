@@ -0,0 +1,186 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"reflect"
+)
+
+// Reference slices are fields of type []*T, where *T is a modelable.
+// They model one-to-many relations: the parent stores the keys of the children in a repeated property,
+// while each child is stored as an entity on its own.
+// Children are loaded with a batched read and written with batched creates and updates.
+
+// checks if the type is a slice of pointers to modelables
+func isReferenceSlice(t reflect.Type) bool {
+	if t.Kind() != reflect.Slice {
+		return false
+	}
+
+	et := t.Elem()
+	return et.Kind() == reflect.Ptr && et.Elem().Kind() == reflect.Struct && et.Implements(typeOfModelable)
+}
+
+// returns the keys of the children held by the slice value, to be saved as a repeated property
+func referenceSliceKeys(v reflect.Value) []interface{} {
+	keys := make([]interface{}, 0, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		if v.Index(i).IsNil() {
+			continue
+		}
+
+		child := v.Index(i).Interface().(modelable)
+		if key := child.getModel().Key; key != nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// fills the slice field with new children holding the keys stored in the property.
+// The children are loaded later on with readChildren
+func decodeReferenceSlice(field reflect.Value, p datastore.Property) error {
+	var values []interface{}
+	switch x := p.Value.(type) {
+	case []interface{}:
+		values = x
+	case *datastore.Key:
+		values = []interface{}{x}
+	default:
+		if p.Value != nil {
+			return &PropertyError{Name: p.Name, Kind: field.Kind(), Value: p.Value, Err: ErrTypeMismatch}
+		}
+	}
+
+	children := reflect.MakeSlice(field.Type(), 0, len(values))
+	for _, v := range values {
+		key, ok := v.(*datastore.Key)
+		if !ok {
+			return &PropertyError{Name: p.Name, Kind: field.Kind(), Value: v, Err: ErrTypeMismatch}
+		}
+
+		child := reflect.New(field.Type().Elem().Elem())
+		m := child.Interface().(modelable)
+		index(m)
+		m.getModel().Key = key
+		children = reflect.Append(children, child)
+	}
+
+	field.Set(children)
+	return nil
+}
+
+// reads the children of the reference slices of the modelable with a batched read for each slice
+func readChildren(ctx context.Context, m modelable) error {
+	model := m.getModel()
+	val := reflect.ValueOf(m).Elem()
+
+	for _, idx := range model.referenceSlicesIdx {
+		field := val.Field(idx)
+		if field.Len() == 0 {
+			continue
+		}
+
+		if err := treeCanceled(ctx, m); err != nil {
+			return err
+		}
+
+		for i := 0; i < field.Len(); i++ {
+			if !field.Index(i).IsNil() {
+				index(field.Index(i).Interface().(modelable))
+			}
+		}
+
+		if err := ReadMulti(ctx, field.Interface()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reads the children of the reference slices of the modelable and of all its references.
+// It is used when the tree is loaded from the cache, which doesn't hold the children
+func readChildrenTree(ctx context.Context, m modelable) error {
+	if err := readChildren(ctx, m); err != nil {
+		return err
+	}
+
+	for _, ref := range m.getModel().references {
+		if ref.Modelable.getModel().Key == nil {
+			continue
+		}
+
+		if err := treeCanceled(ctx, m); err != nil {
+			return err
+		}
+
+		if err := readChildrenTree(ctx, ref.Modelable); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writes the children of the reference slices of the modelable:
+// new children are created and the existing ones are updated, with a batch for each
+func writeChildren(ctx context.Context, m modelable) error {
+	model := m.getModel()
+	val := reflect.ValueOf(m).Elem()
+
+	for _, idx := range model.referenceSlicesIdx {
+		if err := treeCanceled(ctx, m); err != nil {
+			return err
+		}
+
+		field := val.Field(idx)
+
+		var created []modelable
+		var updated []modelable
+		for i := 0; i < field.Len(); i++ {
+			if field.Index(i).IsNil() {
+				continue
+			}
+
+			child := field.Index(i).Interface().(modelable)
+			if child.getModel().Key == nil {
+				created = append(created, child)
+			} else {
+				updated = append(updated, child)
+			}
+		}
+
+		if len(created) > 0 {
+			if err := CreateMulti(ctx, created, nil); err != nil {
+				return err
+			}
+		}
+
+		if len(updated) > 0 {
+			if err := UpdateMulti(ctx, updated, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// returns the children held by the reference slices of the modelable
+func childrenOf(m modelable) []modelable {
+	model := m.getModel()
+	val := reflect.ValueOf(m).Elem()
+
+	var children []modelable
+	for _, idx := range model.referenceSlicesIdx {
+		field := val.Field(idx)
+		for i := 0; i < field.Len(); i++ {
+			if !field.Index(i).IsNil() {
+				children = append(children, field.Index(i).Interface().(modelable))
+			}
+		}
+	}
+
+	return children
+}
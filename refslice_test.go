@@ -0,0 +1,74 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"testing"
+)
+
+type sliceChild struct {
+	Model
+	Name string
+}
+
+type sliceParent struct {
+	Model
+	Name     string
+	Children []*sliceChild
+}
+
+func TestReferenceSliceProperties(t *testing.T) {
+	parent := sliceParent{Name: "parent"}
+	for i := int64(1); i <= 2; i++ {
+		child := &sliceChild{}
+		index(child)
+		child.Key = datastore.IDKey("sliceChild", i, nil)
+		parent.Children = append(parent.Children, child)
+	}
+	index(&parent)
+
+	props, err := toPropertyList(&parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []interface{}
+	for _, p := range props {
+		if p.Name == "Children" {
+			keys, _ = p.Value.([]interface{})
+		}
+	}
+
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 children keys, got %v", props)
+	}
+
+	loaded := sliceParent{}
+	index(&loaded)
+	if err := fromPropertyList(&loaded, props); err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.Name != "parent" || len(loaded.Children) != 2 {
+		t.Fatalf("invalid loaded parent %+v", loaded)
+	}
+
+	for i, child := range loaded.Children {
+		if !child.Key.Equal(parent.Children[i].Key) {
+			t.Fatalf("child %d has key %v, expected %v", i, child.Key, parent.Children[i].Key)
+		}
+	}
+}
+
+func TestAtomicCreateRejectsChildren(t *testing.T) {
+	parent := sliceParent{Name: "parent"}
+	index(&parent)
+	if err := checkAtomicTree(&parent); err != nil {
+		t.Fatalf("unexpected error for a parent without children: %s", err)
+	}
+
+	parent.Children = []*sliceChild{{Name: "child"}}
+	index(&parent)
+	if err := checkAtomicTree(&parent); err == nil {
+		t.Fatal("expected an error for a parent with children")
+	}
+}
@@ -0,0 +1,88 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"reflect"
+)
+
+// Repair walks the reference tree of the modelable and reconciles the key of each reference model,
+// the key its parent holds for the reference and the key stored in the parent entity.
+// The stored key wins if it points to an existing entity: the reference is reloaded from it.
+// Otherwise the parent entity is stale and it is rewritten with the in-memory reference key.
+// Once repaired, the modelable is saved in memcache.
+func Repair(ctx context.Context, m modelable) error {
+	index(m)
+
+	if err := repair(ctx, m); err != nil {
+		return err
+	}
+
+	return cacheWritten(ctx, m, saveInMemcacheRepairing)
+}
+
+func repair(ctx context.Context, m modelable) error {
+	model := m.getModel()
+	if model.Key == nil {
+		return nil
+	}
+
+	client := ClientFromContext(ctx)
+
+	var stored datastore.PropertyList
+	if err := client.Get(ctx, model.Key, &stored); err != nil {
+		return err
+	}
+
+	storedKeys := make(map[string]*datastore.Key)
+	for _, p := range stored {
+		if k, ok := p.Value.(*datastore.Key); ok {
+			storedKeys[p.Name] = k
+		}
+	}
+
+	typ := reflect.TypeOf(m).Elem()
+	rewrite := false
+
+	for i, ref := range model.references {
+		rm := ref.Modelable.getModel()
+		sk := storedKeys[storedFieldNames(model.encodedStruct, []string{typ.Field(ref.idx).Name})[0]]
+
+		if sk != nil && !sk.Equal(rm.Key) {
+			err := client.Get(ctx, sk, &datastore.PropertyList{})
+			switch err {
+			case nil:
+				// the in-memory reference is stale: reload it from the stored key
+				rm.Key = sk
+				if err := read(ctx, ref.Modelable); err != nil {
+					return err
+				}
+			case datastore.ErrNoSuchEntity:
+				// the stored key is dangling
+				rewrite = true
+			default:
+				return err
+			}
+		} else if sk == nil && rm.Key != nil {
+			rewrite = true
+		}
+
+		ref.Key = rm.Key
+		model.references[i] = ref
+
+		if rm.readonly {
+			continue
+		}
+
+		if err := repair(ctx, ref.Modelable); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+	}
+
+	if !rewrite {
+		return nil
+	}
+
+	_, err := client.Put(ctx, model.Key, m)
+	return err
+}
@@ -0,0 +1,95 @@
+package model
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const keyRequestCache = "__model_request_cache"
+
+// requestCache memoizes the cached entities for the lifetime of a context, usually a request
+type requestCache struct {
+	mutex sync.Mutex
+	items map[string][]byte
+}
+
+// layeredCache puts the request cache in front of the cache of the context: entities read more than once
+// within the request, like a reference shared by several parents, are decoded from the memoized values
+// without hitting the cache again. Writes and deletes go through both layers
+type layeredCache struct {
+	*requestCache
+	next Cache
+}
+
+// WithRequestCache returns a context memoizing the cached entities read or written through it.
+// Entities written by other requests after they have been memoized are not seen by the context,
+// thus it must not outlive the request. See Service.EnableRequestCache
+func WithRequestCache(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(keyRequestCache).(*requestCache); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, keyRequestCache, &requestCache{items: map[string][]byte{}})
+}
+
+// returns the request cache of the context layered on the given cache, or the cache itself if the context has none
+func requestCacheOf(ctx context.Context, next Cache) Cache {
+	rc, ok := ctx.Value(keyRequestCache).(*requestCache)
+	if !ok {
+		return next
+	}
+	return layeredCache{requestCache: rc, next: next}
+}
+
+func (c layeredCache) Get(ctx context.Context, key string) ([]byte, error) {
+	c.mutex.Lock()
+	value, ok := c.items[key]
+	c.mutex.Unlock()
+	if ok {
+		return value, nil
+	}
+
+	value, err := c.next.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	c.items[key] = value
+	c.mutex.Unlock()
+	return value, nil
+}
+
+func (c layeredCache) Set(ctx context.Context, key string, value []byte) error {
+	if err := c.next.Set(ctx, key, value); err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	c.items[key] = value
+	c.mutex.Unlock()
+	return nil
+}
+
+func (c layeredCache) SetWithTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	ec, ok := c.next.(ExpiringCache)
+	if !ok {
+		return c.Set(ctx, key, value)
+	}
+
+	if err := ec.SetWithTTL(ctx, key, value, ttl); err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	c.items[key] = value
+	c.mutex.Unlock()
+	return nil
+}
+
+func (c layeredCache) Delete(ctx context.Context, key string) error {
+	c.mutex.Lock()
+	delete(c.items, key)
+	c.mutex.Unlock()
+	return c.next.Delete(ctx, key)
+}
@@ -0,0 +1,17 @@
+package model
+
+import (
+	"context"
+)
+
+// Writes the modelable to the datastore: the entity is created if the modelable has no Key, updated otherwise.
+// References are handled as Create and Update do
+func Save(ctx context.Context, m modelable) error {
+	index(m)
+
+	if m.getModel().Key == nil {
+		return Create(withHookContext(ctx, OpCreate, "Save", false, false), m)
+	}
+
+	return Update(withHookContext(ctx, OpUpdate, "Save", false, false), m)
+}
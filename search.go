@@ -5,9 +5,9 @@ import (
 	"cloud.google.com/go/datastore"
 	"context"
 	"fmt"
-	"google.golang.org/appengine"
 	"google.golang.org/appengine/search"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -18,6 +18,20 @@ const tagSearch string = "search"
 const tagAtom string = "atom"
 const tagHTML string = "HTML"
 
+// indexes the edge n-grams of a string field to allow prefix searches
+const tagPrefix string = "prefix"
+
+// indexes the value of a string or numeric field as a facet too, to count the results by value.
+// See searchQuery.Facet
+const tagFacet string = "facet"
+
+// suffix of the atom fields holding the edge n-grams of a prefix field
+const prefixFieldSuffix string = "_prefix"
+
+// maximum length of the indexed edge n-grams.
+// Longer prefixes are truncated at query time
+const maxPrefixLen int = 20
+
 type searchType int
 
 const (
@@ -32,11 +46,21 @@ const (
 	_geopoint
 )
 
+// separates the names of the nested searchable fields, i.e. Child_Name.
+// The App Engine Search API allows letters, digits and underscores only in field names
+const searchFieldSeparator string = "_"
+
 // describes the searchable fields for each modelable
 type fieldDescriptor struct {
 	index int
-	name  string
+	// the index sequence of nested fields, starting from the top level field index
+	path []int
+	name string
 	searchType
+	// if true the edge n-grams of the field are indexed too
+	prefix bool
+	// if true the field is indexed as a facet too
+	facet bool
 }
 
 var searchMutex sync.Mutex
@@ -67,20 +91,51 @@ func getSearchablefields(t reflect.Type) []*fieldDescriptor {
 	}
 	searchMutex.Unlock()
 
+	descriptors := searchableFieldsOf(t, nil, "")
+
+	searchMutex.Lock()
+	searchableDefs[t] = descriptors
+	searchMutex.Unlock()
+
+	return descriptors
+}
+
+// maps the searchable fields of t, whose index sequence in the modelable is path.
+// References and nested structs are traversed, and their searchable fields are named after the path, i.e. Child_Name.
+// The fields of embedded structs keep their name
+func searchableFieldsOf(t reflect.Type, path []int, prefix string) []*fieldDescriptor {
 	var descriptors []*fieldDescriptor
 
 	for i := 0; i < t.NumField(); i++ {
 		field := t.Field(i)
+		if field.Type == typeOfModel || field.PkgPath != "" {
+			continue
+		}
 
 		tags := strings.Split(field.Tag.Get(tagDomain), ",")
+		if containsTag(tags, tagSkip) != "" {
+			continue
+		}
+
+		fpath := append(append([]int{}, path...), i)
+
+		if field.Type.Kind() == reflect.Struct && field.Type != typeOfTime && field.Type != typeOfGeoPoint {
+			nested := prefix
+			if !field.Anonymous {
+				nested = prefix + field.Name + searchFieldSeparator
+			}
+			descriptors = append(descriptors, searchableFieldsOf(field.Type, fpath, nested)...)
+		}
 
 		name := containsTag(tags, tagSearch)
 
 		// the field has been flagged if it has model:search tag
 		if name != "" {
 			desc := fieldDescriptor{}
-			desc.index = i
-			desc.name = field.Name
+			desc.index = fpath[0]
+			desc.path = fpath
+			desc.name = prefix + field.Name
+			desc.facet = containsTag(tags, tagFacet) != ""
 
 			switch field.Type.Kind() {
 			case reflect.String:
@@ -91,6 +146,7 @@ func getSearchablefields(t reflect.Type) []*fieldDescriptor {
 				} else {
 					desc.searchType = _str
 				}
+				desc.prefix = containsTag(tags, tagPrefix) != ""
 			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 				desc.searchType = _int
 			case reflect.Float32, reflect.Float64:
@@ -111,38 +167,47 @@ func getSearchablefields(t reflect.Type) []*fieldDescriptor {
 			descriptors = append(descriptors, &desc)
 		}
 	}
-	searchMutex.Lock()
-	searchableDefs[t] = descriptors
-	searchMutex.Unlock()
 
 	return descriptors
 }
 
 func (model *searchable) Save() ([]search.Field, *search.DocumentMetadata, error) {
+	fields, facets := appEngineFields(model.document())
+	if facets != nil {
+		return fields, &search.DocumentMetadata{Facets: facets}, nil
+	}
+
+	return fields, nil, nil
+}
+
+// returns the search document of the searchable fields of the modelable
+func (model *searchable) document() SearchDocument {
 
 	descs := getSearchablefields(reflect.TypeOf(model.modelable).Elem())
 	l := len(descs)
 
 	if l == 0 {
-		return nil, nil, nil
+		return SearchDocument{}
 	}
 
+	typ := reflect.TypeOf(model.modelable).Elem()
 	val := reflect.ValueOf(model.modelable).Elem()
 
-	fields := make([]search.Field, l, cap(descs))
+	fields := make([]SearchField, l, cap(descs))
+	var facets []SearchFacet
 
 	for i, desc := range descs {
 		sf := &fields[i]
 		sf.Name = desc.name
 
-		field := val.Field(desc.index)
+		field := val.FieldByIndex(desc.path)
 		switch desc.searchType {
 		case _str:
-			sf.Value = field.String()
+			sf.Value = analyze(typ, field.String())
 		case _html:
-			sf.Value = search.HTML(field.String())
+			sf.Value = SearchHTML(field.String())
 		case _atom:
-			sf.Value = search.Atom(field.String())
+			sf.Value = SearchAtom(analyze(typ, field.String()))
 		case _f64:
 			sf.Value = float64(field.Float())
 		case _int:
@@ -156,19 +221,64 @@ func (model *searchable) Save() ([]search.Field, *search.DocumentMetadata, error
 				sf.Value = t
 			}
 		case _geopoint:
-			np := field.Interface().(datastore.GeoPoint)
-			legacy := appengine.GeoPoint{}
-			legacy.Lat = np.Lat
-			legacy.Lng = np.Lng
-			sf.Value = legacy
+			sf.Value = field.Interface().(datastore.GeoPoint)
 		case _key:
-			key := model.referenceAtIndex(desc.index).Key
-			sf.Value = search.Atom(key.Encode())
+			var key *datastore.Key
+			if len(desc.path) == 1 {
+				key = model.referenceAtIndex(desc.index).Key
+			} else {
+				// a reference of a reference
+				key = field.Addr().Interface().(modelable).getModel().Key
+			}
+
+			if key != nil {
+				sf.Value = SearchAtom(key.Encode())
+			} else {
+				sf.Value = SearchAtom("")
+			}
+		}
+
+		if desc.facet {
+			switch v := sf.Value.(type) {
+			case string:
+				facets = append(facets, SearchFacet{Name: desc.name, Value: SearchAtom(v)})
+			case SearchAtom:
+				facets = append(facets, SearchFacet{Name: desc.name, Value: v})
+			case float64:
+				facets = append(facets, SearchFacet{Name: desc.name, Value: v})
+			}
+		}
+
+		if desc.prefix {
+			for _, gram := range edgeGrams(analyze(typ, field.String())) {
+				fields = append(fields, SearchField{Name: prefixFieldName(desc.name), Value: SearchAtom(gram)})
+			}
 		}
 	}
 
-	return fields, nil, nil
+	return SearchDocument{Fields: fields, Facets: facets}
+}
 
+func prefixFieldName(name string) string {
+	return name + prefixFieldSuffix
+}
+
+// returns the edge n-grams of each word of s, i.e. "Enzo" gives "e", "en", "enz", "enzo"
+func edgeGrams(s string) []string {
+	var grams []string
+	seen := make(map[string]bool)
+	for _, word := range strings.Fields(strings.ToLower(s)) {
+		r := []rune(word)
+		for i := 1; i <= len(r) && i <= maxPrefixLen; i++ {
+			gram := string(r[:i])
+			if seen[gram] {
+				continue
+			}
+			seen[gram] = true
+			grams = append(grams, gram)
+		}
+	}
+	return grams
 }
 
 func SearchPut(ctx context.Context, mlable modelable) error {
@@ -178,15 +288,7 @@ func SearchPut(ctx context.Context, mlable modelable) error {
 
 // adds the model to the index
 func searchPut(ctx context.Context, model *Model, name string) error {
-
-	index, err := search.Open(name)
-	if nil != err {
-		return err
-	}
-
-	_, err = index.Put(ctx, model.EncodedKey(), &searchable{Model: model})
-
-	return err
+	return searchPutMulti(ctx, []*Model{model}, name)
 }
 
 func SearchPutMulti(ctx context.Context, src interface{}) error {
@@ -215,35 +317,63 @@ func SearchPutMulti(ctx context.Context, src interface{}) error {
 	return searchPutMulti(ctx, models, name)
 }
 
+// maximum number of documents put in the search index with a single call
+const searchBatchSize int = 200
+
+// adds the modelables, which must be of the same type, to the index in batches
+func searchPutModelables(ctx context.Context, ms []modelable) error {
+	for start := 0; start < len(ms); start += searchBatchSize {
+		end := start + searchBatchSize
+		if end > len(ms) {
+			end = len(ms)
+		}
+
+		models := make([]*Model, 0, end-start)
+		for _, m := range ms[start:end] {
+			models = append(models, m.getModel())
+		}
+
+		if err := searchPutMulti(ctx, models, models[0].Name()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func searchPutMulti(ctx context.Context, models []*Model, name string) error {
-	keys := make([]string, len(models), cap(models))
-	items := make([]interface{}, len(models), cap(models))
+	keys := make([]string, len(models))
+	docs := make([]SearchDocument, len(models))
 	for i := range models {
 		keys[i] = models[i].EncodedKey()
-		searchable := &searchable{Model: models[i]}
-		items[i] = searchable
+		docs[i] = (&searchable{Model: models[i]}).document()
 	}
 
-	index, err := search.Open(name)
+	countSearchCall(ctx, name, "Put")
+	return searchBackendFromContext(ctx).IndexPut(ctx, name, keys, docs)
+}
+
+// removes the documents with the given ids from the index in batches
+func searchDeleteMulti(ctx context.Context, ids []string, name string) error {
+	backend := searchBackendFromContext(ctx)
+	for start := 0; start < len(ids); start += searchBatchSize {
+		end := start + searchBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
 
-	if err != nil {
-		panic(err)
-		recover()
-		return err
+		countSearchCall(ctx, name, "Delete")
+		if err := backend.IndexDelete(ctx, name, ids[start:end]); err != nil {
+			return err
+		}
 	}
 
-	_, err = index.PutMulti(ctx, keys, items)
-
-	return err
+	return nil
 }
 
 func searchDelete(ctx context.Context, model *Model, name string) error {
-	index, err := search.Open(name)
-	if nil != err {
-		return nil
-	}
-
-	return index.Delete(ctx, model.EncodedKey())
+	countSearchCall(ctx, name, "Delete")
+	return searchBackendFromContext(ctx).IndexDelete(ctx, name, []string{model.EncodedKey()})
 }
 
 //stays at nil -> ignores the struct datas and gets a key only query from datastore
@@ -256,6 +386,8 @@ type searchQuery struct {
 	name  string
 	mType reflect.Type
 	query bytes.Buffer
+	// the fields whose values are counted
+	facets []string
 }
 
 func NewSearchQuery(m modelable) *searchQuery {
@@ -288,47 +420,124 @@ func (sq *searchQuery) SearchWithModel(field string, ref modelable, op searchOp)
 	sq.query.WriteString(ref.getModel().EncodedKey())
 }
 
+//adds a field comparison to the query. The value is processed by the search analyzer
+//registered for the modelable type, so that it matches the indexed values.
+//field must contain the operator, i.e. "Name ="
+func (sq *searchQuery) SearchWithValue(field string, value string, op searchOp) {
+
+	if sq.query.Len() != 0 && op != SearchNoOp {
+		sq.query.WriteString(" ")
+		sq.query.WriteString(string(op))
+		sq.query.WriteString(" ")
+	}
+
+	sq.query.WriteString(field)
+	sq.query.WriteString(" ")
+	sq.query.WriteString(strconv.Quote(analyze(sq.mType, value)))
+}
+
+//adds a prefix match on a field tagged with "search,prefix".
+//Each word of value must be the prefix of a word of the field.
+//The condition is put in AND with the existing query
+func (sq *searchQuery) Prefix(field string, value string) {
+	for _, word := range strings.Fields(strings.ToLower(analyze(sq.mType, value))) {
+		r := []rune(word)
+		if len(r) > maxPrefixLen {
+			word = string(r[:maxPrefixLen])
+		}
+
+		if sq.query.Len() != 0 {
+			sq.query.WriteString(" ")
+			sq.query.WriteString(string(SearchAnd))
+			sq.query.WriteString(" ")
+		}
+
+		sq.query.WriteString(prefixFieldName(field))
+		sq.query.WriteString(" = ")
+		sq.query.WriteString(strconv.Quote(word))
+	}
+}
+
+//counts the results by the values of the given field, which must be tagged "search,facet".
+//The counts are returned by SearchPage
+func (sq *searchQuery) Facet(field string) {
+	sq.facets = append(sq.facets, field)
+}
+
+// the outcome of a search
+type SearchResult struct {
+	// the number of matching documents, which may be approximate
+	Count int
+	// the cursor of the next page, empty if there are no more results
+	Cursor string
+	Facets []FacetResult
+}
+
+// the number of results for each value of a facet
+type FacetResult struct {
+	Name   string
+	Values []FacetCount
+}
+
+type FacetCount struct {
+	Value string
+	Count int
+}
+
 func (sq *searchQuery) Search(ctx context.Context, dst interface{}, opts *search.SearchOptions) (int, error) {
+	res, err := sq.SearchPage(ctx, dst, opts, "")
+	if res == nil {
+		return 0, err
+	}
+	return res.Count, err
+}
+
+//SearchPage loads into dst a page of results starting from cursor, which is empty for the first page.
+//The size of the page is the limit of the options. The result holds the cursor of the next page and
+//the counts of the facets requested with Facet
+func (sq *searchQuery) SearchPage(ctx context.Context, dst interface{}, opts *search.SearchOptions, cursor string) (*SearchResult, error) {
+	res, err := sq.searchInto(ctx, dst, opts, cursor)
+	if res == nil {
+		return nil, err
+	}
+	return &SearchResult{Count: res.Count, Cursor: res.Cursor, Facets: res.Facets}, err
+}
+
+//runs the query and appends the matching modelables to dst, in the order of the response of the backend
+func (sq *searchQuery) searchInto(ctx context.Context, dst interface{}, opts *search.SearchOptions, cursor string) (*SearchResponse, error) {
 
 	dstv := reflect.ValueOf(dst)
 
 	if !isValidContainer(dstv) {
-		return 0, fmt.Errorf("invalid container of type %s. Container must be a modelable slice", dstv.Elem().Type().Name())
+		return nil, fmt.Errorf("invalid container of type %s. Container must be a modelable slice", dstv.Elem().Type().Name())
 	}
 
 	modelables := dstv.Elem()
 
-	//always do a id-only key. retrieval is demanded to model
+	// the backends return the ids only: the modelables are read from the datastore
 	if nil == opts {
 		opts = &search.SearchOptions{}
 	}
-	opts.IDsOnly = true
-
-	idx, err := search.Open(sq.name)
 
+	req := SearchRequest{Query: sq.query.String(), Limit: opts.Limit, Offset: opts.Offset, Cursor: cursor, Facets: sq.facets}
+	if opts.Sort != nil {
+		for _, e := range opts.Sort.Expressions {
+			req.Sort = append(req.Sort, SearchSort{Expr: e.Expr, Reverse: e.Reverse})
+		}
+	}
+	countSearchCall(ctx, sq.name, "Query")
+	res, err := searchBackendFromContext(ctx).Query(ctx, sq.name, req)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	query := sq.query.String()
-
-	count := 0
-
-	for it := idx.Search(ctx, query, opts); ; {
-		count = it.Count()
-		k, e := it.Next(nil)
-
-		if e == search.Done {
-			break
-		}
-
+	for _, k := range res.IDs {
 		newModelable := reflect.New(sq.mType)
 		m, ok := newModelable.Interface().(modelable)
 
 		if !ok {
 			err = fmt.Errorf("can't cast struct of type %s to modelable", sq.mType.Name())
-			sq = nil
-			return count, err
+			return res, err
 		}
 
 		//Note: indexing here assigns the address of m to the Model.
@@ -340,12 +549,12 @@ func (sq *searchQuery) Search(ctx context.Context, dst interface{}, opts *search
 		model.Key, err = datastore.DecodeKey(k)
 		if err != nil {
 			// todo: handle case
-			return count, err
+			return res, err
 		}
 
 		modelables.Set(reflect.Append(modelables, reflect.ValueOf(m)))
 	}
 
-	return count, ReadMulti(ctx, reflect.Indirect(dstv).Interface())
+	return res, ReadMulti(ctx, reflect.Indirect(dstv).Interface())
 
 }
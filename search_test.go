@@ -9,6 +9,7 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -167,7 +168,7 @@ func TestSearch(t *testing.T) {
 	results = make([]*SearchableModel, 0, 0)
 	rigattiere := Job{}
 	query := NewQuery(&rigattiere)
-	query.WithField("Name =", "Rigattiere")
+	query = query.WithField("Name =", "Rigattiere")
 	err = query.First(ctx, &rigattiere)
 
 	if err != nil {
@@ -192,3 +193,52 @@ func TestSearch(t *testing.T) {
 		}
 	}
 }
+
+func TestEdgeGrams(t *testing.T) {
+	grams := edgeGrams("Enzo Eno")
+	expected := []string{"e", "en", "enz", "enzo", "eno"}
+
+	if len(grams) != len(expected) {
+		t.Fatalf("invalid grams %v, expected %v", grams, expected)
+	}
+
+	for i := range expected {
+		if grams[i] != expected[i] {
+			t.Fatalf("invalid gram at index %d: %q, expected %q", i, grams[i], expected[i])
+		}
+	}
+}
+
+type SearchableAddress struct {
+	City string `model:"search,atom"`
+}
+
+type SearchableEmployer struct {
+	Model
+	Name    string `model:"search"`
+	Address SearchableAddress
+}
+
+type NestedSearchable struct {
+	Model
+	Title    string `model:"search"`
+	Employer SearchableEmployer
+}
+
+func TestNestedSearchableFields(t *testing.T) {
+	descs := getSearchablefields(reflect.TypeOf(NestedSearchable{}))
+
+	names := make([]string, len(descs))
+	for i, d := range descs {
+		names[i] = d.name
+	}
+
+	expected := []string{"Title", "Employer_Name", "Employer_Address_City"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("searchable fields are %v, expected %v", names, expected)
+	}
+
+	if descs[2].searchType != _atom || !reflect.DeepEqual(descs[2].path, []int{2, 2, 0}) {
+		t.Fatalf("unexpected descriptor %+v", descs[2])
+	}
+}
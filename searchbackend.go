@@ -0,0 +1,250 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"fmt"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/search"
+	"os"
+)
+
+const keySearchBackend = "__model_search_backend"
+
+// selects the search backend of the service when none is set with Service.WithSearchBackend.
+// "elasticsearch" uses an ElasticsearchBackend reaching the cluster at ELASTICSEARCH_URL,
+// anything else uses the App Engine Search API
+const envSearchBackend string = "MODEL_SEARCH"
+const envElasticsearchURL string = "ELASTICSEARCH_URL"
+
+// SearchBackend stores the documents of the searchable modelables and runs the search queries on them.
+// Documents are identified by the encoded key of their modelable and are grouped in an index for each kind.
+// Queries use the syntax of the App Engine Search API, i.e. `Name = "Enzo" AND Age > 30`:
+// backends other than AppEngineSearch translate them to their own syntax
+type SearchBackend interface {
+	// adds the documents to the index, replacing the existing ones with the same ids
+	IndexPut(ctx context.Context, index string, ids []string, docs []SearchDocument) error
+	// removes the documents with the given ids from the index
+	IndexDelete(ctx context.Context, index string, ids []string) error
+	// returns a page of the documents matching the request
+	Query(ctx context.Context, index string, req SearchRequest) (*SearchResponse, error)
+}
+
+// the fields and the facets of a searchable modelable
+type SearchDocument struct {
+	Fields []SearchField
+	Facets []SearchFacet
+}
+
+// a field of a search document.
+// Value is a string, a SearchAtom, a SearchHTML, a float64, a time.Time or a datastore.GeoPoint
+type SearchField struct {
+	Name  string
+	Value interface{}
+}
+
+// a facet of a search document, whose values are counted. Value is a SearchAtom or a float64
+type SearchFacet struct {
+	Name  string
+	Value interface{}
+}
+
+// a string field matched as a whole, i.e. a key or a tag
+type SearchAtom string
+
+// a string field holding HTML, whose markup is not searched
+type SearchHTML string
+
+// a sort expression of a search request.
+// Documents are sorted by the expression in descending order, unless reversed
+type SearchSort struct {
+	Expr    string
+	Reverse bool
+}
+
+type SearchRequest struct {
+	Query string
+	// the maximum number of documents of the page, 0 for the default of the backend
+	Limit int
+	// the number of documents skipped by the first page
+	Offset int
+	// the sort expressions, documents are sorted by relevance if empty
+	Sort []SearchSort
+	// where the page starts, as returned by the previous page. Empty for the first page
+	Cursor string
+	// the facets whose values are counted
+	Facets []string
+}
+
+type SearchResponse struct {
+	// the ids of the documents of the page
+	IDs []string
+	// the relevance scores of the documents, aligned with IDs. Nil if the backend doesn't score the documents
+	Scores []float64
+	// the number of matching documents
+	Count int
+	// the cursor of the next page, empty if there are no more results
+	Cursor string
+	Facets []FacetResult
+}
+
+// returns the search backend of the context, scoped by the namespace of the context if any
+func searchBackendFromContext(ctx context.Context) SearchBackend {
+	b, ok := ctx.Value(keySearchBackend).(SearchBackend)
+	if !ok {
+		b = AppEngineSearch{}
+	}
+
+	if ns := NamespaceFromContext(ctx); ns != "" {
+		return namespacedSearch{SearchBackend: b, namespace: ns}
+	}
+	return b
+}
+
+func searchBackendFromEnv() SearchBackend {
+	if os.Getenv(envSearchBackend) != "elasticsearch" {
+		return nil
+	}
+
+	url := os.Getenv(envElasticsearchURL)
+	if url == "" {
+		panic(fmt.Errorf("error initializing the elasticsearch backend: %s is not set", envElasticsearchURL))
+	}
+	return NewElasticsearchBackend(url)
+}
+
+// AppEngineSearch is the SearchBackend using the App Engine Search API.
+// It is the default backend, and it is available on the legacy App Engine runtime only
+type AppEngineSearch struct{}
+
+func (AppEngineSearch) IndexPut(ctx context.Context, index string, ids []string, docs []SearchDocument) error {
+	idx, err := search.Open(index)
+	if err != nil {
+		return err
+	}
+
+	items := make([]interface{}, len(docs))
+	for i := range docs {
+		items[i] = &appEngineDocument{doc: docs[i]}
+	}
+
+	_, err = idx.PutMulti(ctx, ids, items)
+	return err
+}
+
+func (AppEngineSearch) IndexDelete(ctx context.Context, index string, ids []string) error {
+	idx, err := search.Open(index)
+	if err != nil {
+		return nil
+	}
+
+	if len(ids) == 1 {
+		return idx.Delete(ctx, ids[0])
+	}
+	return idx.DeleteMulti(ctx, ids)
+}
+
+func (AppEngineSearch) Query(ctx context.Context, index string, req SearchRequest) (*SearchResponse, error) {
+	idx, err := search.Open(index)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := search.SearchOptions{IDsOnly: true, Limit: req.Limit, Offset: req.Offset, Cursor: search.Cursor(req.Cursor)}
+	if len(req.Sort) > 0 {
+		opts.Sort = &search.SortOptions{}
+		for _, e := range req.Sort {
+			opts.Sort.Expressions = append(opts.Sort.Expressions, search.SortExpression{Expr: e.Expr, Reverse: e.Reverse})
+		}
+	}
+	for _, f := range req.Facets {
+		opts.Facets = append(opts.Facets, search.FacetDiscovery(f))
+	}
+
+	res := &SearchResponse{}
+	it := idx.Search(ctx, req.Query, &opts)
+	for {
+		id, err := it.Next(nil)
+		res.Count = it.Count()
+		if err == search.Done {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		res.IDs = append(res.IDs, id)
+		res.Cursor = string(it.Cursor())
+	}
+
+	// a short page is the last one
+	if opts.Limit > 0 && len(res.IDs) < opts.Limit || opts.Limit <= 0 && len(res.IDs) < appEngineSearchDefaultLimit {
+		res.Cursor = ""
+	}
+
+	facets, err := it.Facets()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, values := range facets {
+		if len(values) == 0 {
+			continue
+		}
+
+		fr := FacetResult{Name: values[0].Name}
+		for _, v := range values {
+			fr.Values = append(fr.Values, FacetCount{Value: fmt.Sprint(v.Value), Count: v.Count})
+		}
+		res.Facets = append(res.Facets, fr)
+	}
+
+	return res, nil
+}
+
+// number of results returned by the App Engine Search API when the options have no limit
+const appEngineSearchDefaultLimit int = 20
+
+// the search.FieldLoadSaver of a SearchDocument
+type appEngineDocument struct {
+	doc SearchDocument
+}
+
+func (d *appEngineDocument) Save() ([]search.Field, *search.DocumentMetadata, error) {
+	fields, facets := appEngineFields(d.doc)
+	if len(facets) == 0 {
+		return fields, nil, nil
+	}
+	return fields, &search.DocumentMetadata{Facets: facets}, nil
+}
+
+func (d *appEngineDocument) Load(fields []search.Field, meta *search.DocumentMetadata) error {
+	return nil
+}
+
+// converts the fields and the facets of the document to the types of the App Engine Search API
+func appEngineFields(doc SearchDocument) ([]search.Field, []search.Facet) {
+	fields := make([]search.Field, len(doc.Fields))
+	for i, f := range doc.Fields {
+		fields[i] = search.Field{Name: f.Name, Value: appEngineValue(f.Value)}
+	}
+
+	var facets []search.Facet
+	for _, f := range doc.Facets {
+		facets = append(facets, search.Facet{Name: f.Name, Value: appEngineValue(f.Value)})
+	}
+	return fields, facets
+}
+
+func appEngineValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case SearchAtom:
+		return search.Atom(x)
+	case SearchHTML:
+		return search.HTML(x)
+	case datastore.GeoPoint:
+		return appengine.GeoPoint{Lat: x.Lat, Lng: x.Lng}
+	}
+	return v
+}
@@ -0,0 +1,108 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"fmt"
+	"google.golang.org/api/iterator"
+	"reflect"
+)
+
+// default number of entities put in the search index by each ReindexAll batch
+const searchReindexBatchSize int = 200
+
+// ReindexAll puts every entity of the kind of prototype into the search index, batch by batch.
+// It is meant to index the existing entities of a kind whose fields have just been tagged search.
+// Each batch is read with its own query, starting from the cursor of the previous one.
+// After each batch progress, if not nil, is called with the number of entities indexed so far
+// and the cursor of the next batch: ReindexAllFrom resumes an interrupted run from that cursor.
+// Returns the number of indexed entities
+func ReindexAll(ctx context.Context, prototype modelable, batchSize int, progress func(indexed int, cursor string)) (int, error) {
+	return ReindexAllFrom(ctx, prototype, batchSize, "", progress)
+}
+
+// ReindexAllFrom is ReindexAll starting from the given cursor
+func ReindexAllFrom(ctx context.Context, prototype modelable, batchSize int, cursor string, progress func(indexed int, cursor string)) (int, error) {
+	index(prototype)
+	model := prototype.getModel()
+	if !model.searchable {
+		return 0, fmt.Errorf("modelable %s has no searchable fields", model.Name())
+	}
+
+	if batchSize <= 0 {
+		batchSize = searchReindexBatchSize
+	}
+
+	q := NewQuery(prototype)
+	mType := reflect.TypeOf(prototype).Elem()
+	client := ClientFromContext(ctx)
+
+	count := 0
+	for {
+		dq := q.datastoreQuery(ctx).KeysOnly().Limit(batchSize)
+		if cursor != "" {
+			c, err := datastore.DecodeCursor(cursor)
+			if err != nil {
+				return count, err
+			}
+			dq = dq.Start(c)
+		}
+
+		dst := reflect.New(reflect.SliceOf(reflect.PtrTo(mType)))
+		var ms []modelable
+
+		it := client.Run(ctx, dq)
+		for {
+			key, err := it.Next(nil)
+			if err == iterator.Done {
+				break
+			}
+
+			if err != nil {
+				return count, err
+			}
+
+			m := reflect.New(mType).Interface().(modelable)
+			index(m)
+			m.getModel().Key = key
+			dst.Elem().Set(reflect.Append(dst.Elem(), reflect.ValueOf(m)))
+			ms = append(ms, m)
+		}
+
+		if len(ms) == 0 {
+			return count, nil
+		}
+
+		next, err := it.Cursor()
+		if err != nil {
+			return count, err
+		}
+
+		if err := ReadMulti(ctx, dst.Elem().Interface()); err != nil {
+			return count, err
+		}
+
+		// the soft deleted entities stay out of the index
+		live := make([]modelable, 0, len(ms))
+		for _, m := range ms {
+			if !IsDeleted(m) {
+				live = append(live, m)
+			}
+		}
+
+		if err := searchPutModelables(ctx, live); err != nil {
+			return count, err
+		}
+
+		count += len(ms)
+		cursor = next.String()
+		if progress != nil {
+			progress(count, cursor)
+		}
+
+		// a short batch is the last one
+		if len(ms) < batchSize {
+			return count, nil
+		}
+	}
+}
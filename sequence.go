@@ -0,0 +1,103 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"fmt"
+	"sync"
+)
+
+const sequenceKind string = "_ModelSequence"
+
+// default number of values each instance reserves at once
+const sequenceBlockSize int64 = 10
+
+// the entity holding the next value of a sequence not yet reserved by any instance
+type sequenceEntity struct {
+	Next int64
+}
+
+// the values of a sequence reserved by the instance, from next to limit excluded
+type sequenceBlock struct {
+	mutex sync.Mutex
+	next  int64
+	limit int64
+	size  int64
+}
+
+var sequencesMutex sync.Mutex
+var sequences = map[string]*sequenceBlock{}
+var sequenceSizes = map[string]int64{}
+
+// Sets how many values of the sequence with the given name each instance reserves at once.
+// Larger blocks spare datastore transactions, but the values reserved by an instance and not used are lost,
+// and the instances hand out values from different blocks at the same time. A size of 1 hands out the values in order
+func SetSequenceBlockSize(name string, size int64) {
+	sequencesMutex.Lock()
+	defer sequencesMutex.Unlock()
+	sequenceSizes[name] = size
+}
+
+// NextSequence returns the next value of the sequence with the given name, starting from 1, i.e. for invoice numbers.
+// The values handed out by an instance are increasing and never repeated across the instances, but they can have gaps.
+// Each instance reserves a block of values with a transaction on the counter entity of the sequence,
+// which is kept in the namespace of the context. See SetSequenceBlockSize
+func NextSequence(ctx context.Context, name string) (int64, error) {
+	key := namespacedKey(ctx, datastore.NameKey(sequenceKind, name, nil))
+	block := sequenceBlockOf(key.Namespace, name)
+
+	block.mutex.Lock()
+	defer block.mutex.Unlock()
+
+	if block.next >= block.limit {
+		if err := block.reserve(ctx, key); err != nil {
+			return 0, fmt.Errorf("error reserving values of sequence %s: %w", name, err)
+		}
+	}
+
+	v := block.next
+	block.next++
+	return v, nil
+}
+
+func sequenceBlockOf(namespace string, name string) *sequenceBlock {
+	sequencesMutex.Lock()
+	defer sequencesMutex.Unlock()
+
+	id := namespace + ":" + name
+	block, ok := sequences[id]
+	if !ok {
+		size, ok := sequenceSizes[name]
+		if !ok || size <= 0 {
+			size = sequenceBlockSize
+		}
+		block = &sequenceBlock{size: size}
+		sequences[id] = block
+	}
+	return block
+}
+
+// reserves a new block of values. Must be called with the mutex of the block held
+func (block *sequenceBlock) reserve(ctx context.Context, key *datastore.Key) error {
+	var first int64
+	client := ClientFromContext(ctx)
+	_, err := client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		seq := sequenceEntity{Next: 1}
+		if err := tx.Get(key, &seq); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		first = seq.Next
+		seq.Next += block.size
+		_, err := tx.Put(key, &seq)
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	block.next = first
+	block.limit = first + block.size
+	return nil
+}
@@ -0,0 +1,26 @@
+package model
+
+import (
+	"context"
+	"testing"
+)
+
+func TestNextSequenceFromBlock(t *testing.T) {
+	block := sequenceBlockOf("", "invoices")
+	block.next, block.limit = 41, 43
+
+	for _, want := range []int64{41, 42} {
+		v, err := NextSequence(context.Background(), "invoices")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if v != want {
+			t.Fatalf("expected %d, got %d", want, v)
+		}
+	}
+
+	if other := sequenceBlockOf("tenant", "invoices"); other == block {
+		t.Fatal("namespaces share the reserved values")
+	}
+}
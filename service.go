@@ -4,26 +4,144 @@ import (
 	"cloud.google.com/go/datastore"
 	"context"
 	"fmt"
+	"go.opentelemetry.io/otel/trace"
 	"os"
+	"sync"
+	"time"
 )
 
 const name = "__flamel_model_service"
 const keyDatastoreClient = "__model_ds_client"
+const keyService = "__model_service"
+
+// default time Destroy waits for the pending work to complete
+const defaultDrainTimeout = 10 * time.Second
 
 type Service struct {
 	project string
+	cache   Cache
+	policy  CachePolicy
+	search  SearchBackend
+	// if true, each request memoizes the entities it reads from the cache
+	requestCache bool
+	// the datastore namespace of the requests, if not the default one
+	namespace string
+	tracer    Tracer
+	// if set, the operations are traced with OpenTelemetry spans
+	tracerProvider trace.TracerProvider
+	metrics        Metrics
+	defaults       Defaults
+
+	// the client shared by the background contexts, created by the first one
+	backgroundMutex  sync.Mutex
+	backgroundClient *datastore.Client
+
+	// the time Destroy waits for the pending work to complete
+	drainTimeout time.Duration
+	// if set, Destroy dispatches the pending outbox messages with it
+	outboxPublisher Publisher
+}
+
+// Sets the cache used by the service. If no cache is set, the one selected by the MODEL_CACHE environment variable
+// is used, or an in-memory cache local to the instance.
+// Apps running on the legacy App Engine runtime can keep using memcache with AppEngineCache,
+// while on the second generation runtimes MemorystoreCache provides the same semantics
+func (service *Service) WithCache(cache Cache) {
+	service.cache = cache
+}
+
+// Sets how the cache is refreshed when modelables are written. The default is CacheWriteThrough
+func (service *Service) WithCachePolicy(policy CachePolicy) {
+	service.policy = policy
+}
+
+// Enables the request cache: within a request, entities already read or written are not fetched from the cache again.
+// See WithRequestCache
+func (service *Service) EnableRequestCache() {
+	service.requestCache = true
+}
+
+// Sets the namespace the requests run in. A request can be moved to another namespace with WithNamespace,
+// i.e. to serve a tenant of a multi-tenant application
+func (service *Service) WithNamespace(ns string) {
+	service.namespace = ns
+}
+
+// Sets the tracer receiving an event for every operation run by the requests. See Tracer
+func (service *Service) WithTracer(tracer Tracer) {
+	service.tracer = tracer
+}
+
+// Sets the OpenTelemetry provider of the tracer of the service. Once set, every operation gets a span,
+// with child spans for the datastore and cache calls it makes, so that request traces show where time is spent
+// within the model. The spans carry the kind of the entities, the number of keys of each call and the errors
+func (service *Service) WithTracerProvider(provider trace.TracerProvider) {
+	service.tracerProvider = provider
+}
+
+// Sets the metrics receiving the counters of the cache lookups, datastore calls, query results
+// and search calls of the requests, by kind. See Metrics
+func (service *Service) WithMetrics(metrics Metrics) {
+	service.metrics = metrics
+}
+
+// Sets how long Destroy waits for the pending work, like the writes queued by SerializeWrites, to complete.
+// The work still pending once the timeout expires is lost. The default is 10 seconds
+func (service *Service) WithDrainTimeout(d time.Duration) {
+	service.drainTimeout = d
+}
+
+// Makes Destroy dispatch the pending messages of the outbox with the given publisher, within the drain timeout,
+// so that the messages written by the instance are not left waiting for the next dispatch. See DispatchOutbox
+func (service *Service) WithOutboxDispatchOnDestroy(publisher Publisher) {
+	service.outboxPublisher = publisher
+}
+
+// Sets the defaults consulted by the operations of the requests when the options of a call don't set them,
+// so that the behavior of the package is tuned in one place for each deployment. See Defaults
+func (service *Service) WithDefaults(defaults Defaults) {
+	service.defaults = defaults
+}
+
+// Sets the backend of the search index. If no backend is set, the one selected by the MODEL_SEARCH environment variable
+// is used, or the App Engine Search API
+func (service *Service) WithSearchBackend(backend SearchBackend) {
+	service.search = backend
 }
 
 func ClientFromContext(ctx context.Context) *datastore.Client {
 	return ctx.Value(keyDatastoreClient).(*datastore.Client)
 }
 
+// returns a context holding a datastore client.
+// If ctx already has one, it is returned as is, else a new client is created.
+// done must be called to release the client once the context is no longer used.
+// It is meant for code that runs outside of the service lifecycle, like task handlers
+func ensureClient(ctx context.Context) (c context.Context, done func(), err error) {
+	if _, ok := ctx.Value(keyDatastoreClient).(*datastore.Client); ok {
+		return ctx, func() {}, nil
+	}
+
+	client, err := datastore.NewClient(ctx, os.Getenv("DATASTORE_PROJECT_ID"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return context.WithValue(ctx, keyDatastoreClient, client), func() { client.Close() }, nil
+}
+
 func (service *Service) Name() string {
 	return name
 }
 
 func (service *Service) Initialize() {
 	service.project = os.Getenv("DATASTORE_PROJECT_ID")
+	if service.cache == nil {
+		service.cache = cacheFromEnv()
+	}
+	if service.search == nil {
+		service.search = searchBackendFromEnv()
+	}
 }
 
 // adds the appengine client to the context
@@ -32,8 +150,80 @@ func (service *Service) OnStart(ctx context.Context) context.Context {
 	if err != nil {
 		panic(fmt.Errorf("error initializing service %s: %s", service.Name(), err.Error()))
 	}
-	return context.WithValue(ctx, keyDatastoreClient, client)
 
+	ctx = service.attach(ctx, client)
+
+	if service.requestCache {
+		ctx = WithRequestCache(ctx)
+	}
+
+	return ctx
+}
+
+// BackgroundContext returns a long-lived context holding the datastore client, the cache and the rest of the
+// configuration of the service, for the code running outside of the lifecycle of the requests,
+// like cron jobs, Pub/Sub consumers and goroutine workers.
+// The datastore client is shared by all the background contexts of the service: they must not be passed to OnEnd.
+// The request cache is never enabled, since the context outlives any request.
+// Unlike the contexts of the requests, it is never canceled: workers should derive their own deadlines from it
+func (service *Service) BackgroundContext() (context.Context, error) {
+	service.backgroundMutex.Lock()
+	defer service.backgroundMutex.Unlock()
+
+	if service.backgroundClient == nil {
+		client, err := datastore.NewClient(context.Background(), service.project)
+		if err != nil {
+			return nil, fmt.Errorf("error initializing the background client of service %s: %w", service.Name(), err)
+		}
+		service.backgroundClient = client
+	}
+
+	return service.attach(context.Background(), service.backgroundClient), nil
+}
+
+// adds the client and the configuration of the service to ctx
+func (service *Service) attach(ctx context.Context, client *datastore.Client) context.Context {
+	ctx = context.WithValue(ctx, keyDatastoreClient, client)
+	ctx = context.WithValue(ctx, keyService, service)
+
+	if service.cache != nil {
+		ctx = context.WithValue(ctx, keyCache, service.cache)
+	}
+
+	if service.policy != CacheWriteThrough {
+		ctx = context.WithValue(ctx, keyCachePolicy, service.policy)
+	}
+
+	if service.search != nil {
+		ctx = context.WithValue(ctx, keySearchBackend, service.search)
+	}
+
+	if service.namespace != "" {
+		ctx = WithNamespace(ctx, service.namespace)
+	}
+
+	if service.tracer != nil {
+		ctx = context.WithValue(ctx, keyTracer, service.tracer)
+	}
+
+	if service.tracerProvider != nil {
+		ctx = context.WithValue(ctx, keyOtelTracer, service.tracerProvider.Tracer(instrumentationName))
+	}
+
+	if service.metrics != nil {
+		ctx = context.WithValue(ctx, keyMetrics, service.metrics)
+	}
+
+	if service.defaults != (Defaults{}) {
+		ctx = WithDefaults(ctx, service.defaults)
+	}
+
+	return ctx
+}
+
+func serviceFromContext(ctx context.Context) *Service {
+	service, _ := ctx.Value(keyService).(*Service)
+	return service
 }
 
 func (service *Service) OnEnd(ctx context.Context) {
@@ -43,4 +233,43 @@ func (service *Service) OnEnd(ctx context.Context) {
 	}
 }
 
-func (service *Service) Destroy() {}
+// Destroy flushes the pending work of the instance and releases the shared datastore client.
+// The writes queued by SerializeWrites are written without waiting for their window,
+// and the outbox is dispatched if a publisher has been set with WithOutboxDispatchOnDestroy.
+// The work is given the drain timeout of the service to complete: what is still pending afterwards is logged and lost.
+// Search documents are indexed synchronously by the writes, thus there is no pending indexing to flush
+func (service *Service) Destroy() {
+	timeout := service.drainTimeout
+	if timeout <= 0 {
+		timeout = defaultDrainTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := drainWriteQueues(ctx); err != nil {
+		warningf(ctx, "error flushing the queued writes of service %s: %s", service.Name(), err.Error())
+	}
+
+	if service.outboxPublisher != nil {
+		if bctx, err := service.BackgroundContext(); err != nil {
+			warningf(ctx, "error dispatching the outbox of service %s: %s", service.Name(), err.Error())
+		} else {
+			deadline, _ := ctx.Deadline()
+			bctx, cancel := context.WithDeadline(bctx, deadline)
+			if _, err := DispatchOutbox(bctx, service.outboxPublisher, 0); err != nil {
+				warningf(ctx, "error dispatching the outbox of service %s: %s", service.Name(), err.Error())
+			}
+			cancel()
+		}
+	}
+
+	service.backgroundMutex.Lock()
+	defer service.backgroundMutex.Unlock()
+	if service.backgroundClient != nil {
+		if err := service.backgroundClient.Close(); err != nil {
+			warningf(ctx, "unable to close the datastore client of service %s: %s", service.Name(), err.Error())
+		}
+		service.backgroundClient = nil
+	}
+}
@@ -0,0 +1,165 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// string id of the singleton entities
+const singletonID string = "singleton"
+
+var singletonsMutex sync.Mutex
+var singletons = map[singletonSlot]*singletonEntry{}
+
+// singletons are kept for each namespace
+type singletonSlot struct {
+	typ       reflect.Type
+	namespace string
+}
+
+// how long the singletons are kept in the memory of the instance
+var singletonTTL = time.Minute
+
+// the properties of a singleton, as last read or written by the instance
+type singletonEntry struct {
+	key     *datastore.Key
+	props   []datastore.Property
+	expires time.Time
+}
+
+// Sets how long the singletons are kept in the memory of the instance.
+// Writes made by other instances are seen once the singleton expires. A non positive ttl disables the instance memory
+func SetSingletonTTL(ttl time.Duration) {
+	singletonsMutex.Lock()
+	defer singletonsMutex.Unlock()
+	singletonTTL = ttl
+	singletons = map[singletonSlot]*singletonEntry{}
+}
+
+// Singleton loads into m the only entity of its kind, which has a well known key.
+// If the entity doesn't exist it is created with the values held by m, that act as defaults.
+// Singletons are kept in the memory of the instance, on top of the cache, for the time set by SetSingletonTTL:
+// they suit settings and feature flags, which are read often and seldom written
+func Singleton(ctx context.Context, m modelable) error {
+	index(m)
+	if loadSingleton(m, NamespaceFromContext(ctx)) {
+		return nil
+	}
+
+	model := m.getModel()
+	model.Key = singletonKey(ctx, model)
+
+	err := Read(ctx, m)
+	if errors.Is(err, datastore.ErrNoSuchEntity) {
+		model.Key = nil
+		opts := NewCreateOptions()
+		opts.WithStringId(singletonID)
+		err = CreateWithOptions(ctx, m, &opts)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	storeSingleton(m)
+	return nil
+}
+
+// UpdateSingleton modifies the singleton m with fn and writes it with optimistic locking:
+// within a transaction m is reloaded from the datastore, fn is applied and m is written.
+// If the singleton is written by someone else meanwhile the transaction is retried, calling fn on the new values,
+// thus fn must only modify m. If the singleton doesn't exist, fn is applied to the values held by m.
+// The references of the singleton are not written
+func UpdateSingleton(ctx context.Context, m modelable, fn func() error) error {
+	ctx = withHookContext(ctx, OpUpdate, "UpdateSingleton", true, false)
+	index(m)
+
+	model := m.getModel()
+	model.Key = singletonKey(ctx, model)
+
+	client := ClientFromContext(ctx)
+	_, err := client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		if err := tx.Get(model.Key, m); err == datastore.ErrNoSuchEntity {
+			initCreateTime(m)
+		} else if err != nil {
+			return err
+		}
+
+		if err := fn(); err != nil {
+			return err
+		}
+
+		if err := beforeUpdate(ctx, m); err != nil {
+			return err
+		}
+
+		_, err := tx.Put(model.Key, m)
+		return err
+	})
+
+	if err != nil {
+		dropSingleton(m)
+		return err
+	}
+
+	storeSingleton(m)
+	return cacheWritten(ctx, m, saveInMemcache)
+}
+
+func singletonKey(ctx context.Context, model *Model) *datastore.Key {
+	return namespacedKey(ctx, datastore.NameKey(model.structName, singletonID, nil))
+}
+
+// loads the singleton from the memory of the instance, if not expired.
+// Singletons with references are always read, to load their references
+func loadSingleton(m modelable, namespace string) bool {
+	model := m.getModel()
+	if len(model.references) > 0 {
+		return false
+	}
+
+	singletonsMutex.Lock()
+	entry, ok := singletons[singletonSlot{typ: reflect.TypeOf(m).Elem(), namespace: namespace}]
+	singletonsMutex.Unlock()
+
+	if !ok || time.Now().After(entry.expires) {
+		return false
+	}
+
+	if err := fromPropertyList(m, entry.props); err != nil {
+		return false
+	}
+
+	model.Key = entry.key
+	return true
+}
+
+func storeSingleton(m modelable) {
+	model := m.getModel()
+	if len(model.references) > 0 {
+		return
+	}
+
+	// encoded as it is: the copy must not refresh the timestamps of the modelable
+	props, err := encodeProperties(m)
+	if err != nil {
+		return
+	}
+
+	singletonsMutex.Lock()
+	defer singletonsMutex.Unlock()
+	if singletonTTL <= 0 {
+		return
+	}
+	singletons[singletonSlot{typ: reflect.TypeOf(m).Elem(), namespace: model.Key.Namespace}] = &singletonEntry{key: model.Key, props: props, expires: time.Now().Add(singletonTTL)}
+}
+
+func dropSingleton(m modelable) {
+	singletonsMutex.Lock()
+	defer singletonsMutex.Unlock()
+	delete(singletons, singletonSlot{typ: reflect.TypeOf(m).Elem(), namespace: m.getModel().Key.Namespace})
+}
@@ -0,0 +1,40 @@
+package model
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type SingletonSettings struct {
+	Model
+	Theme    string
+	MaxItems int
+}
+
+func TestSingletonMemory(t *testing.T) {
+	defer SetSingletonTTL(time.Minute)
+
+	s := SingletonSettings{Theme: "dark", MaxItems: 10}
+	index(&s)
+	s.Key = singletonKey(context.Background(), s.getModel())
+	storeSingleton(&s)
+
+	loaded := SingletonSettings{}
+	index(&loaded)
+	if !loadSingleton(&loaded, "") {
+		t.Fatal("singleton not found in the instance memory")
+	}
+
+	if loaded.Theme != "dark" || loaded.MaxItems != 10 || loaded.StringID() != singletonID {
+		t.Fatalf("singleton loaded as %+v", loaded)
+	}
+
+	SetSingletonTTL(0)
+	storeSingleton(&s)
+	empty := SingletonSettings{}
+	index(&empty)
+	if loadSingleton(&empty, "") {
+		t.Fatal("singleton kept in memory with a zero ttl")
+	}
+}
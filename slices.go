@@ -0,0 +1,218 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Slices of values are stored as a property repeated for each item,
+// and slices of structs, or of pointers to structs, as the repeated properties of the struct fields.
+// Nested slices, like [][]string, are stored as an array property for each inner slice, named after
+// the field and the position of the inner slice: "Field.0", "Field.1" and so on.
+// Only one level of nesting is supported, and structs held by slices can't hold slices themselves,
+// as the items of the flattened slices could not be told apart.
+
+var typeOfKey = reflect.TypeOf(&datastore.Key{})
+
+// checks if values of type t can be stored as items of a slice, or of a nested slice
+func isSliceValue(t reflect.Type) bool {
+	if t == typeOfTime || t == typeOfGeoPoint || t == typeOfKey {
+		return true
+	}
+
+	// []byte items are stored as blobs
+	if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+		return true
+	}
+
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Bool, reflect.String, reflect.Float32, reflect.Float64:
+		return true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+// returns the struct type held by a slice of structs or of pointers to structs, if any.
+// It panics if the items of the slice can't be stored
+func sliceStructType(t reflect.Type, field string) (reflect.Type, bool) {
+	et := t.Elem()
+	if isSliceValue(et) || et.Kind() == reflect.Interface {
+		return nil, false
+	}
+
+	if et.Kind() == reflect.Ptr {
+		et = et.Elem()
+	}
+
+	if et.Kind() != reflect.Struct || et == typeOfTime || et == typeOfGeoPoint {
+		panic(fmt.Errorf("unsupported slice field %s of type %s", field, t))
+	}
+
+	for i := 0; i < et.NumField(); i++ {
+		sf := et.Field(i)
+		if sf.PkgPath != "" || sf.Type.Kind() != reflect.Slice || sf.Type.Elem().Kind() == reflect.Uint8 {
+			continue
+		}
+		if sf.Tag.Get(tagDomain) == tagSkip || sf.Tag.Get("datastore") == "-" {
+			continue
+		}
+		panic(fmt.Errorf("unsupported slice field %s of type %s: the struct items can't hold slices", field, t))
+	}
+
+	return et, true
+}
+
+// checks if the type is a slice of slices of values
+func isNestedSlice(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Slice && t.Elem().Elem().Kind() != reflect.Uint8
+}
+
+// returns the value stored by the datastore for an item of a slice
+func sliceItemValue(name string, v reflect.Value) (interface{}, error) {
+	switch x := v.Interface().(type) {
+	case time.Time, datastore.GeoPoint, *datastore.Key:
+		return x, nil
+	}
+
+	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+		return v.Bytes(), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return uintValue(name, v)
+	case reflect.Bool:
+		return v.Bool(), nil
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	}
+	return nil, &PropertyError{Name: name, Kind: v.Kind(), Value: v.Interface(), Err: ErrUnsupportedType}
+}
+
+// sets an item of a slice from the stored value
+func decodeSliceItem(v reflect.Value, p datastore.Property) error {
+	switch v.Type() {
+	case typeOfTime:
+		x, ok := p.Value.(time.Time)
+		if !ok && p.Value != nil {
+			return &PropertyError{Name: p.Name, Kind: v.Kind(), Value: p.Value, Err: ErrTypeMismatch}
+		}
+		v.Set(reflect.ValueOf(x))
+		return nil
+	case typeOfGeoPoint:
+		x, ok := p.Value.(datastore.GeoPoint)
+		if !ok && p.Value != nil {
+			return &PropertyError{Name: p.Name, Kind: v.Kind(), Value: p.Value, Err: ErrTypeMismatch}
+		}
+		v.Set(reflect.ValueOf(x))
+		return nil
+	}
+
+	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+		x, ok := p.Value.([]byte)
+		if !ok && p.Value != nil {
+			return &PropertyError{Name: p.Name, Kind: v.Kind(), Value: p.Value, Err: ErrTypeMismatch}
+		}
+		v.SetBytes(x)
+		return nil
+	}
+
+	return decodeField(v, p)
+}
+
+// returns a property per item of the slice, holding the item value
+func sliceProperties(name string, v reflect.Value) ([]datastore.Property, error) {
+	props := make([]datastore.Property, 0, v.Len())
+	for j := 0; j < v.Len(); j++ {
+		x, err := sliceItemValue(name, v.Index(j))
+		if err != nil {
+			return nil, err
+		}
+		props = append(props, datastore.Property{Name: name, Value: x, NoIndex: true})
+	}
+	return props, nil
+}
+
+// returns the pointer to the struct held by an item of a slice of structs or of pointers to structs.
+// Nil pointers can't be stored, as the flattened items could not be told apart
+func sliceStructItem(name string, v reflect.Value) (interface{}, error) {
+	if v.Kind() != reflect.Ptr {
+		return v.Addr().Interface(), nil
+	}
+
+	if v.IsNil() {
+		return nil, &PropertyError{Name: name, Kind: v.Kind(), Value: nil, Err: ErrUnsupportedType}
+	}
+	return v.Interface(), nil
+}
+
+// returns an array property for each inner slice of the nested slice value
+func nestedSliceProperties(name string, v reflect.Value, noIndex bool) ([]datastore.Property, error) {
+	props := make([]datastore.Property, 0, v.Len())
+	for j := 0; j < v.Len(); j++ {
+		inner := v.Index(j)
+		values := make([]interface{}, inner.Len())
+		for k := range values {
+			x, err := sliceItemValue(name, inner.Index(k))
+			if err != nil {
+				return nil, err
+			}
+			values[k] = x
+		}
+		props = append(props, datastore.Property{Name: referenceName(name, strconv.Itoa(j)), Value: values, NoIndex: noIndex})
+	}
+	return props, nil
+}
+
+// returns the nested slice field the property belongs to, if any
+func nestedSliceFieldOf(s *encodedStruct, name string) (encodedField, bool) {
+	i := strings.Index(name, valSeparator)
+	if i <= 0 {
+		return encodedField{}, false
+	}
+
+	attr, ok := s.fieldNames[name[:i]]
+	return attr, ok && attr.isNestedSlice
+}
+
+// sets the inner slice held by the array property at its position in the nested slice field
+func decodeNestedSliceItem(field reflect.Value, p datastore.Property) error {
+	pos, err := strconv.Atoi(childName(p.Name))
+	if err != nil || pos < 0 {
+		return &PropertyError{Name: p.Name, Kind: field.Kind(), Value: p.Value, Err: ErrTypeMismatch}
+	}
+
+	var values []interface{}
+	switch x := p.Value.(type) {
+	case []interface{}:
+		values = x
+	default:
+		if p.Value != nil {
+			values = []interface{}{x}
+		}
+	}
+
+	for field.Len() <= pos {
+		field.Set(reflect.Append(field, reflect.Zero(field.Type().Elem())))
+	}
+
+	inner := reflect.MakeSlice(field.Type().Elem(), len(values), len(values))
+	for k, x := range values {
+		if err := decodeSliceItem(inner.Index(k), datastore.Property{Name: p.Name, Value: x}); err != nil {
+			return err
+		}
+	}
+
+	field.Index(pos).Set(inner)
+	return nil
+}
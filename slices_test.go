@@ -0,0 +1,59 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type sliceItem struct {
+	Name  string
+	Count int
+}
+
+type sliceEntity struct {
+	Model
+	Items    []sliceItem
+	Pointers []*sliceItem
+	Matrix   [][]int
+	Times    []time.Time
+}
+
+func TestSliceFields(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	src := sliceEntity{
+		Items:    []sliceItem{{"a", 1}, {"b", 2}},
+		Pointers: []*sliceItem{{"c", 3}},
+		Matrix:   [][]int{{1, 2}, {}, {3}},
+		Times:    []time.Time{now},
+	}
+	index(&src)
+
+	props, err := toPropertyList(&src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := sliceEntity{Matrix: [][]int{{9}, {9}, {9}, {9}}}
+	index(&dst)
+	if err := fromPropertyList(&dst, props); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(dst.Items, src.Items) || !reflect.DeepEqual(dst.Pointers, src.Pointers) {
+		t.Fatalf("invalid decoded struct slices %+v", dst)
+	}
+
+	if len(dst.Matrix) != 3 || !reflect.DeepEqual(dst.Matrix[0], []int{1, 2}) || len(dst.Matrix[1]) != 0 || dst.Matrix[2][0] != 3 {
+		t.Fatalf("invalid decoded nested slice %v", dst.Matrix)
+	}
+
+	if len(dst.Times) != 1 || !dst.Times[0].Equal(now) {
+		t.Fatalf("invalid decoded times %v", dst.Times)
+	}
+
+	src.Pointers = append(src.Pointers, nil)
+	if _, err := toPropertyList(&src); err == nil {
+		t.Fatal("expected nil pointers to be rejected")
+	}
+}
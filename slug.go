@@ -0,0 +1,143 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// derives the value of a string field from another field, i.e. `model:"slug=Title"`.
+// Slugs are unique among the entities of the same kind
+const tagSlug string = "slug"
+
+// number of numeric suffixes tried to resolve a slug collision
+const maxSlugAttempts int = 10
+
+type slugDescriptor struct {
+	// index of the slug field
+	index int
+	// index of the field the slug is derived from
+	source int
+	// misuse of the tag, returned by the writes of the modelable
+	err error
+}
+
+// returns the descriptor of the slug field at index i of t, derived from the field named source
+func newSlugDescriptor(t reflect.Type, i int, source string) *slugDescriptor {
+	field := t.Field(i)
+	if err := checkSlugTag(t, field, source); err != nil {
+		return &slugDescriptor{index: i, err: err}
+	}
+
+	sf, _ := t.FieldByName(source)
+	return &slugDescriptor{index: i, source: sf.Index[0]}
+}
+
+// checks that the slug field is a string derived from a field of the struct, i.e. `model:"slug=Title"`
+func checkSlugTag(t reflect.Type, field reflect.StructField, source string) error {
+	if field.Type.Kind() != reflect.String {
+		return fmt.Errorf("slug field %s of struct %s must be a string", field.Name, t.Name())
+	}
+
+	if source == "" {
+		return fmt.Errorf("slug field %s of struct %s has no source field. Use %s=<field>", field.Name, t.Name(), tagSlug)
+	}
+
+	sf, found := t.FieldByName(source)
+	if !found || len(sf.Index) != 1 {
+		return fmt.Errorf("slug source field %s not found in struct %s", source, t.Name())
+	}
+	return nil
+}
+
+// returns a lowercase, url-safe version of s
+func Slugify(s string) string {
+	a := Analyzer{lowercase: true, foldAccents: true}
+	s = a.normalize(s)
+
+	var b strings.Builder
+	dash := false
+	for _, r := range s {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+			continue
+		}
+
+		if !dash && b.Len() > 0 {
+			b.WriteRune('-')
+			dash = true
+		}
+	}
+
+	return strings.TrimSuffix(b.String(), "-")
+}
+
+// fills the slug field of the modelable, if empty, and claims it for key.
+// On collisions the slug gets a numeric suffix
+func claimSlug(ctx context.Context, m modelable, key *datastore.Key) error {
+	model := m.getModel()
+	if model.slug == nil {
+		return nil
+	}
+
+	if model.slug.err != nil {
+		return model.slug.err
+	}
+
+	val := reflect.ValueOf(m).Elem()
+	field := val.Field(model.slug.index)
+	if field.String() != "" {
+		return nil
+	}
+
+	base := Slugify(fmt.Sprint(val.Field(model.slug.source).Interface()))
+	if base == "" {
+		return nil
+	}
+
+	group := val.Type().Field(model.slug.index).Name
+
+	for i := 1; i <= maxSlugAttempts; i++ {
+		candidate := base
+		if i > 1 {
+			candidate = fmt.Sprintf("%s-%d", base, i)
+		}
+
+		field.SetString(candidate)
+		_, err := claimMarkers(ctx, key, uniqueMarkerKey(m, group))
+		if err == nil {
+			return nil
+		}
+
+		if !errors.Is(err, ErrUniqueConstraint) {
+			field.SetString("")
+			return err
+		}
+	}
+
+	field.SetString("")
+	return fmt.Errorf("%w: unable to find a free slug for %q in %s", ErrUniqueConstraint, base, model.Name())
+}
+
+// Loads values from the datastore for the entity with the given slug.
+// See LookupBy
+func FromSlug(ctx context.Context, m modelable, slug string) error {
+	model := m.getModel()
+	if !model.isRegistered() {
+		index(m)
+	}
+
+	if model.slug == nil {
+		return fmt.Errorf("modelable %s has no slug field", model.Name())
+	}
+
+	if model.slug.err != nil {
+		return model.slug.err
+	}
+
+	return LookupBy(ctx, m, reflect.TypeOf(m).Elem().Field(model.slug.index).Name, slug)
+}
@@ -0,0 +1,124 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"reflect"
+	"time"
+)
+
+// marks a time.Time field as the deletion time of the entity, i.e. `model:"softdelete"`.
+// Deleting the entity sets the field instead of removing it. Queries skip the deleted entities with Query.SkipDeleted
+const tagSoftDelete string = "softdelete"
+
+const keyPurge = "__model_purge"
+
+// reports whether the deletes running with ctx must erase the soft deletable entities
+func isPurging(ctx context.Context) bool {
+	purge, _ := ctx.Value(keyPurge).(bool)
+	return purge
+}
+
+// returns the name of the soft delete field of the modelables of type t, if any
+func softDeleteFieldOf(t reflect.Type) string {
+	m := reflect.New(t).Interface().(modelable)
+	index(m)
+	if sd := m.getModel().softDelete; sd != nil {
+		return sd.name
+	}
+	return ""
+}
+
+// reports whether the modelable has been soft deleted
+func IsDeleted(m modelable) bool {
+	index(m)
+	model := m.getModel()
+	if model.softDelete == nil {
+		return false
+	}
+
+	t := reflect.ValueOf(m).Elem().Field(model.softDelete.index).Interface().(time.Time)
+	return !t.IsZero()
+}
+
+func setDeletedAt(m modelable, t time.Time) {
+	model := m.getModel()
+	reflect.ValueOf(m).Elem().Field(model.softDelete.index).Set(reflect.ValueOf(t))
+}
+
+// marks the modelable as deleted and writes it, removing it from the cache and the search index
+func softDelete(ctx context.Context, m modelable) error {
+	model := m.getModel()
+	setDeletedAt(m, time.Now().Truncate(time.Microsecond))
+
+	if _, err := putEntity(ctx, model.Key, m); err != nil {
+		setDeletedAt(m, time.Time{})
+		return err
+	}
+
+	if err := cacheFromContext(ctx).Delete(ctx, cacheKey(model.Key)); err != nil && err != ErrCacheMiss {
+		return err
+	}
+
+	if model.searchable {
+		return searchDelete(ctx, model, model.Name())
+	}
+
+	return nil
+}
+
+// marks the entities with the given keys as deleted, setting the given property.
+// The entities are read and written as property lists, in batches
+func softDeleteKeys(ctx context.Context, keys []*datastore.Key, property string, now time.Time) error {
+	client := ClientFromContext(ctx)
+	size := batchSize(ctx)
+	for start := 0; start < len(keys); start += size {
+		end := start + size
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		entities := make([]datastore.PropertyList, end-start)
+		if err := client.GetMulti(ctx, keys[start:end], entities); err != nil {
+			return err
+		}
+
+		for i := range entities {
+			found := false
+			for j := range entities[i] {
+				if entities[i][j].Name == property {
+					entities[i][j].Value = now
+					found = true
+				}
+			}
+
+			if !found {
+				entities[i] = append(entities[i], datastore.Property{Name: property, Value: now})
+			}
+		}
+
+		if _, err := client.PutMulti(ctx, keys[start:end], entities); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Restore clears the deletion time of a soft deleted modelable and writes it back
+func Restore(ctx context.Context, m modelable) error {
+	index(m)
+	if m.getModel().softDelete == nil {
+		return nil
+	}
+
+	setDeletedAt(m, time.Time{})
+	return Update(ctx, m)
+}
+
+// Purge erases the modelable from the datastore, even if it is soft deletable.
+// References are left untouched, as Delete does
+func Purge(ctx context.Context, m modelable) error {
+	ctx = context.WithValue(ctx, keyPurge, true)
+	return Delete(ctx, m, nil)
+}
@@ -2,9 +2,9 @@ package model
 
 import (
 	"cloud.google.com/go/datastore"
-	"encoding/gob"
 	"errors"
 	"fmt"
+	"math"
 	"reflect"
 	"strings"
 	"sync"
@@ -21,6 +21,42 @@ var (
 	typeOfPLS       = reflect.TypeOf((*datastore.PropertyLoadSaver)(nil)).Elem()
 )
 
+// errors wrapped by a *PropertyError when a property can't be converted from or to its field
+var (
+	ErrTypeMismatch    = errors.New("property type does not match the field")
+	ErrUnsupportedType = errors.New("unsupported field type")
+	ErrFieldOverflow   = errors.New("value overflows the field")
+)
+
+// PropertyError describes a property that can't be converted from or to its field.
+// It wraps one of ErrTypeMismatch, ErrUnsupportedType or ErrFieldOverflow, to be checked with errors.Is
+type PropertyError struct {
+	// the name of the property
+	Name string
+	// the kind of the field
+	Kind reflect.Kind
+	// the value that could not be converted
+	Value interface{}
+	Err   error
+}
+
+func (e *PropertyError) Error() string {
+	return fmt.Sprintf("property %s with value %v, field of kind %s: %s", e.Name, e.Value, e.Kind, e.Err.Error())
+}
+
+func (e *PropertyError) Unwrap() error {
+	return e.Err
+}
+
+// converts an unsigned value to the int64 stored by the datastore, failing if it doesn't fit
+func uintValue(name string, v reflect.Value) (int64, error) {
+	u := v.Uint()
+	if u > math.MaxInt64 {
+		return 0, &PropertyError{Name: name, Kind: v.Kind(), Value: u, Err: ErrFieldOverflow}
+	}
+	return int64(u), nil
+}
+
 //struct value represent a struct that internally can map other structs
 //fieldIndex is the index of the struct
 type encodedField struct {
@@ -30,6 +66,16 @@ type encodedField struct {
 	isExtension bool
 	// if true it implements the datastore.PropertyLoadSaver interface
 	isPLS bool
+	// if true the field is a slice of pointers to modelables
+	isReferenceSlice bool
+	// if true the field is a map stored as a property per entry
+	isMap bool
+	// if true the field is stored as a JSON blob
+	isJSON bool
+	// if true the field is a slice of slices, stored as an array property per inner slice
+	isNestedSlice bool
+	// if true the field is set automatically on write and never loaded as zero
+	isTimestamp bool
 }
 
 // todo convert to bitmask?
@@ -42,6 +88,33 @@ type encodedStruct struct {
 	fieldNames    map[string]encodedField
 	referencesIdx []int
 	extensionsIdx []int
+	// indexes of the fields holding slices of references
+	referenceSlicesIdx []int
+	// indexes of the map fields
+	mapsIdx []int
+	// indexes of the nested slice fields
+	nestedSlicesIdx []int
+	// indexes of the fields that are not written when zero
+	omitEmptyIdx []int
+	// constraints checked before writing
+	validations []validationRule
+	// maps the unique constraint groups to the indexes of the fields composing them
+	uniqueGroups map[string][]int
+	slug         *slugDescriptor
+	id           *idDescriptor
+	version      *versionDescriptor
+	createTime   *timestampDescriptor
+	updateTime   *timestampDescriptor
+	softDelete   *timestampDescriptor
+	denorms      []denormDescriptor
+	// the names of the properties of the fields tagged with name=, and the fields of those properties
+	storedNames    map[string]string
+	fieldsOfStored map[string]string
+	modified       *modifiedDescriptor
+	// the precompiled encoding of the fields, in field order
+	codec []fieldCodec
+	// hash of the layout of the struct, to discard the cache entries written by other versions of it
+	layout uint64
 }
 
 func newEncodedStruct(name string) *encodedStruct {
@@ -52,10 +125,41 @@ func newEncodedStruct(name string) *encodedStruct {
 }
 
 //Keeps track of encoded structs according to their reflect.Type.
-//It is used as a cache to avoid to map structs that have been already mapped
-var encodedStructsMutex sync.Mutex
+//It is used as a cache to avoid to map structs that have been already mapped.
+//Once stored, an encoded struct is read without locks by the models pointing to it, thus it is never modified:
+//the mappings that need to change it replace it with a modified copy
+var encodedStructsMutex sync.RWMutex
 var encodedStructs = map[reflect.Type]*encodedStruct{}
 
+// returns the encoded struct of type t, if it has been mapped
+func encodedStructOf(t reflect.Type) (*encodedStruct, bool) {
+	encodedStructsMutex.RLock()
+	defer encodedStructsMutex.RUnlock()
+	s, ok := encodedStructs[t]
+	return s, ok
+}
+
+// returns the encoded struct of type t, mapping it if it has not been mapped yet.
+// Concurrent calls for the same type map it only once and share the same encoded struct
+func encodedStructFor(t reflect.Type) *encodedStruct {
+	if s, ok := encodedStructOf(t); ok {
+		return s
+	}
+
+	encodedStructsMutex.Lock()
+	defer encodedStructsMutex.Unlock()
+
+	// the struct may have been mapped while waiting for the lock
+	if s, ok := encodedStructs[t]; ok {
+		return s
+	}
+
+	s := newEncodedStruct(t.Name())
+	mapStructureLocked(t, s)
+	return s
+}
+
+// returns the type of the mapped struct with the given name. Must be called with the encodedStructsMutex held
 func structTypeByName(name string) reflect.Type {
 	for k, v := range encodedStructs {
 		if v.structName == name {
@@ -65,6 +169,7 @@ func structTypeByName(name string) reflect.Type {
 	return nil
 }
 
+// returns the mapped struct with the given name. Must be called with the encodedStructsMutex held
 func encodedStructByName(name string) *encodedStruct {
 	for _, v := range encodedStructs {
 		if v.structName == name {
@@ -74,12 +179,6 @@ func encodedStructByName(name string) *encodedStruct {
 	return nil
 }
 
-func mapStructure(t reflect.Type, s *encodedStruct) {
-	encodedStructsMutex.Lock()
-	mapStructureLocked(t, s)
-	encodedStructsMutex.Unlock()
-}
-
 // checks if field has tag "tag"
 // todo: can we do better than a linear search?
 func containsTag(tags []string, value string) string {
@@ -91,6 +190,20 @@ func containsTag(tags []string, value string) string {
 	return ""
 }
 
+// checks if field has a tag in the form "name=value" and returns its value.
+// A tag "name" with no value is reported as found, with an empty value
+func tagValue(tags []string, name string) (string, bool) {
+	for _, v := range tags {
+		if v == name {
+			return "", true
+		}
+		if strings.HasPrefix(v, name+"=") {
+			return v[len(name)+1:], true
+		}
+	}
+	return "", false
+}
+
 //maps a structure into a linked list representation of its fields.
 //It is used to ease the conversion between the Model framework and the datastore
 func mapStructureLocked(t reflect.Type, s *encodedStruct) {
@@ -123,8 +236,115 @@ func mapStructureLocked(t reflect.Type, s *encodedStruct) {
 			s.searchable = true
 		}
 
+		stored := mapStoredName(s, field.Name, tags)
+
+		if group, ok := tagValue(tags, tagUnique); ok {
+			// a unique field with no group is a group on its own
+			if group == "" {
+				group = field.Name
+			}
+			if s.uniqueGroups == nil {
+				s.uniqueGroups = make(map[string][]int)
+			}
+			s.uniqueGroups[group] = append(s.uniqueGroups[group], i)
+		}
+
+		if kind, ok := tagValue(tags, tagCount); ok && kind != "" {
+			switch fType.Kind() {
+			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+				registerCounterLocked(kind, t, i, stored)
+			default:
+				panic(fmt.Errorf("counter field %s of struct %s must be an int", field.Name, t.Name()))
+			}
+		}
+
+		if path, ok := tagValue(tags, tagDenorm); ok {
+			d := registerDenormLocked(t, i, path)
+			if !containsDenorm(s.denorms, d) {
+				s.denorms = append(s.denorms, d)
+			}
+		}
+
+		if source, ok := tagValue(tags, tagSlug); ok {
+			// a misused tag is reported by the writes of the modelable rather than at registration
+			s.slug = newSlugDescriptor(t, i, source)
+			// slugs are always unique
+			if s.slug.err == nil {
+				if s.uniqueGroups == nil {
+					s.uniqueGroups = make(map[string][]int)
+				}
+				if _, ok := s.uniqueGroups[field.Name]; !ok {
+					s.uniqueGroups[field.Name] = []int{i}
+				}
+			}
+		}
+
+		isCreateTime := containsTag(tags, tagCreateTime) != ""
+		isUpdateTime := containsTag(tags, tagUpdateTime) != ""
+		if (isCreateTime || isUpdateTime) && fType != typeOfTime {
+			panic(fmt.Errorf("timestamp field %s of struct %s must be a time.Time", field.Name, t.Name()))
+		}
+
+		if isCreateTime {
+			s.createTime = &timestampDescriptor{index: i, name: stored}
+		}
+
+		if isUpdateTime {
+			s.updateTime = &timestampDescriptor{index: i, name: stored}
+		}
+
+		if containsTag(tags, tagSoftDelete) != "" {
+			if fType != typeOfTime {
+				panic(fmt.Errorf("soft delete field %s of struct %s must be a time.Time", field.Name, t.Name()))
+			}
+			if containsTag(tags, tagOmitEmpty) != "" {
+				panic(fmt.Errorf("soft delete field %s of struct %s can't be omitted when empty", field.Name, t.Name()))
+			}
+			s.softDelete = &timestampDescriptor{index: i, name: stored}
+		}
+
+		// timestamps are never reset by a zero value, thus they are not reset when missing either
+		if containsTag(tags, tagOmitEmpty) != "" && !isCreateTime && !isUpdateTime {
+			s.omitEmptyIdx = append(s.omitEmptyIdx, i)
+		}
+
+		if containsTag(tags, tagVersion) != "" {
+			if fType.Kind() != reflect.Int64 {
+				panic(fmt.Errorf("version field %s of struct %s must be an int64", field.Name, t.Name()))
+			}
+			s.version = &versionDescriptor{index: i, name: stored}
+		}
+
+		if containsTag(tags, tagModified) != "" {
+			if fType.Kind() != reflect.String {
+				panic(fmt.Errorf("modified field %s of struct %s must be a string", field.Name, t.Name()))
+			}
+			s.modified = &modifiedDescriptor{index: i, name: stored}
+		}
+
+		if rule, ok := validationRuleOf(t, i, tags); ok {
+			s.validations = append(s.validations, rule)
+		}
+
+		if containsTag(tags, tagId) != "" {
+			switch fType.Kind() {
+			case reflect.String, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+				s.id = &idDescriptor{index: i}
+			default:
+				panic(fmt.Errorf("id field %s of struct %s must be a string or an int", field.Name, t.Name()))
+			}
+		}
+
 		sName := field.Name
-		sValue := encodedField{index: i}
+		sValue := encodedField{index: i, isTimestamp: isCreateTime || isUpdateTime}
+
+		// JSON fields are opaque to the codec, thus their type is not mapped
+		if containsTag(tags, tagJSON) != "" {
+			sValue.isJSON = true
+			s.fieldNames[sName] = sValue
+			continue
+		}
+
 		if fType.Implements(typeOfPLS) {
 			sValue.isPLS = true
 		}
@@ -134,19 +354,42 @@ func mapStructureLocked(t reflect.Type, s *encodedStruct) {
 			s.extensionsIdx = append(s.extensionsIdx, i)
 			sValue.isExtension = true
 		case reflect.Map:
-			fallthrough
+			if !isMapField(fType) {
+				continue
+			}
+			s.mapsIdx = append(s.mapsIdx, i)
+			sValue.isMap = true
 		case reflect.Array:
 			continue
 		case reflect.Slice:
-			//todo: validate supported slices
-			//notifica a GAE che è uno slice usando property.multiple in save/load
-			//pensare a come rappresentare nella mappa uno slice.
-			//todo::if here, nested slice so not supported
-			fType = field.Type.Elem()
-			if fType.Kind() != reflect.Struct {
+			// slices of modelables are references to many children, mapped when indexed
+			if isReferenceSlice(fType) {
+				s.referenceSlicesIdx = append(s.referenceSlicesIdx, i)
+				sValue.isReferenceSlice = true
 				break
 			}
-			fallthrough
+
+			if isNestedSlice(fType) {
+				if !isSliceValue(fType.Elem().Elem()) {
+					panic(fmt.Errorf("unsupported slice field %s of struct %s: nested slices can only hold values", field.Name, t.Name()))
+				}
+				s.nestedSlicesIdx = append(s.nestedSlicesIdx, i)
+				sValue.isNestedSlice = true
+				break
+			}
+
+			// slices of structs, or of pointers to structs, are flattened
+			et, ok := sliceStructType(fType, field.Name)
+			if !ok {
+				break
+			}
+
+			if cs, saved := encodedStructs[et]; saved {
+				sValue.childStruct = renamedStructLocked(et, cs, sName)
+			} else {
+				sValue.childStruct = newEncodedStruct(sName)
+				mapStructureLocked(et, sValue.childStruct)
+			}
 		case reflect.Ptr:
 			//if we have a pointer we map the value it points to
 			fieldElem := fType.Elem()
@@ -160,8 +403,7 @@ func mapStructureLocked(t reflect.Type, s *encodedStruct) {
 			//else we map the other struct
 			cs, saved := encodedStructs[fType]
 			if saved {
-				sValue.childStruct = cs
-				sValue.childStruct.structName = sName
+				sValue.childStruct = renamedStructLocked(fType, cs, sName)
 			} else {
 				sValue.childStruct = newEncodedStruct(sName)
 			}
@@ -190,12 +432,26 @@ func mapStructureLocked(t reflect.Type, s *encodedStruct) {
 
 		s.fieldNames[sName] = sValue
 	}
+
+	// searchable fields of references and nested structs make the struct searchable too
+	if !s.searchable && len(searchableFieldsOf(t, nil, "")) > 0 {
+		s.searchable = true
+	}
+
+	s.codec = compileCodec(t, s)
+	s.layout = layoutOf(t)
 	encodedStructs[t] = s
+}
 
-	// once the struct has been mapped
-	// register it to the gob for memcache decoding
-	obj := reflect.New(t).Interface()
-	gob.Register(obj)
+// returns a copy of the stored encoded struct of type t named after the field holding it,
+// and replaces the stored one with the copy, so that the struct read by other models is left untouched.
+// The copy shares the field mappings of the original, which are never modified after the mapping.
+// Must be called with the encodedStructsMutex held
+func renamedStructLocked(t reflect.Type, cs *encodedStruct, name string) *encodedStruct {
+	child := *cs
+	child.structName = name
+	encodedStructs[t] = &child
+	return &child
 }
 
 func encodeStruct(name string, s interface{}, props *[]datastore.Property, multiple bool, codec *encodedStruct) error {
@@ -236,6 +492,12 @@ func encodeStruct(name string, s interface{}, props *[]datastore.Property, multi
 			switch v.Kind() {
 			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 				p.Value = v.Int()
+			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+				x, err := uintValue(p.Name, v)
+				if err != nil {
+					return err
+				}
+				p.Value = x
 			case reflect.Bool:
 				p.Value = v.Bool()
 			case reflect.String:
@@ -245,19 +507,38 @@ func encodeStruct(name string, s interface{}, props *[]datastore.Property, multi
 			case reflect.Slice:
 				if v.Type().Elem().Kind() != reflect.Uint8 {
 					if val, ok := codec.fieldNames[field.Name]; ok {
+						// nested slices are supported only as fields of the modelable
+						if val.isNestedSlice {
+							return &PropertyError{Name: p.Name, Kind: v.Kind(), Value: v.Interface(), Err: ErrUnsupportedType}
+						}
+
+						if val.childStruct == nil {
+							sprops, err := sliceProperties(p.Name, v)
+							if err != nil {
+								return err
+							}
+							*props = append(*props, sprops...)
+							continue
+						}
+
 						for j := 0; j < v.Len(); j++ {
-							if err := encodeStruct(val.childStruct.structName, v.Index(j).Addr().Interface(), props, true, val.childStruct); err != nil {
+							item, err := sliceStructItem(p.Name, v.Index(j))
+							if err != nil {
+								return err
+							}
+
+							if err := encodeStruct(val.childStruct.structName, item, props, true, val.childStruct); err != nil {
 								panic(err)
 							}
 						}
-						break
+						continue
 					}
 				}
 				p.NoIndex = true
 				p.Value = v.Bytes()
 			case reflect.Struct:
 				if !v.CanAddr() {
-					return fmt.Errorf("datastore: unsupported struct field %s for entity of type %s: value %v is unaddressable", p.Name, sType, v)
+					return &PropertyError{Name: p.Name, Kind: v.Kind(), Value: v.Interface(), Err: ErrUnsupportedType}
 				}
 
 				if val, ok := codec.fieldNames[p.Name]; ok {
@@ -297,6 +578,10 @@ func isZero(m interface{}) bool {
 			if field.Int() != 0 {
 				return false
 			}
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if field.Uint() != 0 {
+				return false
+			}
 		case reflect.Bool:
 			if field.Bool() {
 				return false
@@ -339,7 +624,7 @@ func decodeStruct(s reflect.Value, p datastore.Property, encodedField encodedFie
 		}
 
 		typ := field.Elem().Elem().Type()
-		es, ok := encodedStructs[typ]
+		es, ok := encodedStructOf(typ)
 		if !ok {
 			return fmt.Errorf("struct of type %q has not been mapped. Can't load into field at index %d", typ, encodedField.index)
 		}
@@ -359,13 +644,17 @@ func decodeStruct(s reflect.Value, p datastore.Property, encodedField encodedFie
 		case typeOfTime:
 			x, ok := p.Value.(time.Time)
 			if !ok && p.Value != nil {
-				return errors.New("error - Invalid Time type")
+				return &PropertyError{Name: p.Name, Kind: field.Kind(), Value: p.Value, Err: ErrTypeMismatch}
+			}
+			// timestamps are never reset by a zero value
+			if encodedField.isTimestamp && x.IsZero() {
+				break
 			}
 			field.Set(reflect.ValueOf(x))
 		case typeOfGeoPoint:
 			x, ok := p.Value.(datastore.GeoPoint)
 			if !ok && p.Value != nil {
-				return errors.New("error - invalid geoPoint type")
+				return &PropertyError{Name: p.Name, Kind: field.Kind(), Value: p.Value, Err: ErrTypeMismatch}
 			}
 			field.Set(reflect.ValueOf(x))
 		default:
@@ -404,10 +693,14 @@ func decodeStruct(s reflect.Value, p datastore.Property, encodedField encodedFie
 			l.mem[p.Name] = index + 1
 			for field.Len() <= index {
 				sliceElem := reflect.New(field.Type().Elem()).Elem()
+				// pointers to structs are allocated
+				if sliceKind == reflect.Ptr {
+					sliceElem = reflect.New(field.Type().Elem().Elem())
+				}
 				field.Set(reflect.Append(field, sliceElem))
 			}
 
-			if sliceKind == reflect.Struct {
+			if encodedField.childStruct != nil {
 				if attr, ok := encodedField.childStruct.fieldNames[p.Name]; ok {
 					if err := decodeStruct(field.Index(index), p, attr, l); err != nil {
 						return err
@@ -421,7 +714,7 @@ func decodeStruct(s reflect.Value, p datastore.Property, encodedField encodedFie
 					}
 				}
 			} else {
-				err := decodeField(field.Index(index), p)
+				err := decodeSliceItem(field.Index(index), p)
 				if err != nil {
 					return err
 				}
@@ -441,23 +734,36 @@ func decodeStruct(s reflect.Value, p datastore.Property, encodedField encodedFie
 	return nil
 }
 
-// todo define errors
+// decodes the property into the field, reporting conversion failures as *PropertyError
 func decodeField(field reflect.Value, p datastore.Property) error {
 
+	if field.Type() == typeOfBlobRef {
+		return decodeBlobRef(field, p)
+	}
+
 	switch field.Kind() {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		x, ok := p.Value.(int64)
 		if !ok && p.Value != nil {
-			return errors.New("error 1")
+			return &PropertyError{Name: p.Name, Kind: field.Kind(), Value: p.Value, Err: ErrTypeMismatch}
 		}
 		if field.OverflowInt(x) {
-			return fmt.Errorf("value %v overflows struct field of type %v", x, field.Type())
+			return &PropertyError{Name: p.Name, Kind: field.Kind(), Value: x, Err: ErrFieldOverflow}
 		}
 		field.SetInt(x)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		x, ok := p.Value.(int64)
+		if !ok && p.Value != nil {
+			return &PropertyError{Name: p.Name, Kind: field.Kind(), Value: p.Value, Err: ErrTypeMismatch}
+		}
+		if x < 0 || field.OverflowUint(uint64(x)) {
+			return &PropertyError{Name: p.Name, Kind: field.Kind(), Value: x, Err: ErrFieldOverflow}
+		}
+		field.SetUint(uint64(x))
 	case reflect.Bool:
 		x, ok := p.Value.(bool)
 		if !ok && p.Value != nil {
-			return errors.New("error 2")
+			return &PropertyError{Name: p.Name, Kind: field.Kind(), Value: p.Value, Err: ErrTypeMismatch}
 		}
 		field.SetBool(x)
 	case reflect.String:
@@ -468,29 +774,29 @@ func decodeField(field reflect.Value, p datastore.Property) error {
 			field.SetString(x)
 		default:
 			if p.Value != nil {
-				return errors.New("error 3")
+				return &PropertyError{Name: p.Name, Kind: field.Kind(), Value: p.Value, Err: ErrTypeMismatch}
 			}
 		}
 	case reflect.Float32, reflect.Float64:
 		x, ok := p.Value.(float64)
 		if !ok && p.Value != nil {
-			return errors.New("error 4")
+			return &PropertyError{Name: p.Name, Kind: field.Kind(), Value: p.Value, Err: ErrTypeMismatch}
 		}
 		if field.OverflowFloat(x) {
-			return fmt.Errorf("value %v overflows struct field of type %v", x, field.Type())
+			return &PropertyError{Name: p.Name, Kind: field.Kind(), Value: x, Err: ErrFieldOverflow}
 		}
 		field.SetFloat(x)
 	case reflect.Ptr:
 		x, ok := p.Value.(*datastore.Key)
 		if !ok && p.Value != nil {
-			return fmt.Errorf("unsupported load type %s", field.Type().String())
+			return &PropertyError{Name: p.Name, Kind: field.Kind(), Value: p.Value, Err: ErrTypeMismatch}
 		}
 		if _, ok := field.Interface().(*datastore.Key); !ok {
-			return fmt.Errorf("unsupported pointer interface %s", field.Interface())
+			return &PropertyError{Name: p.Name, Kind: field.Kind(), Value: p.Value, Err: ErrUnsupportedType}
 		}
 		field.Set(reflect.ValueOf(x))
 	default:
-		return fmt.Errorf("unsupported load type %s", field.Kind().String())
+		return &PropertyError{Name: p.Name, Kind: field.Kind(), Value: p.Value, Err: ErrUnsupportedType}
 	}
 	return nil
 }
@@ -529,46 +835,78 @@ func childName(fullName string) string {
 }
 
 func toPropertyList(modelable modelable) ([]datastore.Property, error) {
+	if err := validate(modelable); err != nil {
+		return nil, err
+	}
+
+	stampTimes(modelable)
+	return encodeProperties(modelable)
+}
+
+// encodes the modelable as it is, without setting its timestamps
+func encodeProperties(modelable modelable) ([]datastore.Property, error) {
 	value := reflect.ValueOf(modelable).Elem()
 	sType := value.Type()
 
+	if usesDatastoreCodec(sType) {
+		return saveWithDatastoreCodec(modelable)
+	}
+
 	model := modelable.getModel()
 
 	var props []datastore.Property
-	//loop through prototype fields
+	//loop through the precompiled fields
 	//and handle them accordingly to their type
-	for i := 0; i < sType.NumField(); i++ {
-		field := sType.Field(i)
+	for _, fc := range model.codec {
+		i := fc.index
+		p := datastore.Property{Name: fc.name, NoIndex: fc.noIndex}
 
-		if field.Type == typeOfModel {
+		if ref := model.referenceAtIndex(i); ref != nil {
+			rm := ref.Modelable.getModel()
+			p.Value = rm.Key
+			props = append(props, p)
 			continue
 		}
 
-		if field.Tag.Get("datastore") == "-" {
+		if fc.mapped && fc.attr.isReferenceSlice {
+			p.Value = referenceSliceKeys(value.Field(i))
+			props = append(props, p)
 			continue
 		}
 
-		tags := strings.Split(field.Tag.Get(tagDomain), ",")
-
-		if containsTag(tags, tagSkip) != "" {
+		if fc.mapped && fc.attr.isMap {
+			mprops, err := mapProperties(fc.name, value.Field(i), p.NoIndex)
+			if err != nil {
+				return nil, err
+			}
+			props = append(props, mprops...)
 			continue
 		}
 
-		p := datastore.Property{}
+		if fc.mapped && fc.attr.isJSON {
+			if fc.omitEmpty && value.Field(i).IsZero() {
+				continue
+			}
 
-		if containsTag(tags, tagNoindex) != "" {
-			p.NoIndex = true
+			jp, err := jsonProperty(fc.name, value.Field(i))
+			if err != nil {
+				return nil, err
+			}
+			props = append(props, jp)
+			continue
 		}
 
-		p.Name = field.Name
+		v := value.Field(i)
+		if fc.omitEmpty && v.IsZero() {
+			continue
+		}
 
-		if ref := model.referenceAtIndex(i); ref != nil {
-			rm := ref.Modelable.getModel()
-			p.Value = rm.Key
+		if fc.encode != nil {
+			p.Value = fc.encode(v)
 			props = append(props, p)
 			continue
 		}
-		v := value.Field(i)
+
 		switch x := v.Interface().(type) {
 		case time.Time:
 			p.Value = x
@@ -589,6 +927,11 @@ func toPropertyList(modelable modelable) ([]datastore.Property, error) {
 			switch v.Kind() {
 			case reflect.Interface:
 				// if valid interface, treat it like an extension
+				if raw := rawExtensionAt(model, v, i); raw != nil {
+					props = append(props, raw.properties(fc.name, p.NoIndex)...)
+					continue
+				}
+
 				if v.IsNil() {
 					continue
 				}
@@ -599,7 +942,7 @@ func toPropertyList(modelable modelable) ([]datastore.Property, error) {
 				}
 
 				typ := v.Elem().Elem().Type()
-				es, ok := encodedStructs[typ]
+				es, ok := encodedStructOf(typ)
 				if !ok {
 					msg := fmt.Sprintf("struct of type %q has not been mapped. Can't save interface at index %d", typ, i)
 					panic(msg)
@@ -609,29 +952,51 @@ func toPropertyList(modelable modelable) ([]datastore.Property, error) {
 				p.Value = v.Elem().Type().Elem().Name()
 				props = append(props, p)
 
-				err := encodeStruct(field.Name, v.Elem().Interface(), &props, false, es)
+				err := encodeStruct(fc.name, v.Elem().Interface(), &props, false, es)
 				if err != nil {
 					panic(err)
 				}
 				continue
 			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 				p.Value = v.Int()
+			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+				x, err := uintValue(p.Name, v)
+				if err != nil {
+					return nil, err
+				}
+				p.Value = x
 			case reflect.Bool:
 				p.Value = v.Bool()
 			case reflect.String:
 				p.Value = v.String()
 			case reflect.Float32, reflect.Float64:
 				p.Value = v.Float()
+			case reflect.Map:
+				// maps the codec can't store are skipped
+				continue
 			case reflect.Slice:
 				sliceKind := v.Type().Elem().Kind()
 				if sliceKind != reflect.Uint8 {
 
 					if val, ok := model.fieldNames[p.Name]; ok {
-						if sliceKind == reflect.Struct {
+						if val.isNestedSlice {
+							nprops, err := nestedSliceProperties(p.Name, v, p.NoIndex)
+							if err != nil {
+								return nil, err
+							}
+							props = append(props, nprops...)
+							continue
+						}
+
+						if val.childStruct != nil {
 							for j := 0; j < v.Len(); j++ {
-								//if the slice is made of structs we encode them
+								//if the slice is made of structs, or of pointers to structs, we encode them
+								item, err := sliceStructItem(p.Name, v.Index(j))
+								if err != nil {
+									return nil, err
+								}
 
-								if err := encodeStruct(val.childStruct.structName, v.Index(j).Addr().Interface(), &props, true, val.childStruct); err != nil {
+								if err := encodeStruct(p.Name, item, &props, true, val.childStruct); err != nil {
 									panic(err)
 								}
 							}
@@ -658,6 +1023,12 @@ func toPropertyList(modelable modelable) ([]datastore.Property, error) {
 								switch sv.Kind() {
 								case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 									sp.Value = sv.Int()
+								case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+									x, err := uintValue(sp.Name, sv)
+									if err != nil {
+										return nil, err
+									}
+									sp.Value = x
 								case reflect.Bool:
 									sp.Value = sv.Bool()
 								case reflect.String:
@@ -677,12 +1048,12 @@ func toPropertyList(modelable modelable) ([]datastore.Property, error) {
 				p.Value = v.Bytes()
 			case reflect.Struct:
 				if !v.CanAddr() {
-					return nil, fmt.Errorf("datastore: unsupported struct field %s: value is unaddressable", field.Name)
+					return nil, &PropertyError{Name: fc.name, Kind: v.Kind(), Value: v.Interface(), Err: ErrUnsupportedType}
 				}
 				//if struct, recursively call itself until an error is found
 				//as debug, check consistency. we should have a value at i
 				if val, ok := model.fieldNames[p.Name]; ok {
-					err := encodeStruct(val.childStruct.structName, v.Addr().Interface(), &props, false, val.childStruct)
+					err := encodeStruct(p.Name, v.Addr().Interface(), &props, false, val.childStruct)
 					if err != nil {
 						panic(err)
 					}
@@ -694,7 +1065,7 @@ func toPropertyList(modelable modelable) ([]datastore.Property, error) {
 
 		props = append(props, p)
 	}
-	return props, nil
+	return renameProperties(props, model.storedNames), nil
 }
 
 func fromPropertyList(modelable modelable, props []datastore.Property) error {
@@ -705,15 +1076,99 @@ func fromPropertyList(modelable modelable, props []datastore.Property) error {
 	model := modelable.getModel()
 	pl := propertyLoader{}
 
-	for _, p := range props {
+	if usesDatastoreCodec(sType) {
+		return loadWithDatastoreCodec(modelable, props)
+	}
+
+	// the properties of the fields tagged with name= are loaded into their fields
+	props = renameProperties(props, model.fieldsOfStored)
+	trackModified(modelable, props)
+
+	// in lenient mode the properties that can't be loaded are collected and skipped
+	lenient := model.lenient || isLenient(sType)
+	var mismatches []FieldMismatch
+	mismatch := func(p datastore.Property, err error) error {
+		if !lenient {
+			return err
+		}
+		mismatches = append(mismatches, FieldMismatch{Property: p.Name, Err: err})
+		return nil
+	}
+
+	model.unresolved = false
+	model.rawExtensions = nil
+
+	// extensions whose type was unknown are decoded again
+	for _, i := range model.extensionsIdx {
+		field := value.Field(i)
+		if _, ok := field.Interface().(*RawExtension); ok {
+			field.Set(reflect.Zero(field.Type()))
+		}
+	}
+
+	// fields omitted when empty are zeroed, as their property might be missing
+	for _, i := range model.omitEmptyIdx {
+		field := value.Field(i)
+		field.Set(reflect.Zero(field.Type()))
+	}
+
+	// maps and nested slices are rebuilt from their entries
+	for _, i := range model.mapsIdx {
+		field := value.Field(i)
+		field.Set(reflect.Zero(field.Type()))
+	}
+
+	for _, i := range model.nestedSlicesIdx {
+		field := value.Field(i)
+		field.Set(reflect.Zero(field.Type()))
+	}
+
+	// properties written by other libraries are brought to the framework layout.
+	// Reference slices keep their keys in a single array
+	loaded := flattenProperties(props, func(name string) bool {
+		if attr, ok := nestedSliceFieldOf(model.encodedStruct, name); ok {
+			return attr.isNestedSlice
+		}
+		attr, ok := model.fieldNames[name]
+		return ok && attr.isReferenceSlice
+	})
+
+	for _, p := range loaded {
+		if attr, ok := model.fieldNames[p.Name]; ok && attr.isJSON {
+			if err := decodeJSONField(value.Field(attr.index), p); err != nil {
+				if err := mismatch(p, err); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if attr, ok := nestedSliceFieldOf(model.encodedStruct, p.Name); ok {
+			if err := decodeNestedSliceItem(value.Field(attr.index), p); err != nil {
+				if err := mismatch(p, err); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if attr, ok := mapFieldOf(model.encodedStruct, p.Name); ok {
+			if err := decodeMapEntry(value.Field(attr.index), p); err != nil {
+				if err := mismatch(p, err); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
 		//if we have a reference we set the key in the corresponding model index
 		//to be processed later within datastore transaction
 
 		//we consider a reference only if the model says so.
 		//in this way we can mix model. with datastore. package
 		pure := pureName(p.Name)
-		if field, ok := sType.FieldByName(pure); ok {
-			if ref := model.referenceAtIndex(field.Index[0]); ref != nil {
+		if attr, ok := model.fieldNames[pure]; ok {
+			if ref := model.referenceAtIndex(attr.index); ref != nil {
 				//cast to key
 				if key, ok := p.Value.(*datastore.Key); ok || p.Value == nil {
 					rm := ref.Modelable.getModel()
@@ -721,7 +1176,19 @@ func fromPropertyList(modelable modelable, props []datastore.Property) error {
 					continue
 				}
 
-				return fmt.Errorf("no struct of type key found for reference %s", pure)
+				if err := mismatch(p, &PropertyError{Name: p.Name, Kind: sType.Field(attr.index).Type.Kind(), Value: p.Value, Err: ErrTypeMismatch}); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if attr.isReferenceSlice {
+				if err := decodeReferenceSlice(value.Field(attr.index), p); err != nil {
+					if err := mismatch(p, err); err != nil {
+						return err
+					}
+				}
+				continue
 			}
 		}
 
@@ -734,10 +1201,14 @@ func fromPropertyList(modelable modelable, props []datastore.Property) error {
 
 			if attr.isExtension {
 				// if the value of the extension is currently nil, create it
-				if field := val.Elem().Field(attr.index); field.IsNil() {
+				field := val.Elem().Field(attr.index)
+				if _, raw := field.Interface().(*RawExtension); field.IsNil() || raw {
 					extype := findExtensionType(bname, props)
 					if extype == nil {
-						return fmt.Errorf("no valid type for Extension field %s", bname)
+						// the stored type is unknown: the properties are kept as they are, to be saved back
+						model.unresolved = true
+						loadRawExtension(model, field, attr.index, bname, p)
+						continue
 					}
 
 					obj := reflect.New(extype)
@@ -747,7 +1218,9 @@ func fromPropertyList(modelable modelable, props []datastore.Property) error {
 
 			err := decodeStruct(val, p, attr, &pl)
 			if nil != err {
-				return err
+				if err := mismatch(p, err); err != nil {
+					return err
+				}
 			}
 			continue
 		}
@@ -766,6 +1239,10 @@ func fromPropertyList(modelable modelable, props []datastore.Property) error {
 		}
 	}
 
+	if len(mismatches) > 0 {
+		return &FieldMismatchError{StructName: model.Name(), StructType: sType, Fields: mismatches}
+	}
+
 	return nil
 }
 
@@ -773,7 +1250,8 @@ func findExtensionType(ext string, props []datastore.Property) reflect.Type {
 	needle := makeExtensionTypeName(ext)
 	for _, v := range props {
 		if v.Name == needle {
-			return structTypeByName(v.Value.(string))
+			name, _ := v.Value.(string)
+			return extensionTypeByName(name)
 		}
 	}
 	return nil
@@ -0,0 +1,201 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+type decodedEntity struct {
+	Model
+	Small int8
+	Flag  bool
+}
+
+func TestPropertyErrors(t *testing.T) {
+	e := decodedEntity{}
+	index(&e)
+
+	err := fromPropertyList(&e, []datastore.Property{{Name: "Small", Value: int64(1000)}})
+	if !errors.Is(err, ErrFieldOverflow) {
+		t.Fatalf("expected an overflow, got %v", err)
+	}
+
+	err = fromPropertyList(&e, []datastore.Property{{Name: "Flag", Value: "yes"}})
+	var perr *PropertyError
+	if !errors.As(err, &perr) || !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("expected a type mismatch, got %v", err)
+	}
+
+	if perr.Name != "Flag" || perr.Kind != reflect.Bool {
+		t.Fatalf("invalid property error %+v", perr)
+	}
+}
+
+type mappedEntity struct {
+	Model
+	Labels map[string]string
+	Scores map[string]int
+	Nested map[string][]string
+}
+
+func TestMapFields(t *testing.T) {
+	src := mappedEntity{Labels: map[string]string{"b": "2", "a": "1"}, Scores: map[string]int{"x": 3}}
+	index(&src)
+
+	props, err := toPropertyList(&src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make([]string, len(props))
+	for i, p := range props {
+		names[i] = p.Name
+	}
+
+	if !reflect.DeepEqual(names, []string{"Labels.a", "Labels.b", "Scores.x"}) {
+		t.Fatalf("invalid map properties %v", names)
+	}
+
+	dst := mappedEntity{Labels: map[string]string{"stale": "value"}}
+	index(&dst)
+	if err := fromPropertyList(&dst, props); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(dst.Labels, src.Labels) || !reflect.DeepEqual(dst.Scores, src.Scores) {
+		t.Fatalf("invalid decoded maps %+v", dst)
+	}
+}
+
+type unsignedEntity struct {
+	Model
+	Small  uint8
+	Big    uint64
+	Counts []uint32
+}
+
+func TestUnsignedFields(t *testing.T) {
+	src := unsignedEntity{Small: 200, Big: 1 << 40, Counts: []uint32{1, 2}}
+	index(&src)
+
+	props, err := toPropertyList(&src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := unsignedEntity{}
+	index(&dst)
+	if err := fromPropertyList(&dst, props); err != nil {
+		t.Fatal(err)
+	}
+
+	if dst.Small != src.Small || dst.Big != src.Big || !reflect.DeepEqual(dst.Counts, src.Counts) {
+		t.Fatalf("invalid decoded entity %+v", dst)
+	}
+
+	src.Big = 1 << 63
+	if _, err := toPropertyList(&src); !errors.Is(err, ErrFieldOverflow) {
+		t.Fatalf("expected an overflow, got %v", err)
+	}
+
+	err = fromPropertyList(&dst, []datastore.Property{{Name: "Small", Value: int64(-1)}})
+	if !errors.Is(err, ErrFieldOverflow) {
+		t.Fatalf("expected an overflow, got %v", err)
+	}
+}
+
+type concurrentExtra struct {
+	Color string
+}
+
+type concurrentEntity struct {
+	Model
+	Title string
+	Ext   interface{}
+}
+
+// run with -race to check the concurrent access to the mapped structs
+func TestConcurrentIndexing(t *testing.T) {
+	const workers = 32
+
+	structs := make(chan *encodedStruct, workers)
+	errs := make(chan error, workers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			src := concurrentEntity{Title: "title", Ext: &concurrentExtra{Color: "red"}}
+			index(&src)
+			structs <- src.getModel().encodedStruct
+
+			props, err := toPropertyList(&src)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			dst := concurrentEntity{}
+			index(&dst)
+			if err := fromPropertyList(&dst, props); err != nil {
+				errs <- err
+				return
+			}
+
+			if dst.Title != src.Title {
+				errs <- fmt.Errorf("invalid decoded entity %+v", dst)
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(structs)
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	var first *encodedStruct
+	for s := range structs {
+		if first == nil {
+			first = s
+		}
+		if s != first {
+			t.Fatal("the struct has been mapped more than once")
+		}
+	}
+}
+
+type concurrentOwner struct {
+	Model
+	Name string
+}
+
+type concurrentHolder struct {
+	Model
+	Boss concurrentOwner `model:"readonly"`
+}
+
+func TestMappingLeavesStoredStruct(t *testing.T) {
+	owner := concurrentOwner{}
+	index(&owner)
+	stored := owner.getModel().encodedStruct
+
+	holder := concurrentHolder{}
+	index(&holder)
+
+	if stored.structName != "concurrentOwner" || stored.readonly {
+		t.Fatalf("the mapping of the holder modified the stored struct %+v", stored)
+	}
+
+	if es, _ := encodedStructOf(reflect.TypeOf(owner)); es == stored || es.structName != "Boss" || !es.readonly {
+		t.Fatalf("invalid struct of the reference %+v", es)
+	}
+}
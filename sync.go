@@ -0,0 +1,121 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"fmt"
+	"google.golang.org/api/iterator"
+	"reflect"
+	"time"
+)
+
+// SyncResult lists the entities of a kind changed after a watermark, for the incremental sync of clients
+type SyncResult struct {
+	Created []*datastore.Key
+	Updated []*datastore.Key
+	Deleted []*datastore.Key
+	// the time of the latest change found, to pass to the next Sync. It is the given one if nothing changed
+	Watermark time.Time
+}
+
+// Sync returns the keys of the entities of the given kind created, updated and soft deleted at or after since,
+// giving offline clients an incremental sync of any kind: the clients pass the watermark of a sync to the next one,
+// and read the created and updated entities they need.
+// The modelables of the kind must have an indexed field tagged updatetime. Entities are reported as created
+// if their field tagged createtime, if any, is after since, and as deleted if their field tagged softdelete is.
+// Entities erased from the datastore can't be reported.
+// The entities changed at the watermark itself are reported again by the next Sync,
+// so that the ones sharing its time but committed afterwards are not skipped.
+// Writes committed while Sync runs may carry a time before the watermark: clients can pass a slightly earlier time,
+// as syncing an entity twice is harmless
+func Sync(ctx context.Context, kind string, since time.Time) (*SyncResult, error) {
+	t := modelableTypeOfKind(kind)
+	if t == nil {
+		return nil, fmt.Errorf("no modelable registered for kind %s", kind)
+	}
+
+	m := reflect.New(t).Interface().(modelable)
+	index(m)
+	model := m.getModel()
+	if model.updateTime == nil {
+		return nil, fmt.Errorf("modelables of kind %s have no updatetime field. Can't sync them", kind)
+	}
+
+	result := &SyncResult{Watermark: since}
+	deleted := make(map[string]bool)
+
+	if sd := model.softDelete; sd != nil {
+		err := syncChanges(ctx, kind, sd.name, since, func(key *datastore.Key, props datastore.PropertyList) {
+			// the entities that are not deleted hold the zero time
+			at := timeProperty(props, sd.name)
+			if at.IsZero() {
+				return
+			}
+
+			result.Deleted = append(result.Deleted, key)
+			result.advance(at)
+			deleted[key.Encode()] = true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := syncChanges(ctx, kind, model.updateTime.name, since, func(key *datastore.Key, props datastore.PropertyList) {
+		result.advance(timeProperty(props, model.updateTime.name))
+
+		// entities deleted before since are already gone from the clients
+		if deleted[key.Encode()] || (model.softDelete != nil && !timeProperty(props, model.softDelete.name).IsZero()) {
+			return
+		}
+
+		if ct := model.createTime; ct != nil && timeProperty(props, ct.name).After(since) {
+			result.Created = append(result.Created, key)
+			return
+		}
+		result.Updated = append(result.Updated, key)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (result *SyncResult) advance(t time.Time) {
+	if t.After(result.Watermark) {
+		result.Watermark = t
+	}
+}
+
+// calls found for the entities of kind whose time property is at or after since, in time order
+func syncChanges(ctx context.Context, kind string, property string, since time.Time, found func(key *datastore.Key, props datastore.PropertyList)) error {
+	q := newDatastoreQuery(ctx, kind).
+		Filter(fmt.Sprintf("%s >=", property), since).
+		Order(property)
+
+	it := ClientFromContext(ctx).Run(ctx, q)
+	for {
+		var props datastore.PropertyList
+		key, err := it.Next(&props)
+		if err == iterator.Done {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("error syncing kind %s: %w", kind, err)
+		}
+
+		found(key, props)
+	}
+}
+
+// returns the value of the time property with the given name, or the zero time if missing
+func timeProperty(props datastore.PropertyList, name string) time.Time {
+	for _, p := range props {
+		if t, ok := p.Value.(time.Time); ok && p.Name == name {
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,198 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// the payload of a modelable passed through a task queue or a topic.
+// It holds the properties of the entity, thus it can be decoded by a newer or older version of the struct
+type taskPayload struct {
+	Key        string         `json:",omitempty"`
+	Properties []taskProperty `json:"Properties"`
+}
+
+type taskProperty struct {
+	Name    string
+	NoIndex bool `json:",omitempty"`
+	taskValue
+}
+
+type taskValue struct {
+	Type  string
+	Value json.RawMessage `json:",omitempty"`
+}
+
+// EncodeForTask encodes the modelable with its key as JSON, to be passed to a task or a message.
+// References are encoded by key
+func EncodeForTask(m modelable) ([]byte, error) {
+	index(m)
+
+	props, err := encodeProperties(m)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := taskPayload{Key: m.getModel().EncodedKey(), Properties: make([]taskProperty, len(props))}
+	for i, p := range props {
+		v, err := encodeTaskValue(p.Value)
+		if err != nil {
+			return nil, fmt.Errorf("can't encode property %s: %w", p.Name, err)
+		}
+		payload.Properties[i] = taskProperty{Name: p.Name, NoIndex: p.NoIndex, taskValue: v}
+	}
+
+	return json.Marshal(payload)
+}
+
+// DecodeFromTask decodes into the modelable the data encoded with EncodeForTask.
+// Properties with no matching field are ignored. References only get their key, and can be read afterwards
+func DecodeFromTask(data []byte, m modelable) error {
+	var payload taskPayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return err
+	}
+
+	props := make([]datastore.Property, len(payload.Properties))
+	for i, tp := range payload.Properties {
+		v, err := decodeTaskValue(tp.taskValue)
+		if err != nil {
+			return fmt.Errorf("can't decode property %s: %w", tp.Name, err)
+		}
+		props[i] = datastore.Property{Name: tp.Name, NoIndex: tp.NoIndex, Value: v}
+	}
+
+	index(m)
+	if err := fromPropertyList(m, props); err != nil {
+		return err
+	}
+
+	model := m.getModel()
+	model.Key = nil
+	if payload.Key != "" {
+		key, err := datastore.DecodeKey(payload.Key)
+		if err != nil {
+			return err
+		}
+		model.Key = key
+	}
+
+	for i, ref := range model.references {
+		model.references[i].Key = ref.Modelable.getModel().Key
+	}
+
+	return nil
+}
+
+func encodeTaskValue(value interface{}) (taskValue, error) {
+	var typ string
+	var v interface{}
+
+	switch x := value.(type) {
+	case nil:
+		return taskValue{Type: "null"}, nil
+	case int64:
+		typ, v = "int", x
+	case bool:
+		typ, v = "bool", x
+	case string:
+		typ, v = "string", x
+	case float64:
+		typ, v = "float", x
+	case []byte:
+		typ, v = "bytes", base64.StdEncoding.EncodeToString(x)
+	case time.Time:
+		typ, v = "time", x.Format(time.RFC3339Nano)
+	case datastore.GeoPoint:
+		typ, v = "geo", x
+	case *datastore.Key:
+		if x == nil {
+			return taskValue{Type: "null"}, nil
+		}
+		typ, v = "key", x.Encode()
+	case []interface{}:
+		values := make([]taskValue, len(x))
+		for i, e := range x {
+			ev, err := encodeTaskValue(e)
+			if err != nil {
+				return taskValue{}, err
+			}
+			values[i] = ev
+		}
+		typ, v = "array", values
+	default:
+		return taskValue{}, fmt.Errorf("unsupported property type %T", value)
+	}
+
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return taskValue{}, err
+	}
+
+	return taskValue{Type: typ, Value: raw}, nil
+}
+
+func decodeTaskValue(tv taskValue) (interface{}, error) {
+	switch tv.Type {
+	case "null":
+		return nil, nil
+	case "int":
+		var x int64
+		err := json.Unmarshal(tv.Value, &x)
+		return x, err
+	case "bool":
+		var x bool
+		err := json.Unmarshal(tv.Value, &x)
+		return x, err
+	case "string":
+		var x string
+		err := json.Unmarshal(tv.Value, &x)
+		return x, err
+	case "float":
+		var x float64
+		err := json.Unmarshal(tv.Value, &x)
+		return x, err
+	case "bytes":
+		var x string
+		if err := json.Unmarshal(tv.Value, &x); err != nil {
+			return nil, err
+		}
+		return base64.StdEncoding.DecodeString(x)
+	case "time":
+		var x string
+		if err := json.Unmarshal(tv.Value, &x); err != nil {
+			return nil, err
+		}
+		return time.Parse(time.RFC3339Nano, x)
+	case "geo":
+		var x datastore.GeoPoint
+		err := json.Unmarshal(tv.Value, &x)
+		return x, err
+	case "key":
+		var x string
+		if err := json.Unmarshal(tv.Value, &x); err != nil {
+			return nil, err
+		}
+		return datastore.DecodeKey(x)
+	case "array":
+		var values []taskValue
+		if err := json.Unmarshal(tv.Value, &values); err != nil {
+			return nil, err
+		}
+
+		x := make([]interface{}, len(values))
+		for i, ev := range values {
+			v, err := decodeTaskValue(ev)
+			if err != nil {
+				return nil, err
+			}
+			x[i] = v
+		}
+		return x, nil
+	}
+
+	return nil, fmt.Errorf("unknown property type %q", tv.Type)
+}
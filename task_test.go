@@ -0,0 +1,39 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"testing"
+	"time"
+)
+
+type taskEntity struct {
+	Model
+	Name    string
+	Count   int
+	Created time.Time
+	Tags    []string
+}
+
+func TestTaskEncoding(t *testing.T) {
+	src := taskEntity{Name: "Enzo", Count: 3, Created: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), Tags: []string{"a", "b"}}
+	index(&src)
+	src.Key = datastore.IDKey("taskEntity", 42, nil)
+
+	data, err := EncodeForTask(&src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := taskEntity{}
+	if err := DecodeFromTask(data, &dst); err != nil {
+		t.Fatal(err)
+	}
+
+	if dst.Name != src.Name || dst.Count != src.Count || !dst.Created.Equal(src.Created) || len(dst.Tags) != 2 {
+		t.Fatalf("invalid decoded entity %+v", dst)
+	}
+
+	if !dst.Key.Equal(src.Key) {
+		t.Fatalf("invalid decoded key %v", dst.Key)
+	}
+}
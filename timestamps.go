@@ -0,0 +1,77 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"reflect"
+	"time"
+)
+
+// time.Time fields automatically set on write, i.e. `model:"createtime"`.
+// The create time is set when the entity is created, the update time on every write
+const (
+	tagCreateTime string = "createtime"
+	tagUpdateTime string = "updatetime"
+)
+
+type timestampDescriptor struct {
+	// index of the time field
+	index int
+	name  string
+}
+
+// sets the create time of a new entity, if unset. It is called by the create operations only
+func initCreateTime(m modelable) {
+	model := m.getModel()
+	if model.createTime == nil {
+		return
+	}
+
+	field := reflect.ValueOf(m).Elem().Field(model.createTime.index)
+	if field.Interface().(time.Time).IsZero() {
+		// the datastore keeps times with microsecond precision
+		field.Set(reflect.ValueOf(time.Now().Truncate(time.Microsecond)))
+	}
+}
+
+// loads the stored create time into a modelable being updated without it, i.e. one that has not been read,
+// so that the update doesn't overwrite it
+func preserveCreateTime(ctx context.Context, m modelable) error {
+	model := m.getModel()
+	if model.createTime == nil || model.Key == nil {
+		return nil
+	}
+
+	field := reflect.ValueOf(m).Elem().Field(model.createTime.index)
+	if !field.Interface().(time.Time).IsZero() {
+		return nil
+	}
+
+	var stored datastore.PropertyList
+	if err := getEntity(ctx, model.Key, &stored); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		}
+		return err
+	}
+
+	for _, p := range stored {
+		if t, ok := p.Value.(time.Time); ok && p.Name == model.createTime.name {
+			field.Set(reflect.ValueOf(t))
+		}
+	}
+	return nil
+}
+
+// refreshes the update time of the modelable before encoding it.
+// The create time is set by the create operations, see initCreateTime
+func stampTimes(m modelable) {
+	model := m.getModel()
+	if model.updateTime == nil {
+		return
+	}
+
+	// the datastore keeps times with microsecond precision
+	now := time.Now().Truncate(time.Microsecond)
+	reflect.ValueOf(m).Elem().Field(model.updateTime.index).Set(reflect.ValueOf(now))
+}
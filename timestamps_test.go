@@ -0,0 +1,92 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"testing"
+	"time"
+)
+
+type stampedEntity struct {
+	Model
+	Name      string
+	CreatedAt time.Time `model:"createtime"`
+	UpdatedAt time.Time `model:"updatetime"`
+}
+
+func TestTimestampTags(t *testing.T) {
+	e := stampedEntity{Name: "stamped"}
+	index(&e)
+
+	if _, err := EstimateCost(&e); err != nil {
+		t.Fatal(err)
+	}
+
+	if !e.CreatedAt.IsZero() || !e.UpdatedAt.IsZero() {
+		t.Fatalf("the cost estimate stamped the entity: %+v", e)
+	}
+
+	// the create time is set by the create operations only, not by every write
+	if _, err := toPropertyList(&e); err != nil {
+		t.Fatal(err)
+	}
+
+	if !e.CreatedAt.IsZero() || e.UpdatedAt.IsZero() {
+		t.Fatalf("expected only the update time to be set by a write, got %+v", e)
+	}
+
+	initCreateTime(&e)
+	if e.CreatedAt.IsZero() {
+		t.Fatal("the create time of a new entity has not been set")
+	}
+
+	created := e.CreatedAt
+	time.Sleep(time.Millisecond)
+
+	props, err := toPropertyList(&e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !e.CreatedAt.Equal(created) {
+		t.Fatalf("the create time changed from %s to %s", created, e.CreatedAt)
+	}
+
+	if !e.UpdatedAt.After(created) {
+		t.Fatalf("expected the update time to be refreshed, got %s", e.UpdatedAt)
+	}
+
+	for _, p := range props {
+		if p.Name == "UpdatedAt" && !p.Value.(time.Time).Equal(e.UpdatedAt) {
+			t.Fatalf("the stored update time %v is not the one of the entity", p.Value)
+		}
+	}
+}
+
+func TestZeroTimestampsAreNotLoaded(t *testing.T) {
+	now := time.Now().Truncate(time.Microsecond)
+	e := stampedEntity{CreatedAt: now, UpdatedAt: now}
+	index(&e)
+
+	props := []datastore.Property{
+		{Name: "Name", Value: "loaded"},
+		{Name: "CreatedAt", Value: time.Time{}},
+		{Name: "UpdatedAt", Value: time.Time{}},
+	}
+	if err := fromPropertyList(&e, props); err != nil {
+		t.Fatal(err)
+	}
+
+	if e.Name != "loaded" || !e.CreatedAt.Equal(now) || !e.UpdatedAt.Equal(now) {
+		t.Fatalf("zero timestamps overwrote the entity: %+v", e)
+	}
+
+	later := now.Add(time.Hour)
+	props = []datastore.Property{{Name: "UpdatedAt", Value: later}}
+	if err := fromPropertyList(&e, props); err != nil {
+		t.Fatal(err)
+	}
+
+	if !e.UpdatedAt.Equal(later) {
+		t.Fatalf("expected the stored update time %s, got %s", later, e.UpdatedAt)
+	}
+}
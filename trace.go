@@ -0,0 +1,193 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const keyPropertyTrace = "__model_property_trace"
+
+// PropertyTrace reports, field by field, the properties written and read by the operations
+// run with a context returned by WithPropertyTrace. It answers questions like "why is my field not saved?"
+type PropertyTrace struct {
+	mutex   sync.Mutex
+	entries []TraceEntry
+}
+
+// TraceEntry describes what became of a field of a modelable when it was saved or loaded
+type TraceEntry struct {
+	// "save" or "load"
+	Op   string
+	Kind string
+	// the encoded key of the entity, if known
+	Key string
+	// the name of the field. It is empty for the loaded properties that match no field
+	Field string
+	// why the field has no property, if so
+	Reason     string
+	Properties []TracedProperty
+}
+
+type TracedProperty struct {
+	Name string
+	// approximate size of the value in bytes
+	Size    int
+	NoIndex bool
+}
+
+// WithPropertyTrace returns a context tracing the properties of the modelables saved and loaded with it.
+// Tracing has a cost and is meant for debugging only
+func WithPropertyTrace(ctx context.Context) context.Context {
+	return context.WithValue(ctx, keyPropertyTrace, &PropertyTrace{})
+}
+
+// PropertyTraceFrom returns the trace recorded with ctx, or nil if ctx is not traced
+func PropertyTraceFrom(ctx context.Context) *PropertyTrace {
+	t, _ := ctx.Value(keyPropertyTrace).(*PropertyTrace)
+	return t
+}
+
+// Entries returns the traced fields, in the order they were saved or loaded
+func (t *PropertyTrace) Entries() []TraceEntry {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]TraceEntry(nil), t.entries...)
+}
+
+func (t *PropertyTrace) String() string {
+	var b strings.Builder
+	for _, e := range t.Entries() {
+		field := e.Field
+		if field == "" {
+			field = "(no field)"
+		}
+		fmt.Fprintf(&b, "%s %s %s %s:", e.Op, e.Kind, e.Key, field)
+		if e.Reason != "" {
+			fmt.Fprintf(&b, " %s", e.Reason)
+		}
+		for _, p := range e.Properties {
+			index := "indexed"
+			if p.NoIndex {
+				index = "noindex"
+			}
+			fmt.Fprintf(&b, " %s (%d bytes, %s)", p.Name, p.Size, index)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// attaches the trace of ctx, if any, to the model until the returned function is called
+func traceModel(ctx context.Context, model *Model) func() {
+	t := PropertyTraceFrom(ctx)
+	if t == nil {
+		return func() {}
+	}
+
+	model.trace = t
+	return func() {
+		model.trace = nil
+	}
+}
+
+// records the properties of the modelable, grouped by the field they belong to
+func (t *PropertyTrace) record(op string, m modelable, props []datastore.Property) {
+	model := m.getModel()
+	typ := reflect.TypeOf(m).Elem()
+
+	claimed := make([]bool, len(props))
+	var entries []TraceEntry
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.Type == typeOfModel {
+			continue
+		}
+
+		entry := TraceEntry{Op: op, Kind: model.Name(), Key: model.EncodedKey(), Field: field.Name}
+		for j, p := range props {
+			if !claimed[j] && isPropertyOf(p.Name, storedFieldNames(model.encodedStruct, []string{field.Name})) {
+				claimed[j] = true
+				entry.Properties = append(entry.Properties, TracedProperty{Name: p.Name, Size: propertySize(p.Value), NoIndex: p.NoIndex})
+			}
+		}
+
+		if len(entry.Properties) == 0 {
+			entry.Reason = missingPropertyReason(op, field)
+		}
+		entries = append(entries, entry)
+	}
+
+	for j, p := range props {
+		if claimed[j] {
+			continue
+		}
+		entries = append(entries, TraceEntry{
+			Op:         op,
+			Kind:       model.Name(),
+			Key:        model.EncodedKey(),
+			Reason:     "property matches no field",
+			Properties: []TracedProperty{{Name: p.Name, Size: propertySize(p.Value), NoIndex: p.NoIndex}},
+		})
+	}
+
+	t.mutex.Lock()
+	t.entries = append(t.entries, entries...)
+	t.mutex.Unlock()
+}
+
+// explains why a field has no property
+func missingPropertyReason(op string, field reflect.StructField) string {
+	tags := strings.Split(field.Tag.Get(tagDomain), ",")
+	switch {
+	case field.PkgPath != "":
+		return "unexported field"
+	case containsTag(tags, tagSkip) != "" || field.Tag.Get("datastore") == "-":
+		return "skipped by tag"
+	case op == "load":
+		return "no stored property"
+	case containsTag(tags, tagOmitEmpty) != "":
+		return "empty value omitted"
+	}
+	return "no property emitted"
+}
+
+// returns the approximate size of a property value
+func propertySize(v interface{}) int {
+	switch x := v.(type) {
+	case nil:
+		return 0
+	case string:
+		return len(x)
+	case []byte:
+		return len(x)
+	case bool:
+		return 1
+	case int64, float64, time.Time:
+		return 8
+	case datastore.GeoPoint:
+		return 16
+	case *datastore.Key:
+		if x == nil {
+			return 0
+		}
+		return len(x.Encode())
+	case []interface{}:
+		size := 0
+		for _, e := range x {
+			size += propertySize(e)
+		}
+		return size
+	case *datastore.Entity:
+		size := 0
+		for _, p := range x.Properties {
+			size += len(p.Name) + propertySize(p.Value)
+		}
+		return size
+	}
+	return 0
+}
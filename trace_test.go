@@ -0,0 +1,46 @@
+package model
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+type TracedModel struct {
+	Model
+	Name    string
+	Note    string `model:"noindex"`
+	Skipped string `model:"-"`
+	Empty   string `model:"omitempty"`
+}
+
+func TestPropertyTrace(t *testing.T) {
+	ctx := WithPropertyTrace(context.Background())
+
+	m := TracedModel{Name: "Enzo", Note: "note", Skipped: "skipped"}
+	index(&m)
+	defer traceModel(ctx, m.getModel())()
+
+	if _, err := m.Save(); err != nil {
+		t.Fatalf("error saving: %v", err)
+	}
+
+	entries := PropertyTraceFrom(ctx).Entries()
+	if len(entries) != 4 {
+		t.Fatalf("expected 4 traced fields, got %v", entries)
+	}
+
+	expected := map[string]string{"Skipped": "skipped by tag", "Empty": "empty value omitted"}
+	for _, e := range entries {
+		if e.Reason != expected[e.Field] {
+			t.Fatalf("field %s traced with reason %q, expected %q", e.Field, e.Reason, expected[e.Field])
+		}
+		if e.Field == "Note" && (len(e.Properties) != 1 || !e.Properties[0].NoIndex || e.Properties[0].Size != 4) {
+			t.Fatalf("unexpected trace of Note: %+v", e)
+		}
+	}
+
+	if !strings.Contains(PropertyTraceFrom(ctx).String(), "save TracedModel") {
+		t.Fatalf("unexpected report %s", PropertyTraceFrom(ctx))
+	}
+}
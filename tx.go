@@ -0,0 +1,290 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"sync"
+)
+
+const keyTransaction = "__model_transaction"
+
+// Tx is a datastore transaction in which the creates, updates, deletes and reads of several modelables enlist,
+// so that they are all committed or none is. See RunInTransaction
+type Tx struct {
+	ctx context.Context
+	// the modelables written and deleted in the transaction, whose cache is refreshed once committed
+	written []modelable
+	deleted []modelable
+}
+
+// RunInTransaction runs fn in a datastore transaction, retried as set by the options.
+// The operations run with the given Tx are committed together when fn returns nil.
+// The cache is refreshed after the commit, while the search index and the counters are updated as the operations run.
+// fn may run more than once, thus it must not have side effects other than the operations of the Tx
+func RunInTransaction(ctx context.Context, fn func(tx *Tx) error, opts ...datastore.TransactionOption) error {
+	var t *Tx
+	err := runTransaction(ctx, func(tctx context.Context, dtx *datastore.Transaction) error {
+		t = &Tx{ctx: tctx}
+		return fn(t)
+	}, opts...)
+
+	if err != nil {
+		return err
+	}
+
+	for _, m := range t.written {
+		if err := cacheWritten(ctx, m, saveInMemcacheRepairing); err != nil {
+			warningf(ctx, "error saving modelable %s to memcache: %s", m.getModel().Name(), err.Error())
+		}
+	}
+
+	for _, m := range t.deleted {
+		if err := deleteFromMemcache(ctx, m); err != nil && err != ErrCacheMiss {
+			warningf(ctx, "error removing modelable %s from memcache: %s", m.getModel().Name(), err.Error())
+		}
+	}
+
+	return nil
+}
+
+// Create writes the modelable and its new references as new entities, as Create does
+func (t *Tx) Create(m modelable) error {
+	ctx := withHookContext(t.ctx, OpCreate, "Tx.Create", true, false)
+	index(m)
+
+	if err := beforeCreate(ctx, m); err != nil {
+		return err
+	}
+
+	if err := createWithOptions(ctx, m, new(CreateOptions)); err != nil {
+		return err
+	}
+
+	t.written = append(t.written, m)
+	return nil
+}
+
+// Update writes the modelable and its references, as Update does
+func (t *Tx) Update(m modelable) error {
+	ctx := withHookContext(t.ctx, OpUpdate, "Tx.Update", true, false)
+	index(m)
+
+	if err := beforeUpdate(ctx, m); err != nil {
+		return err
+	}
+
+	if err := update(ctx, m); err != nil {
+		return err
+	}
+
+	t.written = append(t.written, m)
+	return nil
+}
+
+// Delete deletes the modelable along with its references, as Clear does
+func (t *Tx) Delete(m modelable) error {
+	ctx := withHookContext(t.ctx, OpDelete, "Tx.Delete", true, false)
+	index(m)
+
+	if err := beforeDelete(ctx, m); err != nil {
+		return err
+	}
+
+	if hasDeleteGuards() {
+		if err := checkDeleteGuards(ctx, clearedKeys(m), nil); err != nil {
+			return err
+		}
+	}
+
+	if err := clear(ctx, m); err != nil {
+		return err
+	}
+
+	t.deleted = append(t.deleted, m)
+	return nil
+}
+
+// Read loads the modelable and its references from the datastore, bypassing the cache
+func (t *Tx) Read(m modelable) error {
+	ctx := withHookContext(t.ctx, OpRead, "Tx.Read", true, false)
+	index(m)
+
+	if err := read(ctx, m); err != nil {
+		return err
+	}
+
+	return afterLoad(ctx, m)
+}
+
+// the state of an attempt of a transaction run by runTransaction, shared by the operations enlisting in it
+type txState struct {
+	tx    *datastore.Transaction
+	mutex sync.Mutex
+	// the entities put and deleted in the transaction, by encoded key
+	written map[string]modelable
+	deleted map[string]bool
+	// the deltas of the counters of the parents, written once before the commit
+	counters map[string]*counterDelta
+	// called once the outcome of the attempt is known
+	commitHooks   []func()
+	rollbackHooks []func()
+}
+
+func newTxState(tx *datastore.Transaction) *txState {
+	return &txState{tx: tx, written: map[string]modelable{}, deleted: map[string]bool{}, counters: map[string]*counterDelta{}}
+}
+
+func txStateFrom(ctx context.Context) *txState {
+	state, _ := ctx.Value(keyTransaction).(*txState)
+	return state
+}
+
+// records that the modelable has been put with the given key in the transaction
+func (state *txState) put(key *datastore.Key, src interface{}) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	if m, ok := src.(modelable); ok {
+		state.written[key.Encode()] = m
+	}
+	delete(state.deleted, key.Encode())
+}
+
+// records that the entity with the given key has been deleted in the transaction
+func (state *txState) delete(key *datastore.Key) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	delete(state.written, key.Encode())
+	state.deleted[key.Encode()] = true
+}
+
+// registers fn to be called if the attempt is committed
+func (state *txState) onCommit(fn func()) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.commitHooks = append(state.commitHooks, fn)
+}
+
+// registers fn to be called if the attempt fails, to undo the in-memory changes of the operations
+func (state *txState) onRollback(fn func()) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.rollbackHooks = append(state.rollbackHooks, fn)
+}
+
+// runs the hooks of the outcome of the attempt, once
+func (state *txState) finish(committed bool) {
+	state.mutex.Lock()
+	hooks := state.rollbackHooks
+	if committed {
+		hooks = state.commitHooks
+	}
+	state.commitHooks, state.rollbackHooks = nil, nil
+	state.mutex.Unlock()
+
+	// the in-memory changes are undone in reverse order
+	if !committed {
+		for i := len(hooks) - 1; i >= 0; i-- {
+			hooks[i]()
+		}
+		return
+	}
+
+	for _, hook := range hooks {
+		hook()
+	}
+}
+
+// runs fn in a new datastore transaction, passing it a context whose operations enlist in the transaction.
+// The counters updated by the operations are written before the commit. When fn runs again, because the commit
+// conflicted, and when the transaction fails, the in-memory changes of the failed attempt are undone
+func runTransaction(ctx context.Context, fn func(ctx context.Context, tx *datastore.Transaction) error, opts ...datastore.TransactionOption) error {
+	var state *txState
+	_, err := ClientFromContext(ctx).RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		if state != nil {
+			state.finish(false)
+		}
+
+		state = newTxState(tx)
+		tctx := context.WithValue(ctx, keyTransaction, state)
+		if err := fn(tctx, tx); err != nil {
+			return err
+		}
+		return writeCounters(tctx, state)
+	}, opts...)
+
+	if state != nil {
+		state.finish(err == nil)
+	}
+	return err
+}
+
+// returns the transaction the operations running with ctx enlist in, if any
+func transactionFrom(ctx context.Context) *datastore.Transaction {
+	if state := txStateFrom(ctx); state != nil {
+		return state.tx
+	}
+	return nil
+}
+
+// runs fn in the transaction of ctx, if any, or in a new one
+func runInTransaction(ctx context.Context, fn func(tx *datastore.Transaction) error, opts ...datastore.TransactionOption) error {
+	if tx := transactionFrom(ctx); tx != nil {
+		return fn(tx)
+	}
+
+	_, err := ClientFromContext(ctx).RunInTransaction(ctx, fn, opts...)
+	return err
+}
+
+// writes the entity within the transaction of ctx, if any.
+// Incomplete keys are allocated first, since the keys put in a transaction are known only once committed
+func putEntity(ctx context.Context, key *datastore.Key, src interface{}) (_ *datastore.Key, err error) {
+	done := traceDatastoreCall(ctx, "Put", key.Kind, 1)
+	defer func() { done(err) }()
+
+	client := ClientFromContext(ctx)
+	tx := transactionFrom(ctx)
+	if tx == nil {
+		return client.Put(ctx, key, src)
+	}
+
+	if key.Incomplete() {
+		keys, err := client.AllocateIDs(ctx, []*datastore.Key{key})
+		if err != nil {
+			return nil, err
+		}
+		key = keys[0]
+	}
+
+	if _, err := tx.Put(key, src); err != nil {
+		return nil, err
+	}
+	txStateFrom(ctx).put(key, src)
+	return key, nil
+}
+
+// reads the entity within the transaction of ctx, if any
+func getEntity(ctx context.Context, key *datastore.Key, dst interface{}) (err error) {
+	done := traceDatastoreCall(ctx, "Get", key.Kind, 1)
+	defer func() { done(err) }()
+
+	if tx := transactionFrom(ctx); tx != nil {
+		return tx.Get(key, dst)
+	}
+	return ClientFromContext(ctx).Get(ctx, key, dst)
+}
+
+// deletes the entity within the transaction of ctx, if any
+func deleteEntity(ctx context.Context, key *datastore.Key) (err error) {
+	done := traceDatastoreCall(ctx, "Delete", key.Kind, 1)
+	defer func() { done(err) }()
+
+	if state := txStateFrom(ctx); state != nil {
+		if err := state.tx.Delete(key); err != nil {
+			return err
+		}
+		state.delete(key)
+		return nil
+	}
+	return ClientFromContext(ctx).Delete(ctx, key)
+}
@@ -0,0 +1,371 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// flags a field as unique among the entities of the same kind.
+// Fields sharing the same group, i.e. `model:"unique=tenantslug"`, are unique as a combination
+const tagUnique string = "unique"
+
+// kind of the marker entities claiming the unique values
+const uniqueKind string = "_ModelUnique"
+
+var ErrUniqueConstraint = errors.New("unique constraint violation")
+
+// a uniqueMarker is stored for each unique group of an entity.
+// Its key name is made of the normalized values of the group, so that a value can be claimed only once
+type uniqueMarker struct {
+	Owner *datastore.Key
+}
+
+// normalizes a field value for the unique comparison
+func uniqueValue(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.String:
+		return strconv.Quote(strings.ToLower(strings.TrimSpace(v.String())))
+	case reflect.Ptr:
+		if k, ok := v.Interface().(*datastore.Key); ok && k != nil {
+			return k.Encode()
+		}
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// returns the keys of the markers for the unique groups of the modelable.
+// Groups whose fields are all zero are not constrained
+func uniqueMarkerKeys(m modelable) []*datastore.Key {
+	model := m.getModel()
+	if len(model.uniqueGroups) == 0 {
+		return nil
+	}
+
+	groups := make([]string, 0, len(model.uniqueGroups))
+	for group := range model.uniqueGroups {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	keys := make([]*datastore.Key, 0, len(groups))
+	for _, group := range groups {
+		if key := uniqueMarkerKey(m, group); key != nil {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// returns the key of the marker of a single unique group, or nil if all the fields of the group are zero
+func uniqueMarkerKey(m modelable, group string) *datastore.Key {
+	model := m.getModel()
+	val := reflect.ValueOf(m).Elem()
+
+	empty := true
+	values := make([]string, 0, len(model.uniqueGroups[group]))
+	for _, idx := range model.uniqueGroups[group] {
+		field := val.Field(idx)
+		if !isZeroValue(field) {
+			empty = false
+		}
+		values = append(values, uniqueValue(field))
+	}
+
+	if empty {
+		return nil
+	}
+
+	return uniqueMarkerKeyOf(model.structName, group, values...)
+}
+
+func uniqueMarkerKeyOf(kind string, group string, values ...string) *datastore.Key {
+	name := fmt.Sprintf("%s:%s:%s", kind, group, strings.Join(values, ","))
+	return datastore.NameKey(uniqueKind, name, nil)
+}
+
+func isZeroValue(v reflect.Value) bool {
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+// the unique values claimed for a write: the markers the entity didn't own before the write,
+// and the markers of the values it had stored, released once the write succeeds
+type uniqueClaim struct {
+	claimed  []*datastore.Key
+	previous []*datastore.Key
+}
+
+// claims the unique values of the modelable on behalf of the entity with the given key.
+// Returns ErrUniqueConstraint if any of the values is owned by another entity,
+// the markers of the values the entity didn't own before and of the ones it had stored otherwise.
+// The values no longer in use are released by settleUnique, once the entity has been written
+func claimUnique(ctx context.Context, m modelable, key *datastore.Key) (uniqueClaim, error) {
+	model := m.getModel()
+	if len(model.uniqueGroups) == 0 {
+		return uniqueClaim{}, nil
+	}
+
+	// the stored values are read before the write replaces them
+	stored, err := storedMarkerKeys(ctx, []*datastore.Key{key})
+	if err != nil {
+		return uniqueClaim{}, err
+	}
+
+	claimed, err := claimMarkers(ctx, key, uniqueMarkerKeys(m)...)
+	if err != nil {
+		if errors.Is(err, ErrUniqueConstraint) {
+			return uniqueClaim{}, fmt.Errorf("%w for %s", err, model.Name())
+		}
+		return uniqueClaim{}, err
+	}
+
+	return uniqueClaim{claimed: claimed, previous: stored[0]}, nil
+}
+
+// settles the unique values claimed for the entity with the given key, once written with the given outcome:
+// if the write succeeded the values the entity no longer uses are released, otherwise the claimed ones are
+func settleUnique(ctx context.Context, m modelable, key *datastore.Key, claim uniqueClaim, err error) error {
+	if len(m.getModel().uniqueGroups) == 0 {
+		return nil
+	}
+
+	if err != nil {
+		return unclaimMarkers(ctx, key, claim.claimed...)
+	}
+
+	return releaseMarkers(ctx, key, claim.previous, namespacedMarkerKeys(m, key)...)
+}
+
+// returns the keys of the markers for the unique groups of the modelable, in the namespace of key
+func namespacedMarkerKeys(m modelable, key *datastore.Key) []*datastore.Key {
+	mkeys := uniqueMarkerKeys(m)
+	for _, mk := range mkeys {
+		mk.Namespace = key.Namespace
+	}
+	return mkeys
+}
+
+// returns the markers of the unique values stored for the entities with the given keys, in their namespaces.
+// The markers are derived from the entities, read by key, thus they are strongly consistent.
+// Missing entities and kinds without unique values have no markers
+func storedMarkerKeys(ctx context.Context, keys []*datastore.Key) ([][]*datastore.Key, error) {
+	markers := make([][]*datastore.Key, len(keys))
+
+	types := make(map[string]reflect.Type)
+	var unique []int
+	for i, key := range keys {
+		t, ok := types[key.Kind]
+		if !ok {
+			if t = modelableTypeOfKind(key.Kind); t != nil {
+				prototype := reflect.New(t).Interface().(modelable)
+				index(prototype)
+				if len(prototype.getModel().uniqueGroups) == 0 {
+					t = nil
+				}
+			}
+			types[key.Kind] = t
+		}
+
+		if t != nil {
+			unique = append(unique, i)
+		}
+	}
+
+	size := batchSize(ctx)
+	for start := 0; start < len(unique); start += size {
+		end := start + size
+		if end > len(unique) {
+			end = len(unique)
+		}
+
+		batch := make([]*datastore.Key, end-start)
+		for k, i := range unique[start:end] {
+			batch[k] = keys[i]
+		}
+
+		stored := make([]datastore.PropertyList, len(batch))
+		var err error
+		if tx := transactionFrom(ctx); tx != nil {
+			err = tx.GetMulti(batch, stored)
+		} else {
+			err = ClientFromContext(ctx).GetMulti(ctx, batch, stored)
+		}
+
+		merr, isMulti := err.(datastore.MultiError)
+		if err != nil && !isMulti {
+			return nil, err
+		}
+
+		for k, i := range unique[start:end] {
+			if isMulti && merr[k] == datastore.ErrNoSuchEntity {
+				continue
+			}
+
+			if isMulti && merr[k] != nil {
+				return nil, merr[k]
+			}
+
+			m := reflect.New(types[keys[i].Kind]).Interface().(modelable)
+			index(m)
+			if err := fromPropertyList(m, stored[k]); err != nil {
+				return nil, err
+			}
+			markers[i] = namespacedMarkerKeys(m, keys[i])
+		}
+	}
+
+	return markers, nil
+}
+
+// returns the markers of the unique values of the modelable to release once its entity is deleted:
+// the ones of the stored values, read before the delete, and of the in-memory ones
+func deletedMarkerKeys(ctx context.Context, m modelable) ([]*datastore.Key, error) {
+	key := m.getModel().Key
+	stored, err := storedMarkerKeys(ctx, []*datastore.Key{key})
+	if err != nil {
+		return nil, err
+	}
+	return append(stored[0], namespacedMarkerKeys(m, key)...), nil
+}
+
+// atomically assigns the markers to key.
+// Returns ErrUniqueConstraint if any of them is owned by another key,
+// the markers that key didn't own before otherwise
+func claimMarkers(ctx context.Context, key *datastore.Key, mkeys ...*datastore.Key) ([]*datastore.Key, error) {
+	var claimed []*datastore.Key
+	err := runInTransaction(ctx, func(tx *datastore.Transaction) error {
+		claimed = nil
+		for _, mk := range mkeys {
+			// the markers live in the namespace of their owner
+			mk.Namespace = key.Namespace
+
+			marker := uniqueMarker{}
+			err := tx.Get(mk, &marker)
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+
+			if err == nil && marker.Owner.Equal(key) {
+				continue
+			}
+
+			if err == nil {
+				return fmt.Errorf("%w: value %s is already in use", ErrUniqueConstraint, mk.Name)
+			}
+
+			marker.Owner = key
+			if _, err := tx.Put(mk, &marker); err != nil {
+				return err
+			}
+			claimed = append(claimed, mk)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+// deletes the markers claimed by key for a write that failed.
+// Within a transaction the markers have been put by the transaction itself, thus their puts are dropped
+func unclaimMarkers(ctx context.Context, key *datastore.Key, mkeys ...*datastore.Key) error {
+	if len(mkeys) == 0 {
+		return nil
+	}
+
+	if tx := transactionFrom(ctx); tx != nil {
+		return tx.DeleteMulti(mkeys)
+	}
+	return releaseMarkers(ctx, key, mkeys)
+}
+
+// releases the unique values of the modelable claimed on behalf of key, i.e. for a create that failed
+func releaseUnique(ctx context.Context, m modelable, key *datastore.Key) error {
+	return releaseMarkers(ctx, key, namespacedMarkerKeys(m, key))
+}
+
+// deletes the markers owned by key, except the ones listed in keep.
+// The ownership is checked within a transaction, since a released value may have been claimed by another entity
+func releaseMarkers(ctx context.Context, key *datastore.Key, mkeys []*datastore.Key, keep ...*datastore.Key) error {
+	var stale []*datastore.Key
+	for _, mk := range mkeys {
+		if !containsKey(keep, mk) && !containsKey(stale, mk) {
+			stale = append(stale, mk)
+		}
+	}
+
+	if len(stale) == 0 {
+		return nil
+	}
+
+	return runInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var owned []*datastore.Key
+		for _, mk := range stale {
+			marker := uniqueMarker{}
+			err := tx.Get(mk, &marker)
+			if err == datastore.ErrNoSuchEntity {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			if marker.Owner.Equal(key) {
+				owned = append(owned, mk)
+			}
+		}
+		return tx.DeleteMulti(owned)
+	})
+}
+
+// Loads values from the datastore for the entity whose unique field has the given value.
+// The field must be tagged as unique on its own, i.e. `model:"unique"`.
+// The lookup goes through the marker entity of the value rather than through a query, thus it is strongly consistent.
+// Returns datastore.ErrNoSuchEntity if no entity owns the value
+func LookupBy(ctx context.Context, m modelable, field string, value interface{}) error {
+	model := m.getModel()
+	if !model.isRegistered() {
+		index(m)
+	}
+
+	sf, ok := reflect.TypeOf(m).Elem().FieldByName(field)
+	if !ok {
+		return fmt.Errorf("struct of type %s has no field with name %s", model.Name(), field)
+	}
+
+	group := ""
+	for g, idxs := range model.uniqueGroups {
+		if len(idxs) == 1 && idxs[0] == sf.Index[0] {
+			group = g
+			break
+		}
+	}
+
+	if group == "" {
+		return fmt.Errorf("field %s of %s is not unique. Can't lookup by its value", field, model.Name())
+	}
+
+	v := reflect.ValueOf(value)
+	if !v.IsValid() || (v.Kind() == reflect.Ptr && v.IsNil()) {
+		return fmt.Errorf("can't lookup %s of %s by a nil value", field, model.Name())
+	}
+
+	mk := namespacedKey(ctx, uniqueMarkerKeyOf(model.structName, group, uniqueValue(v)))
+
+	marker := uniqueMarker{}
+	client := ClientFromContext(ctx)
+	if err := client.Get(ctx, mk, &marker); err != nil {
+		return err
+	}
+
+	model.Key = marker.Owner
+	return Read(ctx, m)
+}
@@ -0,0 +1,95 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"testing"
+)
+
+type UniqueEntity struct {
+	Model
+	Email  string `model:"unique"`
+	Tenant string `model:"unique=tenantslug"`
+	Slug   string `model:"unique=tenantslug"`
+}
+
+func TestUniqueMarkerKeys(t *testing.T) {
+	entity := UniqueEntity{}
+	index(&entity)
+
+	if keys := uniqueMarkerKeys(&entity); len(keys) != 0 {
+		t.Fatalf("zero entity must not claim unique values. Found %d markers", len(keys))
+	}
+
+	entity.Email = " Enzo@Example.com"
+	entity.Tenant = "acme"
+	entity.Slug = "home"
+
+	keys := uniqueMarkerKeys(&entity)
+	if len(keys) != 2 {
+		t.Fatalf("invalid number of markers: %d, expected 2", len(keys))
+	}
+
+	if name := keys[0].Name; name != `UniqueEntity:Email:"enzo@example.com"` {
+		t.Fatalf("invalid marker name %s", name)
+	}
+
+	if name := keys[1].Name; name != `UniqueEntity:tenantslug:"acme","home"` {
+		t.Fatalf("invalid marker name %s", name)
+	}
+}
+
+func TestNamespacedMarkerKeys(t *testing.T) {
+	entity := UniqueEntity{Email: "enzo@example.com"}
+	index(&entity)
+
+	key := datastore.NameKey("UniqueEntity", "enzo", nil)
+	key.Namespace = "tenant"
+
+	mkeys := namespacedMarkerKeys(&entity, key)
+	if len(mkeys) != 1 || mkeys[0].Namespace != "tenant" {
+		t.Fatalf("expected a marker in the namespace of the entity, got %v", mkeys)
+	}
+
+	// the markers are derived from the values, thus they can be released by key
+	other := UniqueEntity{Email: "Enzo@Example.com "}
+	index(&other)
+	if !mkeys[0].Equal(namespacedMarkerKeys(&other, key)[0]) {
+		t.Fatal("equal values must have the same marker")
+	}
+}
+
+func TestLookupByNil(t *testing.T) {
+	if err := LookupBy(context.Background(), &UniqueEntity{}, "Email", nil); err == nil {
+		t.Fatal("expected an error looking up by a nil value")
+	}
+}
+
+type BareSlugEntity struct {
+	Model
+	Title string
+	Slug  string `model:"slug"`
+}
+
+func TestBareSlugTag(t *testing.T) {
+	entity := BareSlugEntity{Title: "Home"}
+	index(&entity)
+
+	if entity.slug == nil || entity.slug.err == nil {
+		t.Fatal("expected the slug tag without a source to be rejected")
+	}
+
+	if err := claimSlug(context.Background(), &entity, nil); err == nil {
+		t.Fatal("expected the write of a modelable with an invalid slug tag to fail")
+	}
+
+	if warnings := LintModel(&entity); len(warnings) != 1 || warnings[0].Field != "Slug" {
+		t.Fatalf("expected a warning about Slug, got %v", warnings)
+	}
+}
+
+func TestSlugify(t *testing.T) {
+	if s := Slugify("  Perché l'Enzo è  un Rigattiere! "); s != "perche-l-enzo-e-un-rigattiere" {
+		t.Fatalf("invalid slug %q", s)
+	}
+}
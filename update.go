@@ -7,13 +7,34 @@ import (
 )
 
 type UpdateOptions struct {
-	attempts int
+	attempts  int
+	messages  []OutboxMessage
+	indexOnly []string
+	exclude   []string
 }
 
 func (opts *UpdateOptions) InTransaction(attempts int) {
 	opts.attempts = attempts
 }
 
+// Marks as NoIndex all the properties of the updated entity but the ones of the given fields.
+// See CreateOptions.IndexOnly
+func (opts *UpdateOptions) IndexOnly(fields ...string) {
+	opts.indexOnly = append([]string{}, fields...)
+}
+
+// The given fields of the root entity are not written with the in-memory values:
+// their stored values are read within the update transaction and written back as they are.
+// It allows to update an entity without loading its heavy fields
+func (opts *UpdateOptions) ExcludeFields(fields ...string) {
+	opts.exclude = append(opts.exclude, fields...)
+}
+
+// Attaches a message to the outbox, to be stored within the update transaction
+func (opts *UpdateOptions) AttachMessage(topic string, payload []byte) {
+	opts.messages = append(opts.messages, newOutboxMessage(topic, payload))
+}
+
 func NewUpdateOptions() UpdateOptions {
 	return UpdateOptions{}
 }
@@ -23,30 +44,75 @@ func NewUpdateOptions() UpdateOptions {
 // the root modelable will point to the loaded entity
 // If a reference is newly created its value will be updated accordingly to the model
 func UpdateInTransaction(ctx context.Context, m modelable, opts *UpdateOptions) (err error) {
+	ctx, span := startOperation(ctx, OpUpdate, "UpdateInTransaction")
+	defer func() { span.end(ctx, m, err) }()
+
+	ctx = withHookContext(ctx, OpUpdate, "UpdateInTransaction", true, false)
 	index(m)
 
-	to := datastore.MaxAttempts(opts.attempts)
-	client := ClientFromContext(ctx)
-	_, err = client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
-		return update(ctx, m)
-	}, to)
+	if err := beforeUpdate(ctx, m); err != nil {
+		return err
+	}
 
-	if err == nil {
-		if err = saveInMemcache(ctx, m); err != nil {
+	if opts.indexOnly != nil {
+		model := m.getModel()
+		model.indexOnly = opts.indexOnly
+		defer func() {
+			model.indexOnly = nil
+		}()
+	}
+
+	to := datastore.MaxAttempts(transactionAttempts(ctx, opts.attempts))
+	// the entities are written within the transaction of the outbox
+	err = runTransaction(ctx, func(tctx context.Context, tx *datastore.Transaction) error {
+		if opts.exclude != nil {
+			if err := mergeExcluded(tx, m, opts.exclude); err != nil {
+				return err
+			}
+			model := m.getModel()
+			defer func() {
+				model.exclude = nil
+				model.merged = nil
+			}()
+		}
+
+		if err := update(tctx, m); err != nil {
 			return err
 		}
+		return putOutbox(ctx, tx, m.getModel().Key, opts.messages)
+	}, to)
+
+	if err != nil {
+		return err
 	}
 
-	return err
+	// the in-memory modelable doesn't hold the values of the excluded fields: the stale copy is evicted instead
+	if opts.exclude != nil {
+		return evictFromCache(ctx, m)
+	}
+
+	return cacheWritten(ctx, m, saveInMemcacheRepairing)
 }
 
-func Update(ctx context.Context, m modelable) error {
+func Update(ctx context.Context, m modelable) (err error) {
+	ctx, span := startOperation(ctx, OpUpdate, "Update")
+	defer func() { span.end(ctx, m, err) }()
+
+	ctx = withHookContext(ctx, OpUpdate, "Update", false, false)
 	index(m)
 
-	err := update(ctx, m)
+	if q := writeQueueOf(ctx, m); q != nil {
+		return q.update(ctx, m, Update)
+	}
+
+	if err := beforeUpdate(ctx, m); err != nil {
+		return err
+	}
+
+	err = update(ctx, m)
 
 	if err == nil {
-		if err = saveInMemcache(ctx, m); err != nil {
+		if err = cacheWritten(ctx, m, saveInMemcacheRepairing); err != nil {
 			return err
 		}
 	}
@@ -54,6 +120,169 @@ func Update(ctx context.Context, m modelable) error {
 	return err
 }
 
+// Batch version of Update.
+// References are written entity by entity, then the root entities are written
+// with datastore PutMulti calls of at most 500 entities each.
+// Transactions, excluded fields and outbox messages set in the options are ignored.
+// It can return a datastore.MultiError aligned to dst.
+func UpdateMulti(ctx context.Context, dst interface{}, opts *UpdateOptions) (err error) {
+	ctx, span := startOperation(ctx, OpUpdate, "UpdateMulti")
+	defer func() { span.end(ctx, dst, err) }()
+
+	ctx = withHookContext(ctx, OpUpdate, "UpdateMulti", false, true)
+	ms, err := modelablesOf(dst)
+	if err != nil {
+		return err
+	}
+
+	if opts == nil {
+		opts = &UpdateOptions{}
+	}
+
+	for _, m := range ms {
+		index(m)
+	}
+
+	if err := runHooks(ctx, ms, beforeUpdate); err != nil {
+		return err
+	}
+
+	merr := make(datastore.MultiError, len(ms))
+	failed := false
+
+	// versioned entities are checked and written one by one
+	var batched []int
+	for i, m := range ms {
+		if m.getModel().version == nil {
+			batched = append(batched, i)
+			continue
+		}
+
+		if err := update(ctx, m); err != nil {
+			merr[i] = err
+			failed = true
+			continue
+		}
+
+		if err := cacheWritten(ctx, m, saveInMemcacheRepairing); err != nil {
+			merr[i] = err
+			failed = true
+		}
+	}
+
+	// collect the modelables that can be written along with their keys
+	var keys []*datastore.Key
+	var valid []int
+	claims := make([]uniqueClaim, len(ms))
+	for _, i := range batched {
+		m := ms[i]
+		claimed, err := prepareUpdate(ctx, m)
+		if err != nil {
+			merr[i] = err
+			failed = true
+			continue
+		}
+		claims[i] = claimed
+
+		model := m.getModel()
+		if opts.indexOnly != nil {
+			model.indexOnly = opts.indexOnly
+			defer func() {
+				model.indexOnly = nil
+			}()
+		}
+
+		keys = append(keys, model.Key)
+		valid = append(valid, i)
+	}
+
+	client := ClientFromContext(ctx)
+	size := batchSize(ctx)
+	for start := 0; start < len(valid); start += size {
+		end := start + size
+		if end > len(valid) {
+			end = len(valid)
+		}
+
+		src := make([]modelable, 0, end-start)
+		for _, i := range valid[start:end] {
+			src = append(src, ms[i])
+		}
+
+		berr := make(datastore.MultiError, end-start)
+		done := traceDatastoreCall(ctx, "PutMulti", keys[start].Kind, end-start)
+		_, err := client.PutMulti(ctx, keys[start:end], src)
+		done(err)
+		if !collectMultiError(berr, err, 0, end-start) {
+			continue
+		}
+
+		for j, e := range berr {
+			if e != nil {
+				merr[valid[start+j]] = e
+				failed = true
+			}
+		}
+	}
+
+	// the unique values are released once the outcome of the writes is known
+	for _, i := range valid {
+		model := ms[i].getModel()
+		if err := settleUnique(ctx, ms[i], model.Key, claims[i], merr[i]); err != nil && merr[i] == nil {
+			merr[i] = err
+			failed = true
+		}
+	}
+
+	for _, i := range valid {
+		m := ms[i]
+		if merr[i] != nil {
+			continue
+		}
+
+		if err := afterUpdate(ctx, m); err != nil {
+			merr[i] = err
+			failed = true
+			continue
+		}
+
+		if err := cacheWritten(ctx, m, saveInMemcacheRepairing); err != nil {
+			merr[i] = err
+			failed = true
+		}
+	}
+
+	if failed {
+		return merr
+	}
+
+	return nil
+}
+
+// reads the stored properties of the excluded fields of the modelable within the transaction
+func mergeExcluded(tx *datastore.Transaction, m modelable, exclude []string) error {
+	model := m.getModel()
+	if model.Key == nil {
+		return fmt.Errorf("can't update modelable %v. Missing Key", m)
+	}
+
+	var stored datastore.PropertyList
+	if err := tx.Get(model.Key, &stored); err != nil {
+		return err
+	}
+
+	merged := make([]datastore.Property, 0)
+	for _, p := range stored {
+		if isPropertyOf(p.Name, storedFieldNames(model.encodedStruct, exclude)) {
+			merged = append(merged, p)
+		}
+	}
+
+	model.exclude = exclude
+	model.merged = merged
+	return nil
+}
+
 func updateReference(ctx context.Context, ref *reference, key *datastore.Key) (err error) {
 	model := ref.Modelable.getModel()
 
@@ -67,6 +296,10 @@ func updateReference(ctx context.Context, ref *reference, key *datastore.Key) (e
 
 	//we iterate through the references of the current model
 	for i, r := range model.references {
+		if err := treeCanceled(ctx, ref.Modelable); err != nil {
+			return err
+		}
+
 		rm := r.Modelable.getModel()
 		//We check if the parent has a Key related to the reference.
 		//If it does we use the Key provided by the parent to update the children
@@ -99,13 +332,33 @@ func updateReference(ctx context.Context, ref *reference, key *datastore.Key) (e
 		model.references[i] = r
 	}
 
-	client := ClientFromContext(ctx)
-	_, err = client.Put(ctx, key, ref.Modelable)
+	if err := preserveCreateTime(ctx, ref.Modelable); err != nil {
+		return err
+	}
 
+	claimed, err := claimUnique(ctx, ref.Modelable, key)
 	if err != nil {
 		return err
 	}
 
+	copyDenormalized(ref.Modelable)
+
+	defer traceModel(ctx, model)()
+	_, err = putEntity(ctx, key, ref.Modelable)
+
+	// the unique values are released once the outcome of the write is known
+	if serr := settleUnique(ctx, ref.Modelable, key, claimed, err); err == nil {
+		err = serr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err := scheduleDenormalization(ctx, ref.Modelable); err != nil {
+		return err
+	}
+
 	// if the model is searchable, update the search index with the new values
 	if model.searchable {
 		err = searchPut(ctx, model, model.Name())
@@ -117,25 +370,69 @@ func updateReference(ctx context.Context, ref *reference, key *datastore.Key) (e
 // iterates through the modelable reference.
 // if the reference has a Key
 func update(ctx context.Context, m modelable) error {
+	claimed, err := prepareUpdate(ctx, m)
+	if err != nil {
+		return err
+	}
+
+	model := m.getModel()
+	defer traceModel(ctx, model)()
+
+	if model.version != nil {
+		err = putVersioned(ctx, m)
+	} else {
+		var key *datastore.Key
+		if key, err = putEntity(ctx, model.Key, m); err == nil {
+			model.Key = key
+		}
+	}
+
+	// the unique values are released once the outcome of the write is known
+	if serr := settleUnique(ctx, m, model.Key, claimed, err); err == nil {
+		err = serr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return afterUpdate(ctx, m)
+}
+
+// writes the references of the modelable and prepares it to be put.
+// Returns the unique values claimed for it, to be settled with the outcome of the put
+func prepareUpdate(ctx context.Context, m modelable) (uniqueClaim, error) {
 	model := m.getModel()
 
 	if model.Key == nil {
-		return fmt.Errorf("can't update modelable %v. Missing Key", m)
+		return uniqueClaim{}, fmt.Errorf("can't update modelable %v. Missing Key", m)
+	}
+
+	if err := checkIdUnchanged(m); err != nil {
+		return uniqueClaim{}, err
+	}
+
+	if err := preserveCreateTime(ctx, m); err != nil {
+		return uniqueClaim{}, err
 	}
 
 	for i, ref := range model.references {
+		if err := treeCanceled(ctx, m); err != nil {
+			return uniqueClaim{}, err
+		}
+
 		rm := ref.Modelable.getModel()
 
 		if rm.Key != nil {
 			err := updateReference(ctx, &ref, rm.Key)
 			if err != nil {
-				return err
+				return uniqueClaim{}, err
 			}
 		} else if ref.Key != nil {
 			// in this case a new reference has been assigned in place of an empty reference
 			err := updateReference(ctx, &ref, ref.Key)
 			if err != nil {
-				return err
+				return uniqueClaim{}, err
 			}
 		} else if rm.skipIfZero && isZero(ref.Modelable) {
 			// skip if the ref must be kept empty
@@ -144,24 +441,35 @@ func update(ctx context.Context, m modelable) error {
 			// else create it
 			err := createReference(ctx, &ref)
 			if err != nil {
-				return err
+				return uniqueClaim{}, err
 			}
 		}
 
 		model.references[i] = ref
 	}
 
-	client := ClientFromContext(ctx)
-	key, err := client.Put(ctx, model.Key, m)
+	if err := writeChildren(ctx, m); err != nil {
+		return uniqueClaim{}, err
+	}
 
+	claimed, err := claimUnique(ctx, m, model.Key)
 	if err != nil {
-		return err
+		return uniqueClaim{}, err
 	}
 
-	model.Key = key
+	copyDenormalized(m)
+	return claimed, nil
+}
 
+// propagates the values of the updated modelable to its denormalized copies and to the search index
+func afterUpdate(ctx context.Context, m modelable) error {
+	if err := scheduleDenormalization(ctx, m); err != nil {
+		return err
+	}
+
+	model := m.getModel()
 	if model.searchable {
-		err = searchPut(ctx, model, model.Name())
+		return searchPut(ctx, model, model.Name())
 	}
 
 	return nil
@@ -0,0 +1,175 @@
+package model
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// constraints checked before writing an entity, i.e. `model:"required,maxlen=120"`.
+// required rejects zero values, maxlen limits the length of strings and slices,
+// min and max bound numeric fields
+const (
+	tagRequired string = "required"
+	tagMaxLen   string = "maxlen"
+	tagMin      string = "min"
+	tagMax      string = "max"
+)
+
+type validationRule struct {
+	// index of the validated field
+	index    int
+	name     string
+	required bool
+	// negative if the length is not limited
+	maxLen int
+	min    *float64
+	max    *float64
+}
+
+// FieldError describes a field violating one of its constraints
+type FieldError struct {
+	Field string
+	// the violated constraint, as written in the tag
+	Constraint string
+}
+
+// ValidationError is returned when writing an entity whose fields violate their constraints.
+// It lists all the offending fields
+type ValidationError struct {
+	Struct string
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = fmt.Sprintf("%s (%s)", f.Field, f.Constraint)
+	}
+	return fmt.Sprintf("invalid %s: %s", e.Struct, strings.Join(msgs, ", "))
+}
+
+// returns the validation rule set by the tags of the field, if any.
+// It panics if a constraint does not apply to the type of the field
+func validationRuleOf(t reflect.Type, i int, tags []string) (validationRule, bool) {
+	field := t.Field(i)
+	rule := validationRule{index: i, name: field.Name, maxLen: -1}
+	found := false
+
+	if containsTag(tags, tagRequired) != "" {
+		rule.required = true
+		found = true
+	}
+
+	if v, ok := tagValue(tags, tagMaxLen); ok {
+		switch field.Type.Kind() {
+		case reflect.String, reflect.Slice:
+		default:
+			panic(fmt.Errorf("maxlen field %s of struct %s must be a string or a slice", field.Name, t.Name()))
+		}
+
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			panic(fmt.Errorf("invalid maxlen %q for field %s of struct %s", v, field.Name, t.Name()))
+		}
+		rule.maxLen = n
+		found = true
+	}
+
+	bound := func(name string) *float64 {
+		v, ok := tagValue(tags, name)
+		if !ok {
+			return nil
+		}
+
+		switch field.Type.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Float32, reflect.Float64:
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		default:
+			panic(fmt.Errorf("%s field %s of struct %s must be a number", name, field.Name, t.Name()))
+		}
+
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			panic(fmt.Errorf("invalid %s %q for field %s of struct %s", name, v, field.Name, t.Name()))
+		}
+		found = true
+		return &f
+	}
+
+	rule.min = bound(tagMin)
+	rule.max = bound(tagMax)
+
+	return rule, found
+}
+
+// checks the fields of the modelable against their constraints
+func validate(m modelable) error {
+	model := m.getModel()
+	if len(model.validations) == 0 {
+		return nil
+	}
+
+	value := reflect.ValueOf(m).Elem()
+	var fields []FieldError
+	for _, rule := range model.validations {
+		if c := rule.check(value.Field(rule.index)); c != "" {
+			fields = append(fields, FieldError{Field: rule.name, Constraint: c})
+		}
+	}
+
+	if len(fields) > 0 {
+		return &ValidationError{Struct: model.Name(), Fields: fields}
+	}
+	return nil
+}
+
+// returns the constraint violated by the field value, or an empty string
+func (rule validationRule) check(v reflect.Value) string {
+	if rule.required {
+		empty := v.IsZero()
+		// references and nested structs are empty if their fields are
+		if v.Kind() == reflect.Struct && v.Type() != typeOfTime && v.Type() != typeOfGeoPoint {
+			empty = isZero(v.Interface())
+		}
+		if empty {
+			return tagRequired
+		}
+	}
+
+	if rule.maxLen >= 0 {
+		l := v.Len()
+		if v.Kind() == reflect.String {
+			l = utf8.RuneCountInString(v.String())
+		}
+		if l > rule.maxLen {
+			return fmt.Sprintf("%s=%d", tagMaxLen, rule.maxLen)
+		}
+	}
+
+	if rule.min == nil && rule.max == nil {
+		return ""
+	}
+
+	var n float64
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		n = v.Float()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n = float64(v.Uint())
+	default:
+		n = float64(v.Int())
+	}
+
+	if rule.min != nil && n < *rule.min {
+		return fmt.Sprintf("%s=%s", tagMin, strconv.FormatFloat(*rule.min, 'f', -1, 64))
+	}
+
+	if rule.max != nil && n > *rule.max {
+		return fmt.Sprintf("%s=%s", tagMax, strconv.FormatFloat(*rule.max, 'f', -1, 64))
+	}
+
+	return ""
+}
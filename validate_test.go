@@ -0,0 +1,53 @@
+package model
+
+import (
+	"errors"
+	"testing"
+)
+
+type validatedEntity struct {
+	Model
+	Name  string   `model:"required,maxlen=5"`
+	Age   int      `model:"min=0,max=150"`
+	Score float64  `model:"min=0.5"`
+	Tags  []string `model:"maxlen=2"`
+}
+
+func TestValidate(t *testing.T) {
+	valid := validatedEntity{Name: "Enzo", Age: 30, Score: 1, Tags: []string{"a"}}
+	index(&valid)
+	if _, err := toPropertyList(&valid); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	invalid := validatedEntity{Name: "", Age: 200, Score: 0.1, Tags: []string{"a", "b", "c"}}
+	index(&invalid)
+	_, err := toPropertyList(&invalid)
+
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected a ValidationError, got %v", err)
+	}
+
+	expected := []FieldError{
+		{Field: "Name", Constraint: "required"},
+		{Field: "Age", Constraint: "max=150"},
+		{Field: "Score", Constraint: "min=0.5"},
+		{Field: "Tags", Constraint: "maxlen=2"},
+	}
+
+	if len(verr.Fields) != len(expected) {
+		t.Fatalf("invalid offending fields %+v", verr.Fields)
+	}
+
+	for i, f := range expected {
+		if verr.Fields[i] != f {
+			t.Fatalf("expected %+v, got %+v", f, verr.Fields[i])
+		}
+	}
+
+	invalid.Name = "Ermenegildo"
+	if _, err := toPropertyList(&invalid); !errors.As(err, &verr) || verr.Fields[0].Constraint != "maxlen=5" {
+		t.Fatalf("expected maxlen violation, got %v", err)
+	}
+}
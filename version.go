@@ -0,0 +1,101 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// marks an int64 field as the version of the entity, i.e. `model:"version"`.
+// Updates succeed only if the stored version matches the in-memory one, and increment it
+const tagVersion string = "version"
+
+var ErrConcurrentModification = errors.New("entity has been modified concurrently")
+
+type versionDescriptor struct {
+	// index of the version field
+	index int
+	name  string
+}
+
+// sets the version of a new entity, if unset
+func initVersion(m modelable) {
+	model := m.getModel()
+	if model.version == nil {
+		return
+	}
+
+	field := reflect.ValueOf(m).Elem().Field(model.version.index)
+	if field.Int() == 0 {
+		field.SetInt(1)
+	}
+}
+
+// writes the modelable if the stored version matches the in-memory one, incrementing it.
+// The check and the write run in a transaction, or in the one of ctx
+func putVersioned(ctx context.Context, m modelable) error {
+	state := txStateFrom(ctx)
+	if state == nil {
+		return runTransaction(ctx, func(ctx context.Context, tx *datastore.Transaction) error {
+			return putVersioned(ctx, m)
+		})
+	}
+	return putVersionedIn(state, state.tx, m)
+}
+
+// writes the modelable within the attempt of state.
+// The commit may fail, or the attempt be retried, after the version has been incremented:
+// the in-memory version is restored if the attempt doesn't commit
+func putVersionedIn(state *txState, tx versionTx, m modelable) error {
+	model := m.getModel()
+	field := reflect.ValueOf(m).Elem().Field(model.version.index)
+	current := field.Int()
+
+	if err := writeVersion(tx, m, current); err != nil {
+		return err
+	}
+
+	state.onRollback(func() {
+		field.SetInt(current)
+	})
+	state.put(model.Key, m)
+	return nil
+}
+
+// the reads and writes of the transaction checking the version, satisfied by *datastore.Transaction
+type versionTx interface {
+	Get(key *datastore.Key, dst interface{}) error
+	Put(key *datastore.Key, src interface{}) (*datastore.PendingKey, error)
+}
+
+// puts the modelable with the version following current, if current is the stored one.
+// Returns ErrConcurrentModification otherwise. The in-memory version is restored if the put fails
+func writeVersion(tx versionTx, m modelable, current int64) error {
+	model := m.getModel()
+	field := reflect.ValueOf(m).Elem().Field(model.version.index)
+
+	var stored datastore.PropertyList
+	if err := tx.Get(model.Key, &stored); err != nil {
+		return err
+	}
+
+	var version int64
+	for _, p := range stored {
+		if v, ok := p.Value.(int64); ok && p.Name == model.version.name {
+			version = v
+		}
+	}
+
+	if version != current {
+		return fmt.Errorf("%w: %s has version %d, stored version is %d", ErrConcurrentModification, model.Key, current, version)
+	}
+
+	field.SetInt(current + 1)
+	if _, err := tx.Put(model.Key, m); err != nil {
+		field.SetInt(current)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"errors"
+	"testing"
+)
+
+type versionedEntity struct {
+	Model
+	Name    string
+	Version int64 `model:"version"`
+}
+
+// a transaction holding the stored entity, whose puts fail with err
+type fakeVersionTx struct {
+	stored datastore.PropertyList
+	err    error
+	puts   int
+}
+
+func (tx *fakeVersionTx) Get(key *datastore.Key, dst interface{}) error {
+	*dst.(*datastore.PropertyList) = tx.stored
+	return nil
+}
+
+func (tx *fakeVersionTx) Put(key *datastore.Key, src interface{}) (*datastore.PendingKey, error) {
+	tx.puts++
+	return nil, tx.err
+}
+
+func TestVersionMismatch(t *testing.T) {
+	e := versionedEntity{Name: "stale", Version: 1}
+	index(&e)
+	e.Key = datastore.NameKey("versionedEntity", "v", nil)
+
+	tx := &fakeVersionTx{stored: datastore.PropertyList{{Name: "Version", Value: int64(2)}}}
+	if err := writeVersion(tx, &e, e.Version); !errors.Is(err, ErrConcurrentModification) {
+		t.Fatalf("expected %v, got %v", ErrConcurrentModification, err)
+	}
+
+	if tx.puts != 0 || e.Version != 1 {
+		t.Fatalf("a stale entity has been written: %d puts, version %d", tx.puts, e.Version)
+	}
+
+	tx.stored = datastore.PropertyList{{Name: "Version", Value: int64(1)}}
+	if err := writeVersion(tx, &e, e.Version); err != nil {
+		t.Fatal(err)
+	}
+
+	if tx.puts != 1 || e.Version != 2 {
+		t.Fatalf("expected the entity to be written with version 2: %d puts, version %d", tx.puts, e.Version)
+	}
+}
+
+func TestVersionRestoredOnFailure(t *testing.T) {
+	e := versionedEntity{Name: "failing", Version: 3}
+	index(&e)
+	e.Key = datastore.NameKey("versionedEntity", "v", nil)
+
+	failure := errors.New("put failed")
+	tx := &fakeVersionTx{stored: datastore.PropertyList{{Name: "Version", Value: int64(3)}}, err: failure}
+	if err := writeVersion(tx, &e, e.Version); err != failure {
+		t.Fatalf("expected %v, got %v", failure, err)
+	}
+
+	if e.Version != 3 {
+		t.Fatalf("expected the in-memory version to be restored to 3, got %d", e.Version)
+	}
+}
+
+func TestVersionRestoredOnRetry(t *testing.T) {
+	e := versionedEntity{Name: "retried", Version: 5}
+	index(&e)
+	e.Key = datastore.NameKey("versionedEntity", "v", nil)
+
+	tx := &fakeVersionTx{stored: datastore.PropertyList{{Name: "Version", Value: int64(5)}}}
+
+	// the first attempt of the outer transaction writes the entity, then fails to commit
+	state := newTxState(nil)
+	if err := putVersionedIn(state, tx, &e); err != nil {
+		t.Fatal(err)
+	}
+
+	if e.Version != 6 {
+		t.Fatalf("expected the written version to be 6, got %d", e.Version)
+	}
+
+	state.finish(false)
+	if e.Version != 5 {
+		t.Fatalf("expected the in-memory version to be restored to 5, got %d", e.Version)
+	}
+
+	// the retry checks the restored version and commits
+	state = newTxState(nil)
+	if err := putVersionedIn(state, tx, &e); err != nil {
+		t.Fatalf("the retry failed: %s", err)
+	}
+	state.finish(true)
+
+	if tx.puts != 2 || e.Version != 6 {
+		t.Fatalf("expected the retry to commit version 6: %d puts, version %d", tx.puts, e.Version)
+	}
+}
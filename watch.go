@@ -0,0 +1,122 @@
+package model
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"errors"
+	"fmt"
+	"google.golang.org/api/iterator"
+	"reflect"
+	"time"
+)
+
+// name of the property holding the last update time of the watched entities,
+// used when the watched kind has no updatetime field
+const watchProperty string = "UpdatedAt"
+
+// interval between two polls of a watched kind
+var WatchPollInterval = 10 * time.Second
+
+// describes an entity of a watched kind that has been written
+type ChangeEvent struct {
+	Key       *datastore.Key
+	UpdatedAt time.Time
+}
+
+// Watch polls the entities of the given kind that have been updated at or after since,
+// and sends them on the returned channel in update order.
+// The entities must keep their update time in an indexed field tagged updatetime,
+// or in an indexed UpdatedAt property.
+// The channel is closed when ctx is done.
+func Watch(ctx context.Context, kind string, since time.Time) (<-chan ChangeEvent, error) {
+	client, ok := ctx.Value(keyDatastoreClient).(*datastore.Client)
+	if !ok {
+		return nil, errors.New("no datastore client found in context")
+	}
+
+	property := watchProperty
+	if t := modelableTypeOfKind(kind); t != nil {
+		m := reflect.New(t).Interface().(modelable)
+		index(m)
+		if ut := m.getModel().updateTime; ut != nil {
+			property = ut.name
+		}
+	}
+
+	events := make(chan ChangeEvent)
+
+	go func() {
+		defer close(events)
+
+		last := since
+		// the keys already sent with the update time last
+		seen := make(map[string]bool)
+		ticker := time.NewTicker(WatchPollInterval)
+		defer ticker.Stop()
+
+		for {
+			var err error
+			last, err = pollChanges(ctx, client, kind, property, last, seen, events)
+			if err != nil && ctx.Err() == nil {
+				warningf(ctx, "error watching kind %s: %s", kind, err.Error())
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// sends the entities updated at or after since, but the ones in seen, and returns the update time of the last one.
+// Entities sharing the update time of the last one sent may still have to come, thus the time is polled again:
+// seen holds the keys already sent with the returned time, so that they are not sent twice
+func pollChanges(ctx context.Context, client *datastore.Client, kind string, property string, since time.Time, seen map[string]bool, events chan<- ChangeEvent) (time.Time, error) {
+	q := newDatastoreQuery(ctx, kind).
+		Filter(fmt.Sprintf("%s >=", property), since).
+		Order(property).
+		Project(property)
+
+	last := since
+	it := client.Run(ctx, q)
+	for {
+		var props datastore.PropertyList
+		key, err := it.Next(&props)
+		if err == iterator.Done {
+			return last, nil
+		}
+
+		if err != nil {
+			return last, err
+		}
+
+		event := ChangeEvent{Key: key}
+		for _, p := range props {
+			if t, ok := p.Value.(time.Time); ok && p.Name == property {
+				event.UpdatedAt = t
+			}
+		}
+
+		encoded := key.Encode()
+		if event.UpdatedAt.Equal(last) && seen[encoded] {
+			continue
+		}
+
+		select {
+		case events <- event:
+			if !event.UpdatedAt.Equal(last) {
+				last = event.UpdatedAt
+				for k := range seen {
+					delete(seen, k)
+				}
+			}
+			seen[encoded] = true
+		case <-ctx.Done():
+			return last, ctx.Err()
+		}
+	}
+}
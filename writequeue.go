@@ -0,0 +1,183 @@
+package model
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const keyQueuedWrite = "__model_queued_write"
+
+var writeQueuesMutex sync.Mutex
+var writeQueues = map[reflect.Type]*writeQueue{}
+
+// SerializeWrites funnels the updates of the given modelable type through a queue local to the instance.
+// Updates of the same entity issued within window are coalesced: only the last one is written,
+// and all the callers get its result. Writes of the kind are issued one at a time.
+// A caller whose context is done stops waiting, but doesn't cancel the write shared with the others.
+// It smooths bursts of writes to high contention entities, like configuration singletons.
+// A non positive window removes the queue
+func SerializeWrites(m modelable, window time.Duration) {
+	t := reflect.TypeOf(m).Elem()
+	writeQueuesMutex.Lock()
+	defer writeQueuesMutex.Unlock()
+
+	if window <= 0 {
+		delete(writeQueues, t)
+		return
+	}
+	writeQueues[t] = &writeQueue{window: window, pending: make(map[string]*queuedWrite)}
+}
+
+// returns the write queue of the modelable, unless the write runs on behalf of the queue itself
+func writeQueueOf(ctx context.Context, m modelable) *writeQueue {
+	if queued, _ := ctx.Value(keyQueuedWrite).(bool); queued {
+		return nil
+	}
+
+	writeQueuesMutex.Lock()
+	defer writeQueuesMutex.Unlock()
+	return writeQueues[reflect.TypeOf(m).Elem()]
+}
+
+type writeQueue struct {
+	window time.Duration
+	mutex  sync.Mutex
+	// the writes waiting for their window to expire, by encoded key
+	pending map[string]*queuedWrite
+	// serializes the writes of the kind
+	writing sync.Mutex
+}
+
+type queuedWrite struct {
+	ctx  context.Context
+	m    modelable
+	done chan struct{}
+	err  error
+	// fires the write once the window expires
+	timer *time.Timer
+	write func(ctx context.Context, m modelable) error
+}
+
+// enqueues the update of the modelable and waits for the write, or for ctx to be done
+func (q *writeQueue) update(ctx context.Context, m modelable, write func(ctx context.Context, m modelable) error) error {
+	key := m.getModel().EncodedKey()
+	if key == "" {
+		// entities without a key can't be coalesced
+		return write(context.WithValue(ctx, keyQueuedWrite, true), m)
+	}
+
+	q.mutex.Lock()
+	w, ok := q.pending[key]
+	if ok {
+		// last write wins
+		w.ctx = ctx
+		w.m = m
+	} else {
+		w = &queuedWrite{ctx: ctx, m: m, done: make(chan struct{}), write: write}
+		q.pending[key] = w
+		w.timer = time.AfterFunc(q.window, func() {
+			q.flush(key, w)
+		})
+	}
+	q.mutex.Unlock()
+
+	select {
+	case <-w.done:
+		return w.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// writes the last modelable queued for the key
+func (q *writeQueue) flush(key string, w *queuedWrite) {
+	q.mutex.Lock()
+	delete(q.pending, key)
+	ctx, m := w.ctx, w.m
+	q.mutex.Unlock()
+
+	q.writing.Lock()
+	w.err = w.write(writeContext(ctx), m)
+	q.writing.Unlock()
+	close(w.done)
+}
+
+// a context holding the values of its parent, but neither its deadline nor its cancellation
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+// returns the context of the coalesced write, shared by all its callers: it keeps the values of ctx,
+// like the namespace, but can't be canceled by the caller that queued it last.
+// The client of the request may be closed by the time the write runs,
+// thus the write uses the one of the background contexts of the service, if known
+func writeContext(ctx context.Context) context.Context {
+	wctx := context.Context(detachedContext{ctx})
+	if service := serviceFromContext(ctx); service != nil {
+		bctx, err := service.BackgroundContext()
+		if err != nil {
+			warningf(ctx, "error writing with the background client of service %s: %s", service.Name(), err.Error())
+		} else {
+			wctx = context.WithValue(wctx, keyDatastoreClient, ClientFromContext(bctx))
+		}
+	}
+	return context.WithValue(wctx, keyQueuedWrite, true)
+}
+
+// writes the pending writes without waiting for their window, and waits for the ones already being written.
+// Returns ctx.Err() if ctx is done before all the writes are
+func (q *writeQueue) drain(ctx context.Context) error {
+	q.mutex.Lock()
+	pending := make(map[string]*queuedWrite, len(q.pending))
+	for key, w := range q.pending {
+		pending[key] = w
+	}
+	q.mutex.Unlock()
+
+	for key, w := range pending {
+		// if the timer already fired, the write is running on its own
+		if w.timer.Stop() {
+			go q.flush(key, w)
+		}
+
+		select {
+		case <-w.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// drains the write queues of all the modelable types. See SerializeWrites
+func drainWriteQueues(ctx context.Context) error {
+	writeQueuesMutex.Lock()
+	queues := make([]*writeQueue, 0, len(writeQueues))
+	for _, q := range writeQueues {
+		queues = append(queues, q)
+	}
+	writeQueuesMutex.Unlock()
+
+	for _, q := range queues {
+		if err := q.drain(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
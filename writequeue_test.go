@@ -0,0 +1,127 @@
+package model
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDrainWriteQueues(t *testing.T) {
+	s := SingletonSettings{Theme: "dark"}
+	index(&s)
+	s.Key = singletonKey(context.Background(), s.getModel())
+
+	SerializeWrites(&s, time.Hour)
+	defer SerializeWrites(&s, 0)
+
+	written := make(chan modelable, 1)
+	write := func(ctx context.Context, m modelable) error {
+		written <- m
+		return nil
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- writeQueueOf(context.Background(), &s).update(context.Background(), &s, write)
+	}()
+
+	// wait for the write to be queued
+	q := writeQueueOf(context.Background(), &s)
+	for {
+		q.mutex.Lock()
+		n := len(q.pending)
+		q.mutex.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := drainWriteQueues(ctx); err != nil {
+		t.Fatalf("error draining the write queues: %s", err.Error())
+	}
+
+	if m := <-written; m != &s {
+		t.Fatalf("invalid written modelable %+v", m)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatalf("the queued write failed: %s", err.Error())
+	}
+}
+
+func TestCoalescedWriteOutlivesCanceledCaller(t *testing.T) {
+	s := SingletonSettings{Theme: "dark"}
+	index(&s)
+	s.Key = singletonKey(context.Background(), s.getModel())
+
+	SerializeWrites(&s, time.Hour)
+	defer SerializeWrites(&s, 0)
+
+	var writes int32
+	written := make(chan error, 1)
+	write := func(ctx context.Context, m modelable) error {
+		atomic.AddInt32(&writes, 1)
+		written <- ctx.Err()
+		return nil
+	}
+
+	q := writeQueueOf(context.Background(), &s)
+	first := make(chan error, 1)
+	go func() {
+		first <- q.update(context.Background(), &s, write)
+	}()
+
+	// the second update is coalesced with the first one
+	cctx, cancel := context.WithCancel(context.Background())
+	last := make(chan error, 1)
+	for {
+		q.mutex.Lock()
+		n := len(q.pending)
+		q.mutex.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		last <- q.update(cctx, &s, write)
+	}()
+
+	for {
+		q.mutex.Lock()
+		w := q.pending[s.EncodedKey()]
+		coalesced := w != nil && w.ctx == cctx
+		q.mutex.Unlock()
+		if coalesced {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	if err := <-last; err != context.Canceled {
+		t.Fatalf("expected the canceled caller to return %v, got %v", context.Canceled, err)
+	}
+
+	ctx, done := context.WithTimeout(context.Background(), time.Second)
+	defer done()
+	if err := q.drain(ctx); err != nil {
+		t.Fatalf("error draining the write queue: %s", err.Error())
+	}
+
+	if err := <-written; err != nil {
+		t.Fatalf("the coalesced write ran with a done context: %s", err.Error())
+	}
+
+	if err := <-first; err != nil {
+		t.Fatalf("the coalesced write failed: %s", err.Error())
+	}
+
+	if n := atomic.LoadInt32(&writes); n != 1 {
+		t.Fatalf("expected the updates to be coalesced into 1 write, got %d", n)
+	}
+}